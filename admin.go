@@ -0,0 +1,43 @@
+// File: admin.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file serves the optional admin panel at /_admin (enabled with -admin), a small
+// static app embedded in the binary that lists the models, renders their items as tables with
+// paging and per-field filters, and offers create, edit and delete forms generated from the model
+// schemas. The schemas of the served models are listed at GET /_admin/models.
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed admin
+var adminFiles embed.FS
+
+// adminHandler serves the admin panel below /_admin/.
+func adminHandler(store *Store, models []string) http.Handler {
+	files, _ := fs.Sub(adminFiles, "admin")
+	static := http.StripPrefix("/_admin/", http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_admin/models" {
+			static.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+			return
+		}
+		schemas := make([]ModelSchema, 0, len(models))
+		for _, model := range models {
+			if schema, ok := store.Schema(model); ok {
+				schemas = append(schemas, schema)
+			}
+		}
+		writeJSON(w, http.StatusOK, schemas)
+	})
+}
@@ -0,0 +1,260 @@
+/*
+ * File: admin/admin.js
+ * Author: Mohamed Riyad
+ * Email: mohamed.riyad@example.com
+ * Date: November 2024
+ * License: MIT
+ * Description: Lists the models of /_admin/models, renders the items of the selected model as a
+ * paged table with a filter per scalar field, and generates create and edit forms from the model
+ * schema. Items are addressed by ID, or by key for models keyed by several fields.
+ */
+
+"use strict";
+
+const pageSize = 20;
+const state = { schemas: [], schema: null, offset: 0, filters: {} };
+
+// element creates an element with attributes and children.
+function element(tag, attributes = {}, ...children) {
+  const node = document.createElement(tag);
+  for (const [name, value] of Object.entries(attributes)) {
+    if (name.startsWith("on")) node.addEventListener(name.slice(2), value);
+    else if (value !== false && value !== undefined) node.setAttribute(name, value === true ? "" : value);
+  }
+  for (const child of children) node.append(child);
+  return node;
+}
+
+// api sends a request to a model route and returns the decoded response, throwing the detail of
+// the problem answered to failed requests.
+async function api(method, path, query = {}, body) {
+  const params = new URLSearchParams();
+  for (const [name, value] of Object.entries(query)) {
+    if (value !== undefined && value !== "") params.set(name, value);
+  }
+  const headers = {};
+  const tenant = document.getElementById("tenant").value;
+  if (tenant) headers["X-Tenant-ID"] = tenant;
+  const authorization = document.getElementById("authorization").value;
+  if (authorization) headers["Authorization"] = authorization;
+  if (body !== undefined) headers["Content-Type"] = "application/json";
+  const search = params.toString();
+  const response = await fetch(path + (search ? "?" + search : ""), {
+    method, headers, body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (!response.ok) {
+    let message = (await response.text()).trim();
+    try {
+      const problem = JSON.parse(message);
+      message = problem.detail || problem.title || message;
+    } catch (error) { /* not problem details */ }
+    throw new Error(`${response.status} ${message}`);
+  }
+  return response.status === 204 ? null : response.json();
+}
+
+// address returns the query parameters naming an item: its ID, or its key.
+function address(schema, item) {
+  if (schema.id) return { id: item[schema.id] };
+  const parts = schema.key.map((name) => String(item[name]).replace(/%/g, "%25").replace(/,/g, "%2C"));
+  return { key: parts.join(",") };
+}
+
+// fields returns the fields of a schema shown in tables and forms.
+function fields(schema) {
+  return schema.fields.filter((field) => field.json !== "-");
+}
+
+// scalar reports whether items can be filtered by a field.
+function scalar(field) {
+  return ["string", "integer", "number", "boolean"].includes(field.type);
+}
+
+// format renders a value in a table cell.
+function format(value) {
+  if (value === null || value === undefined) return "";
+  return typeof value === "object" ? JSON.stringify(value) : String(value);
+}
+
+// showError replaces the view with an error message.
+function showError(error) {
+  document.getElementById("view").append(element("p", { class: "error" }, String(error.message || error)));
+}
+
+// renderModels lists the models in the navigation.
+function renderModels() {
+  const nav = document.getElementById("models");
+  nav.replaceChildren(...state.schemas.map((schema) =>
+    element("a", {
+      href: "#" + schema.model,
+      class: state.schema === schema ? "active" : false,
+    }, schema.model)));
+}
+
+// filterInput returns the filter input of a field in the table header.
+function filterInput(field) {
+  if (!scalar(field)) return "";
+  const value = state.filters[field.json] || "";
+  const onchange = (event) => {
+    state.filters[field.json] = event.target.value;
+    state.offset = 0;
+    renderList();
+  };
+  if (field.type === "boolean" || field.enum) {
+    const options = field.type === "boolean" ? ["true", "false"] : field.enum;
+    return element("select", { onchange },
+      element("option", { value: "" }, "any"),
+      ...options.map((option) => element("option", { value: option, selected: option === value }, option)));
+  }
+  return element("input", { value, placeholder: "filter", onchange });
+}
+
+// renderList shows a page of the items of the selected model.
+async function renderList() {
+  const schema = state.schema;
+  const view = document.getElementById("view");
+  const query = { ...state.filters };
+  let items, count;
+  try {
+    [items, count] = await Promise.all([
+      api("GET", "/" + schema.model, { ...query, offset: state.offset, limit: pageSize }),
+      api("GET", "/" + schema.model, { ...query, count: "true" }).then((result) => result.count),
+    ]);
+  } catch (error) {
+    view.replaceChildren(element("h2", {}, schema.model));
+    showError(error);
+    return;
+  }
+
+  const columns = fields(schema);
+  const last = Math.min(state.offset + items.length, count);
+  const toolbar = element("div", { class: "toolbar" },
+    element("button", { onclick: () => renderForm(null) }, "New " + schema.model),
+    element("span", { class: "pages" }, count ? `${state.offset + 1}–${last} of ${count}` : "No items"),
+    element("button", {
+      disabled: state.offset === 0,
+      onclick: () => { state.offset = Math.max(0, state.offset - pageSize); renderList(); },
+    }, "Previous"),
+    element("button", {
+      disabled: last >= count,
+      onclick: () => { state.offset += pageSize; renderList(); },
+    }, "Next"));
+
+  const header = element("tr", {}, ...columns.map((field) => element("th", {}, field.json)), element("th", {}));
+  const filters = element("tr", { class: "filters" },
+    ...columns.map((field) => element("th", {}, filterInput(field))), element("th", {}));
+  const rows = items.map((item) => element("tr", {},
+    ...columns.map((field) => element("td", { title: format(item[field.json]) }, format(item[field.json]))),
+    element("td", { class: "actions" },
+      element("button", { onclick: () => renderForm(item) }, "Edit"), " ",
+      element("button", { class: "danger", onclick: () => remove(item) }, "Delete"))));
+
+  view.replaceChildren(element("h2", {}, schema.model), toolbar,
+    element("table", {}, element("thead", {}, header, filters), element("tbody", {}, ...rows)));
+}
+
+// remove deletes an item after confirmation.
+async function remove(item) {
+  const schema = state.schema;
+  if (!confirm(`Delete this ${schema.model}?`)) return;
+  try {
+    await api("DELETE", "/" + schema.model, address(schema, item));
+    renderList();
+  } catch (error) {
+    showError(error);
+  }
+}
+
+// fieldInput returns the form input of a field holding a value.
+function fieldInput(field, value, disabled) {
+  const attributes = { name: field.json, disabled };
+  if (field.enum) {
+    return element("select", attributes,
+      ...field.enum.map((option) => element("option", { value: option, selected: option === value }, option)));
+  }
+  switch (field.type) {
+    case "boolean":
+      return element("input", { ...attributes, type: "checkbox", checked: value === true });
+    case "integer":
+    case "number":
+      return element("input", { ...attributes, type: "number", step: field.type === "integer" ? "1" : "any", value: value ?? "" });
+    case "string":
+      return element("input", { ...attributes, value: value ?? "", placeholder: field.format === "date-time" ? "2024-11-01T12:00:00Z" : "" });
+  }
+  return element("textarea", attributes, value === undefined ? "" : JSON.stringify(value, null, 2));
+}
+
+// fieldValue reads the value of a form input.
+function fieldValue(field, input) {
+  if (field.enum) return input.value;
+  switch (field.type) {
+    case "boolean": return input.checked;
+    case "integer":
+    case "number": return input.value === "" ? 0 : Number(input.value);
+    case "string": return input.value;
+  }
+  return input.value.trim() === "" ? null : JSON.parse(input.value);
+}
+
+// renderForm shows the form creating an item (when item is null) or editing one.
+function renderForm(item) {
+  const schema = state.schema;
+  const editing = item !== null;
+  const inputs = [];
+  const form = element("form", { class: "item" });
+  for (const field of fields(schema)) {
+    if (field.readOnly && !editing) continue;
+    const value = editing ? item[field.json] : undefined;
+    const input = fieldInput(field, value, field.readOnly);
+    inputs.push([field, input]);
+    const hints = [field.goType, field.unique ? "unique" : "", field.validate || ""].filter(Boolean).join(", ");
+    form.append(element("label", {}, field.json, element("small", {}, hints)), input);
+  }
+  const message = element("p", { class: "error" });
+  form.append(element("p", {},
+    element("button", { type: "submit" }, editing ? "Save" : "Create"), " ",
+    element("button", { type: "button", onclick: renderList }, "Cancel")), message);
+
+  form.addEventListener("submit", async (event) => {
+    event.preventDefault();
+    const body = editing ? { ...item } : {};
+    try {
+      for (const [field, input] of inputs) {
+        if (!field.readOnly) body[field.json] = fieldValue(field, input);
+      }
+      if (editing) await api("PUT", "/" + schema.model, address(schema, item), body);
+      else await api("POST", "/" + schema.model, {}, body);
+      renderList();
+    } catch (error) {
+      message.textContent = String(error.message || error);
+    }
+  });
+
+  document.getElementById("view").replaceChildren(
+    element("h2", {}, (editing ? "Edit " : "New ") + schema.model), form);
+}
+
+// route shows the model named by the location hash.
+function route() {
+  const model = decodeURIComponent(location.hash.slice(1));
+  const schema = state.schemas.find((s) => s.model === model);
+  if (!schema) return;
+  if (schema !== state.schema) {
+    state.schema = schema;
+    state.offset = 0;
+    state.filters = {};
+  }
+  renderModels();
+  renderList();
+}
+
+window.addEventListener("hashchange", route);
+document.getElementById("tenant").addEventListener("change", () => state.schema && renderList());
+
+api("GET", "/_admin/models")
+  .then((schemas) => {
+    state.schemas = schemas;
+    renderModels();
+    if (location.hash) route();
+  })
+  .catch((error) => { document.getElementById("models").textContent = `Could not load the models: ${error.message}`; });
@@ -0,0 +1,68 @@
+// File: admin_token.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file guards the admin routes, which read or replace the data of every model and
+// every tenant at once (exports, imports, restores, backups, the change feed, the event history,
+// replica snapshots, the usage of the tenants and the data-subject requests). They answer only the callers sending the admin token of the server
+// as "Authorization: Bearer <token>", and are refused to everyone when the server has none. The
+// writes replayed from the Raft log carry no credentials; they hold the rights the leader verified
+// their caller to have as grants instead.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+// Grants recorded with the replicated writes of the clustered mode.
+const (
+	grantAdmin      = "admin"      // the caller held the admin token
+	grantPrivileged = "privileged" // the caller sees the masked fields unmasked
+)
+
+// grantsKey is the context key of the grants of a replayed write.
+type grantsKey struct{}
+
+// withGrants returns a context holding the grants of a replayed write.
+func withGrants(ctx context.Context, grants []string) context.Context {
+	if len(grants) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, grantsKey{}, grants)
+}
+
+// granted reports whether a replayed request holds a grant.
+func granted(r *http.Request, grant string) bool {
+	grants, _ := r.Context().Value(grantsKey{}).([]string)
+	return containsString(grants, grant)
+}
+
+// holdsAdminToken reports whether a request carries the admin token.
+func holdsAdminToken(token string, r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// adminOnly serves next to the callers holding the admin token, answering 401 to the others, or
+// 403 to every caller when token is empty.
+func adminOnly(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if granted(r, grantAdmin) {
+			next(w, r)
+			return
+		}
+		if token == "" {
+			writeProblem(w, r, http.StatusForbidden, "Admin routes are disabled; start the server with -admin-token")
+			return
+		}
+		if !holdsAdminToken(token, r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeProblem(w, r, http.StatusUnauthorized, "The admin token is required in the Authorization header")
+			return
+		}
+		next(w, r)
+	}
+}
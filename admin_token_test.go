@@ -0,0 +1,59 @@
+// File: admin_token_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the admin token guarding the admin routes, and that replicas send it
+// to the routes of their primary.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminOnly(t *testing.T) {
+	store := newTestStore()
+	store.Create("acme/item", &Item{Title: "theirs"})
+	export := func(w http.ResponseWriter, r *http.Request) { handleExport(store, w, r) }
+
+	if w := serveTest(adminOnly("", export), http.MethodGet, "/_export", "", "Authorization", "Bearer "); w.Code != http.StatusForbidden {
+		t.Errorf("admin route without a token: status %d, want 403", w.Code)
+	}
+	for _, authorization := range []string{"", "Bearer wrong", "secret", "Basic c2VjcmV0"} {
+		w := serveTest(adminOnly("secret", export), http.MethodGet, "/_export", "", "Authorization", authorization)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("admin route with Authorization %q: status %d, want 401 with WWW-Authenticate", authorization, w.Code)
+		}
+	}
+	w := serveTest(adminOnly("secret", export), http.MethodGet, "/_export", "", "Authorization", "Bearer secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin route with the token: status %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestReplicaSendsTheAdminToken(t *testing.T) {
+	primary := newTestStore()
+	primary.Create("item", &Item{Title: "replicated"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_replica/snapshot", adminOnly("secret", func(w http.ResponseWriter, r *http.Request) {
+		handleReplicaSnapshot(primary, w, r)
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	replica, err := NewReplica(newTestStore(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot map[string]interface{}
+	if err := replica.get(server.URL, "/_replica/snapshot", &snapshot); err == nil {
+		t.Fatal("replica without the token read the snapshot")
+	}
+	replica.Token = "secret"
+	if err := replica.get(server.URL, "/_replica/snapshot", &snapshot); err != nil {
+		t.Fatalf("replica with the token: %v", err)
+	}
+}
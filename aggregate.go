@@ -0,0 +1,282 @@
+// File: aggregate.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements aggregation, so simple reporting does not require exporting
+// everything. GET /{model}/_aggregate?group_by=done&sum=amount&count=true counts, sums, averages
+// and finds the minimum and maximum of fields over the items matching the usual filters
+// (?title=Go, ?amount_gte=10), optionally grouped by the values of one or more fields. Each
+// parameter takes JSON field names separated by commas; the count is computed when nothing else is
+// asked for. Groups are ordered by their key, and masked fields cannot be aggregated by callers
+// that see them masked.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Aggregation describes the aggregates computed over the items of a model. Fields are named by
+// their Go or JSON names.
+type Aggregation struct {
+	GroupBy []string // fields the items are grouped by; all of them form one group when empty
+	Count   bool
+	Sum     []string // numeric fields
+	Avg     []string // numeric fields
+	Min     []string // orderable fields
+	Max     []string // orderable fields
+}
+
+// AggregateGroup holds the aggregates of a group of items, keyed by JSON field name.
+type AggregateGroup struct {
+	Key   map[string]interface{} `json:"key,omitempty"`
+	Count *int                   `json:"count,omitempty"`
+	Sum   map[string]interface{} `json:"sum,omitempty"` // integers for integer fields
+	Avg   map[string]float64     `json:"avg,omitempty"`
+	Min   map[string]interface{} `json:"min,omitempty"`
+	Max   map[string]interface{} `json:"max,omitempty"`
+}
+
+// aggregateFields are the fields of an aggregation, resolved.
+type aggregateFields struct {
+	groupBy, sum, avg, min, max []*fieldMeta
+}
+
+// fields returns every field an aggregation reads.
+func (a aggregateFields) fields() []*fieldMeta {
+	var fields []*fieldMeta
+	for _, list := range [][]*fieldMeta{a.groupBy, a.sum, a.avg, a.min, a.max} {
+		fields = append(fields, list...)
+	}
+	return fields
+}
+
+// aggregateGroup accumulates the aggregates of a group.
+type aggregateGroup struct {
+	key      []reflect.Value
+	count    int
+	sums     []float64 // of the sum and avg fields, in that order
+	intSums  []int64
+	min, max []reflect.Value
+}
+
+// isNumericKind reports whether a kind can be summed.
+func isNumericKind(kind reflect.Kind) bool {
+	return isIntKind(kind) || kind >= reflect.Uint && kind <= reflect.Uint64 || kind == reflect.Float32 || kind == reflect.Float64
+}
+
+// resolveAggregation resolves the fields of an aggregation, checking they can be aggregated.
+func resolveAggregation(meta *modelMeta, agg Aggregation) (aggregateFields, error) {
+	var resolved aggregateFields
+	resolve := func(names []string, what string, accepts func(t reflect.Type) bool) ([]*fieldMeta, error) {
+		var fields []*fieldMeta
+		for _, name := range names {
+			f, ok := meta.field(name)
+			if !ok {
+				return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", name)}
+			}
+			if !accepts(f.typ) {
+				return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("field %s cannot be %s", name, what)}
+			}
+			fields = append(fields, f)
+		}
+		return fields, nil
+	}
+	numeric := func(t reflect.Type) bool { return isNumericKind(t.Kind()) }
+	var err error
+	if resolved.groupBy, err = resolve(agg.GroupBy, "grouped by", orderable); err != nil {
+		return resolved, err
+	}
+	if resolved.sum, err = resolve(agg.Sum, "summed", numeric); err != nil {
+		return resolved, err
+	}
+	if resolved.avg, err = resolve(agg.Avg, "averaged", numeric); err != nil {
+		return resolved, err
+	}
+	if resolved.min, err = resolve(agg.Min, "compared", orderable); err != nil {
+		return resolved, err
+	}
+	resolved.max, err = resolve(agg.Max, "compared", orderable)
+	return resolved, err
+}
+
+// Aggregate computes aggregates over the items of a model matching every filter, one group per
+// distinct combination of the values of the GroupBy fields, ordered by those values. Only the count
+// is computed when no aggregate is asked for.
+func (s *Store) Aggregate(model string, filters []Filter, agg Aggregation) ([]AggregateGroup, error) {
+	meta, ok := s.meta(model)
+	if !ok {
+		return nil, fmt.Errorf("model %q is not registered", model)
+	}
+	fields, err := resolveAggregation(meta, agg)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields.sum)+len(fields.avg)+len(fields.min)+len(fields.max) == 0 {
+		agg.Count = true
+	}
+	matches, err := s.matching(model, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	numeric := append(append([]*fieldMeta(nil), fields.sum...), fields.avg...)
+	groups := make(map[string]*aggregateGroup)
+	var order []*aggregateGroup
+	for _, m := range matches {
+		item := reflect.ValueOf(m.item)
+		var key strings.Builder
+		values := make([]reflect.Value, len(fields.groupBy))
+		for i, f := range fields.groupBy {
+			values[i] = item.Elem().FieldByIndex(f.index)
+			fmt.Fprintf(&key, "%v\x00", hashKey(values[i]))
+		}
+		g, ok := groups[key.String()]
+		if !ok {
+			g = &aggregateGroup{key: values, sums: make([]float64, len(numeric)), intSums: make([]int64, len(numeric)),
+				min: make([]reflect.Value, len(fields.min)), max: make([]reflect.Value, len(fields.max))}
+			groups[key.String()] = g
+			order = append(order, g)
+		}
+		g.count++
+		for i, f := range numeric {
+			v := item.Elem().FieldByIndex(f.index)
+			switch {
+			case isIntKind(v.Kind()):
+				g.intSums[i] += v.Int()
+			case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+				g.intSums[i] += int64(v.Uint())
+			default:
+				g.sums[i] += v.Float()
+			}
+		}
+		for i, f := range fields.min {
+			if v := item.Elem().FieldByIndex(f.index); !g.min[i].IsValid() || compareValues(v, g.min[i]) < 0 {
+				g.min[i] = v
+			}
+		}
+		for i, f := range fields.max {
+			if v := item.Elem().FieldByIndex(f.index); !g.max[i].IsValid() || compareValues(v, g.max[i]) > 0 {
+				g.max[i] = v
+			}
+		}
+	}
+	if len(fields.groupBy) == 0 && len(order) == 0 {
+		// Aggregates over no item form one empty group
+		order = append(order, &aggregateGroup{sums: make([]float64, len(numeric)), intSums: make([]int64, len(numeric)),
+			min: make([]reflect.Value, len(fields.min)), max: make([]reflect.Value, len(fields.max))})
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		for k := range fields.groupBy {
+			if c := compareValues(order[i].key[k], order[j].key[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	result := make([]AggregateGroup, 0, len(order))
+	for _, g := range order {
+		group := AggregateGroup{}
+		if agg.Count {
+			count := g.count
+			group.Count = &count
+		}
+		for i, f := range fields.groupBy {
+			if group.Key == nil {
+				group.Key = make(map[string]interface{})
+			}
+			group.Key[f.jsonName] = g.key[i].Interface()
+		}
+		for i, f := range numeric {
+			total := g.sums[i] + float64(g.intSums[i])
+			if i < len(fields.sum) {
+				if group.Sum == nil {
+					group.Sum = make(map[string]interface{})
+				}
+				if f.typ.Kind() == reflect.Float32 || f.typ.Kind() == reflect.Float64 {
+					group.Sum[f.jsonName] = g.sums[i]
+				} else {
+					group.Sum[f.jsonName] = g.intSums[i]
+				}
+			} else if g.count > 0 {
+				if group.Avg == nil {
+					group.Avg = make(map[string]float64)
+				}
+				group.Avg[f.jsonName] = total / float64(g.count)
+			}
+		}
+		for i, f := range fields.min {
+			if g.min[i].IsValid() {
+				if group.Min == nil {
+					group.Min = make(map[string]interface{})
+				}
+				group.Min[f.jsonName] = g.min[i].Interface()
+			}
+		}
+		for i, f := range fields.max {
+			if g.max[i].IsValid() {
+				if group.Max == nil {
+					group.Max = make(map[string]interface{})
+				}
+				group.Max[f.jsonName] = g.max[i].Interface()
+			}
+		}
+		result = append(result, group)
+	}
+	return result, nil
+}
+
+// splitFields splits a parameter naming fields separated by commas.
+func splitFields(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// handleAggregate serves GET /{model}/_aggregate?group_by=...&count=true&sum=...&avg=...&min=...&max=...,
+// computing aggregates over the items matching the filters of the query.
+func handleAggregate(store *Store, model string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	meta, _ := store.meta(model)
+	query := r.URL.Query()
+	agg := Aggregation{
+		GroupBy: splitFields(query.Get("group_by")),
+		Count:   query.Get("count") == "true",
+		Sum:     splitFields(query.Get("sum")),
+		Avg:     splitFields(query.Get("avg")),
+		Min:     splitFields(query.Get("min")),
+		Max:     splitFields(query.Get("max")),
+	}
+	fields, err := resolveAggregation(meta, agg)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if refuseMasked(w, r, meta, fields.fields()) {
+		return
+	}
+	filters, err := parseFilters(meta, query)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	groups, err := store.Aggregate(model, filters, agg)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]AggregateGroup{"groups": groups})
+}
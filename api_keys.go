@@ -0,0 +1,349 @@
+// File: api_keys.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements API keys with quotas and usage metering. With a key file the
+// API answers only the requests carrying a known key in their X-API-Key header; the requests and
+// mutations of every key are counted per UTC day and month, those beyond a daily or monthly quota
+// of the key are answered 429 until the quota resets, and GET /_usage reports the consumption of
+// the key of the request. A key bound to a tenant only reaches the namespace of that tenant. Keys
+// are held as SHA-256 hashes, so the usage file the counters are saved to never contains them.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyQuota limits the requests of an API key; zero values are unlimited.
+type KeyQuota struct {
+	Daily            int64 `json:"daily,omitempty"`             // requests per UTC day
+	Monthly          int64 `json:"monthly,omitempty"`           // requests per UTC month
+	DailyMutations   int64 `json:"daily_mutations,omitempty"`   // mutations per UTC day
+	MonthlyMutations int64 `json:"monthly_mutations,omitempty"` // mutations per UTC month
+}
+
+// KeyCounts counts the requests of an API key over a period and the mutations among them.
+type KeyCounts struct {
+	Requests  int64 `json:"requests"`
+	Mutations int64 `json:"mutations"`
+}
+
+// KeyUsage reports the consumption of an API key.
+type KeyUsage struct {
+	KeyID     string    `json:"key_id"` // first characters of the hash of the key
+	Name      string    `json:"name,omitempty"`
+	Day       string    `json:"day"`   // UTC day of Today, as 2006-01-02
+	Month     string    `json:"month"` // UTC month of ThisMonth, as 2006-01
+	Today     KeyCounts `json:"today"`
+	ThisMonth KeyCounts `json:"this_month"`
+	Total     KeyCounts `json:"total"`
+	Rejected  int64     `json:"rejected"` // requests answered 429 for exceeding the quota
+	Quota     KeyQuota  `json:"quota"`
+}
+
+// APIKey is an API key of a key file.
+type APIKey struct {
+	Name   string    `json:"name,omitempty"`   // owner of the key
+	Tenant string    `json:"tenant,omitempty"` // the only tenant the key reaches, any tenant when empty
+	Quota  *KeyQuota `json:"quota,omitempty"`
+}
+
+// APIKeys authenticates requests by API key and meters their usage.
+type APIKeys struct {
+	// Default is the quota of the keys without one of their own.
+	Default KeyQuota
+
+	keys  map[string]APIKey    // by hash of the key
+	usage map[string]*KeyUsage // by hash of the key
+	path  string               // usage file, none when empty
+	mux   sync.Mutex
+}
+
+// hashAPIKey returns the hash an API key is held as.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadAPIKeys reads a key file: a JSON object of the API keys, each with its owner and quota, as
+// {"<key>": {"name": "acme", "tenant": "acme", "quota": {"daily": 10000, "monthly_mutations": 50000}}}.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string]APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("api keys %s: %w", path, err)
+	}
+	k := NewAPIKeys()
+	for key, apiKey := range keys {
+		if apiKey.Tenant != "" && !validTenant(apiKey.Tenant) {
+			return nil, fmt.Errorf("api keys %s: invalid tenant %q", path, apiKey.Tenant)
+		}
+		k.Add(key, apiKey)
+	}
+	return k, nil
+}
+
+// NewAPIKeys creates an empty key registry.
+func NewAPIKeys() *APIKeys {
+	return &APIKeys{keys: make(map[string]APIKey), usage: make(map[string]*KeyUsage)}
+}
+
+// Add registers an API key.
+func (k *APIKeys) Add(key string, apiKey APIKey) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.keys[hashAPIKey(key)] = apiKey
+}
+
+// Tenants returns the tenants the keys are bound to.
+func (k *APIKeys) Tenants() []string {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	var tenants []string
+	for _, apiKey := range k.keys {
+		if apiKey.Tenant != "" && !containsString(tenants, apiKey.Tenant) {
+			tenants = append(tenants, apiKey.Tenant)
+		}
+	}
+	return tenants
+}
+
+// quota returns the quota of a key. It must be called while holding the lock.
+func (k *APIKeys) quota(hash string) KeyQuota {
+	if q := k.keys[hash].Quota; q != nil {
+		return *q
+	}
+	return k.Default
+}
+
+// account returns the usage counters of a key, started over for the day and the month of now. It
+// must be called while holding the lock.
+func (k *APIKeys) account(hash string, now time.Time) *KeyUsage {
+	usage, ok := k.usage[hash]
+	if !ok {
+		usage = &KeyUsage{KeyID: hash[:12]}
+		k.usage[hash] = usage
+	}
+	if day := now.Format("2006-01-02"); usage.Day != day {
+		usage.Day, usage.Today = day, KeyCounts{}
+	}
+	if month := now.Format("2006-01"); usage.Month != month {
+		usage.Month, usage.ThisMonth = month, KeyCounts{}
+	}
+	return usage
+}
+
+// exceeded returns the quota a request would exceed and how long until it resets, or "" when it
+// is within the quota.
+func (quota KeyQuota) exceeded(usage *KeyUsage, mutation bool, now time.Time) (string, time.Duration) {
+	year, month, day := now.Date()
+	tomorrow := time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC).Sub(now)
+	nextMonth := time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC).Sub(now)
+	switch {
+	case quota.Daily > 0 && usage.Today.Requests >= quota.Daily:
+		return "Daily request quota exceeded", tomorrow
+	case quota.Monthly > 0 && usage.ThisMonth.Requests >= quota.Monthly:
+		return "Monthly request quota exceeded", nextMonth
+	case mutation && quota.DailyMutations > 0 && usage.Today.Mutations >= quota.DailyMutations:
+		return "Daily mutation quota exceeded", tomorrow
+	case mutation && quota.MonthlyMutations > 0 && usage.ThisMonth.Mutations >= quota.MonthlyMutations:
+		return "Monthly mutation quota exceeded", nextMonth
+	}
+	return "", 0
+}
+
+// Handler answers 401 to the requests without a known API key and 429 to those exceeding the quota
+// of their key, and counts the others before passing them to next. GET /_usage is answered for
+// every known key, whatever its consumption, and is not counted. The requests of a key bound to a
+// tenant are served in its namespace, and refused with 403 when they select another tenant. The
+// requests signed by a node of the cluster need no key.
+func (k *APIKeys) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fromPeer(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Header.Get(APIKeyHeader)
+		hash := hashAPIKey(key)
+		k.mux.Lock()
+		apiKey, known := k.keys[hash]
+		k.mux.Unlock()
+		if key == "" || !known {
+			writeProblem(w, r, http.StatusUnauthorized, "A valid API key is required in the "+APIKeyHeader+" header")
+			return
+		}
+		if apiKey.Tenant != "" {
+			if tenant := r.Header.Get(TenantHeader); tenant != "" && tenant != apiKey.Tenant {
+				writeProblem(w, r, http.StatusForbidden, "The API key is bound to another tenant")
+				return
+			}
+			r = r.Clone(r.Context())
+			r.Header.Set(TenantHeader, apiKey.Tenant)
+		}
+		if r.URL.Path == "/_usage" {
+			handleUsage(k, hash, w, r)
+			return
+		}
+
+		mutation := r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch || r.Method == http.MethodDelete
+		now := time.Now().UTC()
+		k.mux.Lock()
+		usage := k.account(hash, now)
+		message, wait := k.quota(hash).exceeded(usage, mutation, now)
+		if message != "" {
+			usage.Rejected++
+		} else {
+			for _, counts := range []*KeyCounts{&usage.Today, &usage.ThisMonth, &usage.Total} {
+				counts.Requests++
+				if mutation {
+					counts.Mutations++
+				}
+			}
+		}
+		k.mux.Unlock()
+
+		if message != "" {
+			setRetryAfter(w, wait)
+			writeProblem(w, r, http.StatusTooManyRequests, message)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Usage returns the usage of a key.
+func (k *APIKeys) Usage(key string) (KeyUsage, bool) {
+	return k.usageOf(hashAPIKey(key))
+}
+
+// usageOf returns the usage of the key of a hash.
+func (k *APIKeys) usageOf(hash string) (KeyUsage, bool) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	apiKey, ok := k.keys[hash]
+	if !ok {
+		return KeyUsage{}, false
+	}
+	usage := *k.account(hash, time.Now().UTC())
+	usage.Name, usage.Quota = apiKey.Name, k.quota(hash)
+	return usage, true
+}
+
+// OpenUsage loads the counters saved to a usage file, which SaveUsage saves them to from then on.
+// A missing file starts the counters from zero.
+func (k *APIKeys) OpenUsage(path string) error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &k.usage); err != nil {
+		return fmt.Errorf("usage %s: %w", path, err)
+	}
+	return nil
+}
+
+// SaveUsage saves the counters to the usage file, replacing it atomically.
+func (k *APIKeys) SaveUsage() error {
+	k.mux.Lock()
+	if k.path == "" {
+		k.mux.Unlock()
+		return nil
+	}
+	path := k.path
+	data, err := json.Marshal(k.usage)
+	k.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Start saves the counters to the usage file every interval in the background until the returned
+// stop function is called.
+func (k *APIKeys) Start(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := k.SaveUsage(); err != nil {
+					log.Printf("usage: cannot save the counters: %v", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// handleUsage serves GET /_usage, the usage of the key of the request.
+func handleUsage(k *APIKeys, hash string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	usage, _ := k.usageOf(hash)
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// ParseKeyQuota parses a quota of the form "daily=10000,monthly=200000,daily_mutations=1000,monthly_mutations=20000".
+func ParseKeyQuota(spec string) (KeyQuota, error) {
+	var quota KeyQuota
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(rule, "=")
+		if !ok {
+			return quota, fmt.Errorf("invalid quota rule %q", rule)
+		}
+		var target *int64
+		switch key {
+		case "daily":
+			target = &quota.Daily
+		case "monthly":
+			target = &quota.Monthly
+		case "daily_mutations":
+			target = &quota.DailyMutations
+		case "monthly_mutations":
+			target = &quota.MonthlyMutations
+		default:
+			return quota, fmt.Errorf("unknown quota %q", key)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return quota, fmt.Errorf("invalid quota value in %q", rule)
+		}
+		*target = n
+	}
+	return quota, nil
+}
@@ -0,0 +1,361 @@
+// File: backup.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements scheduled backups. A BackupJob writes a gzip-compressed dump of
+// the store (the format of /_export) to a BackupTarget on a schedule: a local directory, or an S3
+// or GCS bucket (see backup_s3.go). Backups are optionally sealed with the keys of a Keyring, and
+// only the newest ones are kept. GET /_backups lists the backups of the target, POST /_backups takes
+// one now, and POST /_restore?name=...&mode=replace|merge loads a chosen one through Import, which
+// restores it atomically (replacing the models of the backup by default). With a WAL, backups are
+// also the starting points of point-in-time recovery (see wal.go).
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backup names are the time their dump was complete, so they sort in that order.
+const (
+	backupPrefix     = "backup-"
+	backupTimeFormat = "20060102T150405.000Z"
+	backupSuffix     = ".json.gz"
+	sealedSuffix     = ".enc"
+)
+
+// backupName is the additional data sealed backups are bound to.
+var backupName = []byte("backup")
+
+// ErrBackupNotFound is returned for a backup that is not in the target.
+var ErrBackupNotFound = errors.New("backup not found")
+
+// BackupTarget stores the backups of a store.
+type BackupTarget interface {
+	// Put stores a backup of size bytes read from r, replacing any backup of the same name.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Get opens a backup, or fails with ErrBackupNotFound.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of the stored backups, in any order.
+	List(ctx context.Context) ([]string, error)
+	// Delete removes a backup.
+	Delete(ctx context.Context, name string) error
+}
+
+// ParseBackupTarget parses a target: s3://bucket/prefix and gs://bucket/prefix name buckets (see
+// NewS3TargetFromEnv and NewGCSTargetFromEnv), anything else a local directory.
+func ParseBackupTarget(spec string) (BackupTarget, error) {
+	switch {
+	case strings.HasPrefix(spec, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(spec, "s3://"), "/")
+		return NewS3TargetFromEnv(bucket, prefix)
+	case strings.HasPrefix(spec, "gs://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(spec, "gs://"), "/")
+		return NewGCSTargetFromEnv(bucket, prefix)
+	}
+	return NewDirTarget(spec)
+}
+
+// isBackupName reports whether a name is that of a backup, so a client cannot name other files.
+func isBackupName(name string) bool {
+	stamp := strings.TrimPrefix(name, backupPrefix)
+	stamp = strings.TrimSuffix(stamp, sealedSuffix)
+	stamp = strings.TrimSuffix(stamp, backupSuffix)
+	_, err := time.Parse(backupTimeFormat, stamp)
+	return len(stamp) < len(name) && err == nil
+}
+
+// DirTarget stores backups as files of a local directory.
+type DirTarget struct {
+	dir string
+}
+
+// NewDirTarget creates a target storing backups in dir, created if needed.
+func NewDirTarget(dir string) (*DirTarget, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirTarget{dir: dir}, nil
+}
+
+// Put writes a backup to a temporary file renamed into place, so a partial backup is never listed.
+func (d *DirTarget) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	tmp, err := os.CreateTemp(d.dir, ".tmp-"+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(d.dir, name))
+}
+
+// Get opens a backup file.
+func (d *DirTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(d.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBackupNotFound
+	}
+	return f, err
+}
+
+// List returns the backup files of the directory.
+func (d *DirTarget) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isBackupName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Delete removes a backup file.
+func (d *DirTarget) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(d.dir, name))
+}
+
+// BackupJob backs a store up to a target.
+type BackupJob struct {
+	store  *Store
+	target BackupTarget
+
+	// Keep is the number of backups kept; older ones are deleted after each backup (0 keeps all).
+	Keep int
+	// Keys seal the backups when set. Sealed backups are held in memory while they are sealed.
+	Keys *Keyring
+
+	runMux sync.Mutex // serializes backups, so retention never races a backup being written
+}
+
+// NewBackupJob creates a job backing the store up to target.
+func NewBackupJob(store *Store, target BackupTarget) *BackupJob {
+	return &BackupJob{store: store, target: target}
+}
+
+// Run takes one backup, applies retention, and returns the name of the backup. The dump is
+// compressed to a temporary file first, so the target receives it with its size, and the backup is
+// named after the time the dump was complete: every change made after it is in the WAL.
+func (j *BackupJob) Run(ctx context.Context) (string, error) {
+	j.runMux.Lock()
+	defer j.runMux.Unlock()
+
+	tmp, err := os.CreateTemp("", "crud-backup-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	compressed := gzip.NewWriter(tmp)
+	if err := j.store.ExportContext(ctx, compressed); err != nil {
+		return "", err
+	}
+	if err := compressed.Close(); err != nil {
+		return "", err
+	}
+	name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	var body io.Reader = tmp
+	if j.Keys != nil {
+		data, err := io.ReadAll(tmp)
+		if err != nil {
+			return "", err
+		}
+		if data, err = j.Keys.seal(data, backupName); err != nil {
+			return "", err
+		}
+		name += sealedSuffix
+		body, size = bytes.NewReader(data), int64(len(data))
+	}
+	if err := j.target.Put(ctx, name, body, size); err != nil {
+		return "", fmt.Errorf("backup: %s: %w", name, err)
+	}
+	if err := j.prune(ctx); err != nil {
+		log.Printf("backup: retention failed: %v", err)
+	}
+	return name, nil
+}
+
+// Backups returns the names of the backups of the target, newest first.
+func (j *BackupJob) Backups(ctx context.Context) ([]string, error) {
+	names, err := j.target.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// prune deletes the backups older than the newest Keep.
+func (j *BackupJob) prune(ctx context.Context) error {
+	if j.Keep <= 0 {
+		return nil
+	}
+	names, err := j.Backups(ctx)
+	if err != nil {
+		return err
+	}
+	for len(names) > j.Keep {
+		oldest := names[len(names)-1]
+		if err := j.target.Delete(ctx, oldest); err != nil {
+			return err
+		}
+		names = names[:len(names)-1]
+	}
+	return nil
+}
+
+// Restore loads a backup into the store with Import.
+func (j *BackupJob) Restore(ctx context.Context, name, mode string) (ImportResult, error) {
+	result := ImportResult{Mode: mode}
+	if !isBackupName(name) {
+		return result, ErrBackupNotFound
+	}
+	body, err := j.target.Get(ctx, name)
+	if err != nil {
+		return result, err
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if strings.HasSuffix(name, sealedSuffix) {
+		if j.Keys == nil {
+			return result, fmt.Errorf("backup: %s is sealed but no keys are set", name)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return result, err
+		}
+		if data, _, err = j.Keys.open(data, backupName); err != nil {
+			return result, err
+		}
+		r = bytes.NewReader(data)
+	}
+	decompressed, err := gzip.NewReader(r)
+	if err != nil {
+		return result, fmt.Errorf("backup: %s: %w", name, err)
+	}
+	return j.store.ImportContext(ctx, decompressed, mode)
+}
+
+// Start takes a backup every interval in the background until the returned stop function is called.
+func (j *BackupJob) Start(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				name, err := j.Run(context.Background())
+				if err != nil {
+					log.Printf("backup: %v", err)
+					continue
+				}
+				log.Printf("backup: wrote %s", name)
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// handleBackups serves GET /_backups, listing the backups newest first, and POST /_backups, taking
+// a backup now.
+func handleBackups(job *BackupJob, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		names, err := job.Backups(r.Context())
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"backups": names})
+	case http.MethodPost:
+		name, err := job.Run(r.Context())
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"name": name})
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handleRestore serves POST /_restore?name=...&mode=replace|merge, loading a backup, and POST
+// /_restore?to=2024-11-01T12:00, restoring the store to a past time. job is nil without backups.
+func handleRestore(store *Store, job *BackupJob, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	query := r.URL.Query()
+	name, mode := query.Get("name"), query.Get("mode")
+	if to := query.Get("to"); to != "" && name == "" {
+		t, err := parsePointInTime(to)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		result, err := store.RestoreTo(r.Context(), job, t)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	if name == "" || job == nil {
+		writeProblem(w, r, http.StatusBadRequest, "Either the name of a backup or a time to restore to is required")
+		return
+	}
+	if mode == "" {
+		mode = ImportReplace
+	}
+	result, err := job.Restore(r.Context(), name, mode)
+	switch {
+	case errors.Is(err, ErrBackupNotFound):
+		writeError(w, r, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,108 @@
+// File: cache_control.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements per-route Cache-Control policies. A model can declare the
+// Cache-Control header sent with its collection GETs, its item GETs and the responses to its writes
+// (e.g. "public, max-age=30" on lists and "no-store" on items), so responses behave as intended
+// behind CDNs and proxies. The "*" model holds the defaults of models without their own policy, and
+// tenant collections inherit the policy of their model.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CachePolicy holds the Cache-Control values of a model's routes; an empty value sends no header.
+type CachePolicy struct {
+	List  string // GET of the collection
+	Item  string // GET of one item
+	Write string // POST, PUT, PATCH and DELETE
+}
+
+// SetCachePolicy declares the Cache-Control headers of a model's routes, or the defaults of every
+// model when model is "*". It must be called before the store is used concurrently.
+func (s *Store) SetCachePolicy(model string, policy CachePolicy) error {
+	if _, ok := s.collection(model); !ok && model != "*" {
+		return fmt.Errorf("model %q is not registered", model)
+	}
+	s.typeMux.Lock()
+	defer s.typeMux.Unlock()
+
+	if s.cachePolicies == nil {
+		s.cachePolicies = make(map[string]CachePolicy)
+	}
+	s.cachePolicies[model] = policy
+	return nil
+}
+
+// cachePolicy returns the policy applying to a model.
+func (s *Store) cachePolicy(model string) CachePolicy {
+	s.typeMux.RLock()
+	defer s.typeMux.RUnlock()
+
+	if policy, ok := s.cachePolicies[model]; ok {
+		return policy
+	}
+	if _, base, ok := splitTenantModel(model); ok {
+		if policy, ok := s.cachePolicies[base]; ok {
+			return policy
+		}
+	}
+	return s.cachePolicies["*"]
+}
+
+// setCacheControl sets the Cache-Control header the model's policy declares for a request.
+func (s *Store) setCacheControl(model string, w http.ResponseWriter, r *http.Request) {
+	policy := s.cachePolicy(model)
+	value := policy.Write
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		value = policy.List
+		if r.URL.Query().Get("id") != "" {
+			value = policy.Item
+		}
+	case http.MethodOptions:
+		value = ""
+	}
+	if value != "" {
+		w.Header().Set("Cache-Control", value)
+	}
+}
+
+// ParseCachePolicies parses a list of "model.route=value" rules separated by semicolons, where route
+// is list, item or write, e.g. "item.list=public, max-age=30;item.item=no-store;*.write=no-store".
+func ParseCachePolicies(spec string) (map[string]CachePolicy, error) {
+	policies := make(map[string]CachePolicy)
+	for _, rule := range strings.Split(spec, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		route, value, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid cache rule %q", rule)
+		}
+		model, route, ok := strings.Cut(strings.TrimSpace(route), ".")
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid cache rule %q", rule)
+		}
+		policy := policies[model]
+		switch route {
+		case "list":
+			policy.List = strings.TrimSpace(value)
+		case "item":
+			policy.Item = strings.TrimSpace(value)
+		case "write":
+			policy.Write = strings.TrimSpace(value)
+		default:
+			return nil, fmt.Errorf("invalid cache route in %q", rule)
+		}
+		policies[model] = policy
+	}
+	return policies, nil
+}
@@ -0,0 +1,207 @@
+// File: capacity.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements bounded model capacity. A model can be limited to a maximum
+// number of items; once a create pushes it over the limit, the least recently used (LRU) or the
+// oldest (FIFO) items are evicted with a regular delete event (reason "evicted"), so a public-facing
+// server cannot be filled until it runs out of memory. Eviction counts are published through expvar.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Eviction policies.
+const (
+	EvictLRU  = "lru"
+	EvictFIFO = "fifo"
+)
+
+// evictions counts the evicted items, keyed by model name.
+var evictions = expvar.NewMap("evictions")
+
+// Capacity limits the number of items a model may hold.
+type Capacity struct {
+	MaxItems int
+	Policy   string
+}
+
+// capacityLimit tracks the eviction order of a bounded collection; the front of the list is
+// evicted first.
+type capacityLimit struct {
+	Capacity
+	order    *list.List
+	elements map[int]*list.Element
+	mux      sync.Mutex
+}
+
+// SetCapacity bounds the number of items of a model, evicting the overflow right away.
+// A MaxItems of zero removes the limit. Immutable models cannot be bounded.
+func (s *Store) SetCapacity(model string, capacity Capacity) error {
+	c, ok := s.collection(model)
+	if !ok {
+		return fmt.Errorf("model %q is not registered", model)
+	}
+	if capacity.Policy == "" {
+		capacity.Policy = EvictLRU
+	}
+	if capacity.Policy != EvictLRU && capacity.Policy != EvictFIFO {
+		return fmt.Errorf("invalid eviction policy %q", capacity.Policy)
+	}
+	if capacity.MaxItems > 0 && s.immutability(model) != "" {
+		return fmt.Errorf("model %q is immutable: its items cannot be evicted", model)
+	}
+	if capacity.MaxItems <= 0 {
+		c.limit.Store((*capacityLimit)(nil))
+		return nil
+	}
+
+	limit := &capacityLimit{Capacity: capacity, order: list.New(), elements: make(map[int]*list.Element)}
+
+	// Hold every shard lock while seeding the order so no mutation is missed
+	for _, sh := range c.shards {
+		sh.itemMux.Lock()
+	}
+	c.each(func(id int, item interface{}) error {
+		limit.add(id)
+		return nil
+	})
+	c.limit.Store(limit)
+	for _, sh := range c.shards {
+		sh.itemMux.Unlock()
+	}
+
+	s.evictOverflow(c)
+	return nil
+}
+
+// capacity returns the limit of the collection, or nil when it is unbounded.
+func (c *collection) capacity() *capacityLimit {
+	limit, _ := c.limit.Load().(*capacityLimit)
+	return limit
+}
+
+// track records that an item was stored or used, for collections with a limit.
+func (c *collection) track(id int) {
+	if limit := c.capacity(); limit != nil {
+		limit.add(id)
+	}
+}
+
+// evictOverflow removes items until the collection is back within its limit. It must be called
+// without holding any shard lock.
+func (s *Store) evictOverflow(c *collection) {
+	limit := c.capacity()
+	if limit == nil {
+		return
+	}
+	for {
+		id, ok := limit.victim()
+		if !ok {
+			return
+		}
+
+		sh := c.shard(id)
+		sh.itemMux.Lock()
+		e, exists := sh.snapshot().get(id)
+		if !exists {
+			limit.remove(id)
+			sh.itemMux.Unlock()
+			continue
+		}
+		items := sh.edit()
+		event := s.removeLocked(context.Background(), c, items, id, e.item, "evicted")
+		sh.publish(items)
+		sh.itemMux.Unlock()
+
+		evictions.Add(c.name, 1)
+		s.notify(event)
+	}
+}
+
+// add starts tracking a stored item; items already tracked count as used.
+func (l *capacityLimit) add(id int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if element, ok := l.elements[id]; ok {
+		if l.Policy == EvictLRU {
+			l.order.MoveToBack(element)
+		}
+		return
+	}
+	l.elements[id] = l.order.PushBack(id)
+}
+
+// touch marks an item as recently used. It has no effect under FIFO eviction.
+func (l *capacityLimit) touch(id int) {
+	if l.Policy != EvictLRU {
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if element, ok := l.elements[id]; ok {
+		l.order.MoveToBack(element)
+	}
+}
+
+// remove stops tracking a removed item.
+func (l *capacityLimit) remove(id int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if element, ok := l.elements[id]; ok {
+		l.order.Remove(element)
+		delete(l.elements, id)
+	}
+}
+
+// victim returns the next item to evict while the collection is over its limit.
+func (l *capacityLimit) victim() (int, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.order.Len() <= l.MaxItems {
+		return 0, false
+	}
+	return l.order.Front().Value.(int), true
+}
+
+// ParseCapacities parses limits of the form "model=maxItems[:lru|fifo]", separated by commas.
+func ParseCapacities(spec string) (map[string]Capacity, error) {
+	capacities := make(map[string]Capacity)
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		model, rest, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid capacity rule %q", rule)
+		}
+		max, policy, _ := strings.Cut(rest, ":")
+		maxItems, err := strconv.Atoi(max)
+		if err != nil || maxItems < 0 {
+			return nil, fmt.Errorf("invalid item limit in %q", rule)
+		}
+		if policy == "" {
+			policy = EvictLRU
+		}
+		if policy != EvictLRU && policy != EvictFIFO {
+			return nil, fmt.Errorf("invalid eviction policy in %q", rule)
+		}
+		capacities[model] = Capacity{MaxItems: maxItems, Policy: policy}
+	}
+	return capacities, nil
+}
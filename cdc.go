@@ -0,0 +1,153 @@
+// File: cdc.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements change data capture (CDC) for the Store. Every mutation is
+// assigned a global, monotonically increasing sequence number and recorded in a bounded change log.
+// External systems can poll GET /_cdc?since=<seq> to receive the ordered change records that
+// happened after the last sequence they processed.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultChangeLogSize is the number of change records kept in memory for CDC consumers.
+const DefaultChangeLogSize = 10000
+
+// ChangeLog is a bounded, ordered log of change events.
+type ChangeLog struct {
+	records   []ChangeEvent
+	size      int
+	discarded uint64 // sequence of the last record discarded, 0 when none was
+	mux       sync.RWMutex
+}
+
+// NewChangeLog creates a change log retaining up to size records.
+func NewChangeLog(size int) *ChangeLog {
+	return &ChangeLog{size: size}
+}
+
+// Append adds a record to the log, discarding the oldest one when the log is full.
+func (l *ChangeLog) Append(event ChangeEvent) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if len(l.records) >= l.size {
+		l.discarded = l.records[0].Seq
+		l.records = l.records[1:]
+	}
+	l.records = append(l.records, event)
+}
+
+// Since returns up to limit records with a sequence greater than seq. The boolean result is false when
+// records after seq have already been discarded, meaning the consumer missed changes and must resync.
+func (l *ChangeLog) Since(seq uint64, limit int) ([]ChangeEvent, bool) {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	if l.discarded > seq {
+		return nil, false
+	}
+
+	// Sequence numbers increase but may skip values, so search for the first record after seq
+	start := sort.Search(len(l.records), func(i int) bool { return l.records[i].Seq > seq })
+	end := len(l.records)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+
+	result := make([]ChangeEvent, end-start)
+	copy(result, l.records[start:end])
+	return result, true
+}
+
+// record assigns the next sequence number to a mutation, appends it to the change log, writes it
+// ahead to the WAL and signs it, if enabled. It must be called while holding the lock of the shard
+// being changed, so that changes to the same item are always logged in the order they were applied.
+func (s *Store) record(event ChangeEvent) ChangeEvent {
+	event = s.sequence(event)
+	if s.wal != nil {
+		s.wal.Append(event)
+	}
+	s.signRecord(event)
+	return event
+}
+
+// sequence assigns the next sequence number to an event and appends it to the change log, without
+// writing it to the WAL.
+func (s *Store) sequence(event ChangeEvent) ChangeEvent {
+	s.seqMux.Lock()
+	defer s.seqMux.Unlock()
+
+	s.seq++
+	event.Seq = s.seq
+	event.Time = time.Now()
+	s.changes.Append(event)
+	return event
+}
+
+// LastSeq returns the sequence number of the most recent mutation.
+func (s *Store) LastSeq() uint64 {
+	s.seqMux.Lock()
+	defer s.seqMux.Unlock()
+
+	return s.seq
+}
+
+// handleCDC serves GET /_cdc?since=<seq>&limit=<n> returning ordered change records.
+func handleCDC(store *Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		parsed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid since")
+			return
+		}
+		since = parsed
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = parsed
+	}
+
+	records, ok := store.changes.Since(since, limit)
+	if !ok {
+		writeProblem(w, r, http.StatusGone, "Changes after the requested sequence are no longer available")
+		return
+	}
+
+	for i := range records {
+		sealed, err := sealEvent(records[i])
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		records[i] = sealed
+	}
+	next := since
+	if len(records) > 0 {
+		next = records[len(records)-1].Seq
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"records": records,
+		"next":    next,
+		"latest":  store.LastSeq(),
+	})
+}
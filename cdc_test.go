@@ -0,0 +1,63 @@
+// File: cdc_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the change feed of /_cdc: records are found after any sequence even
+// when sequences skip values, and carry the encrypted fields of their items sealed.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChangeLogSinceSkippedSequences(t *testing.T) {
+	changes := NewChangeLog(3)
+	for _, seq := range []uint64{2, 5, 6, 9} {
+		changes.Append(ChangeEvent{Seq: seq})
+	}
+	if _, ok := changes.Since(1, 0); ok {
+		t.Error("changes after a discarded record reported as available")
+	}
+	for since, want := range map[uint64][]uint64{2: {5, 6, 9}, 4: {5, 6, 9}, 5: {6, 9}, 7: {9}, 9: nil, 12: nil} {
+		records, ok := changes.Since(since, 0)
+		var got []uint64
+		for _, record := range records {
+			got = append(got, record.Seq)
+		}
+		if !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("since %d: %v (%t), want %v", since, got, ok, want)
+		}
+	}
+	if records, _ := changes.Since(2, 2); len(records) != 2 || records[1].Seq != 6 {
+		t.Errorf("limited records are %+v, want 5 and 6", records)
+	}
+}
+
+func TestChangeFeedSealsEncryptedFields(t *testing.T) {
+	keys, err := NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{7}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetFieldKeys(keys)
+	defer SetFieldKeys(nil)
+
+	store := newTestStore()
+	user := store.Create("user", &User{Name: "jane", Email: "jane@example.com", Token: "tok-1234"}).(*User)
+	store.Update("user", user.ID, &User{Name: "jane", Email: "jane@example.com", Token: "tok-5678"})
+	cdc := func(w http.ResponseWriter, r *http.Request) { handleCDC(store, w, r) }
+
+	w := serveTest(cdc, http.MethodGet, "/_cdc", "")
+	if body := w.Body.String(); w.Code != http.StatusOK || strings.Contains(body, "tok-") || !strings.Contains(body, sealedFieldPrefix) {
+		t.Errorf("change feed: status %d: %s", w.Code, body)
+	}
+	var stored User
+	if store.Get("user", user.ID, &stored); stored.Token != "tok-5678" {
+		t.Errorf("stored token is %q, want it left in plaintext", stored.Token)
+	}
+}
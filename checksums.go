@@ -0,0 +1,306 @@
+// File: checksums.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements data integrity checksums. Every item written through to (or
+// loaded from) a backend has the SHA-256 of its plaintext encoding recorded in its shard, under the
+// shard lock, so the checksum always matches the write the backend last received. POST /_verify
+// reads the backend and the mirror back and reports the items whose stored copy no longer matches
+// its checksum (corrupted or modified out of band, with a diff of the changed fields), the items
+// missing from the backend and those the backend holds although the store never wrote them. The
+// checksums are of the plaintext, with the encrypted fields opened, so they do not depend on how
+// the fields were sealed; reconciliation of the mirror compares them too.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// Integrity problems.
+const (
+	IntegrityMissing    = "missing"    // the backend lacks an item of the store
+	IntegrityUnexpected = "unexpected" // the backend holds an item the store did not write
+	IntegrityModified   = "modified"   // the stored item does not match its checksum
+	IntegrityCorrupt    = "corrupt"    // the stored item cannot be decoded
+)
+
+// integrityStats counts the items checked and the mismatches found by verification.
+var integrityStats = expvar.NewMap("integrity")
+
+// checksum is the SHA-256 of the plaintext encoding of an item.
+type checksum [sha256.Size]byte
+
+// checksumsOf selects the checksums of a shard the stored items are verified against. It is called
+// while holding the shard lock.
+type checksumsOf func(sh *storeShard) map[int]checksum
+
+// written selects the checksums of the items as last written through to the backends.
+func written(sh *storeShard) map[int]checksum {
+	return sh.checksums
+}
+
+// IntegrityReport is the result of a verification.
+type IntegrityReport struct {
+	Checked    int                 `json:"checked"` // number of stored copies checked
+	Mismatches []IntegrityMismatch `json:"mismatches"`
+	// Incomplete lists the backends and models that could not be scanned in full, with the error;
+	// only the items the store wrote were checked
+	Incomplete []string `json:"incomplete,omitempty"`
+}
+
+// IntegrityMismatch is a stored copy of an item that does not match its checksum.
+type IntegrityMismatch struct {
+	Backend string      `json:"backend"` // storage or mirror
+	Model   string      `json:"model"`
+	ID      int         `json:"id"`
+	Problem string      `json:"problem"`
+	Diff    []FieldDiff `json:"diff,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// FieldDiff is a field whose stored value differs from the value of the store. The values of
+// encrypted and masked fields are redacted.
+type FieldDiff struct {
+	Field    string          `json:"field"`
+	Stored   json.RawMessage `json:"stored"`   // null when the stored copy lacks the field
+	Expected json.RawMessage `json:"expected"` // null when the store lacks the field
+}
+
+// remember records the checksum of an item written through to the backends, or forgets it when
+// item is nil. data is the encoding written, which is the plaintext unless fields are sealed. It
+// must be called while holding the shard lock.
+func (s *Store) remember(model string, id int, item interface{}, data []byte) {
+	c, ok := s.collection(model)
+	if !ok {
+		return
+	}
+	sh := c.shard(id)
+	if item == nil {
+		delete(sh.checksums, id)
+		return
+	}
+	if len(c.meta.encrypted) > 0 && fieldKeys != nil {
+		var err error
+		if data, err = json.Marshal(item); err != nil {
+			delete(sh.checksums, id)
+			return
+		}
+	}
+	if sh.checksums == nil {
+		sh.checksums = make(map[int]checksum)
+	}
+	sh.checksums[id] = sha256.Sum256(data)
+}
+
+// decodeStored decodes an item read from a backend, opening its encrypted fields, and returns it
+// with its checksum.
+func decodeStored(c *collection, id int, data []byte) (interface{}, checksum, error) {
+	item := reflect.New(c.meta.typ).Interface()
+	if err := json.Unmarshal(data, item); err != nil {
+		return nil, checksum{}, err
+	}
+	if err := openFields(c.name, id, item); err != nil {
+		return nil, checksum{}, err
+	}
+	plain, err := json.Marshal(item)
+	if err != nil {
+		return nil, checksum{}, err
+	}
+	return item, sha256.Sum256(plain), nil
+}
+
+// uncached returns the backend of a cached storage, so verification reads what is actually stored.
+func uncached(storage Storage) Storage {
+	if cached, ok := storage.(*CachedStorage); ok {
+		return cached.Storage
+	}
+	return storage
+}
+
+// Verify reads back the items of every model from the backend and the mirror, and reports the
+// stored copies that do not match the checksums of the items the store wrote. Each item is checked
+// while holding its shard lock, so concurrent writes are not reported as mismatches.
+func (s *Store) Verify(ctx context.Context) (IntegrityReport, error) {
+	report := IntegrityReport{Mismatches: []IntegrityMismatch{}}
+	backends := []struct {
+		name    string
+		storage Storage
+	}{{"storage", s.storage}, {"mirror", s.mirror}}
+
+	collections := s.allCollections()
+	sort.Slice(collections, func(i, j int) bool { return collections[i].name < collections[j].name })
+	for _, backend := range backends {
+		if backend.storage == nil {
+			continue
+		}
+		if err := s.verifyBackend(ctx, &report, backend.name, uncached(backend.storage), collections, written); err != nil {
+			return report, err
+		}
+	}
+	integrityStats.Add("checked", int64(report.Checked))
+	integrityStats.Add("mismatches", int64(len(report.Mismatches)))
+	return report, nil
+}
+
+// verifyBackend checks the items of the collections stored by a backend against the checksums sums
+// selects, adding the mismatches to the report.
+func (s *Store) verifyBackend(ctx context.Context, report *IntegrityReport, name string, storage Storage, collections []*collection, sums checksumsOf) error {
+	for _, c := range collections {
+		// Gather the IDs the backend holds and those with a checksum, then check each
+		ids := make(map[int]bool)
+		err := scanStorage(ctx, storage, c.name, func(id int, data []byte) error {
+			ids[id] = true
+			return nil
+		})
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			report.Incomplete = append(report.Incomplete, fmt.Sprintf("%s %s: %v", name, c.name, err))
+		}
+		for _, sh := range c.shards {
+			sh.itemMux.Lock()
+			for id := range sums(sh) {
+				ids[id] = true
+			}
+			sh.itemMux.Unlock()
+		}
+		sorted := make([]int, 0, len(ids))
+		for id := range ids {
+			sorted = append(sorted, id)
+		}
+		sort.Ints(sorted)
+		for _, id := range sorted {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			mismatch, err := s.verifyItem(c, storage, id, sums)
+			if err != nil {
+				return err
+			}
+			report.Checked++
+			if mismatch != nil {
+				mismatch.Backend = name
+				report.Mismatches = append(report.Mismatches, *mismatch)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyItem checks the stored copy of an item against the checksum sums selects, and returns the
+// mismatch found, if any.
+func (s *Store) verifyItem(c *collection, storage Storage, id int, sums checksumsOf) (*IntegrityMismatch, error) {
+	sh := c.shard(id)
+	sh.itemMux.Lock()
+	defer sh.itemMux.Unlock()
+
+	expected, known := sums(sh)[id]
+	data, found, err := storage.Get(c.name, id)
+	if err != nil {
+		return &IntegrityMismatch{Model: c.name, ID: id, Problem: IntegrityCorrupt, Error: err.Error()}, nil
+	}
+	var current interface{}
+	if e, ok := sh.snapshot().get(id); ok {
+		current = e.item
+	}
+	switch {
+	case !found && !known:
+		return nil, nil
+	case !found:
+		return &IntegrityMismatch{Model: c.name, ID: id, Problem: IntegrityMissing}, nil
+	}
+	stored, sum, err := decodeStored(c, id, data)
+	if err != nil {
+		return &IntegrityMismatch{Model: c.name, ID: id, Problem: IntegrityCorrupt, Error: err.Error()}, nil
+	}
+	if known && sum == expected {
+		return nil, nil
+	}
+	mismatch := &IntegrityMismatch{Model: c.name, ID: id, Problem: IntegrityModified}
+	if !known {
+		mismatch.Problem = IntegrityUnexpected
+	}
+	if mismatch.Diff, err = diffItems(c.meta, stored, current); err != nil {
+		return nil, err
+	}
+	return mismatch, nil
+}
+
+// diffItems returns the fields of a stored item whose values differ from those of the current item
+// of the store (nil when the store has none).
+func diffItems(meta *modelMeta, stored, current interface{}) ([]FieldDiff, error) {
+	fields := func(item interface{}) (map[string]json.RawMessage, error) {
+		values := make(map[string]json.RawMessage)
+		if item == nil {
+			return values, nil
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		return values, json.Unmarshal(data, &values)
+	}
+	storedFields, err := fields(stored)
+	if err != nil {
+		return nil, err
+	}
+	currentFields, err := fields(current)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(storedFields)+len(currentFields))
+	for name := range storedFields {
+		names = append(names, name)
+	}
+	for name := range currentFields {
+		if _, ok := storedFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diff []FieldDiff
+	redacted, _ := json.Marshal(redactedValue)
+	for _, name := range names {
+		a, b := storedFields[name], currentFields[name]
+		if bytes.Equal(a, b) {
+			continue
+		}
+		if f, ok := meta.jsonField(name); ok && (containsField(meta.encrypted, f) || containsField(meta.masked, f)) {
+			if a != nil {
+				a = redacted
+			}
+			if b != nil {
+				b = redacted
+			}
+		}
+		diff = append(diff, FieldDiff{Field: name, Stored: a, Expected: b})
+	}
+	return diff, nil
+}
+
+// handleVerify serves POST /_verify, verifying the items of the backends against their checksums.
+func handleVerify(store *Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	report, err := store.Verify(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
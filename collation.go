@@ -0,0 +1,57 @@
+// File: collation.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements locale-aware collation of strings, for sorting non-English
+// data where byte order is wrong ("Zoë" before "apple", "été" after "zèbre"). A Collator compares
+// strings; NewCollator builds one from the Unicode Collation Algorithm and the CLDR tailorings of
+// golang.org/x/text/collate, so every language it knows sorts in its own order (ñ after n in
+// Spanish, å, ä and ö after z in Swedish, ...) and others in the root order: base letters first,
+// ignoring case and accents, then accents, then case.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// Collator compares strings in the order of a locale, returning -1, 0 or 1.
+type Collator interface {
+	CompareString(a, b string) int
+}
+
+// localeCollator is the collator of a locale. A *collate.Collator keeps buffers between calls and
+// cannot be shared by goroutines, so each comparison takes one from a pool.
+type localeCollator struct {
+	collators sync.Pool
+}
+
+// NewCollator returns the collator of a locale, given as a BCP 47 tag such as "sv", "es-MX" or
+// "de-u-co-phonebk"; "und" selects the root order.
+func NewCollator(locale string) (Collator, error) {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return nil, fmt.Errorf("no collation for locale %q: %v", locale, err)
+	}
+	c := &localeCollator{}
+	c.collators.New = func() interface{} { return collate.New(tag) }
+	return c, nil
+}
+
+// CompareString compares two strings in the order of the locale, then by their bytes so distinct
+// strings never compare equal.
+func (c *localeCollator) CompareString(a, b string) int {
+	collator := c.collators.Get().(*collate.Collator)
+	result := collator.CompareString(a, b)
+	c.collators.Put(collator)
+	if result != 0 {
+		return result
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,113 @@
+// File: collation_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests locale-aware collation: strings sort in the order of any locale,
+// collators can be shared by goroutines, and ?locale= sorts one request.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestCollatorOrdersLocales(t *testing.T) {
+	tests := []struct {
+		locale string
+		words  []string
+	}{
+		{"de", []string{"Äpfel", "apple", "Apple", "été", "zèbre"}},
+		{"sv", []string{"apple", "zèbre", "åsa", "äpple", "öl"}},
+		{"es", []string{"nube", "nutria", "ñandú", "oso"}},
+		{"pl", []string{"lato", "łódź", "mama"}},
+		{"cs", []string{"cena", "hrad", "chata", "ist"}},
+		{"tr", []string{"ıslak", "ilk"}},
+		{"und", []string{"a", "B", "c"}},
+	}
+	for _, test := range tests {
+		collator, err := NewCollator(test.locale)
+		if err != nil {
+			t.Fatalf("%s: %v", test.locale, err)
+		}
+		words := append([]string(nil), test.words...)
+		sort.Slice(words, func(i, j int) bool { return collator.CompareString(words[i], words[j]) < 0 })
+		if !reflect.DeepEqual(words, test.words) {
+			t.Errorf("%s: sorted %q, want %q", test.locale, words, test.words)
+		}
+	}
+}
+
+func TestCollatorDistinguishesDistinctStrings(t *testing.T) {
+	collator, _ := NewCollator("en")
+	if c := collator.CompareString("é", "é"); c == 0 {
+		t.Errorf("distinct strings compared equal")
+	}
+	if c := collator.CompareString("abc", "abc"); c != 0 {
+		t.Errorf("equal strings compared %d", c)
+	}
+}
+
+func TestCollatorRejectsMalformedLocales(t *testing.T) {
+	for _, locale := range []string{"", "not a tag", "x-"} {
+		if _, err := NewCollator(locale); err == nil {
+			t.Errorf("locale %q accepted", locale)
+		}
+	}
+}
+
+func TestCollatorIsSafeForConcurrentUse(t *testing.T) {
+	collator, _ := NewCollator("sv")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if collator.CompareString("zebra", "åsa") != -1 {
+					t.Error("zebra sorted after åsa in Swedish")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSortByRequestLocale(t *testing.T) {
+	store := newTestStore()
+	for _, name := range []string{"åsa", "zebra", "apple"} {
+		store.Create("tag", &Tag{Name: name})
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) { handleRequest(store, "tag", w, r) }
+
+	names := func(locale string) []string {
+		w := serveTest(handler, http.MethodGet, "/tag?sort=name&locale="+locale, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("locale %s: status %d: %s", locale, w.Code, w.Body)
+		}
+		var tags []Tag
+		if err := json.Unmarshal(w.Body.Bytes(), &tags); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, tag := range tags {
+			names = append(names, tag.Name)
+		}
+		return names
+	}
+	if got, want := names("en"), []string{"apple", "åsa", "zebra"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("English order %q, want %q", got, want)
+	}
+	if got, want := names("sv"), []string{"apple", "zebra", "åsa"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Swedish order %q, want %q", got, want)
+	}
+	if w := serveTest(handler, http.MethodGet, "/tag?sort=name&locale=not%20a%20tag", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed locale: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,132 @@
+// File: compare_and_swap.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements compare-and-swap updates, for state machines whose transitions
+// must not be applied twice or out of order (an order goes from open to closed only while it is
+// still open). Store.UpdateIf applies an update only while the given fields of the item still hold
+// the expected values, checked under the shard lock so no other write can slip in between, and
+// PUT requests do the same with ?expect.{field}=value parameters (PUT /item?id=3&expect.done=false).
+// An item whose fields changed is left as it is and answered with 409 Conflict naming the field.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// expectPrefix prefixes the query parameters naming the expected values of the fields of an item.
+const expectPrefix = "expect."
+
+// UpdateIf updates an item like Update while the fields named by expected (by Go or JSON name)
+// still hold the expected values. It reports whether the item exists, and returns an error of
+// status 409 naming a field holding another value, in which case the item is not updated.
+func (s *Store) UpdateIf(model string, id int, expected map[string]interface{}, updated interface{}) (bool, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return false, nil
+	}
+	check, err := expectation(c.meta, expected)
+	if err != nil {
+		return s.exists(model, id), err
+	}
+	return s.updateChecked(context.Background(), model, id, updated, check)
+}
+
+// expectedField is a field of an item with the value it is expected to hold.
+type expectedField struct {
+	field *fieldMeta
+	value reflect.Value
+}
+
+// expectation returns the check of an item holding the expected values, converted to the types
+// of their fields.
+func expectation(meta *modelMeta, expected map[string]interface{}) (func(current interface{}) error, error) {
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]expectedField, 0, len(names))
+	for _, name := range names {
+		f, ok := meta.field(name)
+		if !ok {
+			return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", name)}
+		}
+		value := reflect.ValueOf(expected[name])
+		if !value.IsValid() {
+			value = reflect.Zero(f.typ)
+		}
+		if !value.Type().ConvertibleTo(f.typ) {
+			return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("invalid value for %s", f.jsonName)}
+		}
+		fields = append(fields, expectedField{field: f, value: value.Convert(f.typ)})
+	}
+	return func(current interface{}) error {
+		for _, e := range fields {
+			value := e.field.value(current)
+			if !reflect.DeepEqual(value.Interface(), e.value.Interface()) {
+				err := localizef("%s is %v, not %v", e.field.jsonName, value.Interface(), e.value.Interface())
+				return &Error{Status: http.StatusConflict, Code: CodeConflict, Err: fieldError(e.field, "expected", value.Interface(), err)}
+			}
+		}
+		return nil
+	}, nil
+}
+
+// parseExpectations reads the expected values of the ?expect.{field}= parameters of a request.
+func parseExpectations(meta *modelMeta, query url.Values) (map[string]interface{}, error) {
+	expected := make(map[string]interface{})
+	for param, values := range query {
+		name := strings.TrimPrefix(param, expectPrefix)
+		if name == param {
+			continue
+		}
+		f, ok := meta.field(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s", name)
+		}
+		value, err := parseFieldValue(f.typ, values[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", param, err)
+		}
+		expected[f.name] = value
+	}
+	return expected, nil
+}
+
+// withExpectations adds the check of the ?expect.{field}= parameters of a request to the check of
+// its preconditions (nil when there are none). It answers the request and reports false when a
+// parameter is invalid.
+func withExpectations(meta *modelMeta, check func(current interface{}) error, w http.ResponseWriter, r *http.Request) (func(current interface{}) error, bool) {
+	expected, err := parseExpectations(meta, r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+	if len(expected) == 0 {
+		return check, true
+	}
+	expect, err := expectation(meta, expected)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+	if check == nil {
+		return expect, true
+	}
+	return func(current interface{}) error {
+		if err := check(current); err != nil {
+			return err
+		}
+		return expect(current)
+	}, true
+}
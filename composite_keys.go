@@ -0,0 +1,243 @@
+// File: composite_keys.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements models keyed by several fields. Fields tagged `key:"true"` make
+// up the key of a model, in declaration order (e.g. OrderID and LineNo of an order line), and the
+// store keeps an index from each key to its item, which still has an internal ID. Requests address
+// the items with ?key= instead of ?id=, the components joined by commas: GET /orderline?key=42,3.
+// A comma or percent sign inside a component is escaped as %2C or %25 (sent as %252C and %2525 in
+// the query string). Creating or updating an item whose key is already taken returns 409, and
+// filters on every key field are answered from the key index. In partitioned mode keys are resolved
+// among the items of the local node only.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errKeyConflict is returned when an item's key belongs to another item.
+var errKeyConflict = errors.New("an item with this key already exists")
+
+// keyEscaper escapes the separators of key components.
+var keyEscaper = strings.NewReplacer("%", "%25", ",", "%2C")
+
+// keyIndex maps the keys of a model's items to their IDs.
+type keyIndex struct {
+	fields []*fieldMeta
+	sparse bool // whether items whose key fields are all zero are left out
+	ids    map[string]int
+	mux    sync.RWMutex
+}
+
+// keyFields returns the fields tagged as the key of a model, or nil when it has none. Key fields
+// must be scalars (or times) that query values can be parsed into; other tagged fields are logged
+// and ignored.
+func keyFields(m *modelMeta) []*fieldMeta {
+	var fields []*fieldMeta
+	for _, f := range m.fields {
+		if f.tag.Get("key") != "true" {
+			continue
+		}
+		if !orderable(f.typ) {
+			log.Printf("keys: ignoring key field %s.%s of type %s", m.typ.Name(), f.name, f.typ)
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// newKeyIndex creates an empty index over the key fields of a model.
+func newKeyIndex(fields []*fieldMeta) *keyIndex {
+	return &keyIndex{fields: fields, ids: make(map[string]int)}
+}
+
+// keyOf returns the encoded key of an item.
+func (k *keyIndex) keyOf(item interface{}) string {
+	values := make(map[string]reflect.Value, len(k.fields))
+	for _, f := range k.fields {
+		values[f.name] = f.value(item)
+	}
+	parts, _ := k.components(values)
+	return encodeKey(parts)
+}
+
+// parse validates a key received in a request and returns its canonical encoding, so "042,3" and
+// "42,3" name the same item.
+func (k *keyIndex) parse(key string) (string, error) {
+	parts := strings.Split(key, ",")
+	if len(parts) != len(k.fields) {
+		return "", localizef("key must have %d components", len(k.fields))
+	}
+	for i, f := range k.fields {
+		part, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return "", localizef("invalid key component %q", parts[i])
+		}
+		value, err := parseFieldValue(f.typ, part)
+		if err != nil {
+			return "", localizef("invalid value for key field %q", f.jsonName)
+		}
+		parts[i] = formatKeyValue(reflect.ValueOf(value))
+	}
+	return encodeKey(parts), nil
+}
+
+// components formats the key named by the values of the key fields, keyed by Go field name. It
+// reports false when a key field is missing.
+func (k *keyIndex) components(values map[string]reflect.Value) ([]string, bool) {
+	parts := make([]string, len(k.fields))
+	for i, f := range k.fields {
+		v, ok := values[f.name]
+		if !ok {
+			return nil, false
+		}
+		parts[i] = formatKeyValue(v)
+	}
+	return parts, true
+}
+
+// lookup returns the ID of the item with an encoded key.
+func (k *keyIndex) lookup(key string) (int, bool) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	id, ok := k.ids[key]
+	return id, ok
+}
+
+// indexed reports whether the key of an item belongs in the index.
+func (k *keyIndex) indexed(item interface{}) bool {
+	if !k.sparse {
+		return true
+	}
+	for _, f := range k.fields {
+		if !f.value(item).IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// add indexes the key of an item.
+func (k *keyIndex) add(id int, item interface{}) {
+	if !k.indexed(item) {
+		return
+	}
+	key := k.keyOf(item)
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.ids[key] = id
+}
+
+// remove drops the key of an item, unless it has been taken over by another item.
+func (k *keyIndex) remove(id int, item interface{}) {
+	if !k.indexed(item) {
+		return
+	}
+	key := k.keyOf(item)
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if k.ids[key] == id {
+		delete(k.ids, key)
+	}
+}
+
+// encodeKey joins key components, escaping their separators.
+func encodeKey(parts []string) string {
+	for i, part := range parts {
+		parts[i] = keyEscaper.Replace(part)
+	}
+	return strings.Join(parts, ",")
+}
+
+// formatKeyValue formats a key component. Times are formatted as instants so the same moment in
+// different locations is the same key.
+func formatKeyValue(v reflect.Value) string {
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// GetByKey retrieves an item of a model keyed by several fields by its encoded key.
+func (s *Store) GetByKey(model, key string, result interface{}) bool {
+	id, ok, err := s.keyID(model, key)
+	return err == nil && ok && s.Get(model, id, result)
+}
+
+// keyID resolves the encoded key of an item to its ID.
+func (s *Store) keyID(model, key string) (int, bool, error) {
+	c, ok := s.collection(model)
+	if !ok || c.keys == nil {
+		return 0, false, fmt.Errorf("model %q has no key", model)
+	}
+	canonical, err := c.keys.parse(key)
+	if err != nil {
+		return 0, false, err
+	}
+	id, ok := c.keys.lookup(canonical)
+	return id, ok, nil
+}
+
+// checkKey returns an error of status 409 when the key, a lookup field or a unique field of an item
+// written to the given ID (0 for a creation) belongs to another item.
+func (s *Store) checkKey(model string, id int, item interface{}) error {
+	c, ok := s.collection(model)
+	if !ok {
+		return nil
+	}
+	taken := func(idx *keyIndex) bool {
+		owner, found := idx.lookup(idx.keyOf(item))
+		return idx.indexed(item) && found && owner != id && s.exists(model, owner)
+	}
+	if c.keys != nil && taken(c.keys) {
+		return &Error{Status: http.StatusConflict, Code: CodeConflict, Err: errKeyConflict}
+	}
+	for _, indexes := range []map[string]*keyIndex{c.lookups, c.uniques} {
+		for _, idx := range indexes {
+			if taken(idx) {
+				return uniqueConflict(idx.fields[0], item)
+			}
+		}
+	}
+	return nil
+}
+
+// withKeyID rewrites a ?key= request into the equivalent ?id= request. It answers the request and
+// reports false when the key is invalid or names no item.
+func withKeyID(store *Store, model string, w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" || r.Method == http.MethodPost {
+		return r, true
+	}
+	id, found, err := store.keyID(model, key)
+	switch {
+	case err != nil:
+		writeError(w, r, http.StatusBadRequest, err)
+		return nil, false
+	case !found:
+		writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+		return nil, false
+	}
+	query.Del("key")
+	query.Set("id", strconv.Itoa(id))
+	keyed := r.Clone(r.Context())
+	keyed.URL.RawQuery = query.Encode()
+	return keyed, true
+}
@@ -0,0 +1,93 @@
+// File: context.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the context-aware variants of the store operations, in the
+// manner of database/sql: CreateContext, GetContext, GetAllContext, UpdateContext and
+// DeleteContext behave like the methods they are named after, but give up with the error of their
+// context once it is done, and pass its values (deadlines, traces) down to the storage backends
+// implementing ContextStorage. A write is only given up before it is applied; once applied in
+// memory it is always written through. The model routes serve every request under its own context,
+// so long scans stop as soon as the client disconnects.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+)
+
+// CreateContext adds a new item to a registered model like Insert, unless ctx is done.
+func (s *Store) CreateContext(ctx context.Context, model string, item interface{}) (interface{}, error) {
+	return s.createChecked(ctx, model, item, 0)
+}
+
+// GetContext retrieves an item like Get, unless ctx is done.
+func (s *Store) GetContext(ctx context.Context, model string, id int, result interface{}) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.Get(model, id, result), nil
+}
+
+// GetAllContext retrieves all items of a model like GetAll, stopping with the error of ctx once it
+// is done.
+func (s *Store) GetAllContext(ctx context.Context, model string, result interface{}) error {
+	c, ok := s.collection(model)
+	if !ok {
+		return ctx.Err()
+	}
+	itemSlice := reflect.ValueOf(result).Elem()
+	return c.each(func(id int, item interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		elem := reflect.New(itemSlice.Type().Elem()).Elem()
+		assignItem(elem, item)
+		itemSlice.Set(reflect.Append(itemSlice, elem))
+		return nil
+	})
+}
+
+// UpdateContext replaces an existing item like Update, unless ctx is done. It reports whether the
+// item exists, and returns the error of its key or a unique field holding the value of another
+// item, or that of ctx.
+func (s *Store) UpdateContext(ctx context.Context, model string, id int, updatedItem interface{}) (bool, error) {
+	return s.updateChecked(ctx, model, id, updatedItem, nil)
+}
+
+// DeleteContext removes an item like Delete, unless ctx is done.
+func (s *Store) DeleteContext(ctx context.Context, model string, id int) (bool, error) {
+	return s.deleteChecked(ctx, model, id, nil)
+}
+
+// originKey is the context key of the origin recorded in the change events of a write.
+type originKey struct{}
+
+// withOrigin tags the change events of the writes made under ctx with origin, so that the
+// components writing on behalf of others (such as the sync protocol) can tell their own events
+// apart.
+func withOrigin(ctx context.Context, origin string) context.Context {
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// originOf returns the origin of the writes made under ctx, empty for regular writes.
+func originOf(ctx context.Context) string {
+	origin, _ := ctx.Value(originKey{}).(string)
+	return origin
+}
+
+// contextError returns the error answered for a store operation given up because its context is
+// done: 504 past its deadline, 503 once canceled (the client is usually gone by then).
+func contextError(err error) *Error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Status: http.StatusGatewayTimeout, Code: CodeUnavailable, Err: err}
+	case errors.Is(err, context.Canceled):
+		return &Error{Status: http.StatusServiceUnavailable, Code: CodeUnavailable, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+// File: crdt_sync.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the offline sync protocol. Every field of every item is treated
+// as a last-write-wins register with its own timestamp, and deletion is one more register, so the
+// batched mutations a client recorded while offline can be pushed to POST /{model}/_sync at any time
+// and merged with concurrent changes without losing unrelated field updates. GET /{model}/_sync
+// returns the items changed since a cursor, including deletions, so clients can catch up.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sync mutation operations.
+const (
+	SyncSet    = "set"
+	SyncDelete = "delete"
+)
+
+// syncOrigin marks the change events written by the sync protocol.
+const syncOrigin = "sync"
+
+// SyncMutation is a change recorded by a client. Mutations without an ID create an item; Ref lets
+// the client match the created item with its local copy.
+type SyncMutation struct {
+	ID     int                        `json:"id,omitempty"`
+	Ref    string                     `json:"ref,omitempty"`
+	Op     string                     `json:"op"`
+	Fields map[string]json.RawMessage `json:"fields,omitempty"`
+	Time   time.Time                  `json:"time"`
+}
+
+// SyncPush is the body of a push.
+type SyncPush struct {
+	Mutations []SyncMutation `json:"mutations"`
+}
+
+// SyncItem is the state of one item returned by a pull.
+type SyncItem struct {
+	ID      int                  `json:"id"`
+	Deleted bool                 `json:"deleted,omitempty"`
+	Item    interface{}          `json:"item,omitempty"`
+	Clocks  map[string]time.Time `json:"clocks,omitempty"`
+}
+
+// syncRecord holds the registers of one item.
+type syncRecord struct {
+	clocks  map[string]time.Time
+	deleted time.Time
+	seq     uint64
+}
+
+// live reports whether the item was written after it was last deleted.
+func (r *syncRecord) live() bool {
+	for _, clock := range r.clocks {
+		if clock.After(r.deleted) {
+			return true
+		}
+	}
+	return false
+}
+
+// CRDTSync keeps the per-field registers of a store's items.
+type CRDTSync struct {
+	store   *Store
+	records map[string]map[int]*syncRecord
+	seq     uint64
+	mux     sync.Mutex // guards records and seq
+	pushMux sync.Mutex // serializes the merges of pushes
+}
+
+// EnableSync turns on the offline sync protocol for every model of the store.
+func (s *Store) EnableSync() *CRDTSync {
+	if s.crdt == nil {
+		s.crdt = &CRDTSync{store: s, records: make(map[string]map[int]*syncRecord)}
+		s.Subscribe(s.crdt.observe)
+	}
+	return s.crdt
+}
+
+// record returns the registers of an item. It must be called while holding the lock.
+func (c *CRDTSync) record(model string, id int) *syncRecord {
+	ids, ok := c.records[model]
+	if !ok {
+		ids = make(map[int]*syncRecord)
+		c.records[model] = ids
+	}
+	record, ok := ids[id]
+	if !ok {
+		record = &syncRecord{clocks: make(map[string]time.Time)}
+		ids[id] = record
+	}
+	return record
+}
+
+// observe advances the registers written by regular (non-sync) changes to the event time.
+func (c *CRDTSync) observe(event ChangeEvent) {
+	if event.Origin == syncOrigin {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	record := c.record(event.Model, event.ID)
+	c.seq++
+	record.seq = c.seq
+	if event.Op == OpDelete {
+		record.deleted = event.Time
+		return
+	}
+	newFields, oldFields := syncFields(event.Item), syncFields(event.Old)
+	if meta, ok := c.store.meta(event.Model); ok && meta.id != nil {
+		delete(newFields, meta.id.jsonName)
+	}
+	for name, value := range newFields {
+		if string(oldFields[name]) != string(value) || event.Op == OpCreate {
+			record.clocks[name] = event.Time
+		}
+	}
+}
+
+// syncFields encodes an item as a map of its JSON fields.
+func syncFields(item interface{}) map[string]json.RawMessage {
+	fields := make(map[string]json.RawMessage)
+	if item == nil {
+		return fields
+	}
+	data, err := marshalItem(item)
+	if err == nil {
+		json.Unmarshal(data, &fields)
+	}
+	return fields
+}
+
+// Push merges a batch of client mutations into a model and returns the IDs assigned to created
+// items by their refs.
+func (c *CRDTSync) Push(model string, mutations []SyncMutation) (map[string]int, error) {
+	return c.push(context.Background(), model, mutations)
+}
+
+// push merges mutations like Push, writing them under ctx.
+func (c *CRDTSync) push(ctx context.Context, model string, mutations []SyncMutation) (map[string]int, error) {
+	col, ok := c.store.collection(model)
+	if !ok {
+		return nil, fmt.Errorf("model %q is not registered", model)
+	}
+
+	// Merges are serialized, but the registers are only locked between the writes: the listeners
+	// the writes notify (cascading deletes among them) write in turn and are observed
+	c.pushMux.Lock()
+	defer c.pushMux.Unlock()
+
+	ids := make(map[string]int)
+	for _, mutation := range mutations {
+		if mutation.Time.IsZero() {
+			mutation.Time = time.Now()
+		}
+		if mutation.ID == 0 {
+			if mutation.Op == SyncDelete {
+				continue
+			}
+			mutation.ID = c.store.takeID(col)
+			if mutation.Ref != "" {
+				ids[mutation.Ref] = mutation.ID
+			}
+		}
+		if err := c.merge(ctx, col, mutation); err != nil {
+			return ids, err
+		}
+	}
+	return ids, nil
+}
+
+// merge applies one mutation register by register, writing the merged state through the checked
+// create, update and delete paths, so the mutation is validated and held to the parents, keys,
+// unique fields, immutability and quotas of the model like any other write. The registers only
+// advance once the write succeeds. It must be called while holding pushMux.
+func (c *CRDTSync) merge(ctx context.Context, col *collection, mutation SyncMutation) error {
+	var deleted time.Time
+	clocks := make(map[string]time.Time)
+	c.mux.Lock()
+	if record, ok := c.records[col.name][mutation.ID]; ok {
+		deleted = record.deleted
+		for name, clock := range record.clocks {
+			clocks[name] = clock
+		}
+	}
+	c.mux.Unlock()
+
+	// Pick the registers the mutation wins
+	won := make(map[string]json.RawMessage)
+	switch mutation.Op {
+	case SyncDelete:
+		if !mutation.Time.After(deleted) {
+			return nil
+		}
+		deleted = mutation.Time
+	case SyncSet:
+		for name, value := range mutation.Fields {
+			field, ok := col.meta.jsonField(name)
+			if !ok || field == col.meta.id {
+				continue
+			}
+			if mutation.Time.After(clocks[name]) {
+				won[name] = value
+				clocks[name] = mutation.Time
+			}
+		}
+		if len(won) == 0 {
+			return nil
+		}
+	default:
+		return fmt.Errorf("invalid sync operation %q", mutation.Op)
+	}
+
+	// Write the merged state: delete when the tombstone wins, otherwise store the fields
+	ctx = withOrigin(ctx, syncOrigin)
+	merged := &syncRecord{clocks: clocks, deleted: deleted}
+	var err error
+	switch {
+	case !merged.live():
+		_, err = c.store.deleteChecked(ctx, col.name, mutation.ID, nil)
+	default:
+		var exists bool
+		exists, err = c.store.modify(ctx, col.name, mutation.ID, func(current interface{}) (interface{}, error) {
+			return c.mergedItem(col, mutation.ID, current, won)
+		})
+		if !exists {
+			if int64(mutation.ID) >= atomic.LoadInt64(&col.nextID) {
+				return fmt.Errorf("%s %d does not exist", col.name, mutation.ID)
+			}
+			var item interface{}
+			if item, err = c.mergedItem(col, mutation.ID, nil, won); err == nil {
+				_, err = c.store.createCheckedAt(ctx, col.name, mutation.ID, item, 0)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	record := c.record(col.name, mutation.ID)
+	record.deleted = deleted
+	for name := range won {
+		record.clocks[name] = mutation.Time
+	}
+	c.seq++
+	record.seq = c.seq
+	return nil
+}
+
+// mergedItem returns a new item holding the fields of current (when not nil) replaced by the
+// fields won by a mutation, validated and checked against its parents.
+func (c *CRDTSync) mergedItem(col *collection, id int, current interface{}, won map[string]json.RawMessage) (interface{}, error) {
+	fields := syncFields(current)
+	for name, value := range won {
+		fields[name] = value
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	item := reflect.New(col.meta.typ).Interface()
+	if err := unmarshalItem(data, item); err != nil {
+		return nil, &Error{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Err: fmt.Errorf("invalid fields for %s %d: %w", col.name, id, err)}
+	}
+	if col.meta.id != nil {
+		col.meta.id.value(item).SetInt(int64(id))
+	}
+	if err := validate(col.meta, item); err != nil {
+		return nil, err
+	}
+	if err := c.store.checkParents(col.name, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Pull returns the items of a model changed after the cursor, and the cursor to pull from next.
+// A zero cursor returns every item.
+func (c *CRDTSync) Pull(model string, since uint64) ([]SyncItem, uint64, error) {
+	col, ok := c.store.collection(model)
+	if !ok {
+		return nil, 0, fmt.Errorf("model %q is not registered", model)
+	}
+
+	c.mux.Lock()
+	changed := make(map[int]SyncItem)
+	for id, record := range c.records[model] {
+		if record.seq > since {
+			clocks := make(map[string]time.Time, len(record.clocks))
+			for name, clock := range record.clocks {
+				clocks[name] = clock
+			}
+			changed[id] = SyncItem{ID: id, Deleted: !record.live(), Clocks: clocks}
+		}
+	}
+	cursor := c.seq
+	c.mux.Unlock()
+
+	if since == 0 {
+		col.each(func(id int, item interface{}) error {
+			if _, ok := changed[id]; !ok {
+				changed[id] = SyncItem{ID: id}
+			}
+			return nil
+		})
+	}
+
+	items := make([]SyncItem, 0, len(changed))
+	for id, state := range changed {
+		item := reflect.New(col.meta.typ).Interface()
+		if c.store.Get(model, id, item) {
+			state.Item, state.Deleted = item, false
+		} else {
+			state.Deleted = true
+		}
+		if since == 0 && state.Deleted {
+			continue
+		}
+		items = append(items, state)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items, cursor, nil
+}
+
+// handleSync serves POST /{model}/_sync (push) and GET /{model}/_sync?since=<cursor> (pull).
+func (c *CRDTSync) handleSync(model string, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var push SyncPush
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		ids, err := c.push(r.Context(), model, push.Mutations)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		c.mux.Lock()
+		cursor := c.seq
+		c.mux.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ids": ids, "cursor": cursor})
+
+	case http.MethodGet:
+		var since uint64
+		if v := r.URL.Query().Get("since"); v != "" {
+			parsed, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, "Invalid cursor")
+				return
+			}
+			since = parsed
+		}
+		items, cursor, err := c.Pull(model, since)
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "cursor": cursor})
+
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
@@ -0,0 +1,122 @@
+// File: crdt_sync_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the offline sync protocol: pushed mutations are merged field by
+// field, written through the checked paths of the store, and the writes they cascade to are
+// observed without deadlocking.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSyncMergesFieldsLastWriterWins(t *testing.T) {
+	store := newTestStore()
+	sync := store.EnableSync()
+	now := time.Now()
+
+	ids, err := sync.Push("item", []SyncMutation{{Ref: "a", Op: SyncSet, Time: now, Fields: map[string]json.RawMessage{"title": json.RawMessage(`"offline"`)}}})
+	if err != nil || ids["a"] == 0 {
+		t.Fatalf("push of a new item: ids %v, error %v", ids, err)
+	}
+	id := ids["a"]
+	_, err = sync.Push("item", []SyncMutation{
+		{ID: id, Op: SyncSet, Time: now.Add(-time.Minute), Fields: map[string]json.RawMessage{"title": json.RawMessage(`"stale"`), "done": json.RawMessage(`true`)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var item Item
+	if !store.Get("item", id, &item) || item.Title != "offline" || !item.Done {
+		t.Fatalf("merged item is %+v, want the newer title and the unwritten done flag", item)
+	}
+
+	items, cursor, err := sync.Pull("item", 0)
+	if err != nil || len(items) != 1 || cursor == 0 {
+		t.Fatalf("pull: %d items, cursor %d, error %v", len(items), cursor, err)
+	}
+	if _, err := sync.Push("item", []SyncMutation{{ID: id, Op: SyncDelete, Time: now.Add(time.Minute)}}); err != nil {
+		t.Fatal(err)
+	}
+	items, _, _ = sync.Pull("item", cursor)
+	if len(items) != 1 || !items[0].Deleted || store.exists("item", id) {
+		t.Fatalf("pull after the delete: %+v", items)
+	}
+}
+
+func TestSyncPushCascadesWithoutDeadlock(t *testing.T) {
+	store := newTestStore()
+	store.Register("comment", Comment{})
+	sync := store.EnableSync()
+	store.Create("item", &Item{Title: "discussed"})
+	store.Create("comment", &Comment{SubjectType: "item", SubjectID: 1, Body: "first"})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sync.Push("item", []SyncMutation{{ID: 1, Op: SyncDelete}})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("push of a delete cascading to a comment never returned")
+	}
+	if store.exists("comment", 1) {
+		t.Fatal("the comment of the deleted item was kept")
+	}
+	if item := store.Create("item", &Item{Title: "later"}); item == nil || !store.exists("item", 2) {
+		t.Fatal("write after the push failed")
+	}
+}
+
+func TestSyncPushIsChecked(t *testing.T) {
+	store := newTestStore()
+	store.Register("entry", Entry{})
+	if err := store.SetImmutable("entry", ImmutableReject); err != nil {
+		t.Fatal(err)
+	}
+	sync := store.EnableSync()
+	store.Create("entry", &Entry{Account: "cash", Amount: 100})
+	store.Create("item", &Item{Title: "first", Slug: "first"})
+
+	if _, err := sync.Push("entry", []SyncMutation{{ID: 1, Op: SyncDelete}}); asError(err, 0).Status != http.StatusMethodNotAllowed {
+		t.Errorf("delete of an immutable entry: %v, want 405", err)
+	}
+	if _, err := sync.Push("entry", []SyncMutation{{ID: 1, Op: SyncSet, Fields: map[string]json.RawMessage{"amount": json.RawMessage(`1`)}}}); asError(err, 0).Status != http.StatusMethodNotAllowed {
+		t.Errorf("update of an immutable entry: %v, want 405", err)
+	}
+	var entry Entry
+	if !store.Get("entry", 1, &entry) || entry.Amount != 100 {
+		t.Fatalf("immutable entry is %+v after the pushes", entry)
+	}
+
+	set := func(fields string) error {
+		var values map[string]json.RawMessage
+		json.Unmarshal([]byte(fields), &values)
+		_, err := sync.Push("item", []SyncMutation{{Op: SyncSet, Fields: values}})
+		return err
+	}
+	if err := set(`{"title":"copy","slug":"first"}`); asError(err, 0).Status != http.StatusConflict {
+		t.Errorf("item taking a unique slug: %v, want 409", err)
+	}
+	if err := set(`{"title":"orphan","userId":99}`); err == nil {
+		t.Error("item referencing a missing user was merged")
+	}
+	if _, err := sync.Push("item", []SyncMutation{{ID: 500, Op: SyncSet, Fields: map[string]json.RawMessage{"title": json.RawMessage(`"made up"`)}}}); err == nil {
+		t.Error("set of an ID never assigned was merged")
+	}
+	var items []Item
+	store.Find("item", nil, &items)
+	if len(items) != 1 {
+		t.Fatalf("the refused pushes stored items: %+v", items)
+	}
+}
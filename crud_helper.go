@@ -5,179 +5,874 @@
 // License: MIT
 // Description: This file contains a generic HTTP CRUD helper for Go that can be reused across any project.
 // It provides basic Create, Read, Update, and Delete (CRUD) functionality for any type of data model
-// using reflection. The helper uses an in-memory store (map) to manage items, and the functions
-// are thread-safe using a mutex to ensure concurrent access.
+// using reflection. The helper uses an in-memory store to manage items: every registered model gets
+// its own collection with a separate ID sequence and optional secondary indexes, partitioned into shards that each have their own
+// lock so concurrent writes to different items do not contend. Reads are served from copy-on-write
+// shard snapshots and never take a lock.
 
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DefaultShardCount is the number of shards per model used by NewStore.
+const DefaultShardCount = 32
+
 // Store is a generic structure to hold and manage items in memory.
 type Store struct {
-	data    map[int]interface{}
-	nextID  int
-	itemMux sync.Mutex
+	shardCount  int
+	collections map[string]*collection
+	typeMux     sync.RWMutex
+
+	seq     uint64
+	seqMux  sync.Mutex
+	changes *ChangeLog
+
+	listeners   []func(ChangeEvent)
+	listenerMux sync.Mutex
+
+	cachePolicies map[string]CachePolicy // guarded by typeMux
+	immutable     map[string]string      // immutability modes by model; guarded by typeMux
+	responses     *ResponseCache
+	idempotency   *Idempotency
+	coalescer     *Coalescer
+	misses        *NegativeCache
+	relations     map[string]map[string]*Relation // parent, child; guarded by typeMux
+	manyToMany    []*ManyToMany                   // guarded by typeMux
+	requireMatch  bool
+	relationLinks bool
+	privileged    func(r *http.Request) bool // callers seeing the raw values of masked fields
+	collator      Collator                   // orders sorted strings, byte order when nil; guarded by typeMux
+	itemQuota     func(tenant string) int    // most items of a tenant, unlimited when 0; guarded by typeMux
+	idSlot        int64                      // slot of the IDs this node creates, every ID when 0
+	quotaLocks    map[string]*sync.Mutex     // serialize the creates of each tenant with an item quota; guarded by quotaMux
+	quotaMux      sync.Mutex
+
+	auditLog   io.Writer // receives the audit entries of privacy actions; guarded by auditMux
+	auditMux   sync.Mutex
+	receiptKey []byte // signs erasure receipts
+
+	wal   *EventLog       // mutations are written ahead to, for point-in-time recovery
+	chain *SignatureChain // mutations are signed in, when records are signed
+
+	storage   Storage
+	mirror    Storage
+	crdt      *CRDTSync
+	partition *Partitioner
+}
+
+// collection holds the items of one model together with its own ID sequence.
+type collection struct {
+	nextID int64
+	name   string
+	meta   *modelMeta
+	shards []*storeShard
+
+	indexes  map[string]*fieldIndex
+	indexMux sync.RWMutex
+	keys     *keyIndex               // nil unless the model is keyed by tagged fields
+	lookups  map[string]*keyIndex    // indexes of the lookup fields, by JSON name
+	uniques  map[string]*keyIndex    // indexes of the other unique fields, by JSON name
+	geo      *geoIndex               // nil unless the model is located
+	text     TextIndex               // nil unless the model has a full-text index
+	prefixes map[string]*prefixIndex // prefix indexes of the suggested fields, by Go name
+	findMux  sync.Mutex              // serializes FindOrCreate
+
+	uniqueMux sync.Mutex // serializes the checked writes of models with keys or unique fields
+
+	limit atomic.Value // *capacityLimit, nil when unbounded
 }
 
 // NewStore creates a new instance of Store.
 func NewStore() *Store {
+	return NewShardedStore(DefaultShardCount)
+}
+
+// NewShardedStore creates a Store whose models are each partitioned into n independently locked shards.
+func NewShardedStore(n int) *Store {
+	if n < 1 {
+		n = 1
+	}
 	return &Store{
-		data:   make(map[int]interface{}),
-		nextID: 1,
+		shardCount:  n,
+		collections: make(map[string]*collection),
+		changes:     NewChangeLog(DefaultChangeLogSize),
 	}
 }
 
-// Create adds a new item to the store and returns the item with an assigned ID.
-func (s *Store) Create(item interface{}) interface{} {
-	s.itemMux.Lock()
-	defer s.itemMux.Unlock()
+// Register adds a model to the store under the given name (e.g. "item", Item{}). Each model keeps
+// its items and ID sequence separate from other models. Registering a name again is a no-op.
+// Fields tagged `index:"true"` or `index:"ordered"` are indexed automatically.
+func (s *Store) Register(name string, model interface{}) {
+	s.typeMux.Lock()
+	if _, exists := s.collections[name]; exists {
+		s.typeMux.Unlock()
+		return
+	}
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	meta := metaFor(t)
+	applyJSONNaming(meta)
+	c := &collection{nextID: 1, name: name, meta: meta, shards: make([]*storeShard, s.shardCount)}
+	for i := range c.shards {
+		c.shards[i] = newStoreShard()
+	}
+	if len(c.meta.key) > 0 {
+		c.keys = newKeyIndex(c.meta.key)
+	}
+	c.lookups = newLookupIndexes(c.meta.lookups)
+	c.uniques = newLookupIndexes(c.meta.uniques)
+	c.geo = newGeoIndex(c.meta)
+	s.collections[name] = c
+	s.typeMux.Unlock()
 
-	// Assign a new ID and store the item
-	id := s.nextID
-	s.nextID++
-	itemValue := reflect.ValueOf(item).Elem()
-	itemValue.FieldByName("ID").SetInt(int64(id))
+	s.createTaggedIndexes(name, c.meta)
+	s.createSuggestIndexes(name, c.meta)
+	if _, _, scoped := splitTenantModel(name); !scoped {
+		s.watchCascades(name, c.meta)
+	}
+}
+
+// collection returns the collection of a registered model. Collections of tenant-scoped names are
+// created from their base model on first use.
+func (s *Store) collection(name string) (*collection, bool) {
+	s.typeMux.RLock()
+	c, ok := s.collections[name]
+	s.typeMux.RUnlock()
+	if ok {
+		return c, true
+	}
+	return s.tenantCollection(name)
+}
+
+// registered reports whether a collection is registered under name, without creating tenant
+// collections on demand like collection does.
+func (s *Store) registered(name string) bool {
+	s.typeMux.RLock()
+	defer s.typeMux.RUnlock()
+	_, ok := s.collections[name]
+	return ok
+}
 
-	s.data[id] = item
+// allCollections returns every registered collection.
+func (s *Store) allCollections() []*collection {
+	s.typeMux.RLock()
+	defer s.typeMux.RUnlock()
+
+	collections := make([]*collection, 0, len(s.collections))
+	for _, c := range s.collections {
+		collections = append(collections, c)
+	}
+	return collections
+}
+
+// meta returns the reflection metadata of the model registered under the given name.
+func (s *Store) meta(name string) (*modelMeta, bool) {
+	c, ok := s.collection(name)
+	if !ok {
+		return nil, false
+	}
+	return c.meta, true
+}
+
+// shard returns the shard owning the given ID.
+func (c *collection) shard(id int) *storeShard {
+	return c.shards[c.shardIndex(id)]
+}
+
+// shardIndex returns the position of the shard owning the given ID.
+func (c *collection) shardIndex(id int) int {
+	// Fibonacci hashing spreads sequential IDs evenly across shards
+	h := uint64(id) * 11400714819323198485
+	return int(h % uint64(len(c.shards)))
+}
+
+// Create adds a new item to a model and returns the item with an assigned ID.
+// Models that were not registered yet are registered using the item's type.
+func (s *Store) Create(model string, item interface{}) interface{} {
+	return s.CreateWithTTL(model, item, 0)
+}
+
+// CreateWithTTL adds a new item that expires after ttl (no expiration when ttl is zero).
+// The expiration time is also written to the item's ExpiresAt field when the model has one.
+// Items of immutable models never expire, so it returns nil for them when ttl is set.
+func (s *Store) CreateWithTTL(model string, item interface{}, ttl time.Duration) interface{} {
+	c, ok := s.collection(model)
+	if !ok {
+		s.Register(model, item)
+		c, _ = s.collection(model)
+	}
+	item, _ = s.create(context.Background(), c, 0, item, ttl, nil)
 	return item
 }
 
-// Get retrieves an item by its ID.
-func (s *Store) Get(id int, result interface{}) bool {
-	s.itemMux.Lock()
-	defer s.itemMux.Unlock()
+// SetIDSlot makes the store create only the IDs whose remainder by 1024 is slot, so nodes
+// replicating each other with distinct slots never create the same ID. The slot must lie between 1
+// and 1023; it must be set before items are created.
+func (s *Store) SetIDSlot(slot int) error {
+	if slot < 1 || slot >= partitionIDStride {
+		return fmt.Errorf("ID slot must be between 1 and %d", partitionIDStride-1)
+	}
+	s.idSlot = int64(slot)
+	return nil
+}
 
-	item, exists := s.data[id]
-	if !exists {
-		return false
+// takeID takes the next ID of a collection's sequence that lies in the store's slot.
+func (s *Store) takeID(c *collection) int {
+	if s.idSlot == 0 {
+		return int(atomic.AddInt64(&c.nextID, 1) - 1)
+	}
+	for {
+		next := atomic.LoadInt64(&c.nextID)
+		id := next + (s.idSlot-next%partitionIDStride+partitionIDStride)%partitionIDStride
+		if atomic.CompareAndSwapInt64(&c.nextID, next, id+1) {
+			return int(id)
+		}
+	}
+}
+
+// advanceID moves a collection's sequence past id, so it is never taken again.
+func advanceID(c *collection, id int) {
+	for {
+		next := atomic.LoadInt64(&c.nextID)
+		if int64(id) < next || atomic.CompareAndSwapInt64(&c.nextID, next, int64(id)+1) {
+			return
+		}
+	}
+}
+
+// create adds a new item to a collection like CreateWithTTL, calling unlock (when not nil) once the
+// item is stored, before the listeners are notified. The item gets the next ID of the collection
+// when id is 0, or else id, which must have been taken from the collection's sequence earlier: it
+// fails with 409 when an item holds it. The values of ctx reach the backends.
+func (s *Store) create(ctx context.Context, c *collection, id int, item interface{}, ttl time.Duration, unlock func()) (interface{}, error) {
+	model := c.name
+	if ttl > 0 {
+		if err := s.checkMutable(model); err != nil {
+			if unlock != nil {
+				unlock()
+			}
+			return nil, err
+		}
+	}
+
+	// Assign a new ID and store the item
+	if id == 0 {
+		id = s.takeID(c)
+	} else {
+		advanceID(c, id)
+	}
+	if c.meta.id != nil {
+		c.meta.id.value(item).SetInt(int64(id))
+	}
+
+	now := time.Now()
+	e := entry{item: item, created: now, modified: now, expires: c.meta.expiryFor(item, time.Time{})}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+		c.meta.setExpiry(item, e.expires)
+	}
+
+	sh := c.shard(id)
+	sh.itemMux.Lock()
+	if _, exists := sh.snapshot().get(id); exists {
+		sh.itemMux.Unlock()
+		if unlock != nil {
+			unlock()
+		}
+		return nil, &Error{Status: http.StatusConflict, Code: CodeConflict, Err: localizef("%s %d already exists", model, id)}
+	}
+	items := sh.edit()
+	items.set(id, e)
+	sh.publish(items)
+	c.reindex(id, nil, item)
+	c.track(id)
+	s.persist(ctx, model, id, item)
+	event := s.record(ChangeEvent{Op: OpCreate, Model: model, ID: id, Item: item, Origin: originOf(ctx)})
+	sh.itemMux.Unlock()
+	if unlock != nil {
+		unlock()
+	}
+
+	s.notify(event)
+	s.evictOverflow(c)
+	return item, nil
+}
+
+// Get retrieves an item of a model by its ID. It reads the shard snapshot without locking.
+func (s *Store) Get(model string, id int, result interface{}) bool {
+	_, ok := s.lookup(model, id, result)
+	return ok
+}
+
+// lookup retrieves an item like Get and also returns when it last changed.
+func (s *Store) lookup(model string, id int, result interface{}) (time.Time, bool) {
+	c, ok := s.collection(model)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	e, exists := c.shard(id).snapshot().get(id)
+	if !exists || e.expired(time.Now()) {
+		return time.Time{}, false
+	}
+
+	if limit := c.capacity(); limit != nil {
+		limit.touch(id)
 	}
 
 	// Populate result struct with the found item
-	itemValue := reflect.ValueOf(item)
-	reflect.ValueOf(result).Elem().Set(itemValue)
-	return true
+	assignItem(reflect.ValueOf(result).Elem(), e.item)
+	return e.modified, true
 }
 
-// GetAll retrieves all items in the store.
-func (s *Store) GetAll(result interface{}) {
-	s.itemMux.Lock()
-	defer s.itemMux.Unlock()
+// GetAll retrieves all items of a model, ordered by ID, without locking. Each shard is read from a
+// consistent snapshot, but writes to other shards may interleave with the scan.
+func (s *Store) GetAll(model string, result interface{}) {
+	c, ok := s.collection(model)
+	if !ok {
+		return
+	}
 
 	// Populate result slice with all items
 	itemSlice := reflect.ValueOf(result).Elem()
-	for _, item := range s.data {
-		itemSlice.Set(reflect.Append(itemSlice, reflect.ValueOf(item)))
+	c.each(func(id int, item interface{}) error {
+		elem := reflect.New(itemSlice.Type().Elem()).Elem()
+		assignItem(elem, item)
+		itemSlice.Set(reflect.Append(itemSlice, elem))
+		return nil
+	})
+}
+
+// assignItem stores an item in dst, dereferencing it when dst holds values rather than pointers.
+func assignItem(dst reflect.Value, item interface{}) {
+	itemValue := reflect.ValueOf(item)
+	if itemValue.Kind() == reflect.Ptr && !itemValue.Type().AssignableTo(dst.Type()) {
+		itemValue = itemValue.Elem()
 	}
+	dst.Set(itemValue)
+}
+
+// Update replaces an existing item of a model, keeping its ID. It reports false when the item does not exist, or
+// when its key or a unique field would hold the value of another item, leaving it as it is.
+func (s *Store) Update(model string, id int, updatedItem interface{}) bool {
+	exists, err := s.updateChecked(context.Background(), model, id, updatedItem, nil)
+	return exists && err == nil
+}
+
+// updateChecked updates an item like Update once check (when not nil) accepts the current item.
+// The check runs under the shard lock, so no other write can slip in between. The ID field of the
+// updated item is set to the ID it is stored under. It reports whether the item exists and returns
+// the error of the check.
+func (s *Store) updateChecked(ctx context.Context, model string, id int, updatedItem interface{}, check func(current interface{}) error) (bool, error) {
+	return s.modify(ctx, model, id, func(current interface{}) (interface{}, error) {
+		if check != nil {
+			if err := check(current); err != nil {
+				return nil, err
+			}
+		}
+		if meta, ok := s.meta(model); ok && meta.id != nil {
+			meta.id.value(updatedItem).SetInt(int64(id))
+		}
+		return updatedItem, nil
+	})
 }
 
-// Update updates an existing item in the store.
-func (s *Store) Update(id int, updatedItem interface{}) bool {
-	s.itemMux.Lock()
-	defer s.itemMux.Unlock()
+// modify replaces an item with the one fn derives from the current item, under the shard lock. The
+// current item must not be changed: fn returns a copy. It reports whether the item exists and
+// returns the error of fn, or that of the key or a unique field of the item being taken, in which
+// case the item is left as it is. An item is not modified once ctx is done.
+func (s *Store) modify(ctx context.Context, model string, id int, fn func(current interface{}) (interface{}, error)) (bool, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return s.exists(model, id), err
+	}
+	if err := s.checkMutable(model); err != nil {
+		return s.exists(model, id), err
+	}
+	unlock := c.lockUnique()
+	sh := c.shard(id)
+	sh.itemMux.Lock()
 
-	_, exists := s.data[id]
+	old, exists := sh.snapshot().get(id)
 	if !exists {
-		return false
+		sh.itemMux.Unlock()
+		unlock()
+		return false, nil
+	}
+	updatedItem, err := fn(old.item)
+	if err == nil {
+		err = s.checkKey(model, id, updatedItem)
+	}
+	if err != nil {
+		sh.itemMux.Unlock()
+		unlock()
+		return true, err
 	}
 
 	// Update the item
-	s.data[id] = updatedItem
-	return true
+	items := sh.edit()
+	items.set(id, entry{item: updatedItem, created: old.created, modified: time.Now(), expires: c.meta.expiryFor(updatedItem, old.expires)})
+	sh.publish(items)
+	c.reindex(id, old.item, updatedItem)
+	c.track(id)
+	s.persist(ctx, model, id, updatedItem)
+	event := s.record(ChangeEvent{Op: OpUpdate, Model: model, ID: id, Item: updatedItem, Old: old.item, Origin: originOf(ctx)})
+	sh.itemMux.Unlock()
+	unlock()
+
+	s.notify(event)
+	return true, nil
 }
 
-// Delete removes an item by its ID.
-func (s *Store) Delete(id int) bool {
-	s.itemMux.Lock()
-	defer s.itemMux.Unlock()
+// Delete removes an item of a model by its ID.
+func (s *Store) Delete(model string, id int) bool {
+	exists, _ := s.deleteChecked(context.Background(), model, id, nil)
+	return exists
+}
 
-	_, exists := s.data[id]
+// deleteChecked removes an item like Delete once check (when not nil) accepts it, under the shard
+// lock. It reports whether the item exists and returns the error of the check, or that of ctx once
+// it is done.
+func (s *Store) deleteChecked(ctx context.Context, model string, id int, check func(current interface{}) error) (bool, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return s.exists(model, id), err
+	}
+	if err := s.checkMutable(model); err != nil {
+		return s.exists(model, id), err
+	}
+	sh := c.shard(id)
+	sh.itemMux.Lock()
+
+	e, exists := sh.snapshot().get(id)
 	if !exists {
-		return false
+		sh.itemMux.Unlock()
+		return false, nil
+	}
+	if check != nil {
+		if err := check(e.item); err != nil {
+			sh.itemMux.Unlock()
+			return true, err
+		}
+	}
+
+	items := sh.edit()
+	event := s.removeLocked(ctx, c, items, id, e.item, "")
+	sh.publish(items)
+	sh.itemMux.Unlock()
+
+	s.notify(event)
+	return true, nil
+}
+
+// removeLocked deletes an item from a shard copy being edited and records the delete event, tagged
+// with the reason for automatic removals. It must be called while holding the shard lock.
+func (s *Store) removeLocked(ctx context.Context, c *collection, items *entryTree, id int, item interface{}, reason string) ChangeEvent {
+	items.remove(id)
+	c.reindex(id, item, nil)
+	if limit := c.capacity(); limit != nil {
+		limit.remove(id)
 	}
+	s.persist(ctx, c.name, id, nil)
+	return s.record(ChangeEvent{Op: OpDelete, Model: c.name, ID: id, Old: item, Reason: reason, Origin: originOf(ctx)})
+}
 
-	delete(s.data, id)
-	return true
+// handleRequest handles HTTP requests for CRUD operations on a registered data model.
+func handleRequest(store *Store, model string, w http.ResponseWriter, r *http.Request) {
+	next := func(w http.ResponseWriter, r *http.Request) {
+		serveModel(store, model, w, r)
+	}
+	if store.misses != nil {
+		serve := next
+		next = func(w http.ResponseWriter, r *http.Request) {
+			store.misses.serve(model, w, r, serve)
+		}
+	}
+	if store.coalescer != nil {
+		serve := next
+		next = func(w http.ResponseWriter, r *http.Request) {
+			store.coalescer.serve(model, w, r, serve)
+		}
+	}
+	switch {
+	case store.idempotency != nil && r.Method == http.MethodPost && r.Header.Get(IdempotencyHeader) != "":
+		store.idempotency.serve(model, w, r, next)
+	case store.responses != nil:
+		store.responses.serve(model, w, r, next)
+	default:
+		next(w, r)
+	}
 }
 
-// handleRequest handles HTTP requests for CRUD operations on any data model.
-func handleRequest(store *Store, modelType reflect.Type, w http.ResponseWriter, r *http.Request) {
+// serveModel serves a request to a model without going through the response cache, the read
+// coalescing, the negative cache or the Idempotency-Key replay.
+func serveModel(store *Store, model string, w http.ResponseWriter, r *http.Request) {
+	meta, ok := store.meta(model)
+	if !ok {
+		notFound(w, r, "Unknown model")
+		return
+	}
+	w = store.withMasks(w, r)
+
+	// Serve the sub-resources of the model (e.g. /item/_sync)
+	if rest := subpath(r); rest != "" {
+		handleSubresource(store, model, rest, w, r)
+		return
+	}
+
+	// Address the items of models keyed by several fields with ?key=
+	if len(meta.key) > 0 {
+		if r, ok = withKeyID(store, model, w, r); !ok {
+			return
+		}
+	}
+
+	store.setCacheControl(model, w, r)
+
+	// Append corrections to the items of models in correction mode instead of changing them
+	if (r.Method == http.MethodPut || r.Method == http.MethodPatch) && store.immutability(model) == ImmutableCorrect {
+		handleCorrection(store, model, meta, w, r)
+		return
+	}
+
+	// Route requests for items owned by other nodes in partitioned mode
+	if store.partition != nil && store.partition.route(model, meta, w, r) {
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPost:
 		// Create item
-		newItem := reflect.New(modelType).Interface()
-		if err := json.NewDecoder(r.Body).Decode(newItem); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		newItem := reflect.New(meta.typ).Interface()
+		if err := decodeItem(r.Body, newItem); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, decodeError(meta, err))
 			return
 		}
-		createdItem := store.Create(newItem)
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(createdItem)
+		var ttl time.Duration
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			parsed, err := parseTTL(v)
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, "Invalid TTL")
+				return
+			}
+			ttl = parsed
+		}
+		if err := validate(meta, newItem); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if err := store.checkParents(model, newItem); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if err := store.checkCorrection(model, newItem); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		createdItem, err := store.createChecked(r.Context(), model, newItem, ttl)
+		if err != nil {
+			writeError(w, r, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, createdItem)
 
-	case http.MethodGet:
-		// Get all items
+	case http.MethodGet, http.MethodHead:
+		// Get the items of a list of IDs
+		if r.URL.Query().Has("ids") {
+			handleGetMany(store, model, meta, w, r)
+			return
+		}
+		// Get all items, optionally filtered by field values
 		if r.URL.Query().Get("id") == "" {
-			result := reflect.New(reflect.SliceOf(modelType)).Interface()
-			store.GetAll(result)
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(result)
+			filters, err := parseFilters(meta, r.URL.Query())
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			page, err := parsePage(r.URL.Query())
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			includes, err := store.parseIncludes(model, r.URL.Query().Get("include"))
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			includes = store.withRelationLinks(model, r, includes)
+			// Tag the collection before reading it, so the tag is never newer than the response
+			c, _ := store.collection(model)
+			related := store.includedCollections(includes)
+			modified := c.lastModified()
+			for _, rc := range related {
+				if m := rc.lastModified(); m.After(modified) {
+					modified = m
+				}
+			}
+			if notModified(w, r, collectionETag(c, related...), modified) {
+				return
+			}
+			if r.URL.Query().Get("count") == "true" {
+				n, err := store.Count(model, filters)
+				if err != nil {
+					writeError(w, r, http.StatusBadRequest, err)
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]int{"count": n})
+				return
+			}
+			if r.URL.Query().Get("near") != "" {
+				handleNear(store, model, meta, filters, page, includes, w, r)
+				return
+			}
+			if r.URL.Query().Get("q") != "" {
+				handleSearch(store, model, meta, filters, page, includes, w, r)
+				return
+			}
+			if names := splitFields(r.URL.Query().Get("facets")); len(names) > 0 {
+				handleFacets(store, model, meta, filters, page, includes, names, w, r)
+				return
+			}
+			if r.URL.Query().Get("sort") != "" {
+				handleSorted(store, model, meta, filters, page, includes, w, r)
+				return
+			}
+			if len(includes) > 0 {
+				found, err := store.matching(model, filters)
+				if err != nil {
+					writeError(w, r, http.StatusBadRequest, err)
+					return
+				}
+				setTotalCount(w, r, len(found))
+				start, end := page.bounds(len(found))
+				items := make([]interface{}, 0, end-start)
+				for _, m := range found[start:end] {
+					items = append(items, m.item)
+				}
+				expanded, err := store.expandFor(w, meta, items, includes)
+				if err != nil {
+					writeError(w, r, http.StatusInternalServerError, err)
+					return
+				}
+				writeJSON(w, http.StatusOK, expanded)
+				return
+			}
+			if len(filters) == 0 {
+				if enveloped(r) {
+					if total, err := store.Count(model, nil); err == nil {
+						setTotalCount(w, r, total)
+					}
+				}
+				// Stream the requested page of the collection straight from the shard snapshots
+				writeJSONArray(w, http.StatusOK, func(emit func(item interface{}) error) error {
+					n := 0
+					err := c.each(func(id int, item interface{}) error {
+						if err := r.Context().Err(); err != nil {
+							return err
+						}
+						n++
+						switch {
+						case n <= page.Offset:
+							return nil
+						case page.Limit > 0 && n > page.Offset+page.Limit:
+							return errPageDone
+						}
+						return emit(item)
+					})
+					if err == errPageDone {
+						return nil
+					}
+					return err
+				})
+				return
+			}
+			result := reflect.New(meta.sliceType)
+			if err := store.Find(model, filters, result.Interface()); err != nil {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
+			setTotalCount(w, r, result.Elem().Len())
+			start, end := page.bounds(result.Elem().Len())
+			writeJSON(w, http.StatusOK, result.Elem().Slice(start, end).Interface())
 			return
 		}
 
 		// Get item by ID
 		id, err := strconv.Atoi(r.URL.Query().Get("id"))
 		if err != nil {
-			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, "Invalid ID")
 			return
 		}
-		result := reflect.New(modelType).Interface()
-		if store.Get(id, result) {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(result)
-		} else {
-			http.Error(w, "Item not found", http.StatusNotFound)
+		includes, err := store.parseIncludes(model, r.URL.Query().Get("include"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		includes = store.withRelationLinks(model, r, includes)
+		result := reflect.New(meta.typ).Interface()
+		modified, ok := store.lookup(model, id, result)
+		switch {
+		case !ok:
+			writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+		case len(includes) > 0:
+			expanded, err := store.expandFor(w, meta, []interface{}{result}, includes)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if len(store.includedCollections(includes)) > 0 {
+				// The embedded items may have changed later than the item itself
+				modified = time.Time{}
+			}
+			writeItemJSON(w, r, expanded[0], modified)
+		default:
+			writeItemJSON(w, r, result, modified)
 		}
 
 	case http.MethodPut:
 		// Update item by ID
 		id, err := strconv.Atoi(r.URL.Query().Get("id"))
 		if err != nil {
-			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+		check, ok := store.precondition(w, r)
+		if !ok {
 			return
 		}
-		updatedItem := reflect.New(modelType).Interface()
-		if err := json.NewDecoder(r.Body).Decode(updatedItem); err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		if check, ok = withExpectations(meta, check, w, r); !ok {
 			return
 		}
-		if store.Update(id, updatedItem) {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(updatedItem)
-		} else {
-			http.Error(w, "Item not found", http.StatusNotFound)
+		updatedItem := reflect.New(meta.typ).Interface()
+		if err := decodeItem(r.Body, updatedItem); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, decodeError(meta, err))
+			return
+		}
+		if err := validate(meta, updatedItem); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if err := store.checkParents(model, updatedItem); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if masking(w) {
+			check = keepingMasked(meta, updatedItem, check)
+		}
+		exists, err := store.updateChecked(r.Context(), model, id, updatedItem, check)
+		switch {
+		case !exists:
+			writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+		case err != nil:
+			writePreconditionError(w, r, err)
+		default:
+			if etag, err := itemETag(updatedItem); err == nil {
+				w.Header().Set("ETag", etag)
+			}
+			writeJSON(w, http.StatusOK, updatedItem)
 		}
 
+	case http.MethodPatch:
+		// Merge fields into an item by ID
+		handlePatch(store, model, meta, w, r)
+
 	case http.MethodDelete:
 		// Delete item by ID
 		id, err := strconv.Atoi(r.URL.Query().Get("id"))
 		if err != nil {
-			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+		check, ok := store.precondition(w, r)
+		if !ok {
 			return
 		}
-		if store.Delete(id) {
+		exists, err := store.deleteChecked(r.Context(), model, id, check)
+		switch {
+		case !exists:
+			writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+		case err != nil:
+			writePreconditionError(w, r, err)
+		default:
 			w.WriteHeader(http.StatusNoContent)
-		} else {
-			http.Error(w, "Item not found", http.StatusNotFound)
 		}
 
+	case http.MethodOptions:
+		w.Header().Set("Allow", strings.Join(modelMethods, ", "))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, r, modelMethods...)
+	}
+}
+
+// subpathKey is the context key of the part of a request path below its model route.
+type subpathKey struct{}
+
+// withSubpath records the part of the request path below the model route (e.g. "_sync" for
+// /item/_sync).
+func withSubpath(r *http.Request, rest string) *http.Request {
+	rest = strings.Trim(rest, "/")
+	if rest == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), subpathKey{}, rest))
+}
+
+// subpath returns the part of the request path below the model route.
+func subpath(r *http.Request) string {
+	rest, _ := r.Context().Value(subpathKey{}).(string)
+	return rest
+}
+
+// handleSubresource serves the routes below a model route.
+func handleSubresource(store *Store, model, rest string, w http.ResponseWriter, r *http.Request) {
+	switch rest {
+	case "_sync":
+		if store.crdt == nil {
+			notFound(w, r, "Sync is not enabled")
+			return
+		}
+		store.crdt.handleSync(model, w, r)
+	case "_schema":
+		handleSchema(store, model, w, r)
+	case "_seed":
+		handleSeed(store, model, w, r)
+	case "_find_or_create":
+		handleFindOrCreate(store, model, w, r)
+	case "_aggregate":
+		handleAggregate(store, model, w, r)
+	case "_stats":
+		handleStats(store, model, w, r)
+	case "_timeseries":
+		handleTimeseries(store, model, w, r)
+	case "_search":
+		handleFullTextSearch(store, model, w, r)
+	case "_suggest":
+		handleSuggest(store, model, w, r)
 	default:
-		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		if !handleIncrement(store, model, rest, w, r) && !handleLookup(store, model, rest, w, r) &&
+			!handleChildren(store, model, rest, w, r) && !handleManyToMany(store, model, rest, w, r) {
+			notFound(w, r, "Not found")
+		}
 	}
 }
@@ -0,0 +1,512 @@
+// File: crudgen/main.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: crudgen generates reflection-free, type-specific CRUD code for structs, for users
+// who want the routes of go-crud-helper without the cost of its runtime reflection. For every
+// selected struct T it writes a TStore (an in-memory store with Create, Get, List, Count, Update
+// and Delete) and a THandler serving the same routes as the generic handler: GET lists the items,
+// with equality and _gte/_lte filters on the scalar fields by JSON name, offset, limit and
+// count=true, or returns ?id=; POST creates; PUT replaces ?id=; DELETE deletes ?id=.
+//
+// Structs are selected with -type or annotated with a crud:generate line in their doc comment,
+// and crudgen is meant to be run by go generate from the package declaring them:
+//
+//	//go:generate go run github.com/RyadPasha/go-crud-helper/crudgen -output models_crud.go
+//
+//	// Item is a to-do item.
+//	//crud:generate
+//	type Item struct {
+//		ID    int    `json:"id"`
+//		Title string `json:"title"`
+//	}
+//
+// As in go-crud-helper, an int field named ID holds the ID assigned on creation.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// annotation marks the structs to generate code for in their doc comments.
+const annotation = "crud:generate"
+
+// model is a struct crudgen generates code for.
+type model struct {
+	name   string
+	idType string // type of the ID field, empty when the struct has none
+	fields []field
+}
+
+// field is a scalar field items can be filtered by.
+type field struct {
+	name     string
+	jsonName string
+	typ      string
+	kind     string // string, bool, int, uint or float
+	bits     int
+}
+
+// scalarKinds maps the predeclared scalar types to their kind and size.
+var scalarKinds = map[string]struct {
+	kind string
+	bits int
+}{
+	"string": {"string", 0}, "bool": {"bool", 0},
+	"int": {"int", 0}, "int8": {"int", 8}, "int16": {"int", 16}, "int32": {"int", 32}, "int64": {"int", 64},
+	"uint": {"uint", 0}, "uint8": {"uint", 8}, "uint16": {"uint", 16}, "uint32": {"uint", 32}, "uint64": {"uint", 64},
+	"float32": {"float", 32}, "float64": {"float", 64},
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("crudgen: ")
+	typeNames := flag.String("type", "", "Structs to generate code for, comma-separated (default: the structs annotated with //crud:generate)")
+	output := flag.String("output", "crud_gen.go", "File the code is written to, in the package directory")
+	flag.Parse()
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+
+	var selected []string
+	if *typeNames != "" {
+		selected = strings.Split(*typeNames, ",")
+	}
+	pkg, models, err := parseModels(dir, selected, filepath.Base(*output))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(models) == 0 {
+		log.Fatalf("no struct selected in %s: pass -type or annotate them with //%s", dir, annotation)
+	}
+	source, err := generate(pkg, models)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, *output), source, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseModels reads the structs of the package in dir, except from the generated file, and
+// returns the package name and the selected structs (all annotated ones when selected is empty).
+func parseModels(dir string, selected []string, generated string) (string, []model, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go") && info.Name() != generated
+	}, parser.ParseComments)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(pkgs) != 1 {
+		return "", nil, fmt.Errorf("expected one package in %s, found %d", dir, len(pkgs))
+	}
+
+	var name string
+	var models []model
+	found := make(map[string]bool)
+	for pkgName, pkg := range pkgs {
+		name = pkgName
+		// Visit the files in name order so the output is stable
+		files := make([]string, 0, len(pkg.Files))
+		for filename := range pkg.Files {
+			files = append(files, filename)
+		}
+		sort.Strings(files)
+		for _, filename := range files {
+			for _, decl := range pkg.Files[filename].Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					ts := spec.(*ast.TypeSpec)
+					st, ok := ts.Type.(*ast.StructType)
+					if !ok {
+						continue
+					}
+					doc := ts.Doc
+					if doc == nil && len(gen.Specs) == 1 {
+						doc = gen.Doc
+					}
+					if !isSelected(ts.Name.Name, doc, selected) {
+						continue
+					}
+					found[ts.Name.Name] = true
+					m, err := parseModel(fset, ts.Name.Name, st)
+					if err != nil {
+						return "", nil, err
+					}
+					models = append(models, m)
+				}
+			}
+		}
+	}
+	for _, typeName := range selected {
+		if !found[typeName] {
+			return "", nil, fmt.Errorf("struct %s not found in %s", typeName, dir)
+		}
+	}
+	return name, models, nil
+}
+
+// isSelected reports whether code is generated for a struct.
+func isSelected(name string, doc *ast.CommentGroup, selected []string) bool {
+	if len(selected) > 0 {
+		for _, s := range selected {
+			if s == name {
+				return true
+			}
+		}
+		return false
+	}
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.TrimSpace(strings.TrimPrefix(c.Text, "//")) == annotation {
+			return true
+		}
+	}
+	return false
+}
+
+// parseModel reads the ID and the filterable fields of a struct. Fields of other types are
+// stored and encoded but cannot be filtered by; embedded structs are not supported.
+func parseModel(fset *token.FileSet, name string, st *ast.StructType) (model, error) {
+	m := model{name: name}
+	for _, f := range st.Fields.List {
+		if len(f.Names) == 0 {
+			return m, fmt.Errorf("%s: %s: embedded fields are not supported", fset.Position(f.Pos()), name)
+		}
+		var tag reflect.StructTag
+		if f.Tag != nil {
+			unquoted, err := strconv.Unquote(f.Tag.Value)
+			if err != nil {
+				return m, fmt.Errorf("%s: invalid tag", fset.Position(f.Pos()))
+			}
+			tag = reflect.StructTag(unquoted)
+		}
+		ident, _ := f.Type.(*ast.Ident)
+		for _, fieldName := range f.Names {
+			if !fieldName.IsExported() {
+				continue
+			}
+			jsonName, _, _ := strings.Cut(tag.Get("json"), ",")
+			if jsonName == "-" {
+				continue
+			}
+			if jsonName == "" {
+				jsonName = fieldName.Name
+			}
+			if ident == nil {
+				continue
+			}
+			scalar, ok := scalarKinds[ident.Name]
+			if !ok {
+				continue
+			}
+			if fieldName.Name == "ID" && scalar.kind == "int" {
+				m.idType = ident.Name
+				continue
+			}
+			m.fields = append(m.fields, field{name: fieldName.Name, jsonName: jsonName, typ: ident.Name, kind: scalar.kind, bits: scalar.bits})
+		}
+	}
+	return m, nil
+}
+
+// parsesValues reports whether a model has filters whose values are parsed.
+func (m model) parsesValues() bool {
+	for _, f := range m.fields {
+		if f.kind != "string" {
+			return true
+		}
+	}
+	return false
+}
+
+// generate returns the formatted code of the models.
+func generate(pkg string, models []model) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by crudgen; DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	b.WriteString("import (\n\t\"encoding/json\"\n")
+	// fmt is only used to report invalid values of non-string filters
+	for _, m := range models {
+		if m.parsesValues() {
+			b.WriteString("\t\"fmt\"\n")
+			break
+		}
+	}
+	b.WriteString("\t\"net/http\"\n\t\"net/url\"\n\t\"sort\"\n\t\"strconv\"\n\t\"sync\"\n)\n")
+	for _, m := range models {
+		writeStore(&b, m)
+		writeFilters(&b, m)
+		writeHandler(&b, m)
+	}
+	source, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting the generated code: %v", err)
+	}
+	return source, nil
+}
+
+// writeStore writes the store of a model.
+func writeStore(b *bytes.Buffer, m model) {
+	setID := ""
+	if m.idType != "" {
+		setID = fmt.Sprintf("item.ID = %s(id)\n", m.idType)
+	}
+	fmt.Fprintf(b, `
+// %[1]sStore is an in-memory store of %[1]s values, safe for concurrent use.
+type %[1]sStore struct {
+	mux    sync.RWMutex
+	items  map[int]%[1]s
+	nextID int
+}
+
+// New%[1]sStore creates an empty store.
+func New%[1]sStore() *%[1]sStore {
+	return &%[1]sStore{items: make(map[int]%[1]s), nextID: 1}
+}
+
+// Create stores a new item under the next ID and returns the ID and the stored item.
+func (s *%[1]sStore) Create(item %[1]s) (int, %[1]s) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	id := s.nextID
+	s.nextID++
+	%[2]ss.items[id] = item
+	return id, item
+}
+
+// Get returns the item with the given ID.
+func (s *%[1]sStore) Get(id int) (%[1]s, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	item, ok := s.items[id]
+	return item, ok
+}
+
+// List returns the items accepted by match (all of them when it is nil), ordered by ID.
+func (s *%[1]sStore) List(match func(*%[1]s) bool) []%[1]s {
+	s.mux.RLock()
+	ids := make([]int, 0, len(s.items))
+	for id, item := range s.items {
+		if match == nil || match(&item) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	items := make([]%[1]s, len(ids))
+	for i, id := range ids {
+		items[i] = s.items[id]
+	}
+	s.mux.RUnlock()
+	return items
+}
+
+// Count returns the number of items accepted by match (all of them when it is nil).
+func (s *%[1]sStore) Count(match func(*%[1]s) bool) int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	n := 0
+	for _, item := range s.items {
+		if match == nil || match(&item) {
+			n++
+		}
+	}
+	return n
+}
+
+// Update replaces the item with the given ID and returns it, reporting false when there is none.
+func (s *%[1]sStore) Update(id int, item %[1]s) (%[1]s, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.items[id]; !ok {
+		return item, false
+	}
+	%[2]ss.items[id] = item
+	return item, true
+}
+
+// Delete removes the item with the given ID, reporting false when there is none.
+func (s *%[1]sStore) Delete(id int) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.items[id]; !ok {
+		return false
+	}
+	delete(s.items, id)
+	return true
+}
+`, m.name, setID)
+}
+
+// writeFilters writes the function turning query parameters into a match function.
+func writeFilters(b *bytes.Buffer, m model) {
+	fmt.Fprintf(b, `
+// parse%[1]sFilters returns a function matching the items of the field filters of a query:
+// param=value, param_gte=value and param_lte=value by JSON name.
+func parse%[1]sFilters(query url.Values) (func(*%[1]s) bool, error) {
+	var checks []func(*%[1]s) bool
+`, m.name)
+	for _, f := range m.fields {
+		ops := []struct{ suffix, op string }{{"", "=="}}
+		if f.kind != "bool" {
+			ops = append(ops, struct{ suffix, op string }{"_gte", ">="}, struct{ suffix, op string }{"_lte", "<="})
+		}
+		for _, op := range ops {
+			param := f.jsonName + op.suffix
+			fmt.Fprintf(b, "\tif values, ok := query[%q]; ok {\n", param)
+			switch f.kind {
+			case "string":
+				b.WriteString("\t\tvalue := values[0]\n")
+			case "bool":
+				b.WriteString("\t\tvalue, err := strconv.ParseBool(values[0])\n")
+			case "int":
+				fmt.Fprintf(b, "\t\tparsed, err := strconv.ParseInt(values[0], 10, %d)\n\t\tvalue := %s(parsed)\n", f.bits, f.typ)
+			case "uint":
+				fmt.Fprintf(b, "\t\tparsed, err := strconv.ParseUint(values[0], 10, %d)\n\t\tvalue := %s(parsed)\n", f.bits, f.typ)
+			case "float":
+				fmt.Fprintf(b, "\t\tparsed, err := strconv.ParseFloat(values[0], %d)\n\t\tvalue := %s(parsed)\n", f.bits, f.typ)
+			}
+			if f.kind != "string" {
+				fmt.Fprintf(b, "\t\tif err != nil {\n\t\t\treturn nil, fmt.Errorf(\"invalid value for %s: %%w\", err)\n\t\t}\n", param)
+			}
+			fmt.Fprintf(b, "\t\tchecks = append(checks, func(item *%s) bool { return item.%s %s value })\n\t}\n", m.name, f.name, op.op)
+		}
+	}
+	fmt.Fprintf(b, `	if len(checks) == 0 {
+		return nil, nil
+	}
+	return func(item *%s) bool {
+		for _, check := range checks {
+			if !check(item) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+`, m.name)
+}
+
+// writeHandler writes the HTTP handler of a model.
+func writeHandler(b *bytes.Buffer, m model) {
+	fmt.Fprintf(b, `
+// %[1]sHandler serves the CRUD routes of a %[1]sStore.
+type %[1]sHandler struct {
+	Store *%[1]sStore
+}
+
+// ServeHTTP handles GET (list, or ?id=), POST, PUT ?id= and DELETE ?id=.
+func (h %[1]sHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	writeJSON := func(status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	id := 0
+	if v := query.Get("id"); v != "" || r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		id = parsed
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var item %[1]s
+		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		_, item = h.Store.Create(item)
+		writeJSON(http.StatusCreated, item)
+
+	case http.MethodGet:
+		if id != 0 {
+			item, ok := h.Store.Get(id)
+			if !ok {
+				http.Error(w, "Item not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(http.StatusOK, item)
+			return
+		}
+		match, err := parse%[1]sFilters(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if query.Get("count") == "true" {
+			writeJSON(http.StatusOK, map[string]int{"count": h.Store.Count(match)})
+			return
+		}
+		var offset, limit int
+		for param, target := range map[string]*int{"offset": &offset, "limit": &limit} {
+			if v := query.Get(param); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					http.Error(w, "invalid "+param, http.StatusBadRequest)
+					return
+				}
+				*target = n
+			}
+		}
+		items := h.Store.List(match)
+		if offset > len(items) {
+			offset = len(items)
+		}
+		items = items[offset:]
+		if limit > 0 && limit < len(items) {
+			items = items[:limit]
+		}
+		writeJSON(http.StatusOK, items)
+
+	case http.MethodPut:
+		var item %[1]s
+		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		updated, ok := h.Store.Update(id, item)
+		if !ok {
+			http.Error(w, "Item not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(http.StatusOK, updated)
+
+	case http.MethodDelete:
+		if !h.Store.Delete(id) {
+			http.Error(w, "Item not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+`, m.name)
+}
@@ -0,0 +1,25 @@
+// File: docs.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file serves the API explorer at /_docs. The explorer is a small static page,
+// embedded in the binary, that reads the routes from /openapi.json and lets new users try every
+// operation from the browser, with the tenant and credentials to send entered once.
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed explorer
+var explorerFiles embed.FS
+
+// explorerHandler serves the API explorer below /_docs/.
+func explorerHandler() http.Handler {
+	files, _ := fs.Sub(explorerFiles, "explorer")
+	return http.StripPrefix("/_docs/", http.FileServer(http.FS(files)))
+}
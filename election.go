@@ -0,0 +1,367 @@
+// File: election.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements leader election for primary/replica clusters. Nodes elect a
+// leader by majority vote in numbered terms, and the leader keeps a lease on the other nodes with
+// heartbeats. Only the leader accepts writes; the other nodes follow it as read replicas and
+// forward writes to it. When the leader stops renewing its lease, the remaining majority elects a
+// new one and every replica switches over to it; a leader that loses its majority steps down before
+// the lease it holds on the others runs out, so at most one node accepts writes at any time.
+// Votes and heartbeats are only accepted from the signed nodes, for candidates among the configured
+// nodes. GET /_leader advertises the current leader for clients and load balancers.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Election timings.
+const (
+	electionHeartbeat = 200 * time.Millisecond
+	electionLease     = 2 * time.Second // randomised between 1x and 1.5x before a follower runs
+	electionRPCTime   = 500 * time.Millisecond
+)
+
+// electionRequest is a vote request or a heartbeat.
+type electionRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+}
+
+// electionResponse answers a vote request or a heartbeat.
+type electionResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// LeaderStatus describes the cluster as seen by one node.
+type LeaderStatus struct {
+	Self   string   `json:"self"`
+	Role   string   `json:"role"`
+	Term   uint64   `json:"term"`
+	Leader string   `json:"leader"`
+	Nodes  []string `json:"nodes"`
+}
+
+// Election elects one leader among a fixed set of nodes. The roles are the ones of the Raft mode.
+type Election struct {
+	// Self is the advertised base URL of this node.
+	Self string
+	// Nodes are the base URLs of every node of the cluster, including this one.
+	Nodes []string
+	// OnChange is called with the new leader (empty when unknown) every time it changes.
+	OnChange func(leader string)
+	// Auth signs the requests sent to the other nodes.
+	Auth *ClusterAuth
+
+	client    *http.Client
+	role      string
+	term      uint64
+	votedFor  string
+	leader    string
+	deadline  time.Time // followers run for leader after it, leaders step down after it
+	notified  string
+	notifyMux sync.Mutex
+	mux       sync.Mutex
+}
+
+// NewElection creates the election of the node advertised at self among the given nodes (self is
+// added when missing).
+func NewElection(self string, nodes []string) *Election {
+	e := &Election{
+		Self:   strings.TrimRight(self, "/"),
+		client: &http.Client{Timeout: electionRPCTime},
+		role:   RaftFollower,
+	}
+	for _, node := range append(nodes, e.Self) {
+		if node = strings.TrimRight(strings.TrimSpace(node), "/"); node != "" && !containsString(e.Nodes, node) {
+			e.Nodes = append(e.Nodes, node)
+		}
+	}
+	e.deadline = time.Now().Add(e.timeout())
+	return e
+}
+
+// timeout returns a randomised lease timeout so followers rarely run at the same time.
+func (e *Election) timeout() time.Duration {
+	return electionLease + time.Duration(rand.Int63n(int64(electionLease/2)))
+}
+
+// Status returns the election state of this node.
+func (e *Election) Status() LeaderStatus {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	return LeaderStatus{Self: e.Self, Role: e.role, Term: e.term, Leader: e.leader, Nodes: e.Nodes}
+}
+
+// IsLeader reports whether this node currently accepts writes.
+func (e *Election) IsLeader() bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	return e.role == RaftLeader
+}
+
+// Start runs the election in the background.
+func (e *Election) Start() {
+	go func() {
+		ticker := time.NewTicker(electionHeartbeat)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			e.mux.Lock()
+			role, expired := e.role, time.Now().After(e.deadline)
+			e.mux.Unlock()
+
+			switch {
+			case role == RaftLeader:
+				e.heartbeat()
+			case expired:
+				e.campaign()
+			}
+		}
+	}()
+}
+
+// campaign runs for leader in a new term.
+func (e *Election) campaign() {
+	e.mux.Lock()
+	e.term++
+	e.role, e.votedFor, e.leader = RaftCandidate, e.Self, ""
+	// Retry soon after a split vote; the other candidates are already past their lease
+	e.deadline = time.Now().Add(electionHeartbeat + time.Duration(rand.Int63n(int64(electionLease/2))))
+	term := e.term
+	e.mux.Unlock()
+	e.setLeader("")
+
+	votes := 1
+	for _, response := range e.broadcast("/_election/vote", electionRequest{Term: term, Candidate: e.Self}) {
+		if e.observe(response.Term) {
+			return
+		}
+		if response.Granted {
+			votes++
+		}
+	}
+
+	e.mux.Lock()
+	won := e.role == RaftCandidate && e.term == term && votes > len(e.Nodes)/2
+	if won {
+		e.role, e.leader = RaftLeader, e.Self
+		e.deadline = time.Now().Add(electionLease / 2)
+	}
+	e.mux.Unlock()
+
+	if won {
+		log.Printf("election: %s is the leader of term %d", e.Self, term)
+		e.setLeader(e.Self)
+		e.heartbeat()
+	}
+}
+
+// heartbeat renews the leader's lease on the other nodes, and steps down when a majority has not
+// acknowledged it for half a lease.
+func (e *Election) heartbeat() {
+	sent := time.Now()
+	e.mux.Lock()
+	term := e.term
+	e.mux.Unlock()
+
+	acks := 1
+	for _, response := range e.broadcast("/_election/heartbeat", electionRequest{Term: term, Candidate: e.Self}) {
+		if e.observe(response.Term) {
+			return
+		}
+		if response.Granted {
+			acks++
+		}
+	}
+
+	e.mux.Lock()
+	if e.role != RaftLeader || e.term != term {
+		e.mux.Unlock()
+		return
+	}
+	if acks > len(e.Nodes)/2 {
+		e.deadline = sent.Add(electionLease / 2)
+		e.mux.Unlock()
+		return
+	}
+	stepDown := time.Now().After(e.deadline)
+	if stepDown {
+		e.role, e.leader = RaftFollower, ""
+		e.deadline = time.Now().Add(e.timeout())
+	}
+	e.mux.Unlock()
+
+	if stepDown {
+		log.Printf("election: %s lost its majority and stepped down", e.Self)
+		e.setLeader("")
+	}
+}
+
+// observe steps down when another node answered with a newer term, and reports whether it did.
+func (e *Election) observe(term uint64) bool {
+	e.mux.Lock()
+	if term <= e.term {
+		e.mux.Unlock()
+		return false
+	}
+	e.term, e.role, e.votedFor, e.leader = term, RaftFollower, "", ""
+	e.deadline = time.Now().Add(e.timeout())
+	e.mux.Unlock()
+
+	e.setLeader("")
+	return true
+}
+
+// broadcast sends a request to every other node concurrently and returns the answers received.
+func (e *Election) broadcast(path string, request electionRequest) []electionResponse {
+	body, _ := json.Marshal(request)
+
+	var (
+		responses []electionResponse
+		wg        sync.WaitGroup
+		mux       sync.Mutex
+	)
+	for _, node := range e.Nodes {
+		if node == e.Self {
+			continue
+		}
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			resp, err := e.Auth.Do(e.client, http.MethodPost, node+path, body)
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+
+			var response electionResponse
+			if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&response) == nil {
+				mux.Lock()
+				responses = append(responses, response)
+				mux.Unlock()
+			}
+		}(node)
+	}
+	wg.Wait()
+	return responses
+}
+
+// setLeader reports a leader change to OnChange.
+func (e *Election) setLeader(leader string) {
+	e.notifyMux.Lock()
+	defer e.notifyMux.Unlock()
+
+	if leader != e.notified && e.OnChange != nil {
+		e.OnChange(leader)
+	}
+	e.notified = leader
+}
+
+// vote answers a vote request. A node holding a live lease for another leader refuses to vote, so a
+// node that was cut off cannot depose a healthy leader when it comes back.
+func (e *Election) vote(request electionRequest) electionResponse {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if !containsString(e.Nodes, request.Candidate) || request.Candidate == e.Self {
+		return electionResponse{Term: e.term}
+	}
+	if e.leader != "" && e.leader != request.Candidate && time.Now().Before(e.deadline) {
+		return electionResponse{Term: e.term}
+	}
+	if request.Term > e.term {
+		if e.role == RaftLeader {
+			return electionResponse{Term: e.term}
+		}
+		e.term, e.role, e.votedFor = request.Term, RaftFollower, ""
+	}
+	if request.Term < e.term || (e.votedFor != "" && e.votedFor != request.Candidate) {
+		return electionResponse{Term: e.term}
+	}
+	e.votedFor = request.Candidate
+	e.deadline = time.Now().Add(e.timeout())
+	return electionResponse{Term: e.term, Granted: true}
+}
+
+// acknowledge accepts a heartbeat from the leader of the current or a newer term, when it is another
+// node of the cluster.
+func (e *Election) acknowledge(request electionRequest) electionResponse {
+	e.mux.Lock()
+	if request.Term < e.term || !containsString(e.Nodes, request.Candidate) || request.Candidate == e.Self {
+		defer e.mux.Unlock()
+		return electionResponse{Term: e.term}
+	}
+	changed := e.leader != request.Candidate
+	e.term, e.role, e.leader = request.Term, RaftFollower, request.Candidate
+	e.deadline = time.Now().Add(e.timeout())
+	e.mux.Unlock()
+
+	if changed {
+		log.Printf("election: following %s in term %d", request.Candidate, request.Term)
+		e.setLeader(request.Candidate)
+	}
+	return electionResponse{Term: request.Term, Granted: true}
+}
+
+// Handler serves the election endpoints and GET /_leader, sends every other request to leader while
+// this node leads and to follower otherwise.
+func (e *Election) Handler(leader, follower http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_leader":
+			writeJSON(w, http.StatusOK, e.Status())
+			return
+		case "/_election/vote", "/_election/heartbeat":
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w, r, http.MethodPost)
+				return
+			}
+			if !fromPeer(r) {
+				writeProblem(w, r, http.StatusUnauthorized, "A valid cluster signature is required in the "+ClusterSignatureHeader+" header")
+				return
+			}
+			var request electionRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+				return
+			}
+			if r.URL.Path == "/_election/vote" {
+				writeJSON(w, http.StatusOK, e.vote(request))
+			} else {
+				writeJSON(w, http.StatusOK, e.acknowledge(request))
+			}
+			return
+		}
+
+		if e.IsLeader() {
+			leader.ServeHTTP(w, r)
+		} else {
+			follower.ServeHTTP(w, r)
+		}
+	})
+}
+
+// handleRaftLeader serves GET /_leader in clustered mode from the Raft state.
+func handleRaftLeader(node *RaftNode, w http.ResponseWriter, r *http.Request) {
+	status := node.Status()
+	writeJSON(w, http.StatusOK, LeaderStatus{
+		Self:   status.ID,
+		Role:   status.Role,
+		Term:   status.Term,
+		Leader: status.Leader,
+		Nodes:  append([]string{status.ID}, status.Peers...),
+	})
+}
@@ -0,0 +1,45 @@
+// File: election_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests that the election only follows and votes for the configured nodes,
+// and only hears the nodes signing their requests.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestElectionIgnoresUnknownCandidates(t *testing.T) {
+	e := NewElection("http://a", []string{"http://b", "http://c"})
+
+	for _, candidate := range []string{"http://intruder", "http://a"} {
+		if response := e.vote(electionRequest{Term: 5, Candidate: candidate}); response.Granted {
+			t.Errorf("vote granted to %s", candidate)
+		}
+		if response := e.acknowledge(electionRequest{Term: 5, Candidate: candidate}); response.Granted || e.Status().Leader != "" {
+			t.Errorf("heartbeat of %s made it the leader", candidate)
+		}
+	}
+	if response := e.acknowledge(electionRequest{Term: 5, Candidate: "http://b"}); !response.Granted || e.Status().Leader != "http://b" {
+		t.Errorf("heartbeat of a member was refused: %+v", response)
+	}
+
+	auth := NewClusterAuth("secret")
+	handler := auth.Handler(e.Handler(http.NotFoundHandler(), http.NotFoundHandler()))
+	body := `{"term":9,"candidate":"http://c"}`
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/_election/heartbeat", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned heartbeat: status %d, want 401", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, signedRequest(auth, "/_election/heartbeat", body))
+	if w.Code != http.StatusOK || e.Status().Leader != "http://c" {
+		t.Errorf("signed heartbeat: status %d, leader %q, want 200 and http://c", w.Code, e.Status().Leader)
+	}
+}
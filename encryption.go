@@ -0,0 +1,273 @@
+// File: encryption.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements encryption at rest. EncryptedStorage wraps a Storage backend
+// and seals every encoded item with AES-GCM before it reaches the backend, bound to its model and
+// ID so sealed items cannot be swapped, and opens them again on reads; the store and the layers
+// above the wrapper only ever see plaintext. Keys live in a Keyring loaded from the environment
+// (CRUD_ENCRYPTION_KEYS) or unwrapped by a KMS, each under an ID recorded in the items it sealed:
+// new items are sealed with the primary key while the older keys still open the items they sealed,
+// and Rotate reseals those (and items written before encryption was enabled) with the primary key.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EncryptionKeysEnv is the environment variable the keys of the server are read from.
+const EncryptionKeysEnv = "CRUD_ENCRYPTION_KEYS"
+
+// sealedMagic prefixes the items sealed by EncryptedStorage. Items without it are plaintext.
+var sealedMagic = []byte("CRE1")
+
+// ErrUnknownKey is returned for a sealed item whose key is not in the keyring.
+var ErrUnknownKey = errors.New("encryption: unknown key")
+
+// Keyring holds the AES keys items are sealed with, by ID.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// KMS unwraps the data keys of a keyring, so only their wrapped form is kept in the configuration.
+type KMS interface {
+	// Decrypt returns the plaintext of a data key wrapped by the KMS.
+	Decrypt(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// NewKeyring creates a keyring of AES-128, AES-192 or AES-256 keys (16, 24 or 32 bytes) sealing
+// new items with the key named primary.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{primary: primary, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("encryption: invalid key ID %q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: key %s: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: key %s: %w", id, err)
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[primary]; !ok {
+		return nil, fmt.Errorf("encryption: primary key %q is not in the keyring", primary)
+	}
+	return k, nil
+}
+
+// ParseKeyring parses a list of keys such as "k2:<base64>,k1:<base64>", the first being the
+// primary key.
+func ParseKeyring(spec string) (*Keyring, error) {
+	return parseKeyring(spec, func(id string, key []byte) ([]byte, error) { return key, nil })
+}
+
+// KeyringFromEnv parses the keyring held by the CRUD_ENCRYPTION_KEYS environment variable, or
+// returns nil when it is not set.
+func KeyringFromEnv() (*Keyring, error) {
+	spec := os.Getenv(EncryptionKeysEnv)
+	if spec == "" {
+		return nil, nil
+	}
+	return ParseKeyring(spec)
+}
+
+// KeyringFromKMS parses a list of data keys wrapped by a KMS, in the format of ParseKeyring, and
+// unwraps them.
+func KeyringFromKMS(ctx context.Context, kms KMS, spec string) (*Keyring, error) {
+	return parseKeyring(spec, func(id string, wrapped []byte) ([]byte, error) {
+		return kms.Decrypt(ctx, id, wrapped)
+	})
+}
+
+// parseKeyring parses a list of keys, turning each into an AES key with unwrap.
+func parseKeyring(spec string, unwrap func(id string, key []byte) ([]byte, error)) (*Keyring, error) {
+	keys := make(map[string][]byte)
+	primary := ""
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("encryption: invalid key %q (expected id:base64)", entry)
+		}
+		if _, exists := keys[id]; exists {
+			return nil, fmt.Errorf("encryption: key %s appears twice", id)
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: key %s: %w", id, err)
+		}
+		if keys[id], err = unwrap(id, data); err != nil {
+			return nil, fmt.Errorf("encryption: key %s: %w", id, err)
+		}
+		if primary == "" {
+			primary = id
+		}
+	}
+	if primary == "" {
+		return nil, errors.New("encryption: no keys")
+	}
+	return NewKeyring(primary, keys)
+}
+
+// seal encrypts data with the primary key, bound to the additional data naming what it belongs to.
+func (k *Keyring) seal(data, name []byte) ([]byte, error) {
+	aead := k.keys[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(sealedMagic)+1+len(k.primary)+len(nonce)+len(data)+aead.Overhead())
+	sealed = append(sealed, sealedMagic...)
+	sealed = append(sealed, byte(len(k.primary)))
+	sealed = append(sealed, k.primary...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, data, name), nil
+}
+
+// open decrypts data sealed for the given additional data, and returns the ID of the key that
+// sealed it ("" for plaintext, which is returned as it is).
+func (k *Keyring) open(data, name []byte) ([]byte, string, error) {
+	if !bytes.HasPrefix(data, sealedMagic) {
+		return data, "", nil
+	}
+	rest := data[len(sealedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, "", fmt.Errorf("encryption: %s: truncated data", name)
+	}
+	keyID := string(rest[1 : 1+int(rest[0])])
+	rest = rest[1+int(rest[0]):]
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, keyID, fmt.Errorf("%w %s (%s)", ErrUnknownKey, keyID, name)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, keyID, fmt.Errorf("encryption: %s: truncated data", name)
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], name)
+	if err != nil {
+		return nil, keyID, fmt.Errorf("encryption: %s: %w", name, err)
+	}
+	return plain, keyID, nil
+}
+
+// recordName returns the additional data binding a sealed item to its model and ID.
+func recordName(model string, id int) []byte {
+	return []byte(model + "/" + strconv.Itoa(id))
+}
+
+// EncryptedStorage is a Storage sealing the items it stores with the keys of a keyring.
+type EncryptedStorage struct {
+	Storage
+	keys *Keyring
+}
+
+// NewEncryptedStorage wraps a backend so the items it stores are encrypted with keys.
+func NewEncryptedStorage(backend Storage, keys *Keyring) *EncryptedStorage {
+	return &EncryptedStorage{Storage: backend, keys: keys}
+}
+
+// Put seals an item and stores it in the backend.
+func (e *EncryptedStorage) Put(model string, id int, data []byte) error {
+	return e.PutContext(context.Background(), model, id, data)
+}
+
+// PutContext seals an item like Put, passing ctx to a backend accepting one.
+func (e *EncryptedStorage) PutContext(ctx context.Context, model string, id int, data []byte) error {
+	sealed, err := e.keys.seal(data, recordName(model, id))
+	if err != nil {
+		return err
+	}
+	return writeStorage(ctx, e.Storage, model, id, sealed)
+}
+
+// DeleteContext removes an item like Delete, passing ctx to a backend accepting one.
+func (e *EncryptedStorage) DeleteContext(ctx context.Context, model string, id int) error {
+	return writeStorage(ctx, e.Storage, model, id, nil)
+}
+
+// Get reads an item from the backend and opens it.
+func (e *EncryptedStorage) Get(model string, id int) ([]byte, bool, error) {
+	data, ok, err := e.Storage.Get(model, id)
+	if err != nil || !ok {
+		return data, ok, err
+	}
+	plain, _, err := e.keys.open(data, recordName(model, id))
+	return plain, err == nil, err
+}
+
+// Scan calls fn for every item of a model in ID order, opened.
+func (e *EncryptedStorage) Scan(model string, fn func(id int, data []byte) error) error {
+	return e.ScanContext(context.Background(), model, fn)
+}
+
+// ScanContext scans the items of a model like Scan, passing ctx to a backend accepting one.
+func (e *EncryptedStorage) ScanContext(ctx context.Context, model string, fn func(id int, data []byte) error) error {
+	return scanStorage(ctx, e.Storage, model, func(id int, data []byte) error {
+		plain, _, err := e.keys.open(data, recordName(model, id))
+		if err != nil {
+			return err
+		}
+		return fn(id, plain)
+	})
+}
+
+// Rotate reseals with the primary key every item that was sealed with another key or stored before
+// encryption was enabled, and returns how many were resealed. It must not run concurrently with
+// writes to the backend, so it is meant to run on startup, before the store serves requests.
+func (e *EncryptedStorage) Rotate(ctx context.Context) (int, error) {
+	models, err := e.Storage.Models()
+	if err != nil {
+		return 0, err
+	}
+	type stale struct {
+		id   int
+		data []byte
+	}
+	resealed := 0
+	for _, model := range models {
+		var items []stale
+		err := scanStorage(ctx, e.Storage, model, func(id int, data []byte) error {
+			plain, keyID, err := e.keys.open(data, recordName(model, id))
+			if err != nil {
+				return err
+			}
+			if keyID != e.keys.primary {
+				items = append(items, stale{id, plain})
+			}
+			return nil
+		})
+		if err != nil {
+			return resealed, err
+		}
+		for _, item := range items {
+			if err := ctx.Err(); err != nil {
+				return resealed, err
+			}
+			if err := e.PutContext(ctx, model, item.id, item.data); err != nil {
+				return resealed, err
+			}
+			resealed++
+		}
+	}
+	return resealed, nil
+}
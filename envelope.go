@@ -0,0 +1,130 @@
+// File: envelope.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the optional response envelope. Handlers wrapped with Envelope
+// (every model route with -envelope) answer {"data": ..., "meta": {...}, "error": null} instead of
+// the bare resource: the body of a successful response becomes data, the problem details of a
+// failed one become error, and meta holds the status, the request ID and, for lists, the
+// pagination of the page (total, count, offset and limit) and the facets asked for. Responses without a JSON body (204,
+// 304, HEAD) are passed through. Enveloped lists are buffered instead of streamed.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// TotalCountHeader carries the number of items matching a list request, across all pages.
+const TotalCountHeader = "X-Total-Count"
+
+// envelopeKey is the context key of the state of requests whose response is enveloped.
+type envelopeKey struct{}
+
+// envelopeState holds what handlers add to the meta of an enveloped response.
+type envelopeState struct {
+	facets map[string]ValueDistribution
+}
+
+// envelope is the body of an enveloped response.
+type envelope struct {
+	Data  json.RawMessage `json:"data"`
+	Meta  envelopeMeta    `json:"meta"`
+	Error json.RawMessage `json:"error"`
+}
+
+// envelopeMeta is the metadata of an enveloped response.
+type envelopeMeta struct {
+	Status    int    `json:"status"`
+	RequestID string `json:"requestId,omitempty"`
+	Total     *int   `json:"total,omitempty"`
+	Count     *int   `json:"count,omitempty"`
+	Offset    *int   `json:"offset,omitempty"`
+	Limit     *int   `json:"limit,omitempty"`
+
+	Facets map[string]ValueDistribution `json:"facets,omitempty"`
+}
+
+// Envelope wraps the JSON responses of a handler in an envelope.
+func Envelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorded := newBufferedResponse()
+		for key, values := range w.Header() {
+			recorded.header[key] = values
+		}
+		state := &envelopeState{}
+		next.ServeHTTP(recorded, r.WithContext(context.WithValue(r.Context(), envelopeKey{}, state)))
+		writeEnvelope(w, r, recorded, state)
+	})
+}
+
+// enveloped reports whether the response to a request is enveloped.
+func enveloped(r *http.Request) bool {
+	state, _ := r.Context().Value(envelopeKey{}).(*envelopeState)
+	return state != nil
+}
+
+// setFacets adds the facets of a list to the meta of its response, when it is enveloped. It
+// reports whether it did.
+func setFacets(r *http.Request, facets map[string]ValueDistribution) bool {
+	state, _ := r.Context().Value(envelopeKey{}).(*envelopeState)
+	if state == nil {
+		return false
+	}
+	state.facets = facets
+	return true
+}
+
+// setTotalCount declares the number of items matching a list request, when its response is
+// enveloped.
+func setTotalCount(w http.ResponseWriter, r *http.Request, total int) {
+	if enveloped(r) {
+		w.Header().Set(TotalCountHeader, strconv.Itoa(total))
+	}
+}
+
+// writeEnvelope writes a recorded response in an envelope.
+func writeEnvelope(w http.ResponseWriter, r *http.Request, recorded *bufferedResponse, state *envelopeState) {
+	mediaType, _, _ := mime.ParseMediaType(recorded.header.Get("Content-Type"))
+	body := bytes.TrimSpace(recorded.body.Bytes())
+	if (mediaType != "application/json" && mediaType != problemContentType) || len(body) == 0 {
+		recorded.writeTo(w)
+		return
+	}
+	status := recorded.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	env := envelope{Meta: envelopeMeta{Status: status, RequestID: recorded.header.Get(RequestIDHeader)}}
+	if mediaType == problemContentType {
+		env.Error = body
+	} else {
+		env.Data = body
+	}
+	if v := recorded.header.Get(TotalCountHeader); v != "" && env.Data != nil {
+		total, _ := strconv.Atoi(v)
+		var items []json.RawMessage
+		json.Unmarshal(body, &items)
+		count := len(items)
+		page, _ := parsePage(r.URL.Query())
+		env.Meta.Total, env.Meta.Count, env.Meta.Offset = &total, &count, &page.Offset
+		if page.Limit > 0 {
+			env.Meta.Limit = &page.Limit
+		}
+		env.Meta.Facets = state.facets
+	}
+
+	for key, values := range recorded.header {
+		w.Header()[key] = values
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, status, env)
+}
@@ -0,0 +1,156 @@
+// File: errors.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file defines the machine-readable codes of error responses and the Error type
+// carrying them. Every problem answered by the server has a code (ITEM_NOT_FOUND,
+// VALIDATION_FAILED, CONFLICT, ...), derived from its status unless the error names a more specific
+// one. Applications map their own errors (for example those returned by listeners or checks they
+// plug in) to a status and code with MapError, or with a function registered by
+// RegisterErrorMapper, so they are answered consistently with the built-in ones.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Error codes of the problems answered by the server.
+const (
+	CodeInvalidRequest       = "INVALID_REQUEST"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeForbidden            = "FORBIDDEN"
+	CodeNotFound             = "NOT_FOUND"
+	CodeItemNotFound         = "ITEM_NOT_FOUND"
+	CodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	CodeConflict             = "CONFLICT"
+	CodePreconditionFailed   = "PRECONDITION_FAILED"
+	CodePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	CodeValidationFailed     = "VALIDATION_FAILED"
+	CodePreconditionRequired = "PRECONDITION_REQUIRED"
+	CodeRateLimited          = "RATE_LIMITED"
+	CodeInternal             = "INTERNAL_ERROR"
+	CodeBadGateway           = "BAD_GATEWAY"
+	CodeUnavailable          = "SERVICE_UNAVAILABLE"
+)
+
+// statusCodes are the codes of the problems that do not name one.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusPreconditionFailed:    CodePreconditionFailed,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnprocessableEntity:   CodeValidationFailed,
+	http.StatusPreconditionRequired:  CodePreconditionRequired,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusBadGateway:            CodeBadGateway,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// statusCode returns the code of a status without a more specific one.
+func statusCode(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeInvalidRequest
+}
+
+// Error is an error answered with a given status and code.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error // the underlying error, if any
+}
+
+// Error returns the message of the error, or that of the underlying error.
+func (e *Error) Error() string {
+	if e.Message == "" && e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrItemNotFound is answered to requests naming an item that does not exist.
+var ErrItemNotFound = &Error{Status: http.StatusNotFound, Code: CodeItemNotFound, Message: "Item not found"}
+
+// errorMappers are the functions registered with RegisterErrorMapper, consulted in order.
+var errorMappers struct {
+	sync.RWMutex
+	list []func(error) *Error
+}
+
+// RegisterErrorMapper registers a function turning application errors into API errors; it
+// returns nil for errors it does not know. Mappers run in registration order, before the errors are
+// answered with the status of their call site.
+func RegisterErrorMapper(mapper func(err error) *Error) {
+	errorMappers.Lock()
+	defer errorMappers.Unlock()
+	errorMappers.list = append(errorMappers.list, mapper)
+}
+
+// MapError answers the errors matching target (with errors.Is) with the given status and code.
+func MapError(target error, status int, code string) {
+	RegisterErrorMapper(func(err error) *Error {
+		if errors.Is(err, target) {
+			return &Error{Status: status, Code: code, Err: err}
+		}
+		return nil
+	})
+}
+
+// asError returns the API error an error maps to: the error itself when it is an *Error, the
+// result of the first mapper knowing it, or an error of the given status.
+func asError(err error, status int) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	if apiErr := contextError(err); apiErr != nil {
+		return apiErr
+	}
+	errorMappers.RLock()
+	defer errorMappers.RUnlock()
+	for _, mapper := range errorMappers.list {
+		if mapped := mapper(err); mapped != nil {
+			if mapped.Err == nil {
+				mapped.Err = err
+			}
+			return mapped
+		}
+	}
+	return &Error{Status: status, Code: statusCode(status), Err: err}
+}
+
+// writeError answers a request with the problem of an error, with status unless the error
+// maps to another.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	apiErr := asError(err, status)
+	p := newProblem(apiErr.Status, apiErr.Error())
+	if apiErr.Code != "" {
+		p.Code = apiErr.Code
+	}
+	p.Instance = versionPrefix(r) + r.URL.Path
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		p.Errors = invalid.Errors
+	}
+	localizeProblem(w, r, p, apiErr.Err)
+	writeProblemDetails(w, p)
+}
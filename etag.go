@@ -0,0 +1,173 @@
+// File: etag.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements entity tags for conditional GETs. An item's ETag is a hash of its
+// JSON encoding, so it only changes when the item does; a collection's (weak) ETag is derived from a
+// version number that grows on every change to the collection, so listing it does not need to be
+// hashed. A GET whose If-None-Match header carries the current tag is answered with 304 Not Modified
+// and no body, so polling clients and CDNs stop downloading unchanged JSON. Items and collections also
+// carry a Last-Modified time, so simpler clients can use If-Modified-Since instead. Writes honour
+// If-Match: an update or delete whose tag no longer matches the stored item fails with 412
+// Precondition Failed instead of overwriting a change the client has not seen.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etagEpoch tells the collection versions of different server runs apart, since they restart at zero.
+var etagEpoch = func() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}()
+
+// contentETag returns the strong ETag of an encoded item.
+func contentETag(data []byte) string {
+	h := fnv.New64a()
+	h.Write(data)
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.Sum64())
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// itemETag returns the ETag of an item, as sent when it is read.
+func itemETag(item interface{}) (string, error) {
+	b := getJSONBuffer()
+	defer putJSONBuffer(b)
+
+	if err := b.encode(item); err != nil {
+		return "", err
+	}
+	return contentETag(b.buf.Bytes()), nil
+}
+
+// collectionETag returns the weak ETag of the current state of a collection, and of the collections
+// its response also embeds items of.
+func collectionETag(c *collection, related ...*collection) string {
+	tag := fmt.Sprintf(`W/"%s-%d`, etagEpoch, c.version())
+	for _, r := range related {
+		tag += fmt.Sprintf("-%d", r.version())
+	}
+	return tag + `"`
+}
+
+// etagMatches reports whether an If-None-Match or If-Match header lists the tag. Tags are compared
+// weakly, ignoring the W/ prefix; "*" matches any tag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag and Last-Modified headers of a GET response (modified may be zero when
+// unknown) and answers 304 Not Modified when the client already has that version, reporting whether
+// it did. If-None-Match takes precedence over If-Modified-Since, as HTTP requires.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	current := false
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		current = etagMatches(header, etag)
+	} else if header := r.Header.Get("If-Modified-Since"); header != "" && !modified.IsZero() {
+		// HTTP dates have a resolution of one second
+		since, err := http.ParseTime(header)
+		current = err == nil && !modified.Truncate(time.Second).After(since)
+	}
+	if current {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return current
+}
+
+// writeItemJSON writes an item read by a GET with its ETag and modification time, or 304 Not
+// Modified when the client's copy is current.
+func writeItemJSON(w http.ResponseWriter, r *http.Request, item interface{}, modified time.Time) {
+	b := getJSONBuffer()
+	defer putJSONBuffer(b)
+
+	if err := b.encode(item); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Cannot encode response")
+		return
+	}
+	// The ETag is that of the stored item, so masked callers can still send it in If-Match
+	etag := contentETag(b.buf.Bytes())
+	if masking(w) {
+		b.buf.Reset()
+		if err := b.encode(maskItem(item)); err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "Cannot encode response")
+			return
+		}
+	}
+	if notModified(w, r, etag, modified) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(b.buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(b.buf.Bytes())
+}
+
+// errPreconditionFailed reports that an item changed since the client read it.
+var errPreconditionFailed = errors.New("item was modified since it was read")
+
+// SetRequireIfMatch makes updates and deletes without an If-Match header fail with 428 Precondition
+// Required, so clients cannot overwrite changes they have not seen. It must be called before the
+// store is used concurrently.
+func (s *Store) SetRequireIfMatch(required bool) {
+	s.requireMatch = required
+}
+
+// precondition returns the check an If-Match header puts on the item a write replaces (nil without
+// the header). It answers 428 and returns false when the store requires the header and it is missing.
+func (s *Store) precondition(w http.ResponseWriter, r *http.Request) (func(current interface{}) error, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if s.requireMatch {
+			writeProblem(w, r, http.StatusPreconditionRequired, "If-Match header required")
+			return nil, false
+		}
+		return nil, true
+	}
+	return func(current interface{}) error {
+		etag, err := itemETag(current)
+		if err != nil {
+			return err
+		}
+		if !etagMatches(header, etag) {
+			return errPreconditionFailed
+		}
+		return nil
+	}, true
+}
+
+// writePreconditionError answers a write whose precondition did not hold.
+func writePreconditionError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errPreconditionFailed {
+		writeProblem(w, r, http.StatusPreconditionFailed, "Precondition failed: "+err.Error())
+		return
+	}
+	writeError(w, r, http.StatusInternalServerError, err)
+}
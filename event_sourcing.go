@@ -0,0 +1,349 @@
+// File: event_sourcing.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the event sourcing storage mode. Every mutation is appended to an
+// append-only event log (one JSON event per line: ItemCreated, ItemUpdated or ItemDeleted) and the
+// current state of the store is rebuilt by replaying the log on startup. Because events are never
+// rewritten, the log also provides the full history of every item.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types written to the event log.
+const (
+	EventItemCreated = "ItemCreated"
+	EventItemUpdated = "ItemUpdated"
+	EventItemDeleted = "ItemDeleted"
+)
+
+// StoredEvent is the on-disk representation of a change event.
+type StoredEvent struct {
+	Type  string          `json:"type"`
+	Seq   uint64          `json:"seq"`
+	Model string          `json:"model"`
+	ID    int             `json:"id"`
+	Time  time.Time       `json:"time"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// EventLog is an append-only file of store events.
+type EventLog struct {
+	path string
+	file *os.File
+	mux  sync.Mutex
+
+	// Sync forces every appended event to be flushed to stable storage.
+	Sync bool
+}
+
+// OpenEventLog opens (or creates) the event log at path.
+func OpenEventLog(path string) (*EventLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &EventLog{path: path, file: file}, nil
+}
+
+// Append writes a change event to the log. It is meant to be passed to Store.Subscribe.
+func (l *EventLog) Append(event ChangeEvent) {
+	stored := StoredEvent{Seq: event.Seq, Model: event.Model, ID: event.ID, Time: event.Time}
+	switch event.Op {
+	case OpCreate:
+		stored.Type = EventItemCreated
+	case OpUpdate:
+		stored.Type = EventItemUpdated
+	case OpDelete:
+		stored.Type = EventItemDeleted
+	}
+	if event.Item != nil {
+		sealed, err := sealFields(event.Model, event.ID, event.Item)
+		var data []byte
+		if err == nil {
+			data, err = json.Marshal(sealed)
+		}
+		if err != nil {
+			log.Printf("event log: cannot encode %s %d: %v", event.Model, event.ID, err)
+			return
+		}
+		stored.Data = data
+	}
+
+	line, err := json.Marshal(stored)
+	if err != nil {
+		log.Printf("event log: cannot encode event %d: %v", event.Seq, err)
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Printf("event log: write failed: %v", err)
+		return
+	}
+	if l.Sync {
+		l.file.Sync()
+	}
+}
+
+// Events reads every event from the log ordered by sequence number.
+// Listeners may append concurrently, so lines are not guaranteed to be in sequence order on disk.
+func (l *EventLog) Events() ([]StoredEvent, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []StoredEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event StoredEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("event log %s line %d: %w", l.path, line, err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+	return events, nil
+}
+
+// Replay rebuilds the store state from the log. Models must be registered with the store beforehand
+// so item payloads can be decoded into their types. Listeners subscribed before Replay (such as
+// projections) receive the replayed events; subscribe publishers afterwards to avoid re-sending history.
+func (l *EventLog) Replay(store *Store) error {
+	events, err := l.Events()
+	if err != nil {
+		return err
+	}
+
+	for _, stored := range events {
+		event, err := decodeEvent(store, stored)
+		if err != nil {
+			return err
+		}
+		store.notify(store.apply(event))
+	}
+	return nil
+}
+
+// decodeEvent returns the change event of a stored event, its item decoded into the type of its
+// model, which must be registered.
+func decodeEvent(store *Store, stored StoredEvent) (ChangeEvent, error) {
+	event := ChangeEvent{Seq: stored.Seq, Model: stored.Model, ID: stored.ID, Time: stored.Time}
+	switch stored.Type {
+	case EventItemCreated:
+		event.Op = OpCreate
+	case EventItemUpdated:
+		event.Op = OpUpdate
+	case EventItemDeleted:
+		event.Op = OpDelete
+	default:
+		return event, fmt.Errorf("event log: unknown event type %q at seq %d", stored.Type, stored.Seq)
+	}
+
+	meta, ok := store.meta(stored.Model)
+	if !ok {
+		return event, fmt.Errorf("event log: model %q is not registered", stored.Model)
+	}
+	if event.Op != OpDelete {
+		item := reflect.New(meta.typ).Interface()
+		if err := json.Unmarshal(stored.Data, item); err != nil {
+			return event, fmt.Errorf("event log: seq %d: %w", stored.Seq, err)
+		}
+		if err := openFields(stored.Model, stored.ID, item); err != nil {
+			return event, fmt.Errorf("event log: seq %d: %w", stored.Seq, err)
+		}
+		event.Item = item
+	}
+	return event, nil
+}
+
+// Close closes the log file.
+func (l *EventLog) Close() error {
+	return l.file.Close()
+}
+
+// apply applies a previously recorded event to the store without notifying listeners,
+// keeping the model's ID counter and the sequence number ahead of everything replayed.
+// It returns the event completed with the item it replaced. The model must be registered.
+func (s *Store) apply(event ChangeEvent) ChangeEvent {
+	c, ok := s.collection(event.Model)
+	if !ok {
+		return event
+	}
+	sh := c.shard(event.ID)
+	sh.itemMux.Lock()
+	defer sh.itemMux.Unlock()
+
+	items := sh.edit()
+	old, exists := items.get(event.ID)
+	event.Old = old.item
+	switch event.Op {
+	case OpDelete:
+		if exists {
+			c.reindex(event.ID, old.item, nil)
+		}
+		items.remove(event.ID)
+		if limit := c.capacity(); limit != nil {
+			limit.remove(event.ID)
+		}
+		s.persist(context.Background(), c.name, event.ID, nil)
+	default:
+		modified := event.Time
+		if modified.IsZero() {
+			modified = time.Now()
+		}
+		created := old.created
+		if event.Op == OpCreate {
+			created = modified
+		}
+		c.reindex(event.ID, old.item, event.Item)
+		items.set(event.ID, entry{item: event.Item, created: created, modified: modified, expires: c.meta.expiryFor(event.Item, old.expires)})
+		c.track(event.ID)
+		s.persist(context.Background(), c.name, event.ID, event.Item)
+	}
+	sh.publish(items)
+	advanceID(c, event.ID)
+
+	s.seqMux.Lock()
+	if event.Seq == 0 {
+		// Events received from peers get the next local sequence number
+		s.seq++
+		event.Seq = s.seq
+	} else if event.Seq > s.seq {
+		s.seq = event.Seq
+	}
+	s.changes.Append(event)
+	s.seqMux.Unlock()
+	s.signRecord(event)
+	return event
+}
+
+// applyReplicated writes a change received from another node like a local write, through the
+// checked paths: the sealed fields of the item are opened, and the item is validated and held to
+// its parents, keys and unique fields and to the immutability of its model. Creates and updates
+// replace the item when it exists and create it otherwise. The events carry the origin of ctx.
+func (s *Store) applyReplicated(ctx context.Context, op, model string, id int, data json.RawMessage) error {
+	c, ok := s.collection(model)
+	if !ok {
+		return &Error{Status: http.StatusNotFound, Code: CodeNotFound, Err: localizef("model %q is not registered", model)}
+	}
+	if op == OpDelete {
+		_, err := s.deleteChecked(ctx, model, id, nil)
+		return err
+	}
+
+	item := reflect.New(c.meta.typ).Interface()
+	err := json.Unmarshal(data, item)
+	if err == nil {
+		err = openFields(model, id, item)
+	}
+	if err != nil {
+		return &Error{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Err: fmt.Errorf("invalid %s %d: %w", model, id, err)}
+	}
+	if c.meta.id != nil {
+		c.meta.id.value(item).SetInt(int64(id))
+	}
+	if err := validate(c.meta, item); err != nil {
+		return err
+	}
+	if err := s.checkParents(model, item); err != nil {
+		return err
+	}
+	if !s.exists(model, id) {
+		_, err := s.createCheckedAt(ctx, model, id, item, 0)
+		if e, ok := err.(*Error); !ok || e.Code != CodeConflict || !s.exists(model, id) {
+			return err
+		}
+	}
+	_, err = s.updateChecked(ctx, model, id, item, nil)
+	return err
+}
+
+// handleHistory serves GET /_events?model=<name>&id=<id> returning the recorded events of the log,
+// optionally limited to one model or one item. Only the events of the namespace of the X-Tenant-ID
+// tenant (the default namespace without one) are returned, model naming a base model, and their
+// items are masked unless the caller is privileged, their encrypted fields sealed as in the log.
+func handleHistory(store *Store, eventLog *EventLog, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	tenant := r.Header.Get(TenantHeader)
+	if tenant != "" && !validTenant(tenant) {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid tenant")
+		return
+	}
+
+	model := r.URL.Query().Get("model")
+	id := 0
+	if v := r.URL.Query().Get("id"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+		id = parsed
+	}
+
+	events, err := eventLog.Events()
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Cannot read event log")
+		return
+	}
+	masked := !store.isPrivileged(r)
+	history := make([]StoredEvent, 0, len(events))
+	for _, event := range events {
+		if modelTenant(event.Model) != tenant || model != "" && event.Model != tenantModel(tenant, model) || id != 0 && event.ID != id {
+			continue
+		}
+		if masked && len(event.Data) > 0 {
+			if event.Data, err = maskedEventData(store, event); err != nil {
+				writeProblem(w, r, http.StatusInternalServerError, "Cannot read event log")
+				return
+			}
+		}
+		history = append(history, event)
+	}
+
+	writeJSON(w, http.StatusOK, history)
+}
+
+// maskedEventData returns the item of a stored event with its masked fields masked and its
+// encrypted fields sealed again.
+func maskedEventData(store *Store, stored StoredEvent) (json.RawMessage, error) {
+	event, err := decodeEvent(store, stored)
+	if err != nil {
+		return nil, err
+	}
+	return marshalSealed(stored.Model, stored.ID, maskItem(event.Item))
+}
@@ -0,0 +1,43 @@
+// File: event_sourcing_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the event history: it only holds the events of the namespace of the
+// tenant of the request, and masks their items unless the caller is privileged.
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHistoryIsScopedAndMasked(t *testing.T) {
+	eventLog, err := OpenEventLog(filepath.Join(t.TempDir(), "events.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eventLog.Close()
+	store := newTestStore()
+	store.Subscribe(eventLog.Append)
+	store.SetPrivileged(func(r *http.Request) bool { return r.Header.Get("X-Privileged") == "yes" })
+	store.Create("user", &User{Name: "default", Email: "jane@example.com"})
+	store.Create("acme/user", &User{Name: "acme", Email: "john@example.com"})
+	history := func(w http.ResponseWriter, r *http.Request) { handleHistory(store, eventLog, w, r) }
+
+	w := serveTest(history, http.MethodGet, "/_events?model=user", "")
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "j***@example.com") || strings.Contains(body, "jane@") || strings.Contains(body, "acme") {
+		t.Errorf("history of the default namespace: status %d: %s", w.Code, body)
+	}
+	w = serveTest(history, http.MethodGet, "/_events?model=user", "", TenantHeader, "acme")
+	if body := w.Body.String(); !strings.Contains(body, `"acme/user"`) || strings.Contains(body, `"default"`) {
+		t.Errorf("history of acme: %s", body)
+	}
+	w = serveTest(history, http.MethodGet, "/_events", "", "X-Privileged", "yes")
+	if !strings.Contains(w.Body.String(), "jane@example.com") {
+		t.Errorf("history read by a privileged caller is masked: %s", w.Body)
+	}
+}
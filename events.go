@@ -0,0 +1,53 @@
+// File: events.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file defines the change events emitted by the Store whenever an item is created,
+// updated or deleted. Listeners registered with Subscribe receive every event after the mutation has
+// been applied, which lets other components (broadcasters, caches, bridges) react to writes.
+
+package main
+
+import "time"
+
+// Operations reported in a ChangeEvent.
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// ChangeEvent describes a single mutation applied to the store.
+type ChangeEvent struct {
+	Seq    uint64      `json:"seq"`
+	Op     string      `json:"op"`
+	Model  string      `json:"model"`
+	ID     int         `json:"id"`
+	Item   interface{} `json:"item,omitempty"`
+	Old    interface{} `json:"old,omitempty"`
+	Time   time.Time   `json:"time"`
+	Origin string      `json:"origin,omitempty"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// Subscribe registers a listener that is called for every change applied to the store.
+// Listeners are invoked synchronously after the store lock has been released.
+func (s *Store) Subscribe(listener func(ChangeEvent)) {
+	s.listenerMux.Lock()
+	defer s.listenerMux.Unlock()
+
+	s.listeners = append(s.listeners, listener)
+}
+
+// notify delivers an event to all registered listeners.
+func (s *Store) notify(event ChangeEvent) {
+	s.listenerMux.Lock()
+	listeners := make([]func(ChangeEvent), len(s.listeners))
+	copy(listeners, s.listeners)
+	s.listenerMux.Unlock()
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
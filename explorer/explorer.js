@@ -0,0 +1,136 @@
+/*
+ * File: explorer/explorer.js
+ * Author: Mohamed Riyad
+ * Email: mohamed.riyad@example.com
+ * Date: November 2024
+ * License: MIT
+ * Description: Renders the operations of /openapi.json grouped by model, with a form per operation
+ * for its parameters and body, and sends the requests from the browser.
+ */
+
+"use strict";
+
+const methods = ["get", "post", "put", "delete"];
+
+// resolve follows a $ref of the document.
+function resolve(spec, node) {
+  while (node && node.$ref) {
+    node = node.$ref.replace(/^#\//, "").split("/").reduce((value, key) => value[key], spec);
+  }
+  return node;
+}
+
+// example builds a sample value of a schema, used to prefill request bodies.
+function example(spec, schema, depth = 0) {
+  schema = resolve(spec, schema) || {};
+  if (schema.allOf) return example(spec, schema.allOf[0], depth);
+  if (schema.oneOf) return example(spec, schema.oneOf[0], depth);
+  switch (schema.type) {
+    case "object": {
+      const value = {};
+      if (depth > 3) return value;
+      for (const [name, property] of Object.entries(schema.properties || {})) {
+        const resolved = resolve(spec, property) || {};
+        if (!resolved.readOnly) value[name] = example(spec, property, depth + 1);
+      }
+      return value;
+    }
+    case "array": return depth > 3 ? [] : [example(spec, schema.items, depth + 1)];
+    case "integer": case "number": return 0;
+    case "boolean": return false;
+    case "string": return schema.format === "date-time" ? new Date().toISOString() : "";
+  }
+  return null;
+}
+
+// element creates an element with attributes and children.
+function element(tag, attributes = {}, ...children) {
+  const node = document.createElement(tag);
+  for (const [name, value] of Object.entries(attributes)) node.setAttribute(name, value);
+  for (const child of children) node.append(child);
+  return node;
+}
+
+// renderOperation renders one operation with its form.
+function renderOperation(spec, path, method, item) {
+  const operation = item[method];
+  const parameters = [...(item.parameters || []), ...(operation.parameters || [])].map((p) => resolve(spec, p));
+  const form = element("form");
+  for (const parameter of parameters) {
+    if (parameter.in === "header" && parameter.name === "X-Tenant-ID") continue; // set in the header bar
+    const input = element("input", { name: parameter.name, "data-in": parameter.in });
+    form.append(element("label", {}, `${parameter.in === "path" ? "{" + parameter.name + "}" : parameter.name}`, input,
+      element("small", {}, parameter.description || "")));
+  }
+  let body = null;
+  if (operation.requestBody) {
+    const schema = operation.requestBody.content["application/json"].schema;
+    body = element("textarea", {}, JSON.stringify(example(spec, schema), null, 2));
+    form.append(element("label", {}, "body"), body);
+  }
+  const output = element("div");
+  form.append(element("button", { type: "submit" }, "Send"), output);
+
+  form.addEventListener("submit", async (event) => {
+    event.preventDefault();
+    let url = path;
+    const query = new URLSearchParams();
+    const headers = {};
+    for (const input of form.querySelectorAll("input")) {
+      if (input.value === "") continue;
+      switch (input.dataset.in) {
+        case "path": url = url.replace(`{${input.name}}`, encodeURIComponent(input.value)); break;
+        case "query": query.append(input.name, input.value); break;
+        case "header": headers[input.name] = input.value; break;
+      }
+    }
+    const tenant = document.getElementById("tenant").value;
+    if (tenant) headers["X-Tenant-ID"] = tenant;
+    const authorization = document.getElementById("authorization").value;
+    if (authorization) headers["Authorization"] = authorization;
+    if (body) headers["Content-Type"] = "application/json";
+    if ([...query].length) url += "?" + query;
+
+    output.replaceChildren("Sending…");
+    try {
+      const response = await fetch(url, { method: method.toUpperCase(), headers, body: body ? body.value : undefined });
+      let text = await response.text();
+      try { text = JSON.stringify(JSON.parse(text), null, 2); } catch (e) { /* not JSON */ }
+      const status = element("p", { class: response.ok ? "status-ok" : "status-error" },
+        `${method.toUpperCase()} ${url} → ${response.status} ${response.statusText}`);
+      const received = [...response.headers].map(([name, value]) => `${name}: ${value}`).join("\n");
+      output.replaceChildren(status, element("pre", {}, received), element("pre", {}, text));
+    } catch (error) {
+      output.replaceChildren(element("p", { class: "status-error" }, String(error)));
+    }
+  });
+
+  return element("details", { class: method },
+    element("summary", {}, element("span", { class: "method" }, method.toUpperCase()), path,
+      element("span", { class: "summary" }, operation.summary || "")),
+    form);
+}
+
+// render lists the operations of the document, grouped by the model of their path.
+function render(spec) {
+  document.title = spec.info.title;
+  document.getElementById("title").textContent = `${spec.info.title} ${spec.info.version}`;
+  const root = document.getElementById("paths");
+  root.replaceChildren();
+  const groups = new Map();
+  for (const [path, item] of Object.entries(spec.paths)) {
+    const model = path.split("/")[1];
+    if (!groups.has(model)) groups.set(model, []);
+    for (const method of methods) {
+      if (item[method]) groups.get(model).push(renderOperation(spec, path, method, item));
+    }
+  }
+  for (const [model, operations] of [...groups].sort()) {
+    root.append(element("h2", {}, model), ...operations);
+  }
+}
+
+fetch("/openapi.json")
+  .then((response) => response.json())
+  .then(render)
+  .catch((error) => { document.getElementById("paths").textContent = `Could not load /openapi.json: ${error}`; });
@@ -0,0 +1,404 @@
+// File: export.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements whole-store export and import, for cloning an environment or
+// moving data between storage backends. GET /_export streams a portable JSON dump of every model:
+// its items with their creation, modification and expiration times, and its ID counter. POST
+// /_import restores a dump, either merged into the stored items (?mode=merge, the default: the
+// items of the dump replace those with the same ID) or replacing the items of the models it holds
+// (?mode=replace). An import is applied atomically: one holding an item of the wrong shape or
+// taking the key or a unique field of another item changes nothing.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ExportFormat is the version of the dump format written by Store.Export.
+const ExportFormat = 1
+
+// importOrigin marks the change events written by imports.
+const importOrigin = "import"
+
+// Import modes.
+const (
+	ImportMerge   = "merge"   // items of the dump replace those with the same ID, others are kept
+	ImportReplace = "replace" // items of the dump replace every item of their models
+)
+
+// Export is a dump of the items of a store.
+type Export struct {
+	Format   int           `json:"format"`
+	Exported time.Time     `json:"exported"`
+	Masked   bool          `json:"masked,omitempty"` // the masked fields are masked, so it cannot be imported
+	Seq      uint64        `json:"seq,omitempty"`    // sequence number of the last change before the dump started
+	Models   []ExportModel `json:"models"`
+}
+
+// ExportModel holds the items of one model of a dump.
+type ExportModel struct {
+	Name   string       `json:"name"`
+	NextID int64        `json:"nextId"`
+	Items  []ExportItem `json:"items"`
+}
+
+// ExportItem is an item of a dump with its bookkeeping.
+type ExportItem struct {
+	ID       int             `json:"id"`
+	Created  time.Time       `json:"created"`
+	Modified time.Time       `json:"modified"`
+	Expires  *time.Time      `json:"expires,omitempty"`
+	Item     json.RawMessage `json:"item"`
+}
+
+// ImportResult reports what an import restored.
+type ImportResult struct {
+	Mode    string         `json:"mode"`
+	Models  map[string]int `json:"models"`            // number of items imported, by model
+	Skipped []string       `json:"skipped,omitempty"` // models of the dump that are not registered
+	Seq     uint64         `json:"seq,omitempty"`     // sequence number of the last change before the dump started
+}
+
+// Export writes a dump of every model to w, item by item, so the store is never copied whole. Each
+// model is scanned from its snapshots, so writes are not blocked while the dump is written.
+func (s *Store) Export(w io.Writer) error {
+	return s.ExportContext(context.Background(), w)
+}
+
+// ExportContext writes a dump like Export, stopping with the error of ctx once it is done.
+func (s *Store) ExportContext(ctx context.Context, w io.Writer) error {
+	return s.export(ctx, w, false)
+}
+
+// export writes a dump, masking the masked fields of its items when masked is set.
+func (s *Store) export(ctx context.Context, w io.Writer, masked bool) error {
+	collections := s.allCollections()
+	sort.Slice(collections, func(i, j int) bool { return collections[i].name < collections[j].name })
+
+	seq := s.LastSeq()
+	exported, err := json.Marshal(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	header := ""
+	if masked {
+		header = `"masked":true,`
+	}
+	if seq > 0 {
+		header += fmt.Sprintf(`"seq":%d,`, seq)
+	}
+	if _, err := fmt.Fprintf(w, `{"format":%d,"exported":%s,%s"models":[`, ExportFormat, exported, header); err != nil {
+		return err
+	}
+	for i, c := range collections {
+		name, err := json.Marshal(c.name)
+		if err != nil {
+			return err
+		}
+		separator := ""
+		if i > 0 {
+			separator = ","
+		}
+		if _, err := fmt.Fprintf(w, `%s{"name":%s,"nextId":%d,"items":[`, separator, name, atomic.LoadInt64(&c.nextID)); err != nil {
+			return err
+		}
+		first := true
+		c.scan(func(id int, e entry) bool {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+			if masked {
+				e.item = maskItem(e.item)
+			}
+			err = writeExportItem(w, c.name, id, e, first)
+			first = false
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "]}"); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+// writeExportItem writes an item of a dump, preceded by a comma unless it is the first of its model.
+func writeExportItem(w io.Writer, model string, id int, e entry, first bool) error {
+	sealed, err := sealFields(model, id, e.item)
+	if err != nil {
+		return fmt.Errorf("export: %s %d: %w", model, id, err)
+	}
+	data, err := marshalItem(sealed)
+	if err != nil {
+		return fmt.Errorf("export: %s %d: %w", model, id, err)
+	}
+	exported := ExportItem{ID: id, Created: e.created, Modified: e.modified, Item: data}
+	if !e.expires.IsZero() {
+		exported.Expires = &e.expires
+	}
+	if data, err = json.Marshal(exported); err != nil {
+		return fmt.Errorf("export: %s %d: %w", model, id, err)
+	}
+	if !first {
+		data = append([]byte(","), data...)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// importModel is a model of a dump decoded for its collection.
+type importModel struct {
+	c      *collection
+	nextID int64
+	items  map[int]entry
+}
+
+// Import restores a dump read from r in the given mode (ImportMerge or ImportReplace). The models
+// of the dump that are not registered are skipped. It returns an error of status 400 for a dump
+// that cannot be decoded and 409 for one taking the key or a unique field of another item, in
+// which case nothing is imported.
+func (s *Store) Import(r io.Reader, mode string) (ImportResult, error) {
+	return s.ImportContext(context.Background(), r, mode)
+}
+
+// ImportContext restores a dump like Import, unless ctx is done before it is applied. The values of
+// ctx reach the backends the items are written to.
+func (s *Store) ImportContext(ctx context.Context, r io.Reader, mode string) (ImportResult, error) {
+	result := ImportResult{Mode: mode, Models: make(map[string]int)}
+	if mode != ImportMerge && mode != ImportReplace {
+		return result, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown import mode %s", mode)}
+	}
+	var dump Export
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return result, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("invalid dump: %v", err)}
+	}
+	if dump.Format != ExportFormat {
+		return result, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unsupported dump format %d", dump.Format)}
+	}
+	if dump.Masked {
+		return result, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("the dump is masked and cannot be imported")}
+	}
+	result.Seq = dump.Seq
+
+	// Decode every item before anything is applied
+	var models []*importModel
+	for _, m := range dump.Models {
+		c, ok := s.collection(m.Name)
+		if !ok {
+			result.Skipped = append(result.Skipped, m.Name)
+			continue
+		}
+		if _, seen := result.Models[c.name]; seen {
+			return result, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("model %s appears twice in the dump", m.Name)}
+		}
+		result.Models[c.name] = len(m.Items)
+		imported := &importModel{c: c, nextID: m.NextID, items: make(map[int]entry, len(m.Items))}
+		for _, exported := range m.Items {
+			item := reflect.New(c.meta.typ).Interface()
+			if err := unmarshalItem(exported.Item, item); err != nil {
+				return result, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("invalid item %s %d: %v", m.Name, exported.ID, decodeError(c.meta, err))}
+			}
+			if err := openFields(c.name, exported.ID, item); err != nil {
+				return result, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: err}
+			}
+			if c.meta.id != nil {
+				c.meta.id.value(item).SetInt(int64(exported.ID))
+			}
+			e := entry{item: item, created: exported.Created, modified: exported.Modified}
+			if exported.Expires != nil {
+				e.expires = *exported.Expires
+			}
+			imported.items[exported.ID] = e
+		}
+		models = append(models, imported)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].c.name < models[j].c.name })
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	// Lock every shard of the imported models, in a fixed order so concurrent imports cannot deadlock
+	for _, m := range models {
+		if m.c.constrained() {
+			m.c.uniqueMux.Lock()
+		}
+	}
+	for _, m := range models {
+		for _, sh := range m.c.shards {
+			sh.itemMux.Lock()
+		}
+	}
+	unlock := func() {
+		for _, m := range models {
+			for _, sh := range m.c.shards {
+				sh.itemMux.Unlock()
+			}
+			if m.c.constrained() {
+				m.c.uniqueMux.Unlock()
+			}
+		}
+	}
+
+	for _, m := range models {
+		if err := m.checkUnique(mode); err != nil {
+			unlock()
+			return result, err
+		}
+	}
+	var events []ChangeEvent
+	for _, m := range models {
+		events = append(events, s.importLocked(ctx, m, mode)...)
+	}
+	unlock()
+
+	for _, event := range events {
+		s.notify(event)
+	}
+	for _, m := range models {
+		s.evictOverflow(m.c)
+	}
+	return result, nil
+}
+
+// checkUnique returns the error of two items of a model holding the same key or unique field once
+// the model is imported. It must be called while holding the shard locks of the model.
+func (m *importModel) checkUnique(mode string) error {
+	if !m.c.constrained() {
+		return nil
+	}
+	final := make(map[int]interface{}, len(m.items))
+	if mode == ImportMerge {
+		for _, sh := range m.c.shards {
+			sh.snapshot().ascend(func(id int, e entry) bool {
+				final[id] = e.item
+				return true
+			})
+		}
+	}
+	for id, e := range m.items {
+		final[id] = e.item
+	}
+	for _, idx := range m.c.keyIndexes() {
+		owners := make(map[string]int)
+		for id, item := range final {
+			if !idx.indexed(item) {
+				continue
+			}
+			key := idx.keyOf(item)
+			if _, taken := owners[key]; taken {
+				if idx == m.c.keys {
+					return &Error{Status: http.StatusConflict, Code: CodeConflict, Err: errKeyConflict}
+				}
+				return uniqueConflict(idx.fields[0], item)
+			}
+			owners[key] = id
+		}
+	}
+	return nil
+}
+
+// importLocked applies the items of an imported model and returns the change events to notify. It
+// must be called while holding the shard locks of the model.
+func (s *Store) importLocked(ctx context.Context, m *importModel, mode string) []ChangeEvent {
+	c := m.c
+	var events []ChangeEvent
+	next := m.nextID
+	edited := make([]*entryTree, len(c.shards))
+	for i, sh := range c.shards {
+		edited[i] = sh.edit()
+	}
+	if mode == ImportReplace {
+		for i, items := range edited {
+			c.shards[i].snapshot().ascend(func(id int, e entry) bool {
+				if _, imported := m.items[id]; !imported {
+					items.remove(id)
+					c.reindex(id, e.item, nil)
+					if limit := c.capacity(); limit != nil {
+						limit.remove(id)
+					}
+					s.persist(ctx, c.name, id, nil)
+					events = append(events, s.record(ChangeEvent{Op: OpDelete, Model: c.name, ID: id, Old: e.item, Origin: importOrigin}))
+				}
+				return true
+			})
+		}
+	}
+
+	ids := make([]int, 0, len(m.items))
+	for id := range m.items {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		e := m.items[id]
+		items := edited[c.shardIndex(id)]
+		event := ChangeEvent{Op: OpCreate, Model: c.name, ID: id, Item: e.item, Origin: importOrigin}
+		if old, exists := items.get(id); exists {
+			c.reindex(id, old.item, nil)
+			event.Op, event.Old = OpUpdate, old.item
+		}
+		items.set(id, e)
+		c.reindex(id, nil, e.item)
+		c.track(id)
+		s.persist(ctx, c.name, id, e.item)
+		events = append(events, s.record(event))
+		if int64(id) >= next {
+			next = int64(id) + 1
+		}
+	}
+	for i, sh := range c.shards {
+		sh.publish(edited[i])
+	}
+	if next > atomic.LoadInt64(&c.nextID) || mode == ImportReplace {
+		atomic.StoreInt64(&c.nextID, next)
+	}
+	return events
+}
+
+// handleExport serves GET /_export, streaming a dump of the store.
+func handleExport(store *Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.json"`)
+	if err := store.export(r.Context(), w, !store.isPrivileged(r)); err != nil {
+		// The status is already sent: cut the dump short so it cannot be imported
+		log.Printf("export: %v", err)
+	}
+}
+
+// handleImport serves POST /_import?mode=merge|replace, restoring a dump.
+func handleImport(store *Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = ImportMerge
+	}
+	result, err := store.ImportContext(r.Context(), r.Body, mode)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,103 @@
+// File: facets.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements faceted results, so UIs can render filter sidebars with counts.
+// A collection GET with ?facets=done,userId answers the page of the items matching the filters
+// along with, for each facet field, its most frequent values among all the matching items (not
+// only those of the page) with their counts, in the format of the value distributions of /_stats:
+// {"items": [...], "facets": {"done": {"values": [{"value": false, "count": 2}], ...}}}. Enveloped
+// responses keep the page as data and carry the facets in meta. ?facet_limit= bounds the values
+// listed per facet (10 by default).
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// FacetedPage is a page of items with the facets of all the items matching the request.
+type FacetedPage struct {
+	Items  interface{}                  `json:"items"`
+	Facets map[string]ValueDistribution `json:"facets"`
+}
+
+// Facets counts the values of fields across the items of a model matching every filter, listing
+// the top most frequent values of each.
+func (s *Store) Facets(model string, filters []Filter, fields []string, top int) (map[string]ValueDistribution, error) {
+	meta, ok := s.meta(model)
+	if !ok {
+		return nil, fmt.Errorf("model %q is not registered", model)
+	}
+	resolved, err := distributionFields(meta, fields)
+	if err != nil {
+		return nil, err
+	}
+	found, err := s.matching(model, filters)
+	if err != nil {
+		return nil, err
+	}
+	counts := newValueCounts(resolved)
+	for _, m := range found {
+		counts.add(m.item)
+	}
+	return counts.distributions(top), nil
+}
+
+// handleFacets answers a collection GET asking for facets: the page of the matching items,
+// expanded with their includes, and the facets of all of them.
+func handleFacets(store *Store, model string, meta *modelMeta, filters []Filter, page Page, includes []include, names []string, w http.ResponseWriter, r *http.Request) {
+	top := defaultStatsTop
+	if v := r.URL.Query().Get("facet_limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid facet_limit")
+			return
+		}
+		top = n
+	}
+	fields, err := distributionFields(meta, names)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if refuseMasked(w, r, meta, fields) {
+		return
+	}
+
+	found, err := store.matching(model, filters)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	counts := newValueCounts(fields)
+	for _, m := range found {
+		counts.add(m.item)
+	}
+	setTotalCount(w, r, len(found))
+	start, end := page.bounds(len(found))
+	var items interface{}
+	selected := make([]interface{}, 0, end-start)
+	for _, m := range found[start:end] {
+		selected = append(selected, m.item)
+	}
+	items = selected
+	if len(includes) > 0 {
+		expanded, err := store.expandFor(w, meta, selected, includes)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		items = expanded
+	}
+
+	facets := counts.distributions(top)
+	if setFacets(r, facets) {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+	writeJSON(w, http.StatusOK, FacetedPage{Items: items, Facets: facets})
+}
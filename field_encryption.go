@@ -0,0 +1,132 @@
+// File: field_encryption.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements field-level encryption. String fields tagged `encrypt:"true"`
+// (social security numbers, tokens) are sealed with AES-GCM wherever items leave memory: in the
+// storage backends, the mirror, the event log and the WAL, the retention archive, the dumps of
+// /_export, the change feed of /_cdc, the events published to Redis and MQTT, and the changes
+// replicated by gossip, partitioning and Raft, whichever backend is used. The store keeps them in plaintext, so they are decrypted transparently
+// for the API, and sealed values are opened again when items are loaded, replayed or imported. Each
+// value is bound to its model, ID and field, so sealed values cannot be moved between items.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+)
+
+// sealedFieldPrefix prefixes the sealed values of encrypted fields.
+const sealedFieldPrefix = "enc:"
+
+// fieldKeys is the keyring sealing the encrypted fields, nil until SetFieldKeys is called.
+var fieldKeys *Keyring
+
+// SetFieldKeys sets the keyring sealing the fields tagged `encrypt:"true"`. The first key seals
+// new values while the others still open the values they sealed. It must be called before the
+// store loads or writes any item.
+func SetFieldKeys(keys *Keyring) {
+	fieldKeys = keys
+}
+
+// encryptedFields returns the fields of a model tagged `encrypt:"true"`. Encrypted fields must be
+// strings; other tagged fields are logged and ignored.
+func encryptedFields(m *modelMeta) []*fieldMeta {
+	var fields []*fieldMeta
+	for _, f := range m.fields {
+		if f.tag.Get("encrypt") != "true" {
+			continue
+		}
+		if f.typ.Kind() != reflect.String || f.jsonName == "-" {
+			log.Printf("encrypt: ignoring encrypted field %s.%s, which must be a string", m.typ.Name(), f.name)
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// fieldName returns the additional data binding a sealed value to its model, ID and field.
+func fieldName(model string, id int, f *fieldMeta) []byte {
+	return append(recordName(model, id), "/"+f.name...)
+}
+
+// sealFields returns a copy of an item whose encrypted fields are sealed, or the item itself when
+// it has none or no keys are set.
+func sealFields(model string, id int, item interface{}) (interface{}, error) {
+	if fieldKeys == nil || item == nil {
+		return item, nil
+	}
+	meta := metaFor(reflect.Indirect(reflect.ValueOf(item)).Type())
+	if len(meta.encrypted) == 0 {
+		return item, nil
+	}
+	sealed := copyItem(meta, item)
+	for _, f := range meta.encrypted {
+		v := f.value(sealed)
+		if v.String() == "" {
+			continue
+		}
+		data, err := fieldKeys.seal([]byte(v.String()), fieldName(model, id, f))
+		if err != nil {
+			return nil, err
+		}
+		v.SetString(sealedFieldPrefix + base64.StdEncoding.EncodeToString(data))
+	}
+	return sealed, nil
+}
+
+// marshalSealed encodes an item as JSON with its encrypted fields sealed, for the payloads sent to
+// other nodes.
+func marshalSealed(model string, id int, item interface{}) ([]byte, error) {
+	sealed, err := sealFields(model, id, item)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed)
+}
+
+// sealEvent returns a copy of a change event whose item and previous item have their encrypted
+// fields sealed, for the events published to other systems.
+func sealEvent(event ChangeEvent) (ChangeEvent, error) {
+	var err error
+	if event.Item, err = sealFields(event.Model, event.ID, event.Item); err != nil {
+		return event, err
+	}
+	event.Old, err = sealFields(event.Model, event.ID, event.Old)
+	return event, err
+}
+
+// openFields opens the sealed encrypted fields of a decoded item in place. Values that are not
+// sealed are left as they are.
+func openFields(model string, id int, item interface{}) error {
+	meta := metaFor(reflect.Indirect(reflect.ValueOf(item)).Type())
+	for _, f := range meta.encrypted {
+		v := f.value(item)
+		encoded := strings.TrimPrefix(v.String(), sealedFieldPrefix)
+		if encoded == v.String() {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue // a plaintext value that happens to carry the prefix
+		}
+		if fieldKeys == nil {
+			return fmt.Errorf("encrypt: %s %d: %s is sealed but no field keys are set", model, id, f.jsonName)
+		}
+		plain, keyID, err := fieldKeys.open(data, fieldName(model, id, f))
+		if err != nil {
+			return err
+		}
+		if keyID != "" {
+			v.SetString(string(plain))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// File: find_or_create.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements find-or-create, for callers ensuring that a record keyed by
+// natural attributes (a user by email, a tag by name) exists without creating it twice.
+// Store.FindOrCreate returns the first item whose match fields equal those of the given item, or
+// creates the item when there is none; calls on the same model are serialized, so concurrent
+// callers agree on one item. POST /{model}/_find_or_create?match=name,email does the same over
+// HTTP, answering 201 Created with the created item or 200 OK with the existing one.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// FindOrCreate returns the first item of a model (by ID) whose fields named by match (Go or JSON
+// names) equal those of item, or creates item when no item matches. It reports whether the item
+// was created.
+func (s *Store) FindOrCreate(model string, match []string, item interface{}) (interface{}, bool, error) {
+	return s.findOrCreate(context.Background(), model, match, item, nil)
+}
+
+// findOrCreate finds or creates an item like FindOrCreate, calling check (when not nil) before
+// creating it under ctx.
+func (s *Store) findOrCreate(ctx context.Context, model string, match []string, item interface{}, check func() error) (interface{}, bool, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return nil, false, &Error{Status: http.StatusNotFound, Code: CodeNotFound, Message: "Unknown model"}
+	}
+	filters := make([]Filter, 0, len(match))
+	for _, name := range match {
+		f, ok := c.meta.field(name)
+		if !ok {
+			return nil, false, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", name)}
+		}
+		filters = append(filters, Filter{Field: f.name, Op: FilterEq, Value: f.value(item).Interface()})
+	}
+	if len(filters) == 0 {
+		return nil, false, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "No fields to match"}
+	}
+
+	c.findMux.Lock()
+	defer c.findMux.Unlock()
+	found, err := s.matching(model, filters)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(found) > 0 {
+		existing := reflect.New(c.meta.typ)
+		assignItem(existing.Elem(), found[0].item)
+		return existing.Interface(), false, nil
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return nil, false, err
+		}
+	}
+	created, err := s.createChecked(ctx, model, item, 0)
+	return created, err == nil, err
+}
+
+// handleFindOrCreate serves POST /{model}/_find_or_create?match={fields}, validating the item
+// like POST /{model} before creating it.
+func handleFindOrCreate(store *Store, model string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	meta, _ := store.meta(model)
+	item := reflect.New(meta.typ).Interface()
+	if err := decodeItem(r.Body, item); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, decodeError(meta, err))
+		return
+	}
+	var match []string
+	for _, name := range strings.Split(r.URL.Query().Get("match"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			match = append(match, name)
+		}
+	}
+
+	result, created, err := store.findOrCreate(r.Context(), model, match, item, func() error {
+		if err := validate(meta, item); err != nil {
+			return &Error{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Err: err}
+		}
+		if err := store.checkParents(model, item); err != nil {
+			return &Error{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Err: err}
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+		writeError(w, r, http.StatusBadRequest, err)
+	case created:
+		writeJSON(w, http.StatusCreated, result)
+	default:
+		writeJSON(w, http.StatusOK, result)
+	}
+}
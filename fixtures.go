@@ -0,0 +1,205 @@
+// File: fixtures.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file loads fixture files into the store on startup (-fixtures dir/), so dev
+// and test environments start with known data. Each file of the directory holds the items of the
+// model it is named after (item.json, user.yaml, orderline.yml) as a JSON or YAML list, and the
+// files of a subdirectory go to the tenant it is named after (acme/item.json). Loading upserts:
+// an item replaces the stored item with the same ID, key or lookup value and is created otherwise,
+// keeping its ID when it has one, so fixtures can be loaded again on every start. Models are
+// loaded parents first, and items are checked like POST and PUT requests.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fixtureFile is a fixture file and the (tenant-scoped) model its items belong to.
+type fixtureFile struct {
+	path  string
+	model string
+}
+
+// LoadFixtures upserts the items of the fixture files of a directory and returns how many were
+// written. Files of unregistered models are an error, as are files that are not JSON or YAML.
+func (s *Store) LoadFixtures(dir string) (int, error) {
+	files, err := s.fixtureFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+	loaded := 0
+	for _, file := range files {
+		n, err := s.loadFixtureFile(file)
+		loaded += n
+		if err != nil {
+			return loaded, err
+		}
+	}
+	return loaded, nil
+}
+
+// fixtureFiles lists the fixture files of a directory and of its tenant subdirectories, ordered so
+// the files of parent models come before those of their children.
+func (s *Store) fixtureFiles(dir string) ([]fixtureFile, error) {
+	var files []fixtureFile
+	var walk func(dir, tenant string) error
+	walk = func(dir, tenant string) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("fixtures: %w", err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				if tenant != "" || !validTenant(entry.Name()) {
+					return fmt.Errorf("fixtures: %s is not a tenant directory", path)
+				}
+				if err := walk(path, entry.Name()); err != nil {
+					return err
+				}
+				continue
+			}
+			ext := filepath.Ext(entry.Name())
+			if ext != ".json" && ext != ".yaml" && ext != ".yml" {
+				continue
+			}
+			model := strings.TrimSuffix(entry.Name(), ext)
+			if _, ok := s.meta(model); !ok {
+				return fmt.Errorf("fixtures: %s: model %q is not registered", path, model)
+			}
+			files = append(files, fixtureFile{path: path, model: tenantModel(tenant, model)})
+		}
+		return nil
+	}
+	if err := walk(dir, ""); err != nil {
+		return nil, err
+	}
+
+	// Order the models by their depth in the relation graph, so parents exist when their
+	// children are checked
+	depths := make(map[string]int)
+	var depth func(model string, seen map[string]bool) int
+	depth = func(model string, seen map[string]bool) int {
+		if d, ok := depths[model]; ok {
+			return d
+		}
+		if seen[model] {
+			return 0 // cycles are loaded in name order
+		}
+		seen[model] = true
+		d := 0
+		for _, relation := range s.parents(model) {
+			if relation.Parent != model {
+				if parent := depth(relation.Parent, seen) + 1; parent > d {
+					d = parent
+				}
+			}
+		}
+		depths[model] = d
+		return d
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		_, a, _ := splitTenantModel(files[i].model)
+		_, b, _ := splitTenantModel(files[j].model)
+		if da, db := depth(a, map[string]bool{}), depth(b, map[string]bool{}); da != db {
+			return da < db
+		}
+		return files[i].path < files[j].path
+	})
+	return files, nil
+}
+
+// loadFixtureFile upserts the items of one fixture file.
+func (s *Store) loadFixtureFile(file fixtureFile) (int, error) {
+	data, err := os.ReadFile(file.path)
+	if err != nil {
+		return 0, fmt.Errorf("fixtures: %w", err)
+	}
+	if ext := filepath.Ext(file.path); ext == ".yaml" || ext == ".yml" {
+		value, err := parseYAML(data)
+		if err != nil {
+			return 0, fmt.Errorf("fixtures: %s: %w", file.path, err)
+		}
+		if value == nil {
+			return 0, nil
+		}
+		if data, err = json.Marshal(value); err != nil {
+			return 0, fmt.Errorf("fixtures: %s: %w", file.path, err)
+		}
+	}
+
+	c, ok := s.collection(file.model)
+	if !ok {
+		return 0, fmt.Errorf("fixtures: %s: model %q is not registered", file.path, file.model)
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return 0, fmt.Errorf("fixtures: %s: expected a list of items: %w", file.path, err)
+	}
+	for i, message := range raw {
+		item := reflect.New(c.meta.typ).Interface()
+		if err := unmarshalItem(message, item); err != nil {
+			return i, fmt.Errorf("fixtures: %s: item %d: %w", file.path, i+1, err)
+		}
+		if err := s.upsertFixture(c, item); err != nil {
+			return i, fmt.Errorf("fixtures: %s: item %d: %w", file.path, i+1, err)
+		}
+	}
+	return len(raw), nil
+}
+
+// upsertFixture replaces the stored item an item of a fixture names by ID, key or lookup value,
+// or creates it.
+func (s *Store) upsertFixture(c *collection, item interface{}) error {
+	id := 0
+	if c.meta.id != nil {
+		id = int(c.meta.id.value(item).Int())
+	}
+	if id == 0 && c.keys != nil && c.keys.indexed(item) {
+		if owner, ok := c.keys.lookup(c.keys.keyOf(item)); ok && s.exists(c.name, owner) {
+			id = owner
+		}
+	}
+	for _, f := range c.meta.lookups {
+		idx := c.lookups[f.jsonName]
+		if id != 0 || !idx.indexed(item) {
+			continue
+		}
+		if owner, ok := idx.lookup(idx.keyOf(item)); ok && s.exists(c.name, owner) {
+			id = owner
+		}
+	}
+
+	if err := validate(c.meta, item); err != nil {
+		return err
+	}
+	if err := s.checkParents(c.name, item); err != nil {
+		return err
+	}
+	if err := s.checkKey(c.name, id, item); err != nil {
+		return err
+	}
+	if id == 0 {
+		s.Create(c.name, item)
+		return nil
+	}
+	if c.meta.id != nil {
+		c.meta.id.value(item).SetInt(int64(id))
+	}
+	if s.Update(c.name, id, item) {
+		return nil
+	}
+	// Create the item under the ID of the fixture, keeping the ID counter ahead of it
+	s.notify(s.apply(ChangeEvent{Op: OpCreate, Model: c.name, ID: id, Item: item, Time: time.Now()}))
+	return nil
+}
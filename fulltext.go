@@ -0,0 +1,189 @@
+// File: fulltext.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements full-text indexes, for searches beyond the substring matching
+// of ?q= (see search.go): analyzers, stemming, phrase queries and relevance ranking. A model given a
+// TextIndex with Store.SetFullText has its string fields indexed on every mutation (masked and
+// encrypted fields excepted, so searches never reveal them), and GET /{model}/_search?q=... answers
+// the items matching the query and the usual filters, most relevant first, each with its score in
+// "_score". BleveIndex (see fulltext_bleve.go) keeps the documents in a Bleve index, and the
+// built-in InvertedIndex (see fulltext_index.go) follows the same query syntax without Bleve.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// TextHit is a document matched by a full-text query and its relevance.
+type TextHit struct {
+	ID    int
+	Score float64
+}
+
+// TextIndex is a full-text index of the items of a model. Documents are the string fields of the
+// items by JSON name.
+type TextIndex interface {
+	// Index adds the document of an item, replacing its previous document.
+	Index(id int, fields map[string]string) error
+	// Delete removes the document of an item.
+	Delete(id int) error
+	// Search returns the documents matching a query string, most relevant first.
+	Search(query string) ([]TextHit, error)
+}
+
+// SetFullText indexes the items of a model in a full-text index, from the items already stored
+// on, or stops indexing them when index is nil.
+func (s *Store) SetFullText(model string, index TextIndex) error {
+	c, ok := s.collection(model)
+	if !ok {
+		return fmt.Errorf("model %q is not registered", model)
+	}
+	// Hold every shard lock while building so no mutation is missed
+	for _, sh := range c.shards {
+		sh.itemMux.Lock()
+	}
+	defer func() {
+		for _, sh := range c.shards {
+			sh.itemMux.Unlock()
+		}
+	}()
+	if index != nil {
+		var err error
+		for _, sh := range c.shards {
+			sh.snapshot().ascend(func(id int, e entry) bool {
+				err = index.Index(id, textDocument(c.meta, e.item))
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	c.indexMux.Lock()
+	defer c.indexMux.Unlock()
+	c.text = index
+	return nil
+}
+
+// textDocument returns the document of an item: its string fields by JSON name, except the
+// masked and encrypted ones.
+func textDocument(meta *modelMeta, item interface{}) map[string]string {
+	doc := make(map[string]string)
+	for _, f := range meta.fields {
+		if f.typ.Kind() != reflect.String || f.jsonName == "-" || containsField(meta.masked, f) || containsField(meta.encrypted, f) {
+			continue
+		}
+		if v := f.value(item).String(); v != "" {
+			doc[f.jsonName] = v
+		}
+	}
+	return doc
+}
+
+// reindexText moves an item from its old document to its new one. It must be called while
+// holding the shard lock and the index lock.
+func (c *collection) reindexText(id int, oldItem, newItem interface{}) {
+	if c.text == nil {
+		return
+	}
+	var err error
+	switch {
+	case newItem != nil:
+		err = c.text.Index(id, textDocument(c.meta, newItem))
+	case oldItem != nil:
+		err = c.text.Delete(id)
+	}
+	if err != nil {
+		log.Printf("fulltext: cannot index %s %d: %v", c.name, id, err)
+	}
+}
+
+// FullTextSearch finds the items of a model matching a full-text query and every filter, most
+// relevant first.
+func (s *Store) FullTextSearch(model, query string, filters []Filter) ([]SearchResult, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return nil, fmt.Errorf("model %q is not registered", model)
+	}
+	c.indexMux.RLock()
+	index := c.text
+	c.indexMux.RUnlock()
+	if index == nil {
+		return nil, &Error{Status: http.StatusNotFound, Code: CodeNotFound, Err: localizef("%s has no full-text index", model)}
+	}
+	if strings.TrimSpace(query) == "" {
+		return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("the search has no words")}
+	}
+	hits, err := index.Search(query)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.ID
+	}
+	found, err := s.matchingAmong(model, filters, ids)
+	if err != nil {
+		return nil, err
+	}
+	items := make(map[int]interface{}, len(found))
+	for _, m := range found {
+		items[m.id] = m.item
+	}
+	results := make([]SearchResult, 0, len(found))
+	for _, hit := range hits {
+		if item, ok := items[hit.ID]; ok {
+			results = append(results, SearchResult{ID: hit.ID, Item: item, Score: hit.Score})
+		}
+	}
+	return results, nil
+}
+
+// handleFullTextSearch serves GET /{model}/_search?q=...&offset=...&limit=..., answering the page
+// of the items matching the query and the filters, each with its score.
+func handleFullTextSearch(store *Store, model string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	meta, _ := store.meta(model)
+	values := r.URL.Query()
+	filters, err := parseFilters(meta, values)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	page, err := parsePage(values)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	results, err := store.FullTextSearch(model, values.Get("q"), filters)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	setTotalCount(w, r, len(results))
+	start, end := page.bounds(len(results))
+	selected := make([]interface{}, 0, end-start)
+	for _, result := range results[start:end] {
+		selected = append(selected, result.Item)
+	}
+	expanded, err := store.expandFor(w, meta, selected, nil)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range expanded {
+		expanded[i] = withMetric(expanded[i], "_score", results[start+i].Score)
+	}
+	writeJSON(w, http.StatusOK, expanded)
+}
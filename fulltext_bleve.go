@@ -0,0 +1,72 @@
+// File: fulltext_bleve.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements BleveIndex, the TextIndex (see fulltext.go) kept in a Bleve
+// index. Fields are analyzed with the English analyzer of Bleve (lowercase, stop words removed,
+// Porter stems) and queries use the Bleve query string syntax: terms, +required and -excluded
+// terms, "quoted phrases", field:term, fuzzy term~1, prefix* and boost^2, ranked by TF-IDF.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/lang/en"
+)
+
+// BleveIndex is a full-text index kept in memory by Bleve.
+type BleveIndex struct {
+	index bleve.Index
+}
+
+// NewBleveIndex creates an empty in-memory Bleve index analyzing text in English.
+func NewBleveIndex() (*BleveIndex, error) {
+	mapping := bleve.NewIndexMapping()
+	mapping.DefaultAnalyzer = en.AnalyzerName
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		return nil, err
+	}
+	return &BleveIndex{index: index}, nil
+}
+
+// Index adds the document of an item, replacing its previous document.
+func (x *BleveIndex) Index(id int, fields map[string]string) error {
+	doc := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		doc[name] = value
+	}
+	return x.index.Index(strconv.Itoa(id), doc)
+}
+
+// Delete removes the document of an item.
+func (x *BleveIndex) Delete(id int) error {
+	return x.index.Delete(strconv.Itoa(id))
+}
+
+// Search finds every document matching a query string, most relevant first.
+func (x *BleveIndex) Search(query string) ([]TextHit, error) {
+	count, err := x.index.DocCount()
+	if err != nil || count == 0 {
+		return nil, err
+	}
+	request := bleve.NewSearchRequestOptions(bleve.NewQueryStringQuery(query), int(count), 0, false)
+	result, err := x.index.Search(request)
+	if err != nil {
+		return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("invalid search: %v", err)}
+	}
+	hits := make([]TextHit, 0, len(result.Hits))
+	for _, hit := range result.Hits {
+		id, err := strconv.Atoi(hit.ID)
+		if err != nil {
+			return nil, fmt.Errorf("fulltext: invalid document ID %q", hit.ID)
+		}
+		hits = append(hits, TextHit{ID: id, Score: hit.Score})
+	}
+	return hits, nil
+}
@@ -0,0 +1,565 @@
+// File: fulltext_index.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements InvertedIndex, the built-in TextIndex (see fulltext.go). Text is
+// analyzed into lowercase words, English stop words are dropped and the others reduced to their
+// stem with the Porter algorithm, so "running" matches "runs". The index keeps the positions of
+// every term, for phrase queries, and ranks documents with BM25. Queries use the query string
+// syntax of Bleve: terms (at least one must match), +required and -excluded terms, "quoted
+// phrases" and field:term or field:"phrase" restricted to a field.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BM25 parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// fieldGap separates the positions of the fields of a document, so phrases never span two fields.
+const fieldGap = 100
+
+// stopWords are the English words too common to be indexed.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "for": true, "if": true, "in": true, "into": true, "is": true, "it": true, "no": true,
+	"not": true, "of": true, "on": true, "or": true, "such": true, "that": true, "the": true,
+	"their": true, "then": true, "there": true, "these": true, "they": true, "this": true, "to": true,
+	"was": true, "will": true, "with": true,
+}
+
+// token is an analyzed term and its position in the text.
+type token struct {
+	term     string
+	position int
+}
+
+// analyze splits a text into the stems of its words with their positions, stop words counting as
+// positions so phrases keep their shape.
+func analyze(text string) []token {
+	var tokens []token
+	for i, word := range searchWords(text) {
+		if !stopWords[word] {
+			tokens = append(tokens, token{stem(word), i})
+		}
+	}
+	return tokens
+}
+
+// fieldSpan is the range of positions of a field in a document.
+type fieldSpan struct {
+	field      string
+	start, end int
+}
+
+// textDoc is what the index knows of a document.
+type textDoc struct {
+	terms  []string // distinct terms, to remove the document
+	length int
+	spans  []fieldSpan
+}
+
+// InvertedIndex is the built-in full-text index: the positions of each term in each document.
+type InvertedIndex struct {
+	mux      sync.RWMutex
+	postings map[string]map[int][]int // positions by document by term
+	docs     map[int]*textDoc
+	length   int // total length of the documents
+}
+
+// NewInvertedIndex creates an empty full-text index.
+func NewInvertedIndex() *InvertedIndex {
+	return &InvertedIndex{postings: make(map[string]map[int][]int), docs: make(map[int]*textDoc)}
+}
+
+// Index adds a document, replacing any document of the same ID.
+func (x *InvertedIndex) Index(id int, fields map[string]string) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	doc := &textDoc{}
+	positions := make(map[string][]int)
+	offset := 0
+	for _, name := range names {
+		tokens := analyze(fields[name])
+		span := fieldSpan{field: name, start: offset, end: offset}
+		for _, t := range tokens {
+			positions[t.term] = append(positions[t.term], offset+t.position)
+			span.end = offset + t.position + 1
+		}
+		doc.length += len(tokens)
+		doc.spans = append(doc.spans, span)
+		offset = span.end + fieldGap
+	}
+
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	x.remove(id)
+	for term, list := range positions {
+		docs, ok := x.postings[term]
+		if !ok {
+			docs = make(map[int][]int)
+			x.postings[term] = docs
+		}
+		docs[id] = list
+		doc.terms = append(doc.terms, term)
+	}
+	x.docs[id] = doc
+	x.length += doc.length
+	return nil
+}
+
+// Delete removes a document.
+func (x *InvertedIndex) Delete(id int) error {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	x.remove(id)
+	return nil
+}
+
+// remove removes a document while holding the lock.
+func (x *InvertedIndex) remove(id int) {
+	doc, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(x.postings[term], id)
+		if len(x.postings[term]) == 0 {
+			delete(x.postings, term)
+		}
+	}
+	x.length -= doc.length
+	delete(x.docs, id)
+}
+
+// textClause is a term or phrase of a query.
+type textClause struct {
+	required, excluded bool
+	field              string
+	tokens             []token // positions relative to the first word
+}
+
+// parseTextQuery parses a query string into its clauses.
+func parseTextQuery(query string) []textClause {
+	var clauses []textClause
+	for rest := strings.TrimSpace(query); rest != ""; rest = strings.TrimSpace(rest) {
+		var clause textClause
+		switch rest[0] {
+		case '+':
+			clause.required, rest = true, rest[1:]
+		case '-':
+			clause.excluded, rest = true, rest[1:]
+		}
+		if i := strings.IndexAny(rest, ":\" "); i > 0 && rest[i] == ':' {
+			clause.field, rest = rest[:i], rest[i+1:]
+		}
+		var text string
+		if strings.HasPrefix(rest, "\"") {
+			if end := strings.IndexByte(rest[1:], '"'); end >= 0 {
+				text, rest = rest[1:end+1], rest[end+2:]
+			} else {
+				text, rest = rest[1:], ""
+			}
+		} else if i := strings.IndexByte(rest, ' '); i >= 0 {
+			text, rest = rest[:i], rest[i:]
+		} else {
+			text, rest = rest, ""
+		}
+		if clause.tokens = analyze(text); len(clause.tokens) > 0 {
+			base := clause.tokens[0].position
+			for i := range clause.tokens {
+				clause.tokens[i].position -= base
+			}
+			clauses = append(clauses, clause)
+		}
+	}
+	return clauses
+}
+
+// Search finds the documents matching a query string, most relevant first (ties in ID order).
+func (x *InvertedIndex) Search(query string) ([]TextHit, error) {
+	clauses := parseTextQuery(query)
+	x.mux.RLock()
+	defer x.mux.RUnlock()
+
+	scores := make(map[int]float64)
+	matched := make(map[int]int) // number of required clauses matched
+	excluded := make(map[int]bool)
+	required, optional := 0, 0
+	for _, clause := range clauses {
+		hits := x.match(clause)
+		switch {
+		case clause.excluded:
+			for id := range hits {
+				excluded[id] = true
+			}
+			continue
+		case clause.required:
+			required++
+			for id := range hits {
+				matched[id]++
+			}
+		default:
+			optional++
+		}
+		for id, score := range hits {
+			scores[id] += score
+		}
+	}
+
+	hits := make([]TextHit, 0, len(scores))
+	for id, score := range scores {
+		if excluded[id] || matched[id] < required {
+			continue
+		}
+		hits = append(hits, TextHit{ID: id, Score: score})
+	}
+	if required == 0 && optional == 0 {
+		hits = hits[:0]
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	return hits, nil
+}
+
+// match scores the documents matching a clause while holding the lock.
+func (x *InvertedIndex) match(clause textClause) map[int]float64 {
+	hits := make(map[int]float64)
+	first := x.postings[clause.tokens[0].term]
+	for id, positions := range first {
+		doc := x.docs[id]
+		span := fieldSpan{start: 0, end: math.MaxInt}
+		if clause.field != "" {
+			found := false
+			for _, s := range doc.spans {
+				if s.field == clause.field {
+					span, found = s, true
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		// Count the occurrences of the phrase (or term) starting in the span
+		occurrences := 0
+		for _, p := range positions {
+			if p < span.start || p >= span.end {
+				continue
+			}
+			complete := true
+			for _, t := range clause.tokens[1:] {
+				if !containsInt(x.postings[t.term][id], p+t.position) {
+					complete = false
+					break
+				}
+			}
+			if complete {
+				occurrences++
+			}
+		}
+		if occurrences == 0 {
+			continue
+		}
+		score := 0.0
+		for _, t := range clause.tokens {
+			score += x.bm25(t.term, occurrences, doc.length)
+		}
+		hits[id] = score
+	}
+	return hits
+}
+
+// bm25 scores a term occurring tf times in a document of the given length.
+func (x *InvertedIndex) bm25(term string, tf, length int) float64 {
+	n, df := float64(len(x.docs)), float64(len(x.postings[term]))
+	idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+	avg := float64(x.length) / n
+	if avg == 0 {
+		avg = 1
+	}
+	return idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*(1-bm25B+bm25B*float64(length)/avg))
+}
+
+// containsInt reports whether a sorted list holds a value.
+func containsInt(list []int, v int) bool {
+	i := sort.SearchInts(list, v)
+	return i < len(list) && list[i] == v
+}
+
+// porter holds a word being stemmed: the stem ends at k, and j marks the end of the stem once a
+// suffix is matched.
+type porter struct {
+	b    []byte
+	k, j int
+}
+
+// stem reduces an English word to its stem with the Porter algorithm. Words of other alphabets,
+// and of one or two letters, are kept as they are.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+	p := &porter{b: []byte(word), k: len(word) - 1}
+	p.step1ab()
+	if p.k > 0 {
+		p.step1c()
+		p.step2()
+		p.step3()
+		p.step4()
+		p.step5()
+	}
+	return string(p.b[:p.k+1])
+}
+
+// cons reports whether the letter at i is a consonant.
+func (p *porter) cons(i int) bool {
+	switch p.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !p.cons(i-1)
+	}
+	return true
+}
+
+// m measures the number of consonant sequences in the stem.
+func (p *porter) m() int {
+	n, i := 0, 0
+	for ; i <= p.j && p.cons(i); i++ {
+	}
+	for i <= p.j {
+		for ; i <= p.j && !p.cons(i); i++ {
+		}
+		if i > p.j {
+			break
+		}
+		n++
+		for ; i <= p.j && p.cons(i); i++ {
+		}
+	}
+	return n
+}
+
+// vowelInStem reports whether the stem holds a vowel.
+func (p *porter) vowelInStem() bool {
+	for i := 0; i <= p.j; i++ {
+		if !p.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doublec reports whether the letters at j-1 and j are the same consonant.
+func (p *porter) doublec(j int) bool {
+	return j >= 1 && p.b[j] == p.b[j-1] && p.cons(j)
+}
+
+// cvc reports whether the letters at i-2, i-1 and i are consonant, vowel, consonant, the last not
+// w, x or y.
+func (p *porter) cvc(i int) bool {
+	if i < 2 || !p.cons(i) || p.cons(i-1) || !p.cons(i-2) {
+		return false
+	}
+	return p.b[i] != 'w' && p.b[i] != 'x' && p.b[i] != 'y'
+}
+
+// ends reports whether the word ends with s, setting j to the end of the stem before it.
+func (p *porter) ends(s string) bool {
+	if len(s) > p.k+1 || string(p.b[p.k-len(s)+1:p.k+1]) != s {
+		return false
+	}
+	p.j = p.k - len(s)
+	return true
+}
+
+// setTo replaces the letters after the stem with s.
+func (p *porter) setTo(s string) {
+	p.b = append(p.b[:p.j+1], s...)
+	p.k = p.j + len(s)
+}
+
+// replace replaces the suffix with s when the stem has a consonant sequence.
+func (p *porter) replace(s string) {
+	if p.m() > 0 {
+		p.setTo(s)
+	}
+}
+
+// step1ab removes plurals and -ed or -ing.
+func (p *porter) step1ab() {
+	if p.b[p.k] == 's' {
+		switch {
+		case p.ends("sses"):
+			p.k -= 2
+		case p.ends("ies"):
+			p.setTo("i")
+		case p.b[p.k-1] != 's':
+			p.k--
+		}
+	}
+	if p.ends("eed") {
+		if p.m() > 0 {
+			p.k--
+		}
+	} else if (p.ends("ed") || p.ends("ing")) && p.vowelInStem() {
+		p.k = p.j
+		switch {
+		case p.ends("at"):
+			p.setTo("ate")
+		case p.ends("bl"):
+			p.setTo("ble")
+		case p.ends("iz"):
+			p.setTo("ize")
+		case p.doublec(p.k):
+			if c := p.b[p.k]; c != 'l' && c != 's' && c != 'z' {
+				p.k--
+			}
+		default:
+			p.j = p.k
+			if p.m() == 1 && p.cvc(p.k) {
+				p.setTo("e")
+			}
+		}
+	}
+}
+
+// step1c turns a final y into i when there is another vowel in the stem.
+func (p *porter) step1c() {
+	if p.ends("y") && p.vowelInStem() {
+		p.b[p.k] = 'i'
+	}
+}
+
+// suffixRules replaces the first suffix of a list of (suffix, replacement) pairs the word ends
+// with, when the stem has a consonant sequence.
+func (p *porter) suffixRules(pairs ...string) {
+	for i := 0; i < len(pairs); i += 2 {
+		if p.ends(pairs[i]) {
+			p.replace(pairs[i+1])
+			return
+		}
+	}
+}
+
+// step2 maps double suffixes to single ones.
+func (p *porter) step2() {
+	switch p.b[p.k-1] {
+	case 'a':
+		p.suffixRules("ational", "ate", "tional", "tion")
+	case 'c':
+		p.suffixRules("enci", "ence", "anci", "ance")
+	case 'e':
+		p.suffixRules("izer", "ize")
+	case 'l':
+		p.suffixRules("bli", "ble", "alli", "al", "entli", "ent", "eli", "e", "ousli", "ous")
+	case 'o':
+		p.suffixRules("ization", "ize", "ation", "ate", "ator", "ate")
+	case 's':
+		p.suffixRules("alism", "al", "iveness", "ive", "fulness", "ful", "ousness", "ous")
+	case 't':
+		p.suffixRules("aliti", "al", "iviti", "ive", "biliti", "ble")
+	case 'g':
+		p.suffixRules("logi", "log")
+	}
+}
+
+// step3 handles -ic-, -full, -ness and the like.
+func (p *porter) step3() {
+	switch p.b[p.k] {
+	case 'e':
+		p.suffixRules("icate", "ic", "ative", "", "alize", "al")
+	case 'i':
+		p.suffixRules("iciti", "ic")
+	case 'l':
+		p.suffixRules("ical", "ic", "ful", "")
+	case 's':
+		p.suffixRules("ness", "")
+	}
+}
+
+// step4 removes -ant, -ence and the like when the stem has two consonant sequences.
+func (p *porter) step4() {
+	var suffixes []string
+	switch p.b[p.k-1] {
+	case 'a':
+		suffixes = []string{"al"}
+	case 'c':
+		suffixes = []string{"ance", "ence"}
+	case 'e':
+		suffixes = []string{"er"}
+	case 'i':
+		suffixes = []string{"ic"}
+	case 'l':
+		suffixes = []string{"able", "ible"}
+	case 'n':
+		suffixes = []string{"ant", "ement", "ment", "ent"}
+	case 'o':
+		if p.ends("ion") && p.j >= 0 && (p.b[p.j] == 's' || p.b[p.j] == 't') {
+			break
+		}
+		suffixes = []string{"ou"}
+	case 's':
+		suffixes = []string{"ism"}
+	case 't':
+		suffixes = []string{"ate", "iti"}
+	case 'u':
+		suffixes = []string{"ous"}
+	case 'v':
+		suffixes = []string{"ive"}
+	case 'z':
+		suffixes = []string{"ize"}
+	default:
+		return
+	}
+	if suffixes != nil {
+		matched := false
+		for _, s := range suffixes {
+			if p.ends(s) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+	}
+	if p.m() > 1 {
+		p.k = p.j
+	}
+}
+
+// step5 removes a final -e and reduces a final -ll when the stem is long enough.
+func (p *porter) step5() {
+	p.j = p.k
+	if p.b[p.k] == 'e' {
+		if a := p.m(); a > 1 || a == 1 && !p.cvc(p.k-1) {
+			p.k--
+		}
+	}
+	if p.b[p.k] == 'l' && p.doublec(p.k) && p.m() > 1 {
+		p.k--
+	}
+}
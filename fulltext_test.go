@@ -0,0 +1,209 @@
+// File: fulltext_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests full-text search with both TextIndex engines, and the stemming,
+// query parsing and BM25 scoring of the built-in InvertedIndex.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// textEngines creates an empty index of each engine, by name.
+func textEngines(t *testing.T) map[string]TextIndex {
+	bleveIndex, err := NewBleveIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]TextIndex{"bleve": bleveIndex, "builtin": NewInvertedIndex()}
+}
+
+// searchIDs returns the IDs of the items matching a full-text query, most relevant first.
+func searchIDs(t *testing.T, store *Store, query string) []int {
+	results, err := store.FullTextSearch("item", query, nil)
+	if err != nil {
+		t.Fatalf("search %q: %v", query, err)
+	}
+	ids := []int{}
+	for _, result := range results {
+		ids = append(ids, result.ID)
+	}
+	return ids
+}
+
+func TestFullTextSearch(t *testing.T) {
+	for name, index := range textEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			store := newTestStore()
+			store.Create("item", &Item{Title: "The runner crashed during the tests"})     // 1
+			store.Create("item", &Item{Title: "Running tests in parallel"})               // 2
+			store.Create("item", &Item{Title: "Parallel universes", Slug: "tests-tests"}) // 3
+			if err := store.SetFullText("item", index); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				query string
+				want  []int
+			}{
+				{"runs", []int{2}},                 // stemmed
+				{`"runner crashed"`, []int{1}},     // phrase
+				{`"crashed runner"`, []int{}},      // phrase order
+				{"+parallel -universes", []int{2}}, // required and excluded
+				{"title:universes", []int{3}},      // field
+				{"slug:parallel", []int{}},         // other field
+				{"the", []int{}},                   // stop word
+				{"parallel +runner", []int{1}},     // required among optional
+				{"unknown", []int{}},               // no match
+			}
+			for _, test := range tests {
+				// The engines may order equally relevant hits differently, see the ranking test
+				if got := searchIDs(t, store, test.query); !sameInts(got, test.want) {
+					t.Errorf("search %q: %v, want %v", test.query, got, test.want)
+				}
+			}
+
+			// The index follows the mutations of the store
+			store.Update("item", 1, &Item{Title: "Walking"})
+			store.Delete("item", 2)
+			store.Create("item", &Item{Title: "Runs of luck"})
+			if got := searchIDs(t, store, "running"); !reflect.DeepEqual(got, []int{4}) {
+				t.Errorf("search after mutations: %v, want [4]", got)
+			}
+		})
+	}
+}
+
+func TestFullTextSearchRanksByRelevance(t *testing.T) {
+	for name, index := range textEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			store := newTestStore()
+			store.Create("item", &Item{Title: "A long story of a search engine, its indexes, its queries and its many users"})
+			store.Create("item", &Item{Title: "Search search search"})
+			store.Create("item", &Item{Title: "Something else entirely"})
+			store.SetFullText("item", index)
+
+			results, err := store.FullTextSearch("item", "search", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 2 || results[0].ID != 2 || results[1].ID != 1 {
+				t.Fatalf("ranking: %+v, want item 2 then item 1", results)
+			}
+			if results[0].Score <= results[1].Score || results[1].Score <= 0 {
+				t.Fatalf("scores: %v then %v", results[0].Score, results[1].Score)
+			}
+		})
+	}
+}
+
+func TestFullTextSearchHandler(t *testing.T) {
+	store := newTestStore()
+	store.Create("item", &Item{Title: "Running tests", Done: true})
+	store.Create("item", &Item{Title: "Running late"})
+	handler := func(w http.ResponseWriter, r *http.Request) { handleFullTextSearch(store, "item", w, r) }
+
+	if w := serveTest(handler, http.MethodGet, "/item/_search?q=running", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("search without an index: status %d, want 404", w.Code)
+	}
+	store.SetFullText("item", NewInvertedIndex())
+	w := serveTest(handler, http.MethodGet, "/item/_search?q=runs&done=true", "")
+	var items []Item
+	if err := json.Unmarshal(w.Body.Bytes(), &items); w.Code != http.StatusOK || err != nil || len(items) != 1 || items[0].ID != 1 {
+		t.Fatalf("filtered search: status %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(handler, http.MethodGet, "/item/_search?q=", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("empty search: status %d, want 400", w.Code)
+	}
+}
+
+func TestTextDocumentLeavesProtectedFieldsOut(t *testing.T) {
+	meta, _ := newTestStore().meta("user")
+	doc := textDocument(meta, &User{Name: "Ada", Email: "ada@example.com", Token: "secret"})
+	if !reflect.DeepEqual(doc, map[string]string{"name": "Ada"}) {
+		t.Fatalf("document %v, want only the name", doc)
+	}
+}
+
+func TestStem(t *testing.T) {
+	tests := map[string]string{
+		"caresses": "caress", "ponies": "poni", "cats": "cat", "running": "run", "runs": "run",
+		"agreed": "agre", "happy": "happi", "relational": "relat", "conditional": "condit",
+		"hopeful": "hope", "generalization": "gener", "adjustable": "adjust", "r": "r",
+	}
+	for word, want := range tests {
+		if got := stem(word); got != want {
+			t.Errorf("stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestParseTextQuery(t *testing.T) {
+	clauses := parseTextQuery(`+Running -"the crashed runner" title:tests slug:"fast cars" the`)
+	want := []textClause{
+		{required: true, tokens: []token{{"run", 0}}},
+		{excluded: true, tokens: []token{{"crash", 0}, {"runner", 1}}},
+		{field: "title", tokens: []token{{"test", 0}}},
+		{field: "slug", tokens: []token{{"fast", 0}, {"car", 1}}},
+	}
+	if !reflect.DeepEqual(clauses, want) {
+		t.Fatalf("clauses:\n%+v\nwant:\n%+v", clauses, want)
+	}
+	if clauses := parseTextQuery(`"unterminated phrase`); len(clauses) != 1 || len(clauses[0].tokens) != 2 {
+		t.Fatalf("unterminated phrase: %+v", clauses)
+	}
+}
+
+func TestInvertedIndexBM25(t *testing.T) {
+	x := NewInvertedIndex()
+	x.Index(1, map[string]string{"title": "common rare"})
+	x.Index(2, map[string]string{"title": "common"})
+	x.Index(3, map[string]string{"title": "common words only"})
+
+	hits, _ := x.Search("common rare")
+	if len(hits) != 3 || hits[0].ID != 1 {
+		t.Fatalf("hits %+v, want item 1 first", hits)
+	}
+	// A rarer term weighs more, and a shorter document ranks first among equal matches
+	rare, common := x.bm25("rare", 1, 2), x.bm25("common", 1, 2)
+	if rare <= common {
+		t.Errorf("rare term scored %v, common term %v", rare, common)
+	}
+	if hits[1].ID != 2 || hits[2].ID != 3 || hits[1].Score <= hits[2].Score {
+		t.Errorf("hits %+v, want item 2 before the longer item 3", hits)
+	}
+
+	x.Delete(1)
+	if hits, _ := x.Search("rare"); len(hits) != 0 {
+		t.Errorf("deleted document still matches: %+v", hits)
+	}
+	if x.length != 4 || len(x.postings["rare"]) != 0 {
+		t.Errorf("deleted document left length %d and postings %v", x.length, x.postings["rare"])
+	}
+}
+
+// sameInts reports whether two lists hold the same values, in any order.
+func sameInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[int]int)
+	for _, v := range a {
+		counts[v]++
+	}
+	for _, v := range b {
+		counts[v]--
+	}
+	for _, n := range counts {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,277 @@
+// File: geo.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements geospatial fields and radius queries, for location-based apps.
+// A model is located by a field of type Location, or by two float fields named Lat and Lng (or
+// tagged `geo:"lat"` and `geo:"lng"`), in degrees. The items of located models are kept in a
+// spatial index, a grid of cells of a tenth of a degree, so a collection GET with
+// ?near=51.5,-0.1&radius_km=5 only reads the items of the cells around the point. It answers the
+// items matching the usual filters within the radius (every one without ?radius_km=), nearest
+// first, each holding its great-circle distance in "_distance_km".
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Spatial index constants.
+const (
+	earthRadiusKm  = 6371.0088
+	kmPerDegree    = earthRadiusKm * math.Pi / 180
+	geoCellDegrees = 0.1
+	geoLngCells    = 3600 // 360 / geoCellDegrees
+)
+
+// Location is a point on Earth, in degrees.
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// geoFields returns the latitude and longitude fields of a model, if it is located.
+func geoFields(m *modelMeta) (lat, lng *fieldMeta) {
+	locationType := reflect.TypeOf(Location{})
+	for _, f := range m.fields {
+		if f.typ == locationType {
+			at := func(i int, name string) *fieldMeta {
+				index := append(append([]int(nil), f.index...), i)
+				return &fieldMeta{name: f.name + "." + name, jsonName: f.jsonName, index: index, typ: reflect.TypeOf(float64(0))}
+			}
+			return at(0, "Lat"), at(1, "Lng")
+		}
+	}
+	for _, f := range m.fields {
+		if kind := f.typ.Kind(); kind != reflect.Float64 && kind != reflect.Float32 {
+			continue
+		}
+		switch {
+		case f.tag.Get("geo") == "lat", lat == nil && f.name == "Lat":
+			lat = f
+		case f.tag.Get("geo") == "lng", lng == nil && f.name == "Lng":
+			lng = f
+		}
+	}
+	if lat == nil || lng == nil {
+		return nil, nil
+	}
+	return lat, lng
+}
+
+// geoCell is a cell of the spatial grid, numbered from the equator and the prime meridian.
+type geoCell struct {
+	lat, lng int
+}
+
+// cellOf returns the cell holding a point.
+func cellOf(lat, lng float64) geoCell {
+	return geoCell{int(math.Floor(lat / geoCellDegrees)), wrapLngCell(int(math.Floor(lng / geoCellDegrees)))}
+}
+
+// wrapLngCell brings a longitude cell number across the antimeridian back into range.
+func wrapLngCell(n int) int {
+	return ((n+geoLngCells/2)%geoLngCells+geoLngCells)%geoLngCells - geoLngCells/2
+}
+
+// geoIndex is the spatial index of a located model: the IDs of its items by grid cell.
+type geoIndex struct {
+	lat, lng *fieldMeta
+	cells    map[geoCell]map[int]struct{}
+	mux      sync.RWMutex
+}
+
+// newGeoIndex creates the spatial index of a model, or returns nil when it is not located.
+func newGeoIndex(meta *modelMeta) *geoIndex {
+	lat, lng := geoFields(meta)
+	if lat == nil {
+		return nil
+	}
+	return &geoIndex{lat: lat, lng: lng, cells: make(map[geoCell]map[int]struct{})}
+}
+
+// point returns the location of an item.
+func (g *geoIndex) point(item interface{}) (float64, float64) {
+	return g.lat.value(item).Float(), g.lng.value(item).Float()
+}
+
+// add indexes the location of an item.
+func (g *geoIndex) add(id int, item interface{}) {
+	cell := cellOf(g.point(item))
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	ids, ok := g.cells[cell]
+	if !ok {
+		ids = make(map[int]struct{})
+		g.cells[cell] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+// remove drops the location of an item from the index.
+func (g *geoIndex) remove(id int, item interface{}) {
+	cell := cellOf(g.point(item))
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	delete(g.cells[cell], id)
+	if len(g.cells[cell]) == 0 {
+		delete(g.cells, cell)
+	}
+}
+
+// within returns the IDs of the items of the cells overlapping the box bounding a circle, which
+// hold every item of the circle. Large boxes holding more cells than the index are answered with
+// every item.
+func (g *geoIndex) within(lat, lng, radiusKm float64) []int {
+	g.mux.RLock()
+	defer g.mux.RUnlock()
+
+	dLat := radiusKm / kmPerDegree
+	minLat, maxLat := math.Floor((lat-dLat)/geoCellDegrees), math.Floor((lat+dLat)/geoCellDegrees)
+	minLng, maxLng := 0.0, float64(geoLngCells-1)
+	if cos := math.Cos((math.Abs(lat) + dLat) * math.Pi / 180); lat+dLat < 90 && lat-dLat > -90 && cos > 0 {
+		dLng := dLat / cos
+		if low, high := math.Floor((lng-dLng)/geoCellDegrees), math.Floor((lng+dLng)/geoCellDegrees); high-low+1 < geoLngCells {
+			minLng, maxLng = low, high
+		}
+	}
+
+	ids := []int{}
+	if (maxLat-minLat+1)*(maxLng-minLng+1) > float64(len(g.cells)) {
+		for _, cell := range g.cells {
+			for id := range cell {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	for i := int(minLat); i <= int(maxLat); i++ {
+		for j := int(minLng); j <= int(maxLng); j++ {
+			for id := range g.cells[geoCell{i, wrapLngCell(j)}] {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// distanceKm is the great-circle distance between two points, by the haversine formula.
+func distanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	const rad = math.Pi / 180
+	dLat, dLng := (lat2-lat1)*rad, (lng2-lng1)*rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// GeoQuery selects the items around a point.
+type GeoQuery struct {
+	Lat, Lng float64
+	RadiusKm float64 // items farther away are left out; every item is kept when zero
+}
+
+// GeoResult is an item found around a point and its distance to it.
+type GeoResult struct {
+	ID         int
+	Item       interface{}
+	DistanceKm float64
+}
+
+// Near finds the items of a located model matching every filter around a point, nearest first
+// (ties in ID order). Radius queries only read the items of the cells around the point.
+func (s *Store) Near(model string, filters []Filter, query GeoQuery) ([]GeoResult, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return nil, fmt.Errorf("model %q is not registered", model)
+	}
+	if c.geo == nil {
+		return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("%s has no location", model)}
+	}
+	if query.Lat < -90 || query.Lat > 90 || query.Lng < -180 || query.Lng > 180 || query.RadiusKm < 0 {
+		return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("invalid point or radius")}
+	}
+	var among []int
+	if query.RadiusKm > 0 {
+		among = c.geo.within(query.Lat, query.Lng, query.RadiusKm)
+	}
+	found, err := s.matchingAmong(model, filters, among)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]GeoResult, 0, len(found))
+	for _, m := range found {
+		lat, lng := c.geo.point(m.item)
+		d := distanceKm(query.Lat, query.Lng, lat, lng)
+		if query.RadiusKm > 0 && d > query.RadiusKm {
+			continue
+		}
+		results = append(results, GeoResult{ID: m.id, Item: m.item, DistanceKm: d})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].DistanceKm < results[j].DistanceKm
+	})
+	return results, nil
+}
+
+// parsePoint parses a point of the form "lat,lng".
+func parsePoint(value string) (float64, float64, error) {
+	latText, lngText, ok := strings.Cut(value, ",")
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latText), 64)
+	if err != nil || !ok {
+		return 0, 0, fmt.Errorf("invalid point %q", value)
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(lngText), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid point %q", value)
+	}
+	return lat, lng, nil
+}
+
+// handleNear answers a collection GET with ?near=: the page of the items matching the filters
+// around the point, expanded with their includes, each with its distance.
+func handleNear(store *Store, model string, meta *modelMeta, filters []Filter, page Page, includes []include, w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	var query GeoQuery
+	var err error
+	if query.Lat, query.Lng, err = parsePoint(values.Get("near")); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid near")
+		return
+	}
+	if v := values.Get("radius_km"); v != "" {
+		if query.RadiusKm, err = strconv.ParseFloat(v, 64); err != nil || query.RadiusKm <= 0 {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid radius_km")
+			return
+		}
+	}
+
+	results, err := store.Near(model, filters, query)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	setTotalCount(w, r, len(results))
+	start, end := page.bounds(len(results))
+	selected := make([]interface{}, 0, end-start)
+	for _, result := range results[start:end] {
+		selected = append(selected, result.Item)
+	}
+	expanded, err := store.expandFor(w, meta, selected, includes)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range expanded {
+		expanded[i] = withMetric(expanded[i], "_distance_km", results[start+i].DistanceKm)
+	}
+	writeJSON(w, http.StatusOK, expanded)
+}
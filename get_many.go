@@ -0,0 +1,116 @@
+// File: get_many.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements batch reads by ID. Store.GetMany retrieves the items of a list
+// of IDs in the order of the list, and GET /{model}?ids=1,5,9 answers them in one call instead of
+// one GET per item (also with ?include=). The IDs naming no item are left out of the response and
+// listed in its X-Missing-IDs header.
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MissingIDsHeader lists the IDs of a GET ?ids= request naming no item.
+const MissingIDsHeader = "X-Missing-IDs"
+
+// maxGetManyIDs is the largest number of IDs accepted by a GET ?ids= request.
+const maxGetManyIDs = 1000
+
+// GetMany retrieves the items of a model with the given IDs into result (a pointer to a slice), in
+// the order of ids, without locking. It returns the IDs naming no item.
+func (s *Store) GetMany(model string, ids []int, result interface{}) []int {
+	itemSlice := reflect.ValueOf(result).Elem()
+	items, missing := s.getMany(model, ids)
+	for _, item := range items {
+		elem := reflect.New(itemSlice.Type().Elem()).Elem()
+		assignItem(elem, item)
+		itemSlice.Set(reflect.Append(itemSlice, elem))
+	}
+	return missing
+}
+
+// getMany returns the stored items with the given IDs, in the order of ids, and the IDs naming no
+// item.
+func (s *Store) getMany(model string, ids []int) ([]interface{}, []int) {
+	c, ok := s.collection(model)
+	if !ok {
+		return nil, ids
+	}
+	now := time.Now()
+	items := make([]interface{}, 0, len(ids))
+	var missing []int
+	for _, id := range ids {
+		e, exists := c.shard(id).snapshot().get(id)
+		if !exists || e.expired(now) {
+			missing = append(missing, id)
+			continue
+		}
+		if limit := c.capacity(); limit != nil {
+			limit.touch(id)
+		}
+		items = append(items, e.item)
+	}
+	return items, missing
+}
+
+// parseIDs parses a comma-separated list of IDs.
+func parseIDs(s string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, localizef("invalid ID %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// handleGetMany serves GET /{model}?ids={ids}.
+func handleGetMany(store *Store, model string, meta *modelMeta, w http.ResponseWriter, r *http.Request) {
+	ids, err := parseIDs(r.URL.Query().Get("ids"))
+	switch {
+	case err != nil:
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	case len(ids) > maxGetManyIDs:
+		writeError(w, r, http.StatusBadRequest, localizef("at most %d IDs can be requested at once", maxGetManyIDs))
+		return
+	}
+	includes, err := store.parseIncludes(model, r.URL.Query().Get("include"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	includes = store.withRelationLinks(model, r, includes)
+
+	items, missing := store.getMany(model, ids)
+	if len(missing) > 0 {
+		values := make([]string, len(missing))
+		for i, id := range missing {
+			values[i] = strconv.Itoa(id)
+		}
+		w.Header().Set(MissingIDsHeader, strings.Join(values, ","))
+	}
+	if len(includes) > 0 {
+		expanded, err := store.expandFor(w, meta, items, includes)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, expanded)
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
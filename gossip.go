@@ -0,0 +1,437 @@
+// File: gossip.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements peer-to-peer replication with gossip membership. Nodes learn about
+// each other by periodically exchanging their member lists (with per-member heartbeat counters) with a
+// few random peers, starting from a list of seeds. Local changes are pushed asynchronously, in batches,
+// to every live member, and each node resolves concurrent writes to the same item with last-write-wins
+// on the change timestamp (ties broken by node address). Replication is best-effort: changes sent while
+// a peer is unreachable are not retried. Each node creates the IDs of its own slot, so nodes creating
+// items concurrently never take the same ID. Received changes are written through the checked paths,
+// held to the validation, parents, unique fields and immutability of their model; the encrypted
+// fields travel sealed. The versions of the items are forgotten after ten minutes, and changes older
+// than that are dropped as stale. Only signed nodes exchange members and changes; operators read the
+// member list with the admin token. Replication counters and lag are published through expvar.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gossip timings and limits.
+const (
+	gossipInterval     = time.Second
+	gossipFanout       = 3
+	gossipFailTimeout  = 5 * time.Second
+	gossipForgetAfter  = time.Minute
+	gossipFlushEvery   = 100 * time.Millisecond
+	gossipMaxBatch     = 256
+	gossipQueueSize    = 10000
+	gossipClientTime   = 5 * time.Second
+	gossipMaxBatchBody = 32 << 20
+	gossipVersionTTL   = 10 * time.Minute
+)
+
+// Gossip replication metrics.
+var (
+	gossipStats = expvar.NewMap("gossip")
+	gossipLag   = expvar.NewMap("gossip_replication_lag_ms")
+)
+
+// GossipMember is a node as seen by the membership protocol.
+type GossipMember struct {
+	Addr      string `json:"addr"`
+	Heartbeat uint64 `json:"heartbeat"`
+	Alive     bool   `json:"alive"`
+	Slot      int    `json:"slot,omitempty"`
+
+	updated time.Time
+	seed    bool
+}
+
+// gossipChange is a replicated change.
+type gossipChange struct {
+	Op     string          `json:"op"`
+	Model  string          `json:"model"`
+	ID     int             `json:"id"`
+	Item   json.RawMessage `json:"item,omitempty"`
+	Time   time.Time       `json:"time"`
+	Origin string          `json:"origin"`
+}
+
+// gossipVersion orders the writes to one item for last-write-wins.
+type gossipVersion struct {
+	time   time.Time
+	origin string
+}
+
+// newer reports whether v wins over other.
+func (v gossipVersion) newer(other gossipVersion) bool {
+	if !v.time.Equal(other.time) {
+		return v.time.After(other.time)
+	}
+	return v.origin > other.origin
+}
+
+// Gossip replicates a store between peers discovered through gossip.
+type Gossip struct {
+	// Addr is the advertised base URL of this node (e.g. "http://10.0.0.1:8080").
+	Addr string
+	// Auth signs the requests sent to the peers.
+	Auth *ClusterAuth
+	// Slot makes the IDs created by this node unique among the peers; it must differ between nodes
+	// and lie between 1 and 1023. It defaults to the position of Addr among the seeds.
+	Slot int
+	// AdminToken lets operators read the member list.
+	AdminToken string
+
+	store     *Store
+	client    *http.Client
+	heartbeat uint64
+	members   map[string]*GossipMember
+	versions  map[string]gossipVersion
+	horizon   time.Time // changes before it are stale; their versions are forgotten
+	queue     chan ChangeEvent
+	mux       sync.Mutex
+	applyMux  sync.Mutex
+}
+
+// NewGossip creates the replicator of a store advertised at addr, joining through the seeds.
+func NewGossip(store *Store, addr string, seeds []string) *Gossip {
+	g := &Gossip{
+		Addr:     strings.TrimRight(addr, "/"),
+		store:    store,
+		client:   &http.Client{Timeout: gossipClientTime},
+		members:  make(map[string]*GossipMember),
+		versions: make(map[string]gossipVersion),
+		queue:    make(chan ChangeEvent, gossipQueueSize),
+	}
+	nodes := []string{g.Addr}
+	for _, seed := range seeds {
+		if seed = strings.TrimRight(strings.TrimSpace(seed), "/"); seed != "" && seed != g.Addr {
+			g.members[seed] = &GossipMember{Addr: seed, seed: true}
+			nodes = append(nodes, seed)
+		}
+	}
+	sort.Strings(nodes)
+	for i, node := range nodes {
+		if node == g.Addr {
+			g.Slot = i + 1
+		}
+	}
+	return g
+}
+
+// Start makes the store create the IDs of the node's slot and runs the membership protocol and the
+// change sender in the background.
+func (g *Gossip) Start() error {
+	if err := g.store.SetIDSlot(g.Slot); err != nil {
+		return fmt.Errorf("gossip: %w", err)
+	}
+	go g.gossipLoop()
+	go g.sendLoop()
+	return nil
+}
+
+// Publish queues a local change for replication. It is meant to be passed to Store.Subscribe;
+// changes received from peers are not sent on again.
+func (g *Gossip) Publish(event ChangeEvent) {
+	if event.Origin != "" {
+		return
+	}
+
+	g.mux.Lock()
+	key := gossipKey(event.Model, event.ID)
+	version := gossipVersion{time: event.Time, origin: g.Addr}
+	if current, ok := g.versions[key]; !ok || version.newer(current) {
+		g.versions[key] = version
+	}
+	g.mux.Unlock()
+
+	select {
+	case g.queue <- event:
+	default:
+		gossipStats.Add("changes_dropped", 1)
+	}
+}
+
+// gossipKey identifies an item across models.
+func gossipKey(model string, id int) string {
+	return fmt.Sprintf("%s#%d", model, id)
+}
+
+// gossipLoop exchanges member lists with a few random members every interval.
+func (g *Gossip) gossipLoop() {
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		g.mux.Lock()
+		g.heartbeat++
+		targets := make([]string, 0, len(g.members))
+		alive := 0
+		for addr, member := range g.members {
+			member.Alive = time.Since(member.updated) < gossipFailTimeout
+			if member.Alive {
+				alive++
+			} else if !member.seed && time.Since(member.updated) > gossipForgetAfter {
+				delete(g.members, addr)
+				continue
+			}
+			targets = append(targets, addr)
+		}
+		view := g.viewLocked()
+		g.forgetVersionsLocked()
+		g.mux.Unlock()
+
+		gossipStats.Set("members_alive", intVar(int64(alive)))
+		rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+		if len(targets) > gossipFanout {
+			targets = targets[:gossipFanout]
+		}
+		for _, target := range targets {
+			go g.exchange(target, view)
+		}
+	}
+}
+
+// forgetVersionsLocked moves the horizon to gossipVersionTTL ago, forgetting the versions before
+// it, so the versions kept are bounded by the writes of that window. It must be called while
+// holding the lock.
+func (g *Gossip) forgetVersionsLocked() {
+	horizon := time.Now().Add(-gossipVersionTTL)
+	if horizon.Sub(g.horizon) < gossipVersionTTL/10 {
+		return
+	}
+	for key, version := range g.versions {
+		if version.time.Before(horizon) {
+			delete(g.versions, key)
+		}
+	}
+	g.horizon = horizon
+	gossipStats.Set("versions", intVar(int64(len(g.versions))))
+}
+
+// exchange sends our member list to a peer and merges the one it answers with.
+func (g *Gossip) exchange(target string, view []GossipMember) {
+	var theirs []GossipMember
+	if err := g.post(target+"/_gossip/members", view, &theirs); err != nil {
+		return
+	}
+	g.merge(theirs)
+}
+
+// viewLocked returns the member list including this node. It must be called while holding the lock.
+func (g *Gossip) viewLocked() []GossipMember {
+	view := []GossipMember{{Addr: g.Addr, Heartbeat: g.heartbeat, Alive: true, Slot: g.Slot}}
+	for _, member := range g.members {
+		view = append(view, *member)
+	}
+	sort.Slice(view, func(i, j int) bool { return view[i].Addr < view[j].Addr })
+	return view
+}
+
+// merge adopts the members of a peer's list whose heartbeat moved on, warning about the members
+// sharing the slot of this node.
+func (g *Gossip) merge(members []GossipMember) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	for _, incoming := range members {
+		if incoming.Addr == "" || incoming.Addr == g.Addr {
+			continue
+		}
+		member, ok := g.members[incoming.Addr]
+		if !ok {
+			member = &GossipMember{Addr: incoming.Addr}
+			g.members[incoming.Addr] = member
+			log.Printf("gossip: discovered %s", incoming.Addr)
+		}
+		if incoming.Heartbeat > member.Heartbeat {
+			member.Heartbeat = incoming.Heartbeat
+			member.updated = time.Now()
+			member.Alive = true
+			if incoming.Slot != member.Slot && incoming.Slot == g.Slot {
+				log.Printf("gossip: %s uses the ID slot %d of this node; set distinct -gossip-slot values", incoming.Addr, g.Slot)
+				gossipStats.Add("slot_conflicts", 1)
+			}
+			member.Slot = incoming.Slot
+		}
+	}
+}
+
+// sendLoop pushes queued changes to every live member in batches.
+func (g *Gossip) sendLoop() {
+	ticker := time.NewTicker(gossipFlushEvery)
+	defer ticker.Stop()
+
+	var batch []gossipChange
+	for {
+		select {
+		case event := <-g.queue:
+			change := gossipChange{Op: event.Op, Model: event.Model, ID: event.ID, Time: event.Time, Origin: g.Addr}
+			if event.Item != nil {
+				data, err := marshalSealed(event.Model, event.ID, event.Item)
+				if err != nil {
+					log.Printf("gossip: cannot encode %s %d: %v", event.Model, event.ID, err)
+					continue
+				}
+				change.Item = data
+			}
+			batch = append(batch, change)
+			if len(batch) < gossipMaxBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		g.mux.Lock()
+		var targets []string
+		for addr, member := range g.members {
+			if member.Alive {
+				targets = append(targets, addr)
+			}
+		}
+		g.mux.Unlock()
+
+		for _, target := range targets {
+			go func(target string, batch []gossipChange) {
+				if err := g.post(target+"/_gossip/changes", batch, nil); err != nil {
+					gossipStats.Add("send_errors", 1)
+					return
+				}
+				gossipStats.Add("changes_sent", int64(len(batch)))
+			}(target, batch)
+		}
+		batch = nil
+	}
+}
+
+// apply merges a change received from a peer, unless a newer write to the item is already known.
+// The change is written through the checked paths, so a change the model refuses is dropped.
+func (g *Gossip) apply(change gossipChange) {
+	// Serialise remote applies so the version check and the write cannot interleave
+	g.applyMux.Lock()
+	defer g.applyMux.Unlock()
+	key := gossipKey(change.Model, change.ID)
+	version := gossipVersion{time: change.Time, origin: change.Origin}
+	g.mux.Lock()
+	current, known := g.versions[key]
+	stale := change.Time.Before(g.horizon) || known && !version.newer(current)
+	g.mux.Unlock()
+	if stale {
+		gossipStats.Add("changes_stale", 1)
+		return
+	}
+
+	ctx := withOrigin(context.Background(), change.Origin)
+	if err := g.store.applyReplicated(ctx, change.Op, change.Model, change.ID, change.Item); err != nil {
+		log.Printf("gossip: refused %s %s %d from %s: %v", change.Op, change.Model, change.ID, change.Origin, err)
+		gossipStats.Add("changes_refused", 1)
+		return
+	}
+	g.mux.Lock()
+	if current, ok := g.versions[key]; !ok || version.newer(current) {
+		g.versions[key] = version
+	}
+	g.mux.Unlock()
+	gossipStats.Add("changes_applied", 1)
+	gossipLag.Set(change.Origin, intVar(time.Since(change.Time).Milliseconds()))
+}
+
+// post sends a JSON request to a peer and decodes the answer into response (when not nil).
+func (g *Gossip) post(url string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := g.Auth.Do(g.client, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gossip: %s answered %s", url, resp.Status)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// handleGossip serves the gossip endpoints: POST /_gossip/members exchanges member lists,
+// GET /_gossip/members returns this node's view and POST /_gossip/changes receives changes. Only
+// the requests signed by a node are served, but for the view, also served with the admin token.
+func (g *Gossip) handleGossip(w http.ResponseWriter, r *http.Request) {
+	view := r.URL.Path == "/_gossip/members" && r.Method == http.MethodGet
+	if !fromPeer(r) && !view {
+		writeProblem(w, r, http.StatusUnauthorized, "A valid cluster signature is required in the "+ClusterSignatureHeader+" header")
+		return
+	}
+	switch {
+	case view:
+		if !fromPeer(r) {
+			adminOnly(g.AdminToken, g.serveView)(w, r)
+			return
+		}
+		g.serveView(w, r)
+
+	case r.URL.Path == "/_gossip/members" && r.Method == http.MethodPost:
+		var members []GossipMember
+		if err := json.NewDecoder(r.Body).Decode(&members); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		g.merge(members)
+		g.mux.Lock()
+		view := g.viewLocked()
+		g.mux.Unlock()
+		writeJSON(w, http.StatusOK, view)
+
+	case r.URL.Path == "/_gossip/changes" && r.Method == http.MethodPost:
+		var changes []gossipChange
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, gossipMaxBatchBody)).Decode(&changes); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		for _, change := range changes {
+			g.apply(change)
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		notFound(w, r, "Not found")
+	}
+}
+
+// serveView writes this node's member list.
+func (g *Gossip) serveView(w http.ResponseWriter, r *http.Request) {
+	g.mux.Lock()
+	view := g.viewLocked()
+	g.mux.Unlock()
+	writeJSON(w, http.StatusOK, view)
+}
+
+// intVar wraps a number as an expvar value.
+func intVar(n int64) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(n)
+	return v
+}
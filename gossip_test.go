@@ -0,0 +1,99 @@
+// File: gossip_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the peer-to-peer mode: nodes create the IDs of distinct slots,
+// received changes go through the checks of their model with their encrypted fields sealed, stale
+// changes are dropped and only signed nodes may push changes.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGossipSlotsKeepIDsApart(t *testing.T) {
+	a, b := newTestStore(), newTestStore()
+	if err := a.SetIDSlot(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetIDSlot(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetIDSlot(partitionIDStride); err == nil {
+		t.Error("slot outside the ID space accepted")
+	}
+
+	g := NewGossip(a, "http://a", []string{"http://b"})
+	ids := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		item := b.Create("item", &Item{Title: "from b"}).(*Item)
+		ids[item.ID] = true
+		data, _ := json.Marshal(item)
+		g.apply(gossipChange{Op: OpCreate, Model: "item", ID: item.ID, Item: data, Time: time.Now(), Origin: "http://b"})
+	}
+	for i := 0; i < 3; i++ {
+		item := a.Create("item", &Item{Title: "from a"}).(*Item)
+		if ids[item.ID] || item.ID%partitionIDStride != 1 {
+			t.Fatalf("node a created ID %d, which is not in its slot", item.ID)
+		}
+		ids[item.ID] = true
+	}
+	if got, _ := a.Count("item", nil); got != 6 {
+		t.Errorf("node a holds %d items, want 6", got)
+	}
+}
+
+func TestGossipAppliesThroughTheChecks(t *testing.T) {
+	keys, err := NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{7}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetFieldKeys(keys)
+	defer SetFieldKeys(nil)
+
+	store := newTestStore()
+	store.Create("user", &User{Name: "local", Email: "taken@example.com"})
+	g := NewGossip(store, "http://a", nil)
+	change := func(id int, user User, at time.Time) gossipChange {
+		data, err := marshalSealed("user", id, &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gossipChange{Op: OpCreate, Model: "user", ID: id, Item: data, Time: at, Origin: "http://b"}
+	}
+
+	sealed := change(1026, User{Name: "remote", Email: "remote@example.com", Token: "tok-1234"}, time.Now())
+	if bytes.Contains(sealed.Item, []byte("tok-1234")) {
+		t.Fatalf("replicated change holds the plaintext token: %s", sealed.Item)
+	}
+	g.apply(sealed)
+	var user User
+	if !store.Get("user", 1026, &user) || user.Token != "tok-1234" {
+		t.Fatalf("replicated user is %+v, want its token opened", user)
+	}
+
+	g.apply(change(2050, User{Name: "duplicate", Email: "taken@example.com"}, time.Now()))
+	if store.exists("user", 2050) {
+		t.Error("change taking a unique email was applied")
+	}
+	g.apply(change(1026, User{Name: "older", Email: "remote@example.com"}, time.Now().Add(-time.Hour)))
+	if store.Get("user", 1026, &user); user.Name != "remote" {
+		t.Errorf("older change replaced the user with %+v", user)
+	}
+
+	w := serveTest(g.handleGossip, http.MethodPost, "/_gossip/changes", "[]")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned changes: status %d, want 401", w.Code)
+	}
+	w = serveTest(g.handleGossip, http.MethodGet, "/_gossip/members", "")
+	if w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "http://a") {
+		t.Errorf("member list without the admin token: status %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,158 @@
+// File: idempotency.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements Idempotency-Key support for the POST routes of the models. The
+// response to a POST carrying the header is remembered for a configurable window, and a retry with
+// the same key (from the same caller, to the same route) gets that response replayed instead of
+// creating the item again. A retry arriving while the first request is still running waits for it.
+// Reusing a key with a different body is rejected with 422, and server errors are not remembered so
+// the request can be retried.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyHeader is the header a client names a retryable request with.
+const IdempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength bounds the keys accepted from clients.
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBody bounds the bodies buffered to fingerprint a request.
+const maxIdempotentBody = 32 << 20
+
+// idempotencyStats counts the replayed responses and the rejected keys.
+var idempotencyStats = expvar.NewMap("idempotency")
+
+// idempotentRequest is a request seen with an Idempotency-Key and, once done, its response.
+type idempotentRequest struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	done        chan struct{} // closed once response is set
+	response    *bufferedResponse
+}
+
+// Idempotency remembers the responses of POST requests carrying an Idempotency-Key.
+type Idempotency struct {
+	// Window is how long a response is replayed for.
+	Window time.Duration
+	// MaxKeys bounds the number of remembered requests; the oldest are forgotten first.
+	MaxKeys int
+
+	order    *list.List // oldest first
+	requests map[string]*list.Element
+	mux      sync.Mutex
+}
+
+// NewIdempotency creates a store of responses replayed for window.
+func NewIdempotency(window time.Duration) *Idempotency {
+	return &Idempotency{
+		Window:   window,
+		MaxKeys:  100000,
+		order:    list.New(),
+		requests: make(map[string]*list.Element),
+	}
+}
+
+// SetIdempotency makes the store's model routes honour Idempotency-Key on POST requests.
+// It must be called before the store is used concurrently.
+func (s *Store) SetIdempotency(idempotency *Idempotency) {
+	s.idempotency = idempotency
+}
+
+// serve runs a POST request once per Idempotency-Key and replays its response to retries.
+func (i *Idempotency) serve(model string, w http.ResponseWriter, r *http.Request, next func(w http.ResponseWriter, r *http.Request)) {
+	name := r.Header.Get(IdempotencyHeader)
+	if len(name) > maxIdempotencyKeyLength {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid Idempotency-Key")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	fingerprint := sha256.Sum256(append([]byte(r.URL.RawQuery+"\x00"), body...))
+	key := model + "\x00" + subpath(r) + "\x00" + requestIdentity(r) + "\x00" + name
+
+	i.mux.Lock()
+	i.expire(time.Now())
+	if element, ok := i.requests[key]; ok {
+		previous := element.Value.(*idempotentRequest)
+		i.mux.Unlock()
+		if previous.fingerprint != fingerprint {
+			idempotencyStats.Add("mismatched", 1)
+			writeProblem(w, r, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+			return
+		}
+		<-previous.done
+		if previous.response == nil {
+			// The first attempt failed and was forgotten; let the client retry
+			writeProblem(w, r, http.StatusConflict, "A request with this Idempotency-Key failed, retry it")
+			return
+		}
+		idempotencyStats.Add("replayed", 1)
+		w.Header().Set("Idempotent-Replayed", "true")
+		previous.response.writeTo(w)
+		return
+	}
+	request := &idempotentRequest{key: key, fingerprint: fingerprint, expires: time.Now().Add(i.Window), done: make(chan struct{})}
+	i.requests[key] = i.order.PushBack(request)
+	for i.order.Len() > i.MaxKeys {
+		i.forget(i.order.Front())
+	}
+	i.mux.Unlock()
+
+	// Retries waiting for this attempt are released even if the handler panics
+	response := newBufferedResponse()
+	completed := false
+	defer func() {
+		i.mux.Lock()
+		defer i.mux.Unlock()
+
+		if completed && response.status < http.StatusInternalServerError {
+			request.response = response
+		} else if element, ok := i.requests[key]; ok && element.Value == request {
+			i.forget(element)
+		}
+		close(request.done)
+	}()
+	next(response, r)
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+	completed = true
+	response.writeTo(w)
+}
+
+// expire forgets the requests whose window has passed. It must be called while holding the lock.
+func (i *Idempotency) expire(now time.Time) {
+	for element := i.order.Front(); element != nil && now.After(element.Value.(*idempotentRequest).expires); element = i.order.Front() {
+		i.forget(element)
+	}
+}
+
+// forget drops a remembered request. It must be called while holding the lock.
+func (i *Idempotency) forget(element *list.Element) {
+	i.order.Remove(element)
+	delete(i.requests, element.Value.(*idempotentRequest).key)
+}
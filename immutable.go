@@ -0,0 +1,213 @@
+// File: immutable.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements append-only models, for ledger-style data such as audit events
+// and financial entries. The items of an immutable model are created and never changed: updates and
+// deletes are rejected with 405, whether they come from the API, the Go methods or transactions.
+// Models in correction mode accept PUT and PATCH as corrections instead: the corrected item is
+// appended as a new item whose field tagged `immutable:"corrects"` holds the ID of the item it
+// corrects, which is kept as it was. Nothing else removes their items either: retention policies of
+// immutable models fail, their items cannot be created with a TTL or carry an ExpiresAt field, and
+// they cannot be bounded by a capacity.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Immutability modes.
+const (
+	ImmutableReject  = "reject"  // updates and deletes are rejected
+	ImmutableCorrect = "correct" // updates are appended as corrections, deletes are rejected
+)
+
+// correctsField returns the field of a model tagged `immutable:"corrects"`, if any.
+func correctsField(m *modelMeta) *fieldMeta {
+	for _, f := range m.fields {
+		if f.tag.Get("immutable") == "corrects" && isIntKind(f.typ.Kind()) && f != m.id {
+			return f
+		}
+	}
+	return nil
+}
+
+// SetImmutable makes a model append-only in the given mode, or mutable again when mode is empty.
+// The correction mode requires an integer field tagged `immutable:"corrects"`, and models with an
+// ExpiresAt field or a capacity limit cannot be made immutable. It must be called before the store
+// is used concurrently.
+func (s *Store) SetImmutable(model, mode string) error {
+	c, ok := s.collection(model)
+	if !ok {
+		return fmt.Errorf("model %q is not registered", model)
+	}
+	switch mode {
+	case "", ImmutableReject:
+	case ImmutableCorrect:
+		if c.meta.corrects == nil {
+			return fmt.Errorf("model %q has no field tagged immutable:\"corrects\"", model)
+		}
+	default:
+		return fmt.Errorf("invalid immutability mode %q", mode)
+	}
+	if mode != "" && c.meta.expiresAt != nil {
+		return fmt.Errorf("model %q has an ExpiresAt field: the items of immutable models cannot expire", model)
+	}
+	if mode != "" && c.capacity() != nil {
+		return fmt.Errorf("model %q has a capacity limit: the items of immutable models cannot be evicted", model)
+	}
+	s.typeMux.Lock()
+	defer s.typeMux.Unlock()
+
+	if mode == "" {
+		delete(s.immutable, model)
+		return nil
+	}
+	if s.immutable == nil {
+		s.immutable = make(map[string]string)
+	}
+	s.immutable[model] = mode
+	return nil
+}
+
+// immutability returns the immutability mode of a model, empty when it is mutable. Tenant
+// collections inherit the mode of their model.
+func (s *Store) immutability(model string) string {
+	s.typeMux.RLock()
+	defer s.typeMux.RUnlock()
+
+	if mode, ok := s.immutable[model]; ok {
+		return mode
+	}
+	if _, base, ok := splitTenantModel(model); ok {
+		return s.immutable[base]
+	}
+	return ""
+}
+
+// checkMutable returns the error rejecting an update or delete of an immutable model.
+func (s *Store) checkMutable(model string) error {
+	switch s.immutability(model) {
+	case ImmutableReject:
+		return &Error{Status: http.StatusMethodNotAllowed, Code: CodeMethodNotAllowed, Err: localizef("the items of %s are immutable", model)}
+	case ImmutableCorrect:
+		return &Error{Status: http.StatusMethodNotAllowed, Code: CodeMethodNotAllowed, Err: localizef("the items of %s are immutable: append a correction instead", model)}
+	}
+	return nil
+}
+
+// checkCorrection rejects a new item correcting an item of its model that does not exist.
+func (s *Store) checkCorrection(model string, item interface{}) error {
+	meta, ok := s.meta(model)
+	if !ok || meta.corrects == nil {
+		return nil
+	}
+	id := int(meta.corrects.value(item).Int())
+	if id != 0 && !s.exists(model, id) {
+		return fieldError(meta.corrects, "exists", id, localizef("%s %d does not exist", model, id))
+	}
+	return nil
+}
+
+// Correct appends a correction of an item of a model in correction mode: correction is created as
+// a new item referencing the item it corrects, which is left as it is.
+func (s *Store) Correct(ctx context.Context, model string, id int, correction interface{}) (interface{}, error) {
+	meta, ok := s.meta(model)
+	if !ok {
+		return nil, &Error{Status: http.StatusNotFound, Code: CodeNotFound, Message: "Unknown model"}
+	}
+	if s.immutability(model) != ImmutableCorrect {
+		return nil, &Error{Status: http.StatusMethodNotAllowed, Code: CodeMethodNotAllowed, Err: localizef("%s does not accept corrections", model)}
+	}
+	if !s.exists(model, id) {
+		return nil, ErrItemNotFound
+	}
+	if meta.id != nil {
+		meta.id.value(correction).SetInt(0)
+	}
+	meta.corrects.value(correction).SetInt(int64(id))
+	return s.createChecked(ctx, model, correction, 0)
+}
+
+// handleCorrection serves PUT and PATCH /{model}?id={id} for models in correction mode, appending
+// the item as replaced or as merged with the body as a correction of the item.
+func handleCorrection(store *Store, model string, meta *modelMeta, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	current := reflect.New(meta.typ).Interface()
+	if !store.Get(model, id, current) {
+		writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+		return
+	}
+
+	var correction interface{}
+	if r.Method == http.MethodPut {
+		correction = reflect.New(meta.typ).Interface()
+		if err := decodeItem(r.Body, correction); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, decodeError(meta, err))
+			return
+		}
+	} else {
+		var patch map[string]interface{}
+		dec := json.NewDecoder(io.LimitReader(r.Body, maxPatchSize))
+		dec.UseNumber()
+		if err := dec.Decode(&patch); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		if correction, err = patchItem(meta, current, patch); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+	}
+	if masking(w) {
+		keepMasked(meta, correction, current)
+	}
+	if err := validate(meta, correction); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if err := store.checkParents(model, correction); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	created, err := store.Correct(r.Context(), model, id, correction)
+	if err != nil {
+		writeError(w, r, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// ParseImmutability parses immutable models of the form "model[=reject|correct]", separated by
+// commas.
+func ParseImmutability(spec string) (map[string]string, error) {
+	modes := make(map[string]string)
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		model, mode, _ := strings.Cut(rule, "=")
+		if mode == "" {
+			mode = ImmutableReject
+		}
+		if mode != ImmutableReject && mode != ImmutableCorrect {
+			return nil, fmt.Errorf("invalid immutability mode in %q", rule)
+		}
+		modes[model] = mode
+	}
+	return modes, nil
+}
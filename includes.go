@@ -0,0 +1,179 @@
+// File: includes.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements eager loading of related items. A GET with ?include= naming
+// related models embeds them in every returned item under the model's name: the parent an item
+// belongs to (GET /item?include=user adds "user": {...}) or the children of an item (GET
+// /user?include=item adds "item": [...]). The parent of a polymorphic relation is embedded under
+// the relation's as name (GET /comment?include=subject). The related items are read from their
+// collections on the server, sparing clients one round trip per item.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// include is a relation embedded in the responses of a GET.
+type include struct {
+	name      string // key of the embedded value
+	tenant    string // tenant of the request, scoping the related models
+	relations []*Relation
+	children  bool   // whether the related items are children of the returned ones
+	linked    bool   // whether only a link to the related items is embedded (see relation_links.go)
+	prefix    string // path prefix of the links
+	masked    bool   // whether the related items are embedded masked (see mask.go)
+}
+
+// model returns the tenant-scoped model of the items included through a relation.
+func (inc include) model(relation *Relation) string {
+	if inc.children {
+		return tenantModel(inc.tenant, relation.Child)
+	}
+	return tenantModel(inc.tenant, relation.Parent)
+}
+
+// parseIncludes resolves the ?include= parameter of a GET on a model. A polymorphic parent is
+// included under its as name, through the relations to each of its parent models.
+func (s *Store) parseIncludes(model, param string) ([]include, error) {
+	if param == "" {
+		return nil, nil
+	}
+	tenant, _, _ := splitTenantModel(model)
+	var includes []include
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if relation, ok := s.relation(model, name); ok {
+			if meta, _ := s.meta(model); meta.id == nil {
+				return nil, fmt.Errorf("model %q has no ID to include %q by", model, name)
+			}
+			includes = append(includes, include{name: name, tenant: tenant, relations: []*Relation{relation}, children: true})
+			continue
+		}
+		inc := include{name: name, tenant: tenant}
+		for _, relation := range s.parents(model) {
+			if (relation.As == "" && relation.Parent == name) || relation.As == name {
+				inc.relations = append(inc.relations, relation)
+			}
+		}
+		if len(inc.relations) == 0 {
+			return nil, fmt.Errorf("unknown relation %q", name)
+		}
+		includes = append(includes, inc)
+	}
+	return includes, nil
+}
+
+// includedCollections returns the collections the included items are read from.
+func (s *Store) includedCollections(includes []include) []*collection {
+	var collections []*collection
+	for _, inc := range includes {
+		if inc.linked {
+			continue
+		}
+		for _, relation := range inc.relations {
+			if c, ok := s.collection(inc.model(relation)); ok {
+				collections = append(collections, c)
+			}
+		}
+	}
+	return collections
+}
+
+// related returns the key of the items an item includes, and the relation they are read through.
+// It reports false when the item references no parent.
+func (inc include) related(meta *modelMeta, item interface{}) (cacheKey, *Relation, bool) {
+	if inc.children {
+		return cacheKey{id: int(meta.id.value(item).Int())}, inc.relations[0], true
+	}
+	for _, relation := range inc.relations {
+		if id, ok := relation.references(item); ok {
+			return cacheKey{relation.Parent, id}, relation, true
+		}
+	}
+	return cacheKey{}, nil, false
+}
+
+// expand encodes items with their related items embedded. Each parent is read once however many
+// items reference it.
+func (s *Store) expand(meta *modelMeta, items []interface{}, includes []include) ([]json.RawMessage, error) {
+	related := make([]map[cacheKey]interface{}, len(includes))
+	for i, inc := range includes {
+		related[i] = make(map[cacheKey]interface{})
+		for _, item := range items {
+			key, relation, ok := inc.related(meta, item)
+			if _, done := related[i][key]; done || !ok || inc.linked {
+				continue
+			}
+			if inc.children {
+				value := reflect.ValueOf(key.id).Convert(relation.ForeignKey.typ).Interface()
+				filters := []Filter{{Field: relation.ForeignKey.name, Op: FilterEq, Value: value}}
+				if relation.Type != nil {
+					filters = append(filters, Filter{Field: relation.Type.name, Op: FilterEq, Value: relation.Parent})
+				}
+				found, err := s.matching(inc.model(relation), filters)
+				if err != nil {
+					return nil, err
+				}
+				children := make([]interface{}, len(found))
+				for j, m := range found {
+					children[j] = m.item
+				}
+				related[i][key] = children
+				continue
+			}
+
+			related[i][key] = nil
+			if c, ok := s.collection(inc.model(relation)); ok {
+				if e, ok := c.shard(key.id).snapshot().get(key.id); ok && !e.expired(time.Now()) {
+					related[i][key] = e.item
+				}
+			}
+		}
+	}
+
+	expanded := make([]json.RawMessage, len(items))
+	for n, item := range items {
+		data, err := marshalItem(item)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		buf.Write(bytes.TrimSuffix(data, []byte("}")))
+		for i, inc := range includes {
+			var value interface{}
+			if key, relation, ok := inc.related(meta, item); ok && inc.linked {
+				value = inc.href(relation, key)
+			} else if ok {
+				value = related[i][key]
+				if inc.masked {
+					value = maskItem(value)
+				}
+			}
+			encoded, err := marshalItem(value)
+			if err != nil {
+				return nil, err
+			}
+			if buf.Len() > 1 {
+				buf.WriteByte(',')
+			}
+			name, _ := json.Marshal(inc.name)
+			buf.Write(name)
+			buf.WriteByte(':')
+			buf.Write(encoded)
+		}
+		buf.WriteByte('}')
+		expanded[n] = buf.Bytes()
+	}
+	return expanded, nil
+}
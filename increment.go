@@ -0,0 +1,139 @@
+// File: increment.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements atomic increments. Store.Increment adds to a numeric field of
+// an item under the shard lock, so concurrent counters (views, stock, votes) never lose an update
+// the way a client reading the item and writing it back would. POST /{model}/{id}/_increment with
+// {"field": "Counter", "by": 3} increments over HTTP (by 1 when "by" is omitted, negative values
+// decrement) and answers the updated item. The result must still satisfy the validate rules of the
+// field, and integer fields only accept whole amounts.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Increment adds by to a numeric field (named by its Go or JSON name) of an item atomically and
+// returns the updated item. It reports whether the item exists.
+func (s *Store) Increment(model string, id int, field string, by float64) (interface{}, bool, error) {
+	return s.increment(context.Background(), model, id, field, by, nil)
+}
+
+// increment increments a field like Increment once check (when not nil) accepts the current item,
+// unless ctx is done.
+func (s *Store) increment(ctx context.Context, model string, id int, field string, by float64, check func(current interface{}) error) (interface{}, bool, error) {
+	meta, ok := s.meta(model)
+	if !ok {
+		return nil, false, nil
+	}
+	f, ok := meta.field(field)
+	if !ok || f == meta.id {
+		return nil, s.exists(model, id), &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", field)}
+	}
+
+	var updated interface{}
+	exists, err := s.modify(ctx, model, id, func(current interface{}) (interface{}, error) {
+		if check != nil {
+			if err := check(current); err != nil {
+				return nil, err
+			}
+		}
+		item := copyItem(meta, current)
+		if err := addToField(f, f.value(item), by); err != nil {
+			return nil, err
+		}
+		if err := validate(meta, item); err != nil {
+			return nil, &Error{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Err: err}
+		}
+		updated = item
+		return updated, nil
+	})
+	return updated, exists, err
+}
+
+// addToField adds an amount to a numeric field, which integer fields only accept when it is whole
+// and the result fits.
+func addToField(f *fieldMeta, v reflect.Value, by float64) error {
+	invalid := func() error {
+		return &Error{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed,
+			Err: fieldError(f, "type", by, localizef("%s cannot be incremented by %v", f.jsonName, by))}
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if by != math.Trunc(by) {
+			return invalid()
+		}
+		n := v.Int() + int64(by)
+		if v.OverflowInt(n) {
+			return invalid()
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := float64(v.Uint()) + by
+		if by != math.Trunc(by) || n < 0 || v.OverflowUint(uint64(n)) {
+			return invalid()
+		}
+		v.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(v.Float() + by)
+	default:
+		return &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("%s is not a number", f.jsonName)}
+	}
+	return nil
+}
+
+// handleIncrement serves POST /{model}/{id}/_increment. It reports false when rest does not name
+// the route.
+func handleIncrement(store *Store, model, rest string, w http.ResponseWriter, r *http.Request) bool {
+	segment, route, ok := strings.Cut(rest, "/")
+	if !ok || route != "_increment" {
+		return false
+	}
+	id, err := strconv.Atoi(segment)
+	if err != nil {
+		return false
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return true
+	}
+	var body struct {
+		Field string   `json:"field"`
+		By    *float64 `json:"by"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Field == "" {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+		return true
+	}
+	by := 1.0
+	if body.By != nil {
+		by = *body.By
+	}
+	check, ok := store.precondition(w, r)
+	if !ok {
+		return true
+	}
+
+	item, exists, err := store.increment(r.Context(), model, id, body.Field, by, check)
+	switch {
+	case !exists:
+		writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+	case err != nil:
+		writePreconditionError(w, r, err)
+	default:
+		if etag, err := itemETag(item); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+		writeJSON(w, http.StatusOK, item)
+	}
+	return true
+}
@@ -0,0 +1,401 @@
+// File: indexes.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements secondary indexes on struct fields. A hash index maps field
+// values to item IDs for equality lookups, while an ordered index keeps (value, ID) pairs in a
+// balanced tree, so range lookups descend to their first value and mutations cost O(log n). Indexes are created with Store.CreateIndex /
+// Store.CreateOrderedIndex or declared with an `index:"true"` / `index:"ordered"` struct tag, and
+// are updated on every mutation so filtered lookups never need to scan the whole collection.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fieldIndex is a secondary index over one field of a model.
+type fieldIndex struct {
+	field   string
+	index   []int
+	ordered bool
+
+	hash    map[interface{}]map[int]struct{}
+	entries *indexNode
+	mux     sync.RWMutex
+}
+
+// indexEntry is one (value, ID) pair of an ordered index.
+type indexEntry struct {
+	value reflect.Value
+	id    int
+}
+
+// indexNode is a node of the AVL tree of an ordered index, ordered by value then ID.
+type indexNode struct {
+	entry       indexEntry
+	left, right *indexNode
+	height      int
+}
+
+// CreateIndex adds a hash index on a field of a model for fast equality lookups.
+// The field may be given by its Go name or its JSON name.
+func (s *Store) CreateIndex(model, field string) error {
+	return s.createIndex(model, field, false)
+}
+
+// CreateOrderedIndex adds an ordered index on a field of a model, supporting both equality
+// and range lookups.
+func (s *Store) CreateOrderedIndex(model, field string) error {
+	return s.createIndex(model, field, true)
+}
+
+// createIndex builds an index from the items already stored and registers it for maintenance.
+func (s *Store) createIndex(model, field string, ordered bool) error {
+	c, ok := s.collection(model)
+	if !ok {
+		return fmt.Errorf("model %q is not registered", model)
+	}
+	f, ok := c.meta.field(field)
+	if !ok {
+		return fmt.Errorf("model %q has no field %q", model, field)
+	}
+	if !ordered && !f.typ.Comparable() {
+		return fmt.Errorf("field %q of model %q cannot be hash indexed", field, model)
+	}
+	if ordered && !orderable(f.typ) {
+		return fmt.Errorf("field %q of model %q cannot be ordered", field, model)
+	}
+
+	idx := &fieldIndex{field: f.name, index: f.index, ordered: ordered}
+	if !ordered {
+		idx.hash = make(map[interface{}]map[int]struct{})
+	}
+
+	// Hold every shard lock while building so no mutation is missed
+	for _, sh := range c.shards {
+		sh.itemMux.Lock()
+	}
+	defer func() {
+		for _, sh := range c.shards {
+			sh.itemMux.Unlock()
+		}
+	}()
+	for _, sh := range c.shards {
+		sh.snapshot().ascend(func(id int, e entry) bool {
+			idx.add(id, e.item)
+			return true
+		})
+	}
+
+	c.indexMux.Lock()
+	defer c.indexMux.Unlock()
+	if c.indexes == nil {
+		c.indexes = make(map[string]*fieldIndex)
+	}
+	c.indexes[f.name] = idx
+	return nil
+}
+
+// createTaggedIndexes creates the indexes declared with `index` struct tags on a model.
+func (s *Store) createTaggedIndexes(model string, meta *modelMeta) {
+	for _, f := range meta.fields {
+		switch f.tag.Get("index") {
+		case "true", "hash":
+			s.CreateIndex(model, f.name)
+		case "ordered":
+			s.CreateOrderedIndex(model, f.name)
+		}
+	}
+}
+
+// index returns the index on a field, if there is one.
+func (c *collection) index(field string) (*fieldIndex, bool) {
+	c.indexMux.RLock()
+	defer c.indexMux.RUnlock()
+
+	idx, ok := c.indexes[field]
+	return idx, ok
+}
+
+// reindex moves an item from its old indexed values to its new ones. Either item may be nil
+// for creations and deletions. It must be called while holding the shard lock.
+func (c *collection) reindex(id int, oldItem, newItem interface{}) {
+	c.indexMux.RLock()
+	defer c.indexMux.RUnlock()
+
+	for _, idx := range c.indexes {
+		if oldItem != nil {
+			idx.remove(id, oldItem)
+		}
+		if newItem != nil {
+			idx.add(id, newItem)
+		}
+	}
+	for _, idx := range c.keyIndexes() {
+		if oldItem != nil {
+			idx.remove(id, oldItem)
+		}
+		if newItem != nil {
+			idx.add(id, newItem)
+		}
+	}
+	if c.geo != nil {
+		if oldItem != nil {
+			c.geo.remove(id, oldItem)
+		}
+		if newItem != nil {
+			c.geo.add(id, newItem)
+		}
+	}
+	for _, idx := range c.prefixes {
+		if oldItem != nil {
+			idx.remove(oldItem)
+		}
+		if newItem != nil {
+			idx.add(newItem)
+		}
+	}
+	c.reindexText(id, oldItem, newItem)
+}
+
+// value returns the indexed field of an item.
+func (idx *fieldIndex) value(item interface{}) reflect.Value {
+	return reflect.Indirect(reflect.ValueOf(item)).FieldByIndex(idx.index)
+}
+
+// add indexes an item.
+func (idx *fieldIndex) add(id int, item interface{}) {
+	v := idx.value(item)
+
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	if !idx.ordered {
+		key := hashKey(v)
+		ids, ok := idx.hash[key]
+		if !ok {
+			ids = make(map[int]struct{})
+			idx.hash[key] = ids
+		}
+		ids[id] = struct{}{}
+		return
+	}
+
+	idx.entries = idx.entries.with(indexEntry{value: v, id: id})
+}
+
+// remove drops an item from the index.
+func (idx *fieldIndex) remove(id int, item interface{}) {
+	v := idx.value(item)
+
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	if !idx.ordered {
+		key := hashKey(v)
+		delete(idx.hash[key], id)
+		if len(idx.hash[key]) == 0 {
+			delete(idx.hash, key)
+		}
+		return
+	}
+
+	idx.entries = idx.entries.without(indexEntry{value: v, id: id})
+}
+
+// lookup returns the IDs whose field equals v.
+func (idx *fieldIndex) lookup(v reflect.Value) []int {
+	if idx.ordered {
+		return idx.lookupRange(v, v)
+	}
+
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	ids := make([]int, 0, len(idx.hash[hashKey(v)]))
+	for id := range idx.hash[hashKey(v)] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// lookupRange returns the IDs whose field lies between min and max (inclusive), ordered by value.
+// An invalid min or max leaves that side of the range open. Only ordered indexes support ranges.
+func (idx *fieldIndex) lookupRange(min, max reflect.Value) []int {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	var ids []int
+	idx.entries.ascendFrom(min, func(entry indexEntry) bool {
+		if max.IsValid() && compareValues(entry.value, max) > 0 {
+			return false
+		}
+		ids = append(ids, entry.id)
+		return true
+	})
+	return ids
+}
+
+// compareEntries orders the entries of an ordered index by value, then by ID.
+func compareEntries(a, b indexEntry) int {
+	if c := compareValues(a.value, b.value); c != 0 {
+		return c
+	}
+	return compareOrdered(a.id < b.id, a.id > b.id)
+}
+
+// depth returns the height of a subtree, 0 when it is empty.
+func (n *indexNode) depth() int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+// joinIndex returns a node of an entry over two subtrees whose heights differ by at most one.
+func joinIndex(e indexEntry, left, right *indexNode) *indexNode {
+	height := left.depth()
+	if right.depth() > height {
+		height = right.depth()
+	}
+	return &indexNode{entry: e, left: left, right: right, height: height + 1}
+}
+
+// balanceIndex returns a node of an entry over two subtrees whose heights differ by at most two,
+// rotating them so they differ by at most one.
+func balanceIndex(e indexEntry, left, right *indexNode) *indexNode {
+	switch {
+	case left.depth() > right.depth()+1:
+		if left.left.depth() >= left.right.depth() {
+			return joinIndex(left.entry, left.left, joinIndex(e, left.right, right))
+		}
+		lr := left.right
+		return joinIndex(lr.entry, joinIndex(left.entry, left.left, lr.left), joinIndex(e, lr.right, right))
+	case right.depth() > left.depth()+1:
+		if right.right.depth() >= right.left.depth() {
+			return joinIndex(right.entry, joinIndex(e, left, right.left), right.right)
+		}
+		rl := right.left
+		return joinIndex(rl.entry, joinIndex(e, left, rl.left), joinIndex(right.entry, rl.right, right.right))
+	}
+	return joinIndex(e, left, right)
+}
+
+// with returns the subtree holding an entry.
+func (n *indexNode) with(e indexEntry) *indexNode {
+	if n == nil {
+		return joinIndex(e, nil, nil)
+	}
+	switch c := compareEntries(e, n.entry); {
+	case c < 0:
+		return balanceIndex(n.entry, n.left.with(e), n.right)
+	case c > 0:
+		return balanceIndex(n.entry, n.left, n.right.with(e))
+	}
+	return joinIndex(e, n.left, n.right)
+}
+
+// without returns the subtree without an entry.
+func (n *indexNode) without(e indexEntry) *indexNode {
+	if n == nil {
+		return nil
+	}
+	switch c := compareEntries(e, n.entry); {
+	case c < 0:
+		return balanceIndex(n.entry, n.left.without(e), n.right)
+	case c > 0:
+		return balanceIndex(n.entry, n.left, n.right.without(e))
+	case n.left == nil:
+		return n.right
+	case n.right == nil:
+		return n.left
+	}
+	// Replace the entry with the first one of the right subtree
+	first := n.right
+	for first.left != nil {
+		first = first.left
+	}
+	return balanceIndex(first.entry, n.left, n.right.without(first.entry))
+}
+
+// ascendFrom calls fn in order for the entries of a subtree whose value is at least min (every
+// entry when min is invalid) until it returns false, and reports whether it never did.
+func (n *indexNode) ascendFrom(min reflect.Value, fn func(indexEntry) bool) bool {
+	if n == nil {
+		return true
+	}
+	if min.IsValid() && compareValues(n.entry.value, min) < 0 {
+		return n.right.ascendFrom(min, fn)
+	}
+	return n.left.ascendFrom(min, fn) && fn(n.entry) && n.right.ascendFrom(min, fn)
+}
+
+// hashKey normalises a field value into a map key. Times are keyed by instant so the same moment
+// in different locations matches.
+func hashKey(v reflect.Value) interface{} {
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.UnixNano()
+	}
+	return v.Interface()
+}
+
+// orderable reports whether values of type t can be compared with compareValues.
+func orderable(t reflect.Type) bool {
+	if t == reflect.TypeOf(time.Time{}) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// compareValues compares two values of the same orderable type, returning -1, 0 or 1.
+func compareValues(a, b reflect.Value) int {
+	if ta, ok := a.Interface().(time.Time); ok {
+		tb := b.Interface().(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	}
+
+	switch a.Kind() {
+	case reflect.String:
+		return compareOrdered(a.String() < b.String(), a.String() > b.String())
+	case reflect.Bool:
+		return compareOrdered(!a.Bool() && b.Bool(), a.Bool() && !b.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareOrdered(a.Int() < b.Int(), a.Int() > b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareOrdered(a.Uint() < b.Uint(), a.Uint() > b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return compareOrdered(a.Float() < b.Float(), a.Float() > b.Float())
+	}
+	return 0
+}
+
+// compareOrdered turns less/greater results into -1, 0 or 1.
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+// File: indexes_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the ordered indexes against a sorted reference as items are added
+// and removed, and that equality filters on fields whose values cannot be compared are rejected.
+
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// scoredItem is a model with an ordered score and a field holding a slice.
+type scoredItem struct {
+	ID    int      `json:"id"`
+	Score int      `json:"score"`
+	Tags  []string `json:"tags"`
+}
+
+func TestOrderedIndexMatchesSortedReference(t *testing.T) {
+	idx := &fieldIndex{field: "Score", index: []int{1}, ordered: true}
+	scores := make(map[int]int)
+	random := rand.New(rand.NewSource(1))
+	for step := 0; step < 3000; step++ {
+		id := random.Intn(500) + 1
+		if score, ok := scores[id]; ok {
+			idx.remove(id, &scoredItem{ID: id, Score: score})
+			delete(scores, id)
+			if random.Intn(2) == 0 {
+				continue
+			}
+		}
+		scores[id] = random.Intn(50)
+		idx.add(id, &scoredItem{ID: id, Score: scores[id]})
+	}
+
+	min, max := reflect.ValueOf(10), reflect.ValueOf(20)
+	var want []int
+	for score := 10; score <= 20; score++ {
+		for id := 1; id <= 500; id++ {
+			if s, ok := scores[id]; ok && s == score {
+				want = append(want, id)
+			}
+		}
+	}
+	if got := idx.lookupRange(min, max); !reflect.DeepEqual(got, want) {
+		t.Fatalf("range 10..20 holds %v, want %v", got, want)
+	}
+	if got := idx.lookupRange(reflect.Value{}, reflect.Value{}); len(got) != len(scores) {
+		t.Fatalf("index holds %d entries, want %d", len(got), len(scores))
+	}
+	var balanced func(n *indexNode) bool
+	balanced = func(n *indexNode) bool {
+		if n == nil {
+			return true
+		}
+		diff := n.left.depth() - n.right.depth()
+		return diff >= -1 && diff <= 1 && balanced(n.left) && balanced(n.right)
+	}
+	if !balanced(idx.entries) {
+		t.Fatal("ordered index is not balanced")
+	}
+}
+
+func TestEqualityOnIncomparableFieldsIsRejected(t *testing.T) {
+	store := newTestStore()
+	store.Register("scored", scoredItem{})
+	store.Create("scored", &scoredItem{Score: 1, Tags: []string{"a"}})
+
+	if _, err := store.matching("scored", []Filter{{Field: "tags", Op: FilterEq, Value: []string{"a"}}}); err == nil {
+		t.Error("equality filter on a slice field accepted")
+	}
+	if found, err := store.matching("scored", []Filter{{Field: "score", Op: FilterEq, Value: 1}}); err != nil || len(found) != 1 {
+		t.Errorf("equality filter on an integer field: %v, %v", found, err)
+	}
+}
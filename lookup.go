@@ -0,0 +1,123 @@
+// File: lookup.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements lookups by natural key. A field tagged `crud:"unique,lookup"`
+// (e.g. the slug of an item) is a secondary key of its model: the store keeps an index from its
+// values to the items, creating or updating an item with a value already taken returns 409, and the
+// item is served at /{model}/by-{field}/{value} (GET /item/by-slug/hello-world) for every method
+// an ?id= request accepts. Items whose field is empty are not indexed.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// crudOption reports whether a field's crud tag holds an option.
+func (f *fieldMeta) crudOption(option string) bool {
+	for _, o := range strings.Split(f.tag.Get("crud"), ",") {
+		if strings.TrimSpace(o) == option {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupFields returns the fields of a model tagged as secondary keys. A lookup field must also be
+// unique; other tagged fields are logged and ignored.
+func lookupFields(m *modelMeta) []*fieldMeta {
+	var fields []*fieldMeta
+	for _, f := range m.fields {
+		if !f.crudOption("lookup") {
+			continue
+		}
+		if !f.crudOption("unique") || !orderable(f.typ) || f.jsonName == "-" {
+			log.Printf("lookup: ignoring lookup field %s.%s, which must be a unique scalar", m.typ.Name(), f.name)
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// newLookupIndexes creates the indexes of the lookup fields of a model, keyed by JSON name.
+func newLookupIndexes(fields []*fieldMeta) map[string]*keyIndex {
+	if len(fields) == 0 {
+		return nil
+	}
+	lookups := make(map[string]*keyIndex, len(fields))
+	for _, f := range fields {
+		idx := newKeyIndex([]*fieldMeta{f})
+		idx.sparse = true
+		lookups[f.jsonName] = idx
+	}
+	return lookups
+}
+
+// GetByLookup retrieves an item of a model by the value of a lookup field (a Go or JSON name).
+func (s *Store) GetByLookup(model, field, value string, result interface{}) bool {
+	id, ok, err := s.lookupID(model, field, value)
+	return err == nil && ok && s.Get(model, id, result)
+}
+
+// lookupID resolves the value of a lookup field to the ID of its item.
+func (s *Store) lookupID(model, field, value string) (int, bool, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return 0, false, fmt.Errorf("model %q is not registered", model)
+	}
+	if f, ok := c.meta.field(field); ok {
+		field = f.jsonName
+	}
+	idx, ok := c.lookups[field]
+	if !ok {
+		return 0, false, fmt.Errorf("model %q has no lookup field %q", model, field)
+	}
+	canonical, err := idx.parse(keyEscaper.Replace(value))
+	if err != nil {
+		return 0, false, err
+	}
+	id, ok := idx.lookup(canonical)
+	return id, ok && s.exists(model, id), nil
+}
+
+// handleLookup serves /{model}/by-{field}/{value} by rewriting it into a request on the item's ID.
+// It reports false when rest does not name a lookup route.
+func handleLookup(store *Store, model, rest string, w http.ResponseWriter, r *http.Request) bool {
+	route, value, ok := strings.Cut(rest, "/")
+	field := strings.TrimPrefix(route, "by-")
+	if !ok || field == route || value == "" {
+		return false
+	}
+	c, ok := store.collection(model)
+	if !ok || c.lookups[field] == nil {
+		return false
+	}
+	if r.Method == http.MethodPost {
+		methodNotAllowed(w, r, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete)
+		return true
+	}
+	id, found, err := store.lookupID(model, field, value)
+	switch {
+	case err != nil:
+		writeError(w, r, http.StatusBadRequest, err)
+		return true
+	case !found:
+		writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+		return true
+	}
+
+	nested := r.Clone(context.WithValue(r.Context(), subpathKey{}, ""))
+	query := nested.URL.Query()
+	query.Set("id", strconv.Itoa(id))
+	nested.URL.RawQuery = query.Encode()
+	handleRequest(store, model, w, nested)
+	return true
+}
@@ -10,29 +10,866 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // Item represents a generic data model for demonstration purposes.
 type Item struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title" index:"true" suggest:"true"`
+	Done   bool   `json:"done" index:"true"`
+	UserID int    `json:"userId,omitempty" index:"true" rel:"belongsTo=user" privacy:"anonymize"`
+	Slug   string `json:"slug,omitempty" crud:"unique,lookup"`
+}
+
+// ItemV1 represents an item in version 1 of the API, which named the done flag completed.
+type ItemV1 struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Completed bool   `json:"completed"`
+	UserID    int    `json:"userId,omitempty"`
+	Slug      string `json:"slug,omitempty"`
+}
+
+// User represents a second data model, stored separately from items with its own IDs.
+type User struct {
 	ID    int    `json:"id"`
-	Title string `json:"title"`
-	Done  bool   `json:"done"`
+	Name  string `json:"name"`
+	Email string `json:"email" index:"true" crud:"unique" mask:"email"`
+	Token string `json:"token,omitempty" encrypt:"true" mask:"last4"`
+}
+
+// Tag represents a label that can be attached to any number of items.
+type Tag struct {
+	ID   int    `json:"id"`
+	Name string `json:"name" index:"true"`
+}
+
+// OrderLine represents one line of an order, keyed by the order and its position in it rather
+// than by an ID.
+type OrderLine struct {
+	OrderID  int    `json:"orderId" key:"true"`
+	LineNo   int    `json:"lineNo" key:"true"`
+	Product  string `json:"product"`
+	Quantity int    `json:"quantity"`
+}
+
+// Comment represents a remark on either an item or a user, named by SubjectType and SubjectID.
+// Comments are deleted along with their subject.
+type Comment struct {
+	ID          int    `json:"id"`
+	SubjectType string `json:"subjectType" index:"true"`
+	SubjectID   int    `json:"subjectId" index:"true" rel:"belongsTo=item|user,type=SubjectType,as=subject,onDelete=cascade"`
+	Body        string `json:"body"`
+}
+
+// Entry represents a line of a ledger. Entries are immutable: a mistake is fixed by appending an
+// entry correcting it.
+type Entry struct {
+	ID       int    `json:"id"`
+	Account  string `json:"account" index:"true"`
+	Amount   int64  `json:"amount"` // in cents
+	Memo     string `json:"memo,omitempty"`
+	Corrects int    `json:"corrects,omitempty" index:"true" immutable:"corrects"`
+}
+
+// Place represents a point of interest, found by its distance to a point with ?near=.
+type Place struct {
+	ID       int      `json:"id"`
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind" index:"true"`
+	Location Location `json:"location"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(runRestore(os.Args[2:]))
+	}
+
+	port := flag.Int("port", 8080, "HTTP port to listen on")
+	redisAddr := flag.String("redis", "", "Redis address (host:port) used to broadcast change events")
+	redisChannel := flag.String("redis-channel", "crud:changes", "Redis Pub/Sub channel for change events")
+	redisPassword := flag.String("redis-password", "", "Redis password")
+	mqttAddr := flag.String("mqtt", "", "MQTT broker address (host:port) to publish change events to")
+	mqttTopic := flag.String("mqtt-topic", "crud/{model}/{op}/{id}", "MQTT topic template ({model}, {op}, {id})")
+	mqttUser := flag.String("mqtt-user", "", "MQTT username")
+	mqttPassword := flag.String("mqtt-password", "", "MQTT password")
+	sweepInterval := flag.Duration("sweep-interval", 10*time.Second, "How often expired items are removed")
+	retentionSpec := flag.String("retention", "", "Retention rules as model=maxAge[:delete|archive], comma-separated; ages like 90d, 2w or 36h")
+	retentionInterval := flag.Duration("retention-interval", time.Hour, "How often retention rules are applied")
+	retentionDryRun := flag.Bool("retention-dry-run", false, "Only report the items retention rules would purge")
+	retentionArchive := flag.String("retention-archive", "", "File archived items are appended to (JSON lines)")
+	capacitySpec := flag.String("max-items", "", "Item limits as model=maxItems[:lru|fifo], comma-separated")
+	immutableSpec := flag.String("immutable", "entry=correct", "Append-only models as model[=reject|correct], comma-separated")
+	viewsFile := flag.String("views-file", "", "File the saved queries of /_views are persisted to (kept in memory when empty)")
+	collation := flag.String("collation", "", "Locale strings are sorted in with ?sort=, a BCP 47 tag such as de, sv or es-MX (byte order when empty)")
+	fullText := flag.String("fulltext", "item", "Comma-separated models whose string fields are kept in a full-text index for /{model}/_search")
+	fullTextEngine := flag.String("fulltext-engine", "bleve", "Full-text index of the -fulltext models: bleve, or builtin for the built-in inverted index")
+	idempotencyWindow := flag.Duration("idempotency-window", 24*time.Hour, "How long the response to a POST with an Idempotency-Key is replayed to retries (0 disables the header)")
+	relationLinks := flag.Bool("relation-links", false, "Link the relations of returned items that are not included")
+	requireIfMatch := flag.Bool("require-if-match", false, "Reject updates and deletes without an If-Match header")
+	negativeCache := flag.Duration("negative-cache", 0, "Answer GETs of IDs found missing with 404 for this long without looking them up (0 disables)")
+	coalesceReads := flag.Bool("coalesce-reads", false, "Answer concurrent identical GETs of the model routes with a single read")
+	responseCache := flag.Duration("response-cache", 0, "Serve repeated GETs of the model routes from memory for this long (0 disables the cache)")
+	responseCacheSize := flag.Int("response-cache-size", 10000, "Maximum number of cached responses")
+	cacheSpec := flag.String("cache-control", "", "Cache-Control headers as model.list|item|write=value, semicolon-separated (model * for every model)")
+	dataFile := flag.String("data-file", "", "Path of the memory-mapped data file items are persisted to")
+	storageCache := flag.Int("storage-cache", 0, "Number of items of the data file cached in memory for reads (0 disables the cache)")
+	writeBehind := flag.Duration("write-behind", 0, "Acknowledge writes from memory and flush them to the data file at this interval (0 writes through)")
+	writeBehindQueue := flag.Int("write-behind-queue", 100000, "Maximum number of writes waiting to be flushed; writers wait when it is full")
+	encryptionKeys := flag.String("encryption-keys", "", "Keys encrypting the data and mirror files, as id:base64 AES keys, comma-separated, the first sealing new items (default $"+EncryptionKeysEnv+")")
+	privilegedToken := flag.String("privileged-token", "", "Bearer token of the callers seeing the masked fields unmasked (none when empty)")
+	backupTarget := flag.String("backup-target", "", "Where backups are written: a directory, s3://bucket/prefix or gs://bucket/prefix (credentials from the environment)")
+	backupInterval := flag.Duration("backup-interval", 0, "How often a backup is taken (0 only takes them on POST /_backups)")
+	backupKeep := flag.Int("backup-keep", 7, "Number of backups kept; older ones are deleted (0 keeps all)")
+	walPath := flag.String("wal", "", "Path of the write-ahead log every mutation is recorded to, for point-in-time recovery at /_restore?to=")
+	signaturesPath := flag.String("signatures", "", "Path of the chain of signed records every mutation is recorded in, verified at /_signatures/verify")
+	signingKey := flag.String("signing-key", "", "Key signing the records: hmac:<base64 key> or ed25519:<base64 seed>")
+	walSync := flag.Bool("wal-sync", true, "Flush every mutation written to the WAL to stable storage before acknowledging it")
+	backupEncrypt := flag.Bool("backup-encrypt", false, "Seal backups with the keys of -encryption-keys")
+	auditLog := flag.String("audit-log", "", "File the audit entries of privacy actions are appended to (JSON lines; logged when empty)")
+	receiptKey := flag.String("receipt-key", "", "Key signing the receipts of /_privacy/erase (random, so receipts cannot be verified after a restart, when empty)")
+	rotateKeys := flag.Bool("rotate-encryption-keys", false, "Reseal the items of the data and mirror files sealed with an older key, or unencrypted, on startup")
+	mirrorFile := flag.String("mirror-file", "", "Path of a secondary data file every mutation is mirrored to")
+	reconcileInterval := flag.Duration("reconcile-interval", 10*time.Minute, "How often the mirror is compared with the store and repaired")
+	reconcileDryRun := flag.Bool("reconcile-dry-run", false, "Only report the drift of the mirror without repairing it")
+	rateLimit := flag.Float64("rate-limit", 0, "Requests per second allowed to each client (0 disables rate limiting)")
+	rateBurst := flag.Int("rate-burst", 0, "Requests each client may send in a burst (the rate, at least 1, when 0)")
+	rateLimitBy := flag.String("rate-limit-by", LimitByIP, "How clients are rate limited: ip, or key (the X-API-Key header, the IP address without one)")
+	rateLimitRedis := flag.String("rate-limit-redis", "", "Redis address (host:port) the rate-limit buckets are shared in (kept in memory when empty; authenticates with -redis-password)")
+	apiKeysFile := flag.String("api-keys", "", "JSON file of the API keys requests must carry in X-API-Key, with their owners and quotas (no keys are required when empty)")
+	apiKeyQuota := flag.String("api-key-quota", "", "Default quota of the API keys as daily=N,monthly=N,daily_mutations=N,monthly_mutations=N")
+	usageFile := flag.String("usage-file", "", "File the usage counters of the API keys are saved to every 10s and loaded from on startup")
+	tenantQuota := flag.String("tenant-quota", "", "Default tenant quota as items=N,rate=R,burst=B,payload=BYTES")
+	tenantList := flag.String("tenants", "", "Tenants served besides the ones bound to API keys or holding items, comma-separated; the admin token creates others")
+	raftID := flag.String("raft-id", "", "Advertised base URL of this node (e.g. http://10.0.0.1:8080); enables clustered mode")
+	raftAddr := flag.String("raft-addr", "", "Address (host:port) the Raft transport of this node listens at and is reached at by the others")
+	raftPeers := flag.String("raft-peers", "", "Other cluster nodes as url=host:port pairs of their base URL and Raft address, comma-separated")
+	raftDir := flag.String("raft-dir", "", "Directory the Raft log and snapshots are persisted to (kept in memory when empty)")
+	gossipAddr := flag.String("gossip-addr", "", "Advertised base URL of this node; enables peer-to-peer replication")
+	gossipSeeds := flag.String("gossip-seeds", "", "Base URLs of the peers to join through, comma-separated")
+	gossipSlot := flag.Int("gossip-slot", 0, "Slot of the IDs this node creates in peer-to-peer mode, distinct per node, from 1 to 1023 (default: the position of -gossip-addr among the sorted seeds)")
+	replicaOf := flag.String("replica-of", "", "Base URL of the primary to replicate; serves reads locally and forwards writes")
+	replicaInterval := flag.Duration("replica-interval", 500*time.Millisecond, "How often a replica polls the primary's change feed")
+	clusterSelf := flag.String("cluster-self", "", "Advertised base URL of this node; enables primary election among -cluster-nodes")
+	clusterNodes := flag.String("cluster-nodes", "", "Base URLs of the nodes electing a primary, comma-separated")
+	partitionSelf := flag.String("partition-self", "", "Advertised base URL of this node; enables partitioned mode")
+	partitionNodes := flag.String("partition-nodes", "", "Base URLs of the nodes of the partition ring, comma-separated")
+	replicationFactor := flag.Int("replication-factor", 2, "Number of nodes each item is stored on in partitioned mode")
+	clusterSecret := flag.String("cluster-secret", "", "Secret shared by the nodes of a cluster, signing the requests they send each other; required by the gossip, partitioned, election and clustered modes (default $"+ClusterSecretEnv+")")
+	syncEnabled := flag.Bool("sync", false, "Enable the offline sync protocol at /{model}/_sync")
+	eventLogPath := flag.String("event-log", "", "Path of the append-only event log; state is rebuilt from it on startup")
+	adminPanel := flag.Bool("admin", false, "Serve the admin panel at /_admin")
+	adminToken := flag.String("admin-token", "", "Bearer token of the callers allowed on the admin routes (exports, imports, restores, backups, /_cdc, /_events, /_tenants, /_replica/snapshot and /_privacy/*), which are refused without it; replicas send it to their primary")
+	fixturesDir := flag.String("fixtures", "", "Directory of JSON or YAML fixture files upserted into the store on startup")
+	messagesDir := flag.String("messages", "", "Directory of message catalogs (<locale>.json) translating error messages")
+	fallbackLocale := flag.String("locale", "", "Locale of the error messages of requests accepting no language with a catalog")
+	envelopeResponses := flag.Bool("envelope", false, "Wrap the responses of the model routes as {\"data\": ..., \"meta\": {...}, \"error\": null}")
+	pathsFlag := flag.String("paths", "rewrite", "How paths with duplicate or trailing slashes are handled: rewrite (serve the normalized path), redirect (308 to it) or strict")
+	apiVersions := flag.String("api-versions", "", "API versions mounting the model routes under /{version}, as name[:deprecated[:sunset]] dates, comma-separated (e.g. v1:2024-11-01:2025-06-01,v2)")
+	jsonNamingFlag := flag.String("json-naming", "", "Naming convention of the JSON fields without a json tag: go (default), snake_case or camelCase")
+	flag.Parse()
+
+	// Set the JSON naming convention before the models are registered
+	naming, err := ParseJSONNaming(*jsonNamingFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	SetJSONNaming(naming)
+	paths, err := ParsePathNormalization(*pathsFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	SetPathNormalization(paths)
+
 	// Create a new instance of the generic Store
 	store := NewStore()
+	store.Register("item", Item{})
+	store.Register("user", User{})
+	store.Register("tag", Tag{})
+	store.Register("comment", Comment{})
+	store.Register("orderline", OrderLine{})
+	store.Register("entry", Entry{})
+	store.Register("place", Place{})
+	if err := store.RegisterManyToMany("item", "tag"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Maintain read models from the mutation stream; subscribed first so they also see replayed events
+	projections := NewProjections()
+	projections.Register("item-titles", NewProjection(map[int]string{}, func(state interface{}, event ChangeEvent) interface{} {
+		titles := state.(map[int]string)
+		if event.Model != "item" {
+			return titles
+		}
+		if item, ok := event.Item.(*Item); ok {
+			titles[event.ID] = item.Title
+		} else if event.Op == OpDelete {
+			delete(titles, event.ID)
+		}
+		return titles
+	}))
+	store.Subscribe(projections.Apply)
+
+	// Maintain aggregate views incrementally on every write
+	views := NewProjections()
+	itemsByStatus := NewView("item")
+	itemsByStatus.Group = func(item interface{}) string {
+		if item.(*Item).Done {
+			return "done"
+		}
+		return "open"
+	}
+	views.Register("items-by-status", itemsByStatus)
+	store.Subscribe(views.Apply)
+
+	// Keep the saved queries run at /_views/{name}/run
+	savedQueries, err := OpenSavedQueries(store, *viewsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Encrypt the items of the data files, and the encrypted fields wherever they are written, with
+	// the keys of the flag or the environment
+	keyring, err := KeyringFromEnv()
+	if *encryptionKeys != "" {
+		keyring, err = ParseKeyring(*encryptionKeys)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	SetFieldKeys(keyring)
+
+	// Mask the personal data of the responses but for the callers holding the privileged token
+	if *privilegedToken != "" {
+		expected := []byte("Bearer " + *privilegedToken)
+		store.SetPrivileged(func(r *http.Request) bool {
+			return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+		})
+	}
+	encrypted := func(storage Storage) Storage {
+		if keyring == nil {
+			return storage
+		}
+		sealed := NewEncryptedStorage(storage, keyring)
+		if *rotateKeys {
+			resealed, err := sealed.Rotate(context.Background())
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("encryption: resealed %d items with the primary key", resealed)
+		}
+		return sealed
+	}
+
+	// Write every mutation ahead to the WAL, and sign it in the signature chain
+	if *walPath != "" {
+		wal, err := OpenEventLog(*walPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		wal.Sync = *walSync
+		if err := store.SetWAL(wal); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *signaturesPath != "" {
+		if *signingKey == "" {
+			log.Fatal("-signatures requires -signing-key")
+		}
+		signer, err := ParseRecordSigner(*signingKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		chain, err := OpenSignatureChain(*signaturesPath, signer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := store.SetSignatureChain(chain); err != nil {
+			log.Fatal(err)
+		}
+		http.HandleFunc("/_signatures", func(w http.ResponseWriter, r *http.Request) {
+			handleSignatures(store, w, r)
+		})
+		http.HandleFunc("/_signatures/", func(w http.ResponseWriter, r *http.Request) {
+			handleSignatures(store, w, r)
+		})
+	}
+
+	// Load the items persisted in the data file and write every change through to it
+	var backends []Storage
+	if *dataFile != "" {
+		file, err := OpenMmapStorage(*dataFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage := encrypted(file)
+		if err := store.Load(storage); err != nil {
+			log.Fatal(err)
+		}
+		var backend Storage = storage
+		if *writeBehind > 0 {
+			queue := NewWriteBehindStorage(storage, *writeBehind)
+			queue.MaxPending = *writeBehindQueue
+			backend = queue
+		}
+		if *storageCache > 0 {
+			backend = NewCachedStorage(backend, *storageCache)
+		}
+		store.SetStorage(backend)
+		backends = append(backends, backend)
+	}
+
+	// Mirror every mutation to a secondary data file and repair its drift on a schedule
+	if *mirrorFile != "" {
+		file, err := OpenMmapStorage(*mirrorFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mirror := encrypted(file)
+		store.SetMirror(mirror)
+		backends = append(backends, mirror)
+		reconciler := NewReconciler(store, mirror)
+		reconciler.DryRun = *reconcileDryRun
+		reconciler.Start(*reconcileInterval)
+	}
+
+	// Save the indexes on shutdown so the next start does not rescan the data files
+	if len(backends) > 0 {
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			for _, backend := range backends {
+				if err := backend.Close(); err != nil {
+					log.Print(err)
+				}
+			}
+			os.Exit(0)
+		}()
+	}
+
+	// Track per-field registers for offline clients; enabled before loading so loaded items are covered
+	if *syncEnabled {
+		store.EnableSync()
+	}
+
+	// Rebuild state from the event log and keep appending every change to it
+	var eventLog *EventLog
+	if *eventLogPath != "" {
+		var err error
+		if eventLog, err = OpenEventLog(*eventLogPath); err != nil {
+			log.Fatal(err)
+		}
+		if err := eventLog.Replay(store); err != nil {
+			log.Fatal(err)
+		}
+		store.Subscribe(eventLog.Append)
+	}
+
+	// Broadcast changes to other replicas through Redis Pub/Sub
+	if *redisAddr != "" {
+		broadcaster := NewRedisBroadcaster(*redisAddr, *redisChannel)
+		broadcaster.Password = *redisPassword
+		store.Subscribe(broadcaster.Publish)
+		broadcaster.Listen(store.invalidateRemote)
+	}
+
+	// Publish changes to an MQTT broker for IoT dashboards and edge devices
+	if *mqttAddr != "" {
+		bridge := NewMQTTBridge(*mqttAddr, *mqttTopic)
+		bridge.Username = *mqttUser
+		bridge.Password = *mqttPassword
+		store.Subscribe(bridge.Publish)
+	}
+
+	// Bound the number of items per model
+	if *capacitySpec != "" {
+		capacities, err := ParseCapacities(*capacitySpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for model, capacity := range capacities {
+			if err := store.SetCapacity(model, capacity); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// Refuse updates and deletes of append-only models
+	immutable, err := ParseImmutability(*immutableSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for model, mode := range immutable {
+		if err := store.SetImmutable(model, mode); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Sort strings in the order of a locale
+	if *collation != "" {
+		collator, err := NewCollator(*collation)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store.SetCollator(collator)
+	}
+
+	// Index the text of the models searched with /{model}/_search
+	for _, model := range splitFields(*fullText) {
+		var index TextIndex
+		switch *fullTextEngine {
+		case "bleve":
+			bleveIndex, err := NewBleveIndex()
+			if err != nil {
+				log.Fatal(err)
+			}
+			index = bleveIndex
+		case "builtin":
+			index = NewInvertedIndex()
+		default:
+			log.Fatalf("unknown full-text engine %q", *fullTextEngine)
+		}
+		if err := store.SetFullText(model, index); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Load the message catalogs of error responses
+	if *messagesDir != "" {
+		locales, err := LoadCatalogs(*messagesDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("messages: loaded catalogs %s from %s", strings.Join(locales, ", "), *messagesDir)
+	}
+	if *fallbackLocale != "" {
+		SetFallbackLocale(*fallbackLocale)
+	}
+
+	// Upsert the fixture files, once the data file and the event log are loaded and every listener
+	// is subscribed
+	if *fixturesDir != "" {
+		n, err := store.LoadFixtures(*fixturesDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("fixtures: loaded %d items from %s", n, *fixturesDir)
+	}
+
+	// Declare the Cache-Control headers of the model routes
+	if *cacheSpec != "" {
+		policies, err := ParseCachePolicies(*cacheSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for model, policy := range policies {
+			if err := store.SetCachePolicy(model, policy); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	store.SetRequireIfMatch(*requireIfMatch)
+	store.SetRelationLinks(*relationLinks)
+	if *idempotencyWindow > 0 {
+		store.SetIdempotency(NewIdempotency(*idempotencyWindow))
+	}
+
+	if *negativeCache > 0 {
+		store.SetNegativeCache(NewNegativeCache(*negativeCache))
+	}
+	if *coalesceReads {
+		store.SetCoalescer(NewCoalescer())
+	}
+
+	// Answer bursts of identical GETs from memory until the model changes
+	if *responseCache > 0 {
+		if *partitionSelf != "" {
+			log.Fatal("-response-cache cannot be used in partitioned mode, where other nodes change the results")
+		}
+		store.SetResponseCache(NewResponseCache(*responseCache, *responseCacheSize))
+	}
 
-	// Register CRUD operations for the "Item" data model
-	http.HandleFunc("/item", func(w http.ResponseWriter, r *http.Request) {
-		handleRequest(store, reflect.TypeOf(Item{}), w, r)
+	// Sign the requests between the nodes of a cluster; their peer routes are refused without a secret
+	cluster := NewClusterAuth(*clusterSecret)
+	if cluster == nil && (*gossipAddr != "" || *partitionSelf != "" || *clusterSelf != "" || *raftID != "") {
+		log.Fatal("-gossip-addr, -partition-self, -cluster-self and -raft-id require -cluster-secret")
+	}
+
+	// Replicate changes to peers discovered through gossip
+	if *gossipAddr != "" {
+		if *raftID != "" {
+			log.Fatal("-gossip-addr and -raft-id select different replication modes")
+		}
+		gossip := NewGossip(store, *gossipAddr, strings.Split(*gossipSeeds, ","))
+		gossip.Auth = cluster
+		gossip.AdminToken = *adminToken
+		if *gossipSlot != 0 {
+			gossip.Slot = *gossipSlot
+		}
+		if err := gossip.Start(); err != nil {
+			log.Fatal(err)
+		}
+		store.Subscribe(gossip.Publish)
+		http.HandleFunc("/_gossip/", gossip.handleGossip)
+	}
+
+	// Spread items over a consistent-hashing ring of nodes
+	if *partitionSelf != "" {
+		if *raftID != "" || *gossipAddr != "" || *replicaOf != "" {
+			log.Fatal("-partition-self cannot be combined with -raft-id, -gossip-addr or -replica-of")
+		}
+		partitioner := NewPartitioner(store, *partitionSelf, strings.Split(*partitionNodes, ","))
+		partitioner.ReplicationFactor = *replicationFactor
+		partitioner.Auth = cluster
+		partitioner.AdminToken = *adminToken
+		if err := partitioner.Start(); err != nil {
+			log.Fatal(err)
+		}
+		http.HandleFunc("/_partition/", partitioner.handlePartition)
+	}
+
+	// Remove expired items in the background
+	store.StartSweeper(*sweepInterval)
+
+	// Apply the data retention rules on a schedule
+	if *retentionSpec != "" {
+		policies, err := ParseRetentionPolicies(*retentionSpec, *retentionDryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		job := NewRetentionJob(store, policies...)
+		if *retentionArchive != "" {
+			archive, err := os.OpenFile(*retentionArchive, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			job.Archive = archive
+		}
+		job.Start(*retentionInterval)
+	}
+
+	// Enforce tenant quotas and account their usage
+	tenants := NewTenants(store)
+	if *tenantQuota != "" {
+		quota, err := ParseTenantQuota(*tenantQuota)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tenants.Default = quota
+	}
+	tenants.AdminToken = *adminToken
+	for _, tenant := range strings.Split(*tenantList, ",") {
+		if tenant = strings.TrimSpace(tenant); tenant != "" {
+			if !validTenant(tenant) {
+				log.Fatalf("invalid tenant %q in -tenants", tenant)
+			}
+			tenants.Allow(tenant)
+		}
+	}
+
+	// Register CRUD operations for the data models
+	models := []string{"item", "user", "tag", "comment", "orderline", "entry", "place"}
+	modelRoutes := http.NewServeMux()
+	for _, model := range models {
+		model := model
+		serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handleTenantRequest(tenants, model, w, r)
+		})
+		modelRoutes.Handle("/"+model, serve)
+		modelRoutes.Handle("/"+model+"/", serve)
+	}
+	modelRoutes.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		notFound(w, r, "Not found")
+	})
+	envelop := func(handler http.Handler) http.Handler {
+		if *envelopeResponses {
+			return Envelope(handler)
+		}
+		return handler
+	}
+	for _, model := range models {
+		http.Handle("/"+model, envelop(modelRoutes))
+		http.Handle("/"+model+"/", envelop(modelRoutes))
+	}
+
+	// Mount the model routes under each API version, where v1 still calls the done flag completed
+	if *apiVersions != "" {
+		versions, err := ParseAPIVersions(store, *apiVersions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, version := range versions {
+			if version.Name == "v1" {
+				version.Transform("item", ItemV1{}, func(stored interface{}) interface{} {
+					item := stored.(*Item)
+					return ItemV1{ID: item.ID, Title: item.Title, Completed: item.Done, UserID: item.UserID, Slug: item.Slug}
+				}, func(version interface{}) interface{} {
+					item := version.(*ItemV1)
+					return &Item{ID: item.ID, Title: item.Title, Done: item.Completed, UserID: item.UserID, Slug: item.Slug}
+				})
+			}
+			http.Handle("/"+version.Name+"/", envelop(version.Handler(modelRoutes)))
+		}
+	}
+
+	// Answer the paths matching no route with the not-found handler
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		notFound(w, r, "Not found")
+	})
+
+	// Describe the model routes as an OpenAPI document, serve an explorer driven by it, generate
+	// typed clients and export a Postman collection
+	http.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		handleOpenAPI(store, models, w, r)
+	})
+	http.Handle("/_docs/", explorerHandler())
+	http.HandleFunc("/_sdk/go", func(w http.ResponseWriter, r *http.Request) {
+		handleGoClient(store, models, w, r)
+	})
+	http.HandleFunc("/_sdk/typescript", func(w http.ResponseWriter, r *http.Request) {
+		handleTypeScriptClient(store, models, w, r)
+	})
+	http.HandleFunc("/_postman.json", func(w http.ResponseWriter, r *http.Request) {
+		handlePostman(store, models, w, r)
+	})
+	http.Handle("/_docs", http.RedirectHandler("/_docs/", http.StatusMovedPermanently))
+
+	// List, filter and edit the items of every model from the browser
+	if *adminPanel {
+		http.Handle("/_admin/", adminHandler(store, models))
+		http.Handle("/_admin", http.RedirectHandler("/_admin/", http.StatusMovedPermanently))
+	}
+
+	// Serve every model inside a tenant's namespace as /t/{tenant}/{model}, also under the versions
+	serveTenantPath := func(w http.ResponseWriter, r *http.Request) {
+		handleTenantPath(tenants, w, r)
+	}
+	http.HandleFunc("/t/", serveTenantPath)
+	modelRoutes.HandleFunc("/t/", serveTenantPath)
+	serveTenantUsage := adminOnly(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+		handleTenantUsage(tenants, w, r)
 	})
+	http.HandleFunc("/_tenants", serveTenantUsage)
+	http.HandleFunc("/_tenants/", serveTenantUsage)
+
+	// Apply lists of operations across models atomically
+	http.HandleFunc("/_batch", func(w http.ResponseWriter, r *http.Request) {
+		handleTenantBatch(tenants, w, r)
+	})
+
+	// Verify the items of the data files against their checksums
+	http.HandleFunc("/_verify", func(w http.ResponseWriter, r *http.Request) {
+		handleVerify(store, w, r)
+	})
+
+	// Back the store up on a schedule, and restore chosen backups or the state of a past time
+	var backups *BackupJob
+	if *backupTarget != "" {
+		target, err := ParseBackupTarget(*backupTarget)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backups = NewBackupJob(store, target)
+		backups.Keep = *backupKeep
+		if *backupEncrypt {
+			if keyring == nil {
+				log.Fatal("-backup-encrypt requires -encryption-keys")
+			}
+			backups.Keys = keyring
+		}
+		if *backupInterval > 0 {
+			backups.Start(*backupInterval)
+		}
+		http.HandleFunc("/_backups", adminOnly(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+			handleBackups(backups, w, r)
+		}))
+	}
+	if backups != nil || *walPath != "" {
+		http.HandleFunc("/_restore", adminOnly(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+			handleRestore(store, backups, w, r)
+		}))
+	}
+
+	// Export the whole store as a portable dump, and restore dumps
+	http.HandleFunc("/_export", adminOnly(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+		handleExport(store, w, r)
+	}))
+	http.HandleFunc("/_import", adminOnly(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+		handleImport(store, w, r)
+	}))
+
+	// Answer the data-subject requests of the GDPR, recording erasures in the audit log
+	if *auditLog != "" {
+		audit, err := os.OpenFile(*auditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer audit.Close()
+		store.SetAuditLog(audit)
+	}
+	key := []byte(*receiptKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal(err)
+		}
+	}
+	store.SetReceiptKey(key)
+	http.HandleFunc("/_privacy/export", adminOnly(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+		handlePrivacyExport(store, w, r)
+	}))
+	http.HandleFunc("/_privacy/erase", adminOnly(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+		handlePrivacyErase(store, w, r)
+	}))
+
+	// Expose the change data capture feed, and the snapshot read replicas start from
+	http.HandleFunc("/_cdc", adminOnly(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+		handleCDC(store, w, r)
+	}))
+	http.HandleFunc("/_replica/snapshot", adminOnly(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+		handleReplicaSnapshot(store, w, r)
+	}))
+
+	// Serve the read-only projections
+	http.HandleFunc("/_projections/", func(w http.ResponseWriter, r *http.Request) {
+		handleProjection(projections, "/_projections", w, r)
+	})
+
+	// Serve the materialized aggregate views and the saved queries
+	http.HandleFunc("/_views", func(w http.ResponseWriter, r *http.Request) {
+		handleViews(views, savedQueries, w, r)
+	})
+	http.HandleFunc("/_views/", func(w http.ResponseWriter, r *http.Request) {
+		handleViews(views, savedQueries, w, r)
+	})
+
+	// Expose the history recorded in the event log
+	if eventLog != nil {
+		http.HandleFunc("/_events", adminOnly(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+			handleHistory(store, eventLog, w, r)
+		}))
+	}
+
+	// Replicate writes through the Raft log in clustered mode
+	var handler http.Handler = http.DefaultServeMux
+	if *raftID != "" {
+		if *dataFile != "" || *eventLogPath != "" {
+			log.Fatal("clustered mode rebuilds the store from the Raft log; -data-file and -event-log cannot be used with it")
+		}
+		node, err := NewRaftNode(store, *raftID, *raftAddr, strings.Split(*raftPeers, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		node.Dir = *raftDir
+		node.Auth = cluster
+		node.AdminToken = *adminToken
+		if err := node.Start(http.DefaultServeMux); err != nil {
+			log.Fatal(err)
+		}
+		handler = node.Handler()
+		http.HandleFunc("/_leader", func(w http.ResponseWriter, r *http.Request) {
+			handleRaftLeader(node, w, r)
+		})
+	}
+
+	// Serve reads from a local copy of the primary and forward writes to it in replica mode
+	if *replicaOf != "" {
+		if *raftID != "" || *gossipAddr != "" {
+			log.Fatal("-replica-of cannot be combined with -raft-id or -gossip-addr")
+		}
+		replica, err := NewReplica(store, *replicaOf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		replica.Interval = *replicaInterval
+		replica.Token = *adminToken
+		replica.Start()
+		handler = replica.Handler(handler)
+	}
+
+	// Elect a primary: the leader accepts writes and the other nodes follow it as read replicas
+	if *clusterSelf != "" {
+		if *raftID != "" || *gossipAddr != "" || *replicaOf != "" || *partitionSelf != "" {
+			log.Fatal("-cluster-self cannot be combined with -raft-id, -gossip-addr, -replica-of or -partition-self")
+		}
+		election := NewElection(*clusterSelf, strings.Split(*clusterNodes, ","))
+		election.Auth = cluster
+		follower, err := NewReplica(store, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		follower.Interval = *replicaInterval
+		follower.Token = *adminToken
+		election.OnChange = func(leader string) {
+			if leader == election.Self {
+				leader = ""
+			}
+			if err := follower.SetPrimary(leader); err != nil {
+				log.Print(err)
+			}
+		}
+		follower.Start()
+		election.Start()
+		handler = election.Handler(handler, follower.Handler(handler))
+	}
+
+	// Serve the POST requests overriding their method as that method, on normalized paths
+	handler = withMethodOverride(withPathNormalization(http.DefaultServeMux, handler))
+
+	// Require an API key, metered and held to its daily and monthly quotas, on every request
+	if *apiKeysFile != "" {
+		apiKeys, err := LoadAPIKeys(*apiKeysFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if apiKeys.Default, err = ParseKeyQuota(*apiKeyQuota); err != nil {
+			log.Fatal(err)
+		}
+		tenants.Allow(apiKeys.Tenants()...)
+		if *usageFile != "" {
+			if err := apiKeys.OpenUsage(*usageFile); err != nil {
+				log.Fatal(err)
+			}
+			apiKeys.Start(10 * time.Second)
+		}
+		handler = apiKeys.Handler(handler)
+	}
+
+	// Limit the request rate of each client, answering 429 once its bucket is empty
+	if *rateLimit > 0 {
+		if *rateLimitBy != LimitByIP && *rateLimitBy != LimitByKey {
+			log.Fatalf("invalid -rate-limit-by %q: expected ip or key", *rateLimitBy)
+		}
+		var limiter Limiter = NewMemoryLimiter(*rateLimit, *rateBurst)
+		if *rateLimitRedis != "" {
+			redisLimiter := NewRedisLimiter(*rateLimitRedis, *rateLimit, *rateBurst)
+			redisLimiter.Password = *redisPassword
+			limiter = redisLimiter
+		}
+		handler = withRateLimit(limiter, *rateLimitBy, handler)
+	}
+
+	// Authenticate the requests of the other nodes before the API keys and rate limits exempt them
+	handler = cluster.Handler(handler)
+
+	// Give every request an ID, reported in its error responses
+	handler = withRequestID(handler)
 
-	// Start the HTTP server on port 8080
-	port := 8080
-	fmt.Printf("Starting server on port %d...\n", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	// Start the HTTP server
+	fmt.Printf("Starting server on port %d...\n", *port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), handler))
 }
@@ -0,0 +1,311 @@
+// File: many_to_many.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements many-to-many relations. Linking two models (e.g. items and tags)
+// registers a junction model whose items are the links between them, so links are persisted,
+// replicated and scoped to tenants like any other item. GET /item/{id}/tag lists the tags of an
+// item and PUT /item/{id}/tag replaces them with a JSON array of tag IDs; the same routes work in
+// the other direction (/tag/{id}/item). The links themselves are managed below
+// /item/{id}/relationships/tag: GET lists the linked IDs, POST adds links to a JSON array of IDs and
+// DELETE /item/{id}/relationships/tag/{tagID} removes one. Deleting an item deletes its links.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Link is an item of a junction model, linking an item of the first model to one of the second.
+type Link struct {
+	ID   int `json:"id"`
+	From int `json:"from" index:"true"`
+	To   int `json:"to" index:"true"`
+}
+
+// ManyToMany is a many-to-many relation between two models.
+type ManyToMany struct {
+	From     string
+	To       string
+	Junction string // model holding the links
+}
+
+// RegisterManyToMany links the items of two registered models through a junction model named
+// "{from}_{to}", and serves the links at /{from}/{id}/{to} and /{to}/{id}/{from}.
+// It must be called before the store is used concurrently.
+func (s *Store) RegisterManyToMany(from, to string) error {
+	for _, model := range []string{from, to} {
+		if meta, ok := s.meta(model); !ok || meta.id == nil {
+			return fmt.Errorf("model %q is not registered or has no ID", model)
+		}
+	}
+	relation := &ManyToMany{From: from, To: to, Junction: from + "_" + to}
+	s.Register(relation.Junction, Link{})
+
+	s.typeMux.Lock()
+	s.manyToMany = append(s.manyToMany, relation)
+	s.typeMux.Unlock()
+
+	// Delete the links of deleted items
+	s.Subscribe(func(event ChangeEvent) {
+		if event.Op != OpDelete {
+			return
+		}
+		tenant, model, _ := splitTenantModel(event.Model)
+		for _, field := range relation.sides(model) {
+			junction := tenantModel(tenant, relation.Junction)
+			for _, link := range s.links(junction, field, event.ID) {
+				s.Delete(junction, link.ID)
+			}
+		}
+	})
+	return nil
+}
+
+// sides returns the link fields naming items of the model: From, To or both for a self-relation.
+func (m *ManyToMany) sides(model string) []string {
+	var fields []string
+	if model == m.From {
+		fields = append(fields, "From")
+	}
+	if model == m.To {
+		fields = append(fields, "To")
+	}
+	return fields
+}
+
+// manyToManyRoute finds the relation serving /{model}/{id}/{other}, and the link fields holding
+// the item of the route and the related items.
+func (s *Store) manyToManyRoute(model, other string) (relation *ManyToMany, self, related string, ok bool) {
+	_, base, _ := splitTenantModel(model)
+
+	s.typeMux.RLock()
+	defer s.typeMux.RUnlock()
+	for _, m := range s.manyToMany {
+		switch {
+		case m.From == base && m.To == other:
+			return m, "From", "To", true
+		case m.To == base && m.From == other:
+			return m, "To", "From", true
+		}
+	}
+	return nil, "", "", false
+}
+
+// links returns the links of a junction model whose field names the given item, ordered by ID.
+func (s *Store) links(junction, field string, id int) []Link {
+	found, err := s.matching(junction, []Filter{{Field: field, Op: FilterEq, Value: id}})
+	if err != nil {
+		return nil
+	}
+	links := make([]Link, len(found))
+	for i, m := range found {
+		assignItem(reflect.ValueOf(&links[i]).Elem(), m.item)
+	}
+	return links
+}
+
+// linkedIDs returns the IDs of the items linked to an item.
+func (s *Store) linkedIDs(junction, self, related string, id int) []int {
+	var ids []int
+	for _, link := range s.links(junction, self, id) {
+		ids = append(ids, linkEnd(link, related))
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// linkEnd returns the item a link names in the given field.
+func linkEnd(link Link, field string) int {
+	if field == "From" {
+		return link.From
+	}
+	return link.To
+}
+
+// manyToManyRequest is a request on the links of one item.
+type manyToManyRequest struct {
+	store      *Store
+	relation   *ManyToMany
+	id         int
+	self       string // link field naming the item
+	related    string // link field naming the related items
+	junction   string
+	otherModel string
+}
+
+// link adds a link to a related item unless linked holds it already, and records it there.
+func (m *manyToManyRequest) link(relatedID int, linked map[int]bool) {
+	if linked[relatedID] {
+		return
+	}
+	linked[relatedID] = true
+	link := &Link{From: m.id, To: relatedID}
+	if m.self == "To" {
+		link.From, link.To = relatedID, m.id
+	}
+	m.store.Create(m.junction, link)
+}
+
+// decodeIDs reads a JSON array of related IDs, answering 400 or 422 when it is invalid.
+func (m *manyToManyRequest) decodeIDs(w http.ResponseWriter, r *http.Request) ([]int, bool) {
+	var ids []int
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid request payload: expected an array of IDs")
+		return nil, false
+	}
+	for _, relatedID := range ids {
+		if !m.store.exists(m.otherModel, relatedID) {
+			_, other, _ := splitTenantModel(m.otherModel)
+			writeProblem(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("%s %d does not exist", other, relatedID))
+			return nil, false
+		}
+	}
+	return ids, true
+}
+
+// handleManyToMany serves /{model}/{id}/{other} and /{model}/{id}/relationships/{other}[/{otherID}]
+// for a many-to-many relation. It reports false when rest does not name one.
+func handleManyToMany(store *Store, model, rest string, w http.ResponseWriter, r *http.Request) bool {
+	segments := strings.Split(rest, "/")
+	if len(segments) < 2 {
+		return false
+	}
+	id, err := strconv.Atoi(segments[0])
+	if err != nil {
+		return false
+	}
+	relationships := segments[1] == "relationships"
+	if relationships {
+		segments = segments[1:]
+	}
+	if len(segments) < 2 || len(segments) > 3 || (len(segments) == 3 && !relationships) {
+		return false
+	}
+	relation, self, related, ok := store.manyToManyRoute(model, segments[1])
+	if !ok {
+		return false
+	}
+	tenant, _, _ := splitTenantModel(model)
+	m := &manyToManyRequest{
+		store:      store,
+		relation:   relation,
+		id:         id,
+		self:       self,
+		related:    related,
+		junction:   tenantModel(tenant, relation.Junction),
+		otherModel: tenantModel(tenant, segments[1]),
+	}
+
+	if !store.exists(model, id) {
+		writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+		return true
+	}
+	if relationships {
+		m.serveRelationships(segments[2:], w, r)
+	} else {
+		m.serveRelated(w, r)
+	}
+	return true
+}
+
+// serveRelated serves /{model}/{id}/{other}: GET lists the related items and PUT replaces them.
+func (m *manyToManyRequest) serveRelated(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		ids, ok := m.decodeIDs(w, r)
+		if !ok {
+			return
+		}
+		wanted := make(map[int]bool, len(ids))
+		for _, relatedID := range ids {
+			wanted[relatedID] = true
+		}
+
+		// Drop the links that are no longer wanted and add the missing ones
+		linked := make(map[int]bool)
+		for _, link := range m.store.links(m.junction, m.self, m.id) {
+			if end := linkEnd(link, m.related); wanted[end] && !linked[end] {
+				linked[end] = true
+			} else {
+				m.store.Delete(m.junction, link.ID)
+			}
+		}
+		for _, relatedID := range ids {
+			m.link(relatedID, linked)
+		}
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPut)
+		return
+	}
+
+	meta, _ := m.store.meta(m.otherModel)
+	items := reflect.MakeSlice(meta.sliceType, 0, 0)
+	for _, relatedID := range m.store.linkedIDs(m.junction, m.self, m.related, m.id) {
+		item := reflect.New(meta.typ)
+		if m.store.Get(m.otherModel, relatedID, item.Interface()) {
+			items = reflect.Append(items, item.Elem())
+		}
+	}
+	writeJSON(w, http.StatusOK, items.Interface())
+}
+
+// serveRelationships serves /{model}/{id}/relationships/{other}[/{otherID}]: GET lists the IDs of
+// the related items, POST links the items of a JSON array of IDs and DELETE unlinks one item.
+func (m *manyToManyRequest) serveRelationships(target []string, w http.ResponseWriter, r *http.Request) {
+	if len(target) == 1 {
+		relatedID, err := strconv.Atoi(target[0])
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, r, http.MethodDelete)
+			return
+		}
+		unlinked := false
+		for _, link := range m.store.links(m.junction, m.self, m.id) {
+			if linkEnd(link, m.related) == relatedID {
+				unlinked = m.store.Delete(m.junction, link.ID) || unlinked
+			}
+		}
+		if !unlinked {
+			writeProblem(w, r, http.StatusNotFound, "Link not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		ids, ok := m.decodeIDs(w, r)
+		if !ok {
+			return
+		}
+		linked := make(map[int]bool)
+		for _, link := range m.store.links(m.junction, m.self, m.id) {
+			linked[linkEnd(link, m.related)] = true
+		}
+		for _, relatedID := range ids {
+			m.link(relatedID, linked)
+		}
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		return
+	}
+	ids := m.store.linkedIDs(m.junction, m.self, m.related, m.id)
+	if ids == nil {
+		ids = []int{}
+	}
+	writeJSON(w, http.StatusOK, ids)
+}
@@ -0,0 +1,222 @@
+// File: mask.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the masking of personal data. String fields tagged with a mask
+// rule (`mask:"email"` answers j***@example.com, `mask:"last4"` ****1234 and `mask:"full"` ****)
+// are masked when items are encoded for callers that are not privileged: in the responses of the
+// model routes (included items too), in /_export dumps, in the event history of /_events and in the
+// values of validation errors.
+// Store.SetPrivileged decides which callers see the raw values; without it no caller does. A
+// masked value written back by a caller leaves the stored value as it is, and masked dumps cannot
+// be imported, so masking never overwrites the data it hides.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// Mask rules.
+const (
+	MaskEmail = "email" // first letter and domain of an email address
+	MaskLast4 = "last4" // last four characters
+	MaskFull  = "full"  // nothing
+)
+
+// maskedRunes replaces the masked characters of a value.
+const maskedRunes = "****"
+
+// maskedFields returns the fields of a model tagged with a mask rule. Masked fields must be
+// strings; other tagged fields, and unknown rules, are logged and ignored.
+func maskedFields(m *modelMeta) []*fieldMeta {
+	var fields []*fieldMeta
+	for _, f := range m.fields {
+		rule := f.tag.Get("mask")
+		if rule == "" {
+			continue
+		}
+		if rule != MaskEmail && rule != MaskLast4 && rule != MaskFull {
+			log.Printf("mask: ignoring unknown mask rule %q of %s.%s", rule, m.typ.Name(), f.name)
+			continue
+		}
+		if f.typ.Kind() != reflect.String || f.jsonName == "-" {
+			log.Printf("mask: ignoring masked field %s.%s, which must be a string", m.typ.Name(), f.name)
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// maskValue masks a value by a rule. Empty values stay empty.
+func maskValue(rule, value string) string {
+	if value == "" {
+		return ""
+	}
+	switch rule {
+	case MaskEmail:
+		local, domain, ok := strings.Cut(value, "@")
+		if !ok || local == "" {
+			return maskedRunes
+		}
+		first, _ := utf8.DecodeRuneInString(local)
+		return string(first) + "***@" + domain
+	case MaskLast4:
+		if utf8.RuneCountInString(value) <= 4 {
+			return maskedRunes
+		}
+		runes := []rune(value)
+		return maskedRunes + string(runes[len(runes)-4:])
+	}
+	return maskedRunes
+}
+
+// maskField returns the masked value of a field.
+func maskField(f *fieldMeta, value string) string {
+	return maskValue(f.tag.Get("mask"), value)
+}
+
+// SetPrivileged sets the function telling the callers allowed to see the raw values of masked
+// fields. Responses are cached and coalesced per Authorization header, which privileged callers
+// should therefore be told apart by.
+func (s *Store) SetPrivileged(fn func(r *http.Request) bool) {
+	s.privileged = fn
+}
+
+// isPrivileged reports whether a caller sees the raw values of masked fields, or was verified to
+// by the leader of a replayed write.
+func (s *Store) isPrivileged(r *http.Request) bool {
+	return granted(r, grantPrivileged) || (s.privileged != nil && s.privileged(r))
+}
+
+// maskingResponse is the response to a caller that is not privileged: the items written through
+// writeJSON and writeJSONArray are masked.
+type maskingResponse struct {
+	http.ResponseWriter
+}
+
+// Unwrap returns the underlying response, for http.ResponseController.
+func (m maskingResponse) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// withMasks returns the response to a request, masking the items written to it unless the caller
+// is privileged.
+func (s *Store) withMasks(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if s.isPrivileged(r) {
+		return w
+	}
+	return maskingResponse{w}
+}
+
+// masking reports whether the items written to a response are masked.
+func masking(w http.ResponseWriter) bool {
+	_, ok := w.(maskingResponse)
+	return ok
+}
+
+// expandFor expands items like expand, masking them and the included items when the response
+// masks items.
+func (s *Store) expandFor(w http.ResponseWriter, meta *modelMeta, items []interface{}, includes []include) ([]json.RawMessage, error) {
+	if masking(w) {
+		items = maskItem(items).([]interface{})
+		for i := range includes {
+			includes[i].masked = true
+		}
+	}
+	return s.expand(meta, items, includes)
+}
+
+// maskItem returns a copy of an item, or of each item of a list, whose masked fields are masked.
+// Values holding no masked field are returned as they are.
+func maskItem(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		if rv.Len() == 0 || !maskable(rv.Type().Elem()) {
+			return v
+		}
+		masked := make([]interface{}, rv.Len())
+		for i := range masked {
+			masked[i] = maskItem(rv.Index(i).Interface())
+		}
+		return masked
+	case reflect.Ptr, reflect.Struct:
+		if rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return v
+		}
+		t := reflect.Indirect(rv).Type()
+		if t.Kind() != reflect.Struct || !maskable(t) {
+			return v
+		}
+		meta := metaFor(t)
+		item := copyItem(meta, v)
+		for _, f := range meta.masked {
+			value := f.value(item)
+			value.SetString(maskField(f, value.String()))
+		}
+		return item
+	}
+	return v
+}
+
+// maskable reports whether values of a type may hold masked fields.
+func maskable(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Struct:
+		return len(metaFor(t).masked) > 0
+	}
+	return false
+}
+
+// keepingMasked returns check followed by restoring the masked values written back in an updated
+// item.
+func keepingMasked(meta *modelMeta, updated interface{}, check func(current interface{}) error) func(current interface{}) error {
+	return func(current interface{}) error {
+		if check != nil {
+			if err := check(current); err != nil {
+				return err
+			}
+		}
+		keepMasked(meta, updated, current)
+		return nil
+	}
+}
+
+// keepMasked restores the stored value of the masked fields of an updated item that a caller
+// wrote back masked, as it read them.
+func keepMasked(meta *modelMeta, updated, current interface{}) {
+	for _, f := range meta.masked {
+		stored := f.value(current).String()
+		if value := f.value(updated); value.String() != stored && value.String() == maskField(f, stored) {
+			value.SetString(stored)
+		}
+	}
+}
+
+// refuseMasked answers 403 to a caller that sees the fields of a model masked and asks to compute
+// over one of them, which would reveal its values, and reports whether it did.
+func refuseMasked(w http.ResponseWriter, r *http.Request, meta *modelMeta, fields []*fieldMeta) bool {
+	if !masking(w) {
+		return false
+	}
+	for _, f := range fields {
+		if containsField(meta.masked, f) {
+			writeProblem(w, r, http.StatusForbidden, "Field "+f.jsonName+" is masked")
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+// File: merge.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements partial updates. PUT replaces an item with the body it is sent,
+// so a client sending a few fields resets the others to their zero value; PATCH merges the body
+// into the stored item instead, as a JSON merge patch (RFC 7396): the fields it holds replace
+// those of the item, null removes them (resetting them to their zero value) and nested objects are
+// merged recursively. Store.Merge does the same from Go, copying the non-zero fields of a partial
+// item. Both apply the merge under the shard lock and check the result like PUT.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// maxPatchSize is the size of the largest PATCH body accepted.
+const maxPatchSize = 1 << 20
+
+// Merge copies the non-zero fields of partial (a model struct or a pointer to one) onto an item and
+// returns the updated item. It reports whether the item exists, and returns the error of the key or
+// a unique field of the item being taken, in which case the item is left as it is.
+func (s *Store) Merge(model string, id int, partial interface{}) (interface{}, bool, error) {
+	meta, ok := s.meta(model)
+	if !ok {
+		return nil, false, nil
+	}
+	var updated interface{}
+	exists, err := s.modify(context.Background(), model, id, func(current interface{}) (interface{}, error) {
+		item := copyItem(meta, current)
+		for _, f := range meta.fields {
+			if v := f.value(partial); !v.IsZero() && f != meta.id {
+				f.value(item).Set(v)
+			}
+		}
+		updated = item
+		return item, nil
+	})
+	return updated, exists, err
+}
+
+// copyItem returns a shallow copy of an item, as a pointer to the model struct.
+func copyItem(meta *modelMeta, item interface{}) interface{} {
+	copied := reflect.New(meta.typ)
+	copied.Elem().Set(reflect.Indirect(reflect.ValueOf(item)))
+	return copied.Interface()
+}
+
+// mergePatch applies a JSON merge patch to a JSON document.
+func mergePatch(target, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	merged, ok := target.(map[string]interface{})
+	if !ok {
+		merged = make(map[string]interface{})
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(merged, name)
+		} else {
+			merged[name] = mergePatch(merged[name], value)
+		}
+	}
+	return merged
+}
+
+// patchItem returns the item a JSON merge patch turns an item into.
+func patchItem(meta *modelMeta, current interface{}, patch map[string]interface{}) (interface{}, error) {
+	data, err := marshalItem(current)
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&document); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(mergePatch(document, patch)); err != nil {
+		return nil, err
+	}
+	item := reflect.New(meta.typ).Interface()
+	if err := unmarshalItem(data, item); err != nil {
+		return nil, decodeError(meta, err)
+	}
+	return item, nil
+}
+
+// handlePatch serves PATCH /{model}?id={id}, merging the body into the item.
+func handlePatch(store *Store, model string, meta *modelMeta, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	check, ok := store.precondition(w, r)
+	if !ok {
+		return
+	}
+	if check, ok = withExpectations(meta, check, w, r); !ok {
+		return
+	}
+	var patch map[string]interface{}
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxPatchSize))
+	dec.UseNumber()
+	if err := dec.Decode(&patch); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	var updated interface{}
+	exists, err := store.modify(r.Context(), model, id, func(current interface{}) (interface{}, error) {
+		if check != nil {
+			if err := check(current); err != nil {
+				return nil, err
+			}
+		}
+		item, err := patchItem(meta, current, patch)
+		if err != nil {
+			return nil, &Error{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Err: err}
+		}
+		if masking(w) {
+			keepMasked(meta, item, current)
+		}
+		if meta.id != nil {
+			meta.id.value(item).SetInt(int64(id))
+		}
+		if err := validate(meta, item); err != nil {
+			return nil, &Error{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Err: err}
+		}
+		if err := store.checkParents(model, item); err != nil {
+			return nil, &Error{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Err: err}
+		}
+		updated = item
+		return item, nil
+	})
+	switch {
+	case !exists:
+		writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+	case err != nil:
+		writePreconditionError(w, r, err)
+	default:
+		if etag, err := itemETag(updated); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+		writeJSON(w, http.StatusOK, updated)
+	}
+}
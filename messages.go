@@ -0,0 +1,221 @@
+// File: messages.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file localizes the messages of error responses. Message catalogs translate
+// the English messages of the server to a language; the catalog of a request is chosen from its
+// Accept-Language header, and the fallback locale (-locale) is used for requests accepting no
+// language with a catalog. Messages holding values (such as "user 7 does not exist") are looked
+// up by their format ("%s %d does not exist"), whose translation may reorder the values with
+// explicit argument indexes ("%[2]d: %[1]s introuvable"). A catalog may also translate an error
+// code, used for the messages it does not list. Catalogs are registered with RegisterCatalog or
+// loaded from a directory of JSON files (-messages dir/, one <locale>.json file per language).
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Catalog translates messages to a language.
+type Catalog interface {
+	// Message returns the translation of a message, message format or error code.
+	Message(key string) (string, bool)
+}
+
+// Messages is a catalog listing the translations of messages, message formats and error codes.
+type Messages map[string]string
+
+// Message returns the translation of a key.
+func (m Messages) Message(key string) (string, bool) {
+	message, ok := m[key]
+	return message, ok
+}
+
+// catalogs are the registered catalogs by lower-case locale, and the fallback locale.
+var catalogs struct {
+	sync.RWMutex
+	byLocale map[string]Catalog
+	fallback string
+}
+
+// RegisterCatalog registers the catalog of a locale (a language tag such as fr or pt-BR),
+// replacing any previous one.
+func RegisterCatalog(locale string, catalog Catalog) {
+	catalogs.Lock()
+	defer catalogs.Unlock()
+	if catalogs.byLocale == nil {
+		catalogs.byLocale = make(map[string]Catalog)
+	}
+	catalogs.byLocale[strings.ToLower(locale)] = catalog
+}
+
+// SetFallbackLocale sets the locale of the requests accepting no language with a catalog. Without
+// one, such requests are answered in English.
+func SetFallbackLocale(locale string) {
+	catalogs.Lock()
+	defer catalogs.Unlock()
+	catalogs.fallback = strings.ToLower(locale)
+}
+
+// LoadCatalogs registers the catalogs of the JSON files of a directory, each holding an object of
+// translations and named after its locale (fr.json, pt-BR.json). It returns the loaded locales.
+func LoadCatalogs(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var locales []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return locales, fmt.Errorf("messages: %w", err)
+		}
+		var messages Messages
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return locales, fmt.Errorf("messages: %s: %w", path, err)
+		}
+		locale := strings.TrimSuffix(filepath.Base(path), ".json")
+		RegisterCatalog(locale, messages)
+		locales = append(locales, locale)
+	}
+	return locales, nil
+}
+
+// localizedError is an error whose message is translated by its format.
+type localizedError struct {
+	format string
+	args   []interface{}
+}
+
+// localizef returns an error formatted like fmt.Errorf, translated by catalogs listing its format.
+func localizef(format string, args ...interface{}) error {
+	return &localizedError{format: format, args: args}
+}
+
+func (e *localizedError) Error() string {
+	return fmt.Sprintf(e.format, e.args...)
+}
+
+// Unwrap returns the errors among the arguments, so the errors a message is formatted from can
+// still be inspected.
+func (e *localizedError) Unwrap() []error {
+	var errs []error
+	for _, arg := range e.args {
+		if err, ok := arg.(error); ok {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// requestCatalog returns the catalog of the first language accepted by a request with one, or
+// that of the fallback locale, and its locale.
+func requestCatalog(r *http.Request) (Catalog, string) {
+	catalogs.RLock()
+	defer catalogs.RUnlock()
+	for _, locale := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if catalog, ok := catalogs.byLocale[locale]; ok {
+			return catalog, locale
+		}
+		if i := strings.IndexByte(locale, '-'); i > 0 {
+			if catalog, ok := catalogs.byLocale[locale[:i]]; ok {
+				return catalog, locale[:i]
+			}
+		}
+	}
+	if catalog, ok := catalogs.byLocale[catalogs.fallback]; ok {
+		return catalog, catalogs.fallback
+	}
+	return nil, ""
+}
+
+// acceptedLanguages returns the lower-case language tags of an Accept-Language header, preferred
+// first, without those of quality 0.
+func acceptedLanguages(header string) []string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+	var languages []language
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = v
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, language{tag, quality})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].quality > languages[j].quality })
+	tags := make([]string, len(languages))
+	for i, l := range languages {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+// localizeProblem translates the title and detail of a problem to the language of a request, and
+// declares it in the Content-Language header. err is the error the detail was formatted from, if
+// any.
+func localizeProblem(w http.ResponseWriter, r *http.Request, p *Problem, err error) {
+	catalogs.RLock()
+	enabled := len(catalogs.byLocale) > 0
+	catalogs.RUnlock()
+	if !enabled {
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+	catalog, locale := requestCatalog(r)
+	if catalog == nil {
+		return
+	}
+	if title, ok := catalog.Message(p.Title); ok {
+		p.Title = title
+	}
+	p.Detail = translate(catalog, p.Detail, p.Code, err)
+	if len(p.Errors) > 0 {
+		errs := make([]FieldError, len(p.Errors))
+		for i, fe := range p.Errors {
+			fe.Message = translate(catalog, fe.Message, "", fe.err)
+			errs[i] = fe
+		}
+		p.Errors = errs
+	}
+	w.Header().Set("Content-Language", locale)
+}
+
+// translate returns the translation of a message by a catalog: that of its format when it was
+// formatted from a localized error, of the message itself, or of its error code.
+func translate(catalog Catalog, message, code string, err error) string {
+	var localized *localizedError
+	if errors.As(err, &localized) && localized.Error() == message {
+		if format, ok := catalog.Message(localized.format); ok {
+			return fmt.Sprintf(format, localized.args...)
+		}
+	}
+	if translated, ok := catalog.Message(message); ok {
+		return translated
+	}
+	if translated, ok := catalog.Message(code); ok && code != "" {
+		return translated
+	}
+	return message
+}
@@ -0,0 +1,154 @@
+// File: metadata.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file caches the reflection metadata of model types. The field layout of a model
+// (field index paths, JSON names, tags and the special ID/ExpiresAt/CreatedAt fields) is computed
+// once, when the model is registered, instead of being looked up with FieldByName on every request.
+// Relations declared with rel tags and the key and lookup fields of the model are resolved at the
+// same time. The fields of embedded structs (e.g. a shared BaseModel{ID, CreatedAt}) are promoted
+// like encoding/json does, so they serve as ID, filters and indexes like direct fields; embedded
+// pointers are not followed.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modelMeta is the cached reflection metadata of a model type.
+type modelMeta struct {
+	typ       reflect.Type
+	sliceType reflect.Type
+
+	id        *fieldMeta
+	expiresAt *fieldMeta
+	createdAt *fieldMeta
+
+	fields []*fieldMeta
+	byName map[string]*fieldMeta
+	byJSON map[string]*fieldMeta
+
+	// renamed holds the JSON names of the untagged fields renamed by the JSON naming convention
+	// (see naming.go) by Go name, and goNames their Go names by JSON name
+	renamed map[string]string
+	goNames map[string]string
+
+	belongsTo  []belongsTo  // relations declared with rel tags
+	key        []*fieldMeta // fields tagged as the key of the model
+	lookups    []*fieldMeta // unique fields items can be looked up by
+	uniques    []*fieldMeta // unique fields that are not lookup fields
+	encrypted  []*fieldMeta // fields sealed wherever items leave memory
+	masked     []*fieldMeta // fields masked for callers that are not privileged
+	anonymized []*fieldMeta // fields cleared when the data of a subject is erased
+	corrects   *fieldMeta   // field referencing the item a correction corrects, for immutable models
+}
+
+// fieldMeta describes one exported field of a model.
+type fieldMeta struct {
+	name     string
+	jsonName string
+	index    []int
+	typ      reflect.Type
+	tag      reflect.StructTag
+}
+
+// metaCache holds the metadata computed for each model type.
+var metaCache sync.Map
+
+// metaFor returns the metadata of a struct type, computing it on first use.
+func metaFor(t reflect.Type) *modelMeta {
+	if cached, ok := metaCache.Load(t); ok {
+		return cached.(*modelMeta)
+	}
+
+	m := &modelMeta{
+		typ:       t,
+		sliceType: reflect.SliceOf(t),
+		byName:    make(map[string]*fieldMeta),
+		byJSON:    make(map[string]*fieldMeta),
+	}
+	timeType := reflect.TypeOf(time.Time{})
+
+	// Walk embedded structs breadth first, so the fields of the outer struct shadow the promoted
+	// ones as in Go and encoding/json
+	type level struct {
+		typ   reflect.Type
+		index []int
+	}
+	for queue := []level{{typ: t}}; len(queue) > 0; queue = queue[1:] {
+		current := queue[0]
+		for i := 0; i < current.typ.NumField(); i++ {
+			sf := current.typ.Field(i)
+			index := append(append([]int(nil), current.index...), i)
+			if sf.Anonymous && sf.Type.Kind() == reflect.Struct && sf.Type != timeType && sf.Tag.Get("json") == "" {
+				queue = append(queue, level{typ: sf.Type, index: index})
+				continue
+			}
+			if _, shadowed := m.byName[sf.Name]; sf.PkgPath != "" || shadowed {
+				continue
+			}
+			f := &fieldMeta{name: sf.Name, jsonName: jsonName(sf), index: index, typ: sf.Type, tag: sf.Tag}
+			m.fields = append(m.fields, f)
+			m.byName[f.name] = f
+			if _, shadowed := m.byJSON[f.jsonName]; f.jsonName != "-" && !shadowed {
+				m.byJSON[f.jsonName] = f
+			}
+
+			switch {
+			case f.name == "ID" && (sf.Type.Kind() >= reflect.Int && sf.Type.Kind() <= reflect.Int64):
+				m.id = f
+			case f.name == "ExpiresAt" && sf.Type == timeType:
+				m.expiresAt = f
+			case f.name == "CreatedAt" && sf.Type == timeType:
+				m.createdAt = f
+			}
+		}
+	}
+	m.belongsTo = parseRelationTags(m)
+	m.key = keyFields(m)
+	m.lookups = lookupFields(m)
+	m.uniques = uniqueFields(m)
+	m.encrypted = encryptedFields(m)
+	m.masked = maskedFields(m)
+	m.anonymized = anonymizedFields(m)
+	m.corrects = correctsField(m)
+
+	actual, _ := metaCache.LoadOrStore(t, m)
+	return actual.(*modelMeta)
+}
+
+// field finds a field by its Go name or its JSON name.
+func (m *modelMeta) field(name string) (*fieldMeta, bool) {
+	if f, ok := m.byName[name]; ok {
+		return f, true
+	}
+	return m.jsonField(name)
+}
+
+// jsonField finds the field encoded under the given JSON name.
+func (m *modelMeta) jsonField(name string) (*fieldMeta, bool) {
+	f, ok := m.byJSON[name]
+	return f, ok
+}
+
+// value returns the field of an item (a struct or a pointer to one).
+func (f *fieldMeta) value(item interface{}) reflect.Value {
+	return reflect.Indirect(reflect.ValueOf(item)).FieldByIndex(f.index)
+}
+
+// jsonName returns the name a field is encoded under by encoding/json ("-" when skipped).
+func jsonName(sf reflect.StructField) string {
+	tag := sf.Tag.Get("json")
+	if tag == "-" {
+		return "-"
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name
+	}
+	return sf.Name
+}
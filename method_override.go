@@ -0,0 +1,78 @@
+// File: method_override.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements method overriding, for clients behind proxies or in
+// environments (HTML forms, some corporate gateways) that only let GET and POST through. A POST
+// request carrying an X-HTTP-Method-Override header, a _method query parameter or a _method field
+// in a form body is served as the PUT, PATCH or DELETE request it names, so it goes through the
+// same routing, preconditions and replication as the real method. Other methods cannot be
+// requested this way, and the overrides of other methods than POST are ignored.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MethodOverrideHeader names the method a POST request is served as.
+const MethodOverrideHeader = "X-HTTP-Method-Override"
+
+// maxOverrideFormSize is the size of the largest form body searched for a _method field.
+const maxOverrideFormSize = 64 << 10
+
+// overridableMethods are the methods a POST request can be served as.
+var overridableMethods = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// withMethodOverride serves the POST requests naming another method as that method.
+func withMethodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		method := r.Header.Get(MethodOverrideHeader)
+		query := r.URL.Query()
+		if method == "" && query.Has("_method") {
+			method = query.Get("_method")
+			query.Del("_method")
+			r.URL.RawQuery = query.Encode()
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); method == "" && mediaType == "application/x-www-form-urlencoded" {
+			method = formMethod(r)
+		}
+		if method == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		method = strings.ToUpper(method)
+		if !containsString(overridableMethods, method) {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid method override")
+			return
+		}
+		r.Method = method
+		r.Header.Del(MethodOverrideHeader)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// formMethod returns the _method field of a form body. The body is left in place for the handler,
+// since clients such as curl send JSON as a form by default.
+func formMethod(r *http.Request) string {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxOverrideFormSize+1))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil || len(body) > maxOverrideFormSize {
+		return ""
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return ""
+	}
+	return form.Get("_method")
+}
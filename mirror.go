@@ -0,0 +1,199 @@
+// File: mirror.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements write-through mirroring to a secondary Storage. Every mutation
+// written through to the primary backend is also written to the mirror, whose failures are logged
+// and counted but never fail the write. A reconciliation job compares the mirror with the store on a
+// schedule, reporting the items that are missing, different or left over in the mirror, and repairs
+// them unless it runs in dry-run mode. The store is the source of truth. Mirrored items are compared
+// by the checksums of their plaintext (see checksums.go), since sealed fields never encode the same
+// way twice.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"expvar"
+	"log"
+	"time"
+)
+
+// mirrorStats holds the mirror write errors and the drift found by reconciliation.
+var mirrorStats = expvar.NewMap("mirror")
+
+// SetMirror makes the store write every mutation through to a secondary backend as well.
+// It must be called before the store is used concurrently.
+func (s *Store) SetMirror(mirror Storage) {
+	s.mirror = mirror
+}
+
+// MirrorDrift reports the differences reconciliation found between the store and its mirror.
+type MirrorDrift struct {
+	Missing  int  `json:"missing"`
+	Changed  int  `json:"changed"`
+	Extra    int  `json:"extra"`
+	Repaired int  `json:"repaired"`
+	DryRun   bool `json:"dry_run"`
+}
+
+// Total returns the number of drifted items.
+func (d MirrorDrift) Total() int {
+	return d.Missing + d.Changed + d.Extra
+}
+
+// Reconciler detects and repairs drift between a store and its mirror.
+type Reconciler struct {
+	store  *Store
+	mirror Storage
+
+	// DryRun only reports drift without repairing it.
+	DryRun bool
+}
+
+// NewReconciler creates a reconciliation job for the store's mirror.
+func NewReconciler(store *Store, mirror Storage) *Reconciler {
+	return &Reconciler{store: store, mirror: mirror}
+}
+
+// Run compares every item once. Each item is compared and repaired while holding its shard lock so
+// concurrent writes, which reach the mirror under the same lock, cannot be overwritten with stale data.
+func (r *Reconciler) Run() (MirrorDrift, error) {
+	drift := MirrorDrift{DryRun: r.DryRun}
+
+	// Include the models only the mirror knows about, so their items are found as extra
+	models, err := r.mirror.Models()
+	if err != nil {
+		return drift, err
+	}
+	for _, model := range models {
+		r.store.collection(model)
+	}
+
+	for _, c := range r.store.allCollections() {
+		// Items missing or different in the mirror
+		var ids []int
+		c.each(func(id int, item interface{}) error {
+			ids = append(ids, id)
+			return nil
+		})
+		for _, id := range ids {
+			if err := r.compare(c, id, &drift); err != nil {
+				return drift, err
+			}
+		}
+
+		// Items the mirror still has although the store does not
+		var extra []int
+		err := r.mirror.Scan(c.name, func(id int, data []byte) error {
+			if _, ok := c.shard(id).snapshot().get(id); !ok {
+				extra = append(extra, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return drift, err
+		}
+		for _, id := range extra {
+			if err := r.remove(c, id, &drift); err != nil {
+				return drift, err
+			}
+		}
+	}
+
+	mirrorStats.Add("drift_missing", int64(drift.Missing))
+	mirrorStats.Add("drift_changed", int64(drift.Changed))
+	mirrorStats.Add("drift_extra", int64(drift.Extra))
+	mirrorStats.Add("repaired", int64(drift.Repaired))
+	if drift.Total() > 0 {
+		log.Printf("mirror: %d missing, %d changed, %d extra, %d repaired (dry run: %t)",
+			drift.Missing, drift.Changed, drift.Extra, drift.Repaired, drift.DryRun)
+	}
+	return drift, nil
+}
+
+// compare checks one stored item against the mirror.
+func (r *Reconciler) compare(c *collection, id int, drift *MirrorDrift) error {
+	sh := c.shard(id)
+	sh.itemMux.Lock()
+	defer sh.itemMux.Unlock()
+
+	e, ok := sh.snapshot().get(id)
+	if !ok {
+		return nil
+	}
+	expected, known := sh.checksums[id]
+	if !known {
+		plain, err := json.Marshal(e.item)
+		if err != nil {
+			return err
+		}
+		expected = sha256.Sum256(plain)
+	}
+	mirrored, found, err := r.mirror.Get(c.name, id)
+	if err != nil {
+		return err
+	}
+	if found {
+		if _, sum, err := decodeStored(c, id, mirrored); err == nil && sum == expected {
+			return nil
+		}
+		drift.Changed++
+	} else {
+		drift.Missing++
+	}
+	if r.DryRun {
+		return nil
+	}
+	data, err := encodeItem(c.name, id, e.item)
+	if err != nil {
+		return err
+	}
+	if err := r.mirror.Put(c.name, id, data); err != nil {
+		return err
+	}
+	drift.Repaired++
+	return nil
+}
+
+// remove drops an item from the mirror unless the store has it again.
+func (r *Reconciler) remove(c *collection, id int, drift *MirrorDrift) error {
+	sh := c.shard(id)
+	sh.itemMux.Lock()
+	defer sh.itemMux.Unlock()
+
+	if _, ok := sh.snapshot().get(id); ok {
+		return nil
+	}
+	drift.Extra++
+	if r.DryRun {
+		return nil
+	}
+	if err := r.mirror.Delete(c.name, id); err != nil {
+		return err
+	}
+	drift.Repaired++
+	return nil
+}
+
+// Start runs the job every interval in the background until the returned stop function is called.
+func (r *Reconciler) Start(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := r.Run(); err != nil {
+					log.Printf("mirror: reconciliation failed: %v", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
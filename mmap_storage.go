@@ -0,0 +1,418 @@
+//go:build unix
+
+// File: mmap_storage.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements a memory-mapped, append-only storage engine. Every put or delete
+// is appended to a data file as a checksummed record and an in-memory index maps each item to the
+// location of its latest version, which is read straight from the mapping. On close the index is
+// saved to a hint file, so reopening only loads the index and scans the records appended since,
+// instead of parsing the whole data file. Superseded records are dropped by compaction.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// Record kinds of the data file.
+const (
+	mmapRecordPut    = 1
+	mmapRecordDelete = 2
+)
+
+// mmapHeaderSize is the size of a record header: crc32, kind, model length, ID and data length.
+const mmapHeaderSize = 4 + 1 + 2 + 8 + 4
+
+// mmapInitialSize is the size the data file is grown to when it is first mapped.
+const mmapInitialSize = 1 << 20
+
+// mmapCompactThreshold is the amount of superseded data that triggers an automatic compaction once
+// it also exceeds half of the file.
+const mmapCompactThreshold = 64 << 20
+
+// MmapStorage is a Storage backed by a memory-mapped append-only data file.
+type MmapStorage struct {
+	path    string
+	file    *os.File
+	mapping []byte
+	end     int64
+	garbage int64
+	index   map[string]map[int]mmapLocation
+	mux     sync.RWMutex
+
+	// Sync forces every write to be flushed to stable storage.
+	Sync bool
+}
+
+// mmapLocation is where the payload of an item's latest record lives.
+type mmapLocation struct {
+	Offset int64
+	Length int
+}
+
+// mmapHint is the index saved next to the data file on close.
+type mmapHint struct {
+	End     int64
+	Garbage int64
+	Index   map[string]map[int]mmapLocation
+}
+
+// OpenMmapStorage opens (or creates) the data file at path and rebuilds its index.
+func OpenMmapStorage(path string) (*MmapStorage, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m := &MmapStorage{path: path, file: file, index: make(map[string]map[int]mmapLocation)}
+	if err := m.open(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// open maps the data file and rebuilds the index from the hint file and the records after it.
+func (m *MmapStorage) open() error {
+	info, err := m.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size < mmapInitialSize {
+		size = mmapInitialSize
+	}
+	if err := m.remap(size); err != nil {
+		return err
+	}
+
+	m.loadHint(info.Size())
+	m.scan()
+	return nil
+}
+
+// loadHint restores the index saved on the last clean close, if it matches the data file.
+func (m *MmapStorage) loadHint(fileSize int64) {
+	file, err := os.Open(m.hintPath())
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	var hint mmapHint
+	if err := gob.NewDecoder(file).Decode(&hint); err != nil || hint.End > fileSize {
+		return
+	}
+	m.end, m.garbage = hint.End, hint.Garbage
+	if hint.Index != nil {
+		m.index = hint.Index
+	}
+}
+
+// scan indexes the records from the current end up to the first missing or corrupt one, which marks
+// the end of the data (a torn write from a crash is discarded).
+func (m *MmapStorage) scan() {
+	for {
+		off := m.end
+		if off+mmapHeaderSize > int64(len(m.mapping)) {
+			return
+		}
+		header := m.mapping[off : off+mmapHeaderSize]
+		kind := header[4]
+		modelLen := int64(binary.LittleEndian.Uint16(header[5:7]))
+		id := int(int64(binary.LittleEndian.Uint64(header[7:15])))
+		dataLen := int64(binary.LittleEndian.Uint32(header[15:19]))
+		total := mmapHeaderSize + modelLen + dataLen
+		if kind != mmapRecordPut && kind != mmapRecordDelete || off+total > int64(len(m.mapping)) {
+			return
+		}
+		record := m.mapping[off : off+total]
+		if crc32.ChecksumIEEE(record[4:]) != binary.LittleEndian.Uint32(record[:4]) {
+			return
+		}
+
+		model := string(record[mmapHeaderSize : mmapHeaderSize+modelLen])
+		location := mmapLocation{Offset: off + mmapHeaderSize + modelLen, Length: int(dataLen)}
+		m.indexRecord(kind, model, id, location, total)
+		m.end = off + total
+	}
+}
+
+// indexRecord points the index at a record, accounting for the data it supersedes.
+func (m *MmapStorage) indexRecord(kind byte, model string, id int, location mmapLocation, size int64) {
+	ids := m.index[model]
+	if previous, ok := ids[id]; ok {
+		m.garbage += mmapHeaderSize + int64(len(model)) + int64(previous.Length)
+	}
+	if kind == mmapRecordDelete {
+		delete(ids, id)
+		m.garbage += size
+		return
+	}
+	if ids == nil {
+		ids = make(map[int]mmapLocation)
+		m.index[model] = ids
+	}
+	ids[id] = location
+}
+
+// remap grows the data file to size and maps it.
+func (m *MmapStorage) remap(size int64) error {
+	if m.mapping != nil {
+		if err := syscall.Munmap(m.mapping); err != nil {
+			return err
+		}
+		m.mapping = nil
+	}
+	if err := m.file.Truncate(size); err != nil {
+		return err
+	}
+	mapping, err := syscall.Mmap(int(m.file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.mapping = mapping
+	return nil
+}
+
+// Put appends a new version of an item.
+func (m *MmapStorage) Put(model string, id int, data []byte) error {
+	return m.append(mmapRecordPut, model, id, data)
+}
+
+// Delete appends a tombstone for an item.
+func (m *MmapStorage) Delete(model string, id int) error {
+	m.mux.RLock()
+	_, exists := m.index[model][id]
+	m.mux.RUnlock()
+	if !exists {
+		return nil
+	}
+	return m.append(mmapRecordDelete, model, id, nil)
+}
+
+// append writes a record at the end of the data file, growing the mapping when it is full.
+// Records are written through the file; the shared mapping sees them immediately.
+func (m *MmapStorage) append(kind byte, model string, id int, data []byte) error {
+	if len(model) > 0xFFFF {
+		return fmt.Errorf("model name %q is too long", model)
+	}
+	record := make([]byte, mmapHeaderSize+len(model)+len(data))
+	record[4] = kind
+	binary.LittleEndian.PutUint16(record[5:7], uint16(len(model)))
+	binary.LittleEndian.PutUint64(record[7:15], uint64(int64(id)))
+	binary.LittleEndian.PutUint32(record[15:19], uint32(len(data)))
+	copy(record[mmapHeaderSize:], model)
+	copy(record[mmapHeaderSize+len(model):], data)
+	binary.LittleEndian.PutUint32(record[:4], crc32.ChecksumIEEE(record[4:]))
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.mapping == nil {
+		return errors.New("storage is closed")
+	}
+	total := int64(len(record))
+	if need := m.end + total; need > int64(len(m.mapping)) {
+		size := int64(len(m.mapping)) * 2
+		for size < need {
+			size *= 2
+		}
+		if err := m.remap(size); err != nil {
+			return err
+		}
+	}
+	if _, err := m.file.WriteAt(record, m.end); err != nil {
+		return err
+	}
+	if m.Sync {
+		if err := m.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	location := mmapLocation{Offset: m.end + mmapHeaderSize + int64(len(model)), Length: len(data)}
+	m.indexRecord(kind, model, id, location, total)
+	m.end += total
+
+	if m.garbage > mmapCompactThreshold && m.garbage > m.end/2 {
+		return m.compactLocked()
+	}
+	return nil
+}
+
+// Get returns a copy of the latest version of an item.
+func (m *MmapStorage) Get(model string, id int) ([]byte, bool, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	location, ok := m.index[model][id]
+	if !ok {
+		return nil, false, nil
+	}
+	return m.read(location), true, nil
+}
+
+// read copies a payload out of the mapping, which may be replaced once the lock is released.
+func (m *MmapStorage) read(location mmapLocation) []byte {
+	data := make([]byte, location.Length)
+	copy(data, m.mapping[location.Offset:])
+	return data
+}
+
+// Models returns the names of the models with stored items in alphabetical order.
+func (m *MmapStorage) Models() ([]string, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	models := make([]string, 0, len(m.index))
+	for model, ids := range m.index {
+		if len(ids) > 0 {
+			models = append(models, model)
+		}
+	}
+	sort.Strings(models)
+	return models, nil
+}
+
+// Scan calls fn for every item of a model in ID order. The lock is not held while fn runs.
+func (m *MmapStorage) Scan(model string, fn func(id int, data []byte) error) error {
+	m.mux.RLock()
+	ids := make([]int, 0, len(m.index[model]))
+	for id := range m.index[model] {
+		ids = append(ids, id)
+	}
+	m.mux.RUnlock()
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		data, ok, err := m.Get(model, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the data file with only the latest version of each item.
+func (m *MmapStorage) Compact() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.compactLocked()
+}
+
+// compactLocked writes the live records to a new file and swaps it in. The hint file is removed
+// first so a crash mid-way never pairs a stale index with the new data file.
+func (m *MmapStorage) compactLocked() error {
+	tmpPath := m.path + ".compact"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	index := make(map[string]map[int]mmapLocation, len(m.index))
+	var end int64
+	for model, ids := range m.index {
+		index[model] = make(map[int]mmapLocation, len(ids))
+		for id, location := range ids {
+			record := make([]byte, mmapHeaderSize+len(model)+location.Length)
+			record[4] = mmapRecordPut
+			binary.LittleEndian.PutUint16(record[5:7], uint16(len(model)))
+			binary.LittleEndian.PutUint64(record[7:15], uint64(int64(id)))
+			binary.LittleEndian.PutUint32(record[15:19], uint32(location.Length))
+			copy(record[mmapHeaderSize:], model)
+			copy(record[mmapHeaderSize+len(model):], m.mapping[location.Offset:location.Offset+int64(location.Length)])
+			binary.LittleEndian.PutUint32(record[:4], crc32.ChecksumIEEE(record[4:]))
+			if _, err := tmp.Write(record); err != nil {
+				tmp.Close()
+				return err
+			}
+			index[model][id] = mmapLocation{Offset: end + mmapHeaderSize + int64(len(model)), Length: location.Length}
+			end += int64(len(record))
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	os.Remove(m.hintPath())
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	syscall.Munmap(m.mapping)
+	m.file.Close()
+	m.file, m.mapping = tmp, nil
+	m.index, m.end, m.garbage = index, end, 0
+
+	size := int64(mmapInitialSize)
+	for size < end {
+		size *= 2
+	}
+	return m.remap(size)
+}
+
+// Close saves the index to the hint file, trims the data file and unmaps it.
+func (m *MmapStorage) Close() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.mapping == nil {
+		return nil
+	}
+	if err := m.saveHint(); err != nil {
+		return err
+	}
+	if err := syscall.Munmap(m.mapping); err != nil {
+		return err
+	}
+	m.mapping = nil
+	if err := m.file.Truncate(m.end); err != nil {
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+	return m.file.Close()
+}
+
+// saveHint writes the index atomically next to the data file.
+func (m *MmapStorage) saveHint() error {
+	tmpPath := m.hintPath() + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(mmapHint{End: m.end, Garbage: m.garbage, Index: m.index}); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, m.hintPath())
+}
+
+// hintPath returns the path of the hint file.
+func (m *MmapStorage) hintPath() string {
+	return m.path + ".hint"
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+// File: mmap_storage_other.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file stubs the memory-mapped storage engine on platforms without mmap support.
+
+package main
+
+import "errors"
+
+// MmapStorage is unavailable on this platform.
+type MmapStorage struct {
+	Storage
+	Sync bool
+}
+
+// OpenMmapStorage reports that memory-mapped storage is not supported on this platform.
+func OpenMmapStorage(path string) (*MmapStorage, error) {
+	return nil, errors.New("memory-mapped storage is not supported on this platform")
+}
+
+// Compact is a no-op on this platform.
+func (m *MmapStorage) Compact() error {
+	return nil
+}
@@ -0,0 +1,239 @@
+// File: mqtt_bridge.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements a bridge that publishes store change events to an MQTT broker.
+// Each model can have its own topic template (e.g. "crud/{model}/{op}/{id}") so IoT dashboards and
+// edge devices can subscribe to exactly the changes they care about. It implements the small subset
+// of MQTT 3.1.1 needed to publish (CONNECT, PUBLISH at QoS 0, PINGREQ) on top of a plain TCP connection.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTTBridge publishes change events to an MQTT broker.
+type MQTTBridge struct {
+	Addr     string
+	ClientID string
+	Username string
+	Password string
+
+	// KeepAlive is announced to the broker in whole seconds, at most 65535; below a second the
+	// broker keeps the connection open without pings.
+	KeepAlive time.Duration
+
+	// DefaultTopic is used for models without their own template.
+	// Supported placeholders: {model}, {op} and {id}.
+	DefaultTopic string
+
+	topics   map[string]string
+	topicMux sync.Mutex
+
+	queue chan ChangeEvent
+	once  sync.Once
+}
+
+// NewMQTTBridge creates a bridge for the given broker address (host:port) and default topic template.
+func NewMQTTBridge(addr, defaultTopic string) *MQTTBridge {
+	return &MQTTBridge{
+		Addr:         addr,
+		ClientID:     "crud-" + newNodeID(),
+		KeepAlive:    30 * time.Second,
+		DefaultTopic: defaultTopic,
+		topics:       make(map[string]string),
+		queue:        make(chan ChangeEvent, 1024),
+	}
+}
+
+// SetTopic sets the topic template used for events of the given model.
+func (b *MQTTBridge) SetTopic(model, template string) {
+	b.topicMux.Lock()
+	defer b.topicMux.Unlock()
+
+	b.topics[model] = template
+}
+
+// Publish queues a change event for delivery to the broker. It is meant to be passed to Store.Subscribe.
+func (b *MQTTBridge) Publish(event ChangeEvent) {
+	b.once.Do(func() { go b.publishLoop() })
+
+	select {
+	case b.queue <- event:
+	default:
+		log.Printf("mqtt: publish queue full, dropping %s event for %s %d", event.Op, event.Model, event.ID)
+	}
+}
+
+// topicFor expands the topic template for an event.
+func (b *MQTTBridge) topicFor(event ChangeEvent) string {
+	b.topicMux.Lock()
+	template, ok := b.topics[event.Model]
+	b.topicMux.Unlock()
+	if !ok {
+		template = b.DefaultTopic
+	}
+
+	return strings.NewReplacer(
+		"{model}", event.Model,
+		"{op}", event.Op,
+		"{id}", strconv.Itoa(event.ID),
+	).Replace(template)
+}
+
+// publishLoop drains the queue, keeps the connection alive and reconnects when it fails.
+func (b *MQTTBridge) publishLoop() {
+	var conn net.Conn
+	var pings <-chan time.Time
+	if keepAlive := b.keepAliveSeconds(); keepAlive > 0 {
+		ping := time.NewTicker(time.Duration(keepAlive) * time.Second / 2)
+		defer ping.Stop()
+		pings = ping.C
+	}
+
+	for {
+		select {
+		case event := <-b.queue:
+			sealed, err := sealEvent(event)
+			var payload []byte
+			if err == nil {
+				payload, err = json.Marshal(sealed)
+			}
+			if err != nil {
+				log.Printf("mqtt: cannot encode event: %v", err)
+				continue
+			}
+			packet := mqttPublishPacket(b.topicFor(event), payload)
+
+			for attempt := 0; attempt < 3; attempt++ {
+				if conn == nil {
+					if conn, err = b.connect(); err != nil {
+						log.Printf("mqtt: connect %s: %v", b.Addr, err)
+						time.Sleep(time.Duration(attempt+1) * 200 * time.Millisecond)
+						continue
+					}
+				}
+				if _, err = conn.Write(packet); err == nil {
+					break
+				}
+				log.Printf("mqtt: publish failed: %v", err)
+				conn.Close()
+				conn = nil
+			}
+
+		case <-pings:
+			if conn == nil {
+				continue
+			}
+			if _, err := conn.Write([]byte{0xC0, 0x00}); err != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+	}
+}
+
+// keepAliveSeconds returns the keep-alive announced to the broker, 0 for none.
+func (b *MQTTBridge) keepAliveSeconds() int {
+	seconds := b.KeepAlive / time.Second
+	if seconds <= 0 {
+		return 0
+	}
+	if seconds > 0xFFFF {
+		return 0xFFFF
+	}
+	return int(seconds)
+}
+
+// connect opens a TCP connection and performs the MQTT CONNECT/CONNACK handshake.
+func (b *MQTTBridge) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", b.Addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	// Variable header: protocol name, level 4 (3.1.1), connect flags and keep-alive
+	flags := byte(0x02) // clean session
+	if b.Username != "" {
+		flags |= 0x80
+	}
+	if b.Password != "" {
+		flags |= 0x40
+	}
+	keepAlive := b.keepAliveSeconds()
+	body := mqttString("MQTT")
+	body = append(body, 0x04, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = append(body, mqttString(b.ClientID)...)
+	if b.Username != "" {
+		body = append(body, mqttString(b.Username)...)
+	}
+	if b.Password != "" {
+		body = append(body, mqttString(b.Password)...)
+	}
+
+	if _, err := conn.Write(mqttPacket(0x10, body)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(reader, ack); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack[0] != 0x20 {
+		conn.Close()
+		return nil, errors.New("mqtt: unexpected reply to CONNECT")
+	}
+	if ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt: connection refused (code %d)", ack[3])
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Drain anything the broker sends (PINGRESP) so its buffers never fill up
+	go io.Copy(io.Discard, reader)
+	return conn, nil
+}
+
+// mqttPublishPacket builds a QoS 0 PUBLISH packet.
+func mqttPublishPacket(topic string, payload []byte) []byte {
+	return mqttPacket(0x30, append(mqttString(topic), payload...))
+}
+
+// mqttPacket prefixes a body with the fixed header and its variable-length remaining length.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttString encodes a length-prefixed UTF-8 string.
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
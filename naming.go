@@ -0,0 +1,247 @@
+// File: naming.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the JSON naming convention of models (-json-naming). By
+// default, fields without a json tag are named after their Go name as encoding/json does; with
+// SetJSONNaming(SnakeCase) or SetJSONNaming(CamelCase), UserID is named user_id or userId instead.
+// The convention is applied to the metadata of the models, so filters, sort parameters, schemas
+// and generated clients use the same names, and to the items encoded in responses and decoded
+// from request bodies, whose top-level keys are renamed between the Go and the JSON names. Fields
+// with a json tag keep the name of their tag, and the fields of nested structs their Go name.
+// Items are still persisted under their Go names, so the convention can change without migrating
+// data files.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// JSONNaming is a naming convention of the JSON fields of models.
+type JSONNaming int
+
+const (
+	GoNames   JSONNaming = iota // UserID, as encoding/json
+	SnakeCase                   // user_id
+	CamelCase                   // userId
+)
+
+// jsonNaming is the naming convention of the fields without a json tag.
+var jsonNaming = GoNames
+
+// namedModels holds the metadata of the model types the naming convention was applied to, by type.
+var namedModels sync.Map
+
+// SetJSONNaming sets the naming convention of the fields without a json tag. It must be called
+// before models are registered.
+func SetJSONNaming(naming JSONNaming) {
+	jsonNaming = naming
+}
+
+// ParseJSONNaming parses a naming convention: "go" (or ""), "snake_case" or "camelCase".
+func ParseJSONNaming(s string) (JSONNaming, error) {
+	switch strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(s)) {
+	case "", "go":
+		return GoNames, nil
+	case "snake", "snakecase":
+		return SnakeCase, nil
+	case "camel", "camelcase":
+		return CamelCase, nil
+	}
+	return GoNames, fmt.Errorf("invalid JSON naming %q (expected go, snake_case or camelCase)", s)
+}
+
+// conventionalName converts the Go name of a field by the naming convention.
+func conventionalName(name string) string {
+	if jsonNaming == GoNames {
+		return name
+	}
+	words := splitWords(name)
+	for i, word := range words {
+		word = strings.ToLower(word)
+		if jsonNaming == CamelCase && i > 0 {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		words[i] = word
+	}
+	if jsonNaming == SnakeCase {
+		return strings.Join(words, "_")
+	}
+	return strings.Join(words, "")
+}
+
+// splitWords splits a Go name into its words: UserID into User and ID, HTTPServer into HTTP and
+// Server. Digits stay with the word they follow.
+func splitWords(name string) []string {
+	runes := []rune(name)
+	var words []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		prev, r := runes[i-1], runes[i]
+		boundary := unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)) ||
+			unicode.IsUpper(r) && unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1]) ||
+			r == '_'
+		if boundary {
+			if word := strings.Trim(string(runes[start:i]), "_"); word != "" {
+				words = append(words, word)
+			}
+			start = i
+		}
+	}
+	if word := strings.Trim(string(runes[start:]), "_"); word != "" {
+		words = append(words, word)
+	}
+	return words
+}
+
+// applyJSONNaming renames the untagged fields of a registered model by the naming convention, once
+// per type. The types of nested structs are not registered and keep the names of encoding/json.
+func applyJSONNaming(m *modelMeta) {
+	if jsonNaming == GoNames {
+		return
+	}
+	if _, done := namedModels.LoadOrStore(m.typ, m); done {
+		return
+	}
+	for _, f := range m.fields {
+		if name, _, _ := strings.Cut(f.tag.Get("json"), ","); name != "" {
+			continue
+		}
+		name := conventionalName(f.name)
+		if name == f.name {
+			continue
+		}
+		if m.byJSON[f.jsonName] == f {
+			delete(m.byJSON, f.jsonName)
+		}
+		if _, taken := m.byJSON[name]; !taken {
+			m.byJSON[name] = f
+		}
+		f.jsonName = name
+		if m.renamed == nil {
+			m.renamed = make(map[string]string)
+			m.goNames = make(map[string]string)
+		}
+		m.renamed[f.name] = name
+		m.goNames[name] = f.name
+	}
+}
+
+// renamedMeta returns the metadata of a model type with renamed fields.
+func renamedMeta(t reflect.Type) (*modelMeta, bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if m, ok := namedModels.Load(t); ok && m.(*modelMeta).renamed != nil {
+		return m.(*modelMeta), true
+	}
+	return nil, false
+}
+
+// marshalItem encodes an item, a list of items or any other value like json.Marshal, naming the
+// fields of items by the naming convention.
+func marshalItem(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || jsonNaming == GoNames || v == nil {
+		return data, err
+	}
+	rv := reflect.ValueOf(v)
+	if m, ok := renamedMeta(rv.Type()); ok {
+		return renameKeys(data, m.renamed)
+	}
+	if kind := rv.Kind(); (kind != reflect.Slice && kind != reflect.Array) || rv.Len() == 0 {
+		return data, nil
+	}
+	elem := rv.Type().Elem()
+	if _, ok := renamedMeta(elem); !ok && elem.Kind() != reflect.Interface {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i := 0; i < rv.Len(); i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		item, err := marshalItem(rv.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(item)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// unmarshalItem decodes an item (a pointer to a model struct) like json.Unmarshal, accepting the
+// names of the naming convention.
+func unmarshalItem(data []byte, item interface{}) error {
+	if m, ok := renamedMeta(reflect.TypeOf(item)); ok {
+		renamed, err := renameKeys(data, m.goNames)
+		if err != nil {
+			return err
+		}
+		data = renamed
+	}
+	return json.Unmarshal(data, item)
+}
+
+// decodeItem reads an item from a request body like a json.Decoder, accepting the names of the
+// naming convention.
+func decodeItem(r io.Reader, item interface{}) error {
+	if _, ok := renamedMeta(reflect.TypeOf(item)); !ok {
+		return json.NewDecoder(r).Decode(item)
+	}
+	var data json.RawMessage
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	return unmarshalItem(data, item)
+}
+
+// renameKeys renames the keys of a JSON object by names, keeping their order. Values that are not
+// objects (such as null) are returned as they are.
+func renameKeys(data []byte, names map[string]string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if token, err := dec.Token(); err != nil {
+		return nil, err
+	} else if token != json.Delim('{') {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := token.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if name, ok := names[key]; ok {
+			key = name
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		encoded, _ := json.Marshal(key)
+		buf.Write(encoded)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,115 @@
+// File: negative_cache.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements negative caching of item lookups. A GET of an item that was not
+// found is remembered for a short TTL, and repeated GETs of that ID (a common scraper pattern) are
+// answered 404 straight away instead of being looked up again, which in partitioned mode means
+// asking the other nodes. Creating the item locally drops its cached miss at once; a miss can only
+// outlive a creation made on another node by the TTL.
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// negativeCacheStats counts the lookups answered from the negative cache.
+var negativeCacheStats = expvar.NewMap("negative_cache")
+
+// NegativeCache remembers recently missing items.
+type NegativeCache struct {
+	// TTL is how long a miss is remembered.
+	TTL time.Duration
+	// MaxEntries bounds the number of remembered misses.
+	MaxEntries int
+
+	misses map[cacheKey]time.Time // expiry of each miss
+	gen    uint64                 // bumped on every creation, so a slow miss cannot hide a new item
+	mux    sync.Mutex
+}
+
+// NewNegativeCache creates a cache remembering misses for ttl.
+func NewNegativeCache(ttl time.Duration) *NegativeCache {
+	return &NegativeCache{TTL: ttl, MaxEntries: 100000, misses: make(map[cacheKey]time.Time)}
+}
+
+// SetNegativeCache makes the store's item GETs remember missing IDs, dropping them when the items
+// are created. It must be called before the store is used concurrently.
+func (s *Store) SetNegativeCache(cache *NegativeCache) {
+	s.misses = cache
+	s.Subscribe(func(event ChangeEvent) {
+		if event.Op != OpDelete {
+			cache.forget(cacheKey{event.Model, event.ID})
+		}
+	})
+}
+
+// serve answers a GET of an item recently found missing with 404, and remembers the ones next
+// does not find.
+func (n *NegativeCache) serve(model string, w http.ResponseWriter, r *http.Request, next func(w http.ResponseWriter, r *http.Request)) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || subpath(r) != "" || err != nil {
+		next(w, r)
+		return
+	}
+	key := cacheKey{model, id}
+
+	n.mux.Lock()
+	expires, missing := n.misses[key]
+	if missing && time.Now().After(expires) {
+		delete(n.misses, key)
+		missing = false
+	}
+	gen := n.gen
+	n.mux.Unlock()
+	if missing {
+		negativeCacheStats.Add("hits", 1)
+		writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+		return
+	}
+
+	response := newBufferedResponse()
+	next(response, r)
+	if response.status == http.StatusNotFound {
+		n.remember(key, gen)
+	}
+	response.writeTo(w)
+}
+
+// remember records a miss found in generation gen, first dropping the expired ones when the cache
+// is full.
+func (n *NegativeCache) remember(key cacheKey, gen uint64) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.gen != gen {
+		return
+	}
+	now := time.Now()
+	if len(n.misses) >= n.MaxEntries {
+		for key, expires := range n.misses {
+			if now.After(expires) {
+				delete(n.misses, key)
+			}
+		}
+		if len(n.misses) >= n.MaxEntries {
+			return
+		}
+	}
+	n.misses[key] = now.Add(n.TTL)
+}
+
+// forget drops the miss of an item that now exists.
+func (n *NegativeCache) forget(key cacheKey) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	n.gen++
+	delete(n.misses, key)
+}
@@ -0,0 +1,427 @@
+// File: openapi.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file generates an OpenAPI 3 description of the API from the registered models,
+// served at /openapi.json for client generators, gateways and API explorers. The schema of each
+// model is derived from its struct fields and tags (JSON names, key and lookup fields, relations),
+// and the paths from the routes the server mounts for it: the collection route with its filters and
+// paging, lookups by natural key, nested child routes and many-to-many links. Errors are plain-text
+// bodies, described by the shared Error schema.
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification the generated documents follow.
+const OpenAPIVersion = "3.0.3"
+
+// jsonObject is a JSON object of a generated document.
+type jsonObject = map[string]interface{}
+
+// OpenAPI describes the routes of the given models as an OpenAPI document.
+func (s *Store) OpenAPI(title, version string, models []string) jsonObject {
+	spec := &openAPISpec{store: s, schemas: jsonObject{"Problem": problemSchema}, paths: jsonObject{}}
+	for _, model := range models {
+		spec.addModel(model)
+	}
+	return jsonObject{
+		"openapi": OpenAPIVersion,
+		"info":    jsonObject{"title": title, "version": version},
+		"paths":   spec.paths,
+		"components": jsonObject{
+			"schemas": spec.schemas,
+			"parameters": jsonObject{
+				"TenantID":       jsonObject{"name": TenantHeader, "in": "header", "description": "Tenant whose namespace is used", "schema": jsonObject{"type": "string"}},
+				"IdempotencyKey": jsonObject{"name": IdempotencyHeader, "in": "header", "description": "Key under which retries of the creation are answered with its first response", "schema": jsonObject{"type": "string"}},
+				"IfMatch":        jsonObject{"name": "If-Match", "in": "header", "description": "ETag the item must still have", "schema": jsonObject{"type": "string"}},
+				"IfNoneMatch":    jsonObject{"name": "If-None-Match", "in": "header", "description": "ETag of a cached response, answered with 304 when it is current", "schema": jsonObject{"type": "string"}},
+			},
+		},
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document of the given models at /openapi.json.
+func handleOpenAPI(store *Store, models []string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	writeJSON(w, http.StatusOK, store.OpenAPI("go-crud-helper", "1.0.0", models))
+}
+
+// openAPISpec accumulates the paths and schemas of a document.
+type openAPISpec struct {
+	store   *Store
+	schemas jsonObject
+	paths   jsonObject
+}
+
+// addModel describes the routes of a model.
+func (o *openAPISpec) addModel(model string) {
+	meta, ok := o.store.meta(model)
+	if !ok {
+		return
+	}
+	ref := o.schemaRef(meta.typ)
+	item := content(ref)
+	base := "/" + model
+
+	query := []interface{}{
+		queryParam("id", "ID of the item to return instead of a list", jsonObject{"type": "integer"}),
+		queryParam("offset", "Number of matching items to skip", jsonObject{"type": "integer", "minimum": 0}),
+		queryParam("limit", "Maximum number of items to return", jsonObject{"type": "integer", "minimum": 0}),
+		queryParam("count", "Return {\"count\": n} instead of the items", jsonObject{"type": "boolean"}),
+		queryParam("q", "Only items whose string fields contain every word, most relevant first", jsonObject{"type": "string"}),
+		queryParam("fuzzy", "Also match the words resembling those of q", jsonObject{"type": "boolean"}),
+		queryParam("sort", "Comma-separated fields to order the items by, descending when prefixed with -", jsonObject{"type": "string"}),
+		queryParam("locale", "Locale strings are sorted in", jsonObject{"type": "string"}),
+	}
+	if len(o.store.parents(model)) > 0 || len(o.store.children(model)) > 0 {
+		query = append(query, queryParam("include", "Comma-separated relations to embed in every item", jsonObject{"type": "string"}))
+	}
+	if lat, _ := geoFields(meta); lat != nil {
+		query = append(query,
+			queryParam("near", "Only items around the point lat,lng, nearest first", jsonObject{"type": "string"}),
+			queryParam("radius_km", "Only items within this distance of near", jsonObject{"type": "number", "exclusiveMinimum": 0}))
+	}
+	for _, f := range meta.fields {
+		if f.jsonName == "-" || !orderable(f.typ) {
+			continue
+		}
+		schema := o.schema(f.typ)
+		query = append(query, queryParam(f.jsonName, "Only items whose "+f.jsonName+" equals the value", schema))
+		if f.typ.Kind() != reflect.Bool {
+			query = append(query,
+				queryParam(f.jsonName+"_gte", "Only items whose "+f.jsonName+" is at least the value", schema),
+				queryParam(f.jsonName+"_lte", "Only items whose "+f.jsonName+" is at most the value", schema))
+		}
+	}
+	address := []interface{}{queryParam("id", "ID of the item", jsonObject{"type": "integer"})}
+	if len(meta.key) > 0 {
+		var names []string
+		for _, f := range meta.key {
+			names = append(names, f.jsonName)
+		}
+		keyParam := queryParam("key", "Key of the item: "+strings.Join(names, ",")+", comma-separated", jsonObject{"type": "string"})
+		query = append(query, keyParam)
+		address = append(address, keyParam)
+	}
+
+	o.paths[base] = jsonObject{
+		"parameters": []interface{}{paramRef("TenantID")},
+		"get": operation("List the items of "+model+", or get one with ?id=", query, nil, responses(
+			"200", jsonObject{"description": "The matching items, or the requested item", "content": jsonObject{"application/json": jsonObject{"schema": jsonObject{"oneOf": []interface{}{jsonObject{"type": "array", "items": ref}, ref}}}}},
+			"304", jsonObject{"description": "Not modified since the ETag or date of the request"},
+			"400", errorResponse("Invalid filter, paging or ID"),
+			"404", errorResponse("Item not found"),
+		), paramRef("IfNoneMatch")),
+		"post": operation("Create an item of "+model, []interface{}{queryParam("ttl", "Lifetime of the item (e.g. 30s, 1h)", jsonObject{"type": "string"})}, item, responses(
+			"201", jsonObject{"description": "The created item", "content": item},
+			"400", errorResponse("Invalid request payload"),
+			"409", errorResponse("Key already taken"),
+			"422", errorResponse("Referenced parent does not exist"),
+		), paramRef("IdempotencyKey")),
+		"put":   operation("Replace an item of "+model, address, item, o.writeResponses(item), paramRef("IfMatch")),
+		"patch": operation("Merge fields into an item of "+model, address, content(jsonObject{"type": "object", "description": "JSON merge patch"}), o.writeResponses(item), paramRef("IfMatch")),
+		"delete": operation("Delete an item of "+model, address, nil, responses(
+			"204", jsonObject{"description": "Item deleted"},
+			"404", errorResponse("Item not found"),
+			"412", errorResponse("Item changed since the If-Match ETag"),
+			"428", errorResponse("If-Match header required"),
+		), paramRef("IfMatch")),
+	}
+
+	o.paths[base+"/_schema"] = jsonObject{
+		"get": operation("Describe the fields, keys and relations of "+model, nil, nil, responses(
+			"200", jsonObject{"description": "The model schema", "content": content(jsonObject{"type": "object"})},
+		)),
+	}
+
+	o.paths[base+"/_seed"] = jsonObject{
+		"parameters": []interface{}{paramRef("TenantID")},
+		"post": operation("Create generated items of "+model, []interface{}{
+			queryParam("count", "Number of items to create (default 10)", jsonObject{"type": "integer", "minimum": 1, "maximum": maxSeedCount}),
+			queryParam("seed", "Random seed, making the items deterministic", jsonObject{"type": "integer", "format": "int64"}),
+		}, nil, responses(
+			"201", jsonObject{"description": "The number of created items and the seed used", "content": content(jsonObject{"type": "object"})},
+			"400", errorResponse("Invalid count or seed"),
+			"409", errorResponse("No item could be stored"),
+		)),
+	}
+
+	for _, f := range meta.lookups {
+		o.paths[base+"/by-"+f.jsonName+"/{value}"] = jsonObject{
+			"parameters": []interface{}{paramRef("TenantID"), pathParam("value", "The item's "+f.jsonName, o.schema(f.typ))},
+			"get": operation("Get an item of "+model+" by its "+f.jsonName, nil, nil, responses(
+				"200", jsonObject{"description": "The item", "content": item},
+				"404", errorResponse("Item not found"),
+			)),
+			"put": operation("Replace an item of "+model+" found by its "+f.jsonName, nil, item, o.writeResponses(item), paramRef("IfMatch")),
+			"delete": operation("Delete an item of "+model+" found by its "+f.jsonName, nil, nil, responses(
+				"204", jsonObject{"description": "Item deleted"},
+				"404", errorResponse("Item not found"),
+			), paramRef("IfMatch")),
+		}
+	}
+
+	for _, relation := range o.store.children(model) {
+		childMeta, ok := o.store.meta(relation.Child)
+		if !ok {
+			continue
+		}
+		childRef := o.schemaRef(childMeta.typ)
+		o.paths[base+"/{id}/"+relation.Child] = jsonObject{
+			"parameters": []interface{}{paramRef("TenantID"), pathParam("id", "ID of the "+model, jsonObject{"type": "integer"})},
+			"get": operation("List the "+relation.Child+" items of a "+model, nil, nil, responses(
+				"200", jsonObject{"description": "The children of the item", "content": content(jsonObject{"type": "array", "items": childRef})},
+				"404", errorResponse("Parent not found"),
+			)),
+			"post": operation("Create a "+relation.Child+" item of a "+model, nil, content(childRef), responses(
+				"201", jsonObject{"description": "The created item", "content": content(childRef)},
+				"404", errorResponse("Parent not found"),
+			)),
+		}
+	}
+
+	o.store.typeMux.RLock()
+	manyToMany := append([]*ManyToMany(nil), o.store.manyToMany...)
+	o.store.typeMux.RUnlock()
+	for _, relation := range manyToMany {
+		var other string
+		switch model {
+		case relation.From:
+			other = relation.To
+		case relation.To:
+			other = relation.From
+		default:
+			continue
+		}
+		otherMeta, ok := o.store.meta(other)
+		if !ok {
+			continue
+		}
+		otherRef := o.schemaRef(otherMeta.typ)
+		ids := content(jsonObject{"type": "array", "items": jsonObject{"type": "integer"}})
+		idParam := pathParam("id", "ID of the "+model, jsonObject{"type": "integer"})
+		o.paths[base+"/{id}/"+other] = jsonObject{
+			"parameters": []interface{}{paramRef("TenantID"), idParam},
+			"get": operation("List the "+other+" items linked to a "+model, nil, nil, responses(
+				"200", jsonObject{"description": "The linked items", "content": content(jsonObject{"type": "array", "items": otherRef})},
+				"404", errorResponse("Item not found"),
+			)),
+			"put": operation("Replace the "+other+" items linked to a "+model, nil, ids, responses(
+				"200", jsonObject{"description": "The linked items", "content": content(jsonObject{"type": "array", "items": otherRef})},
+				"404", errorResponse("Item not found"),
+				"422", errorResponse("Linked item does not exist"),
+			)),
+		}
+		o.paths[base+"/{id}/relationships/"+other] = jsonObject{
+			"parameters": []interface{}{paramRef("TenantID"), idParam},
+			"get": operation("List the IDs of the "+other+" items linked to a "+model, nil, nil, responses(
+				"200", jsonObject{"description": "The linked IDs", "content": ids},
+			)),
+			"post": operation("Link "+other+" items to a "+model, nil, ids, responses(
+				"200", jsonObject{"description": "The linked IDs", "content": ids},
+				"422", errorResponse("Linked item does not exist"),
+			)),
+		}
+		o.paths[base+"/{id}/relationships/"+other+"/{otherID}"] = jsonObject{
+			"parameters": []interface{}{paramRef("TenantID"), idParam, pathParam("otherID", "ID of the "+other, jsonObject{"type": "integer"})},
+			"delete": operation("Unlink a "+other+" item from a "+model, nil, nil, responses(
+				"204", jsonObject{"description": "Link removed"},
+				"404", errorResponse("Link not found"),
+			)),
+		}
+	}
+}
+
+// writeResponses returns the responses of a replacement of an item.
+func (o *openAPISpec) writeResponses(item jsonObject) jsonObject {
+	return responses(
+		"200", jsonObject{"description": "The updated item", "content": item},
+		"400", errorResponse("Invalid ID or request payload"),
+		"404", errorResponse("Item not found"),
+		"409", errorResponse("Key already taken"),
+		"412", errorResponse("Item changed since the If-Match ETag"),
+		"422", errorResponse("Referenced parent does not exist"),
+		"428", errorResponse("If-Match header required"),
+	)
+}
+
+// schemaRef returns a reference to the schema of a struct type, adding it to the components.
+func (o *openAPISpec) schemaRef(t reflect.Type) jsonObject {
+	name := t.Name()
+	if _, ok := o.schemas[name]; !ok {
+		o.schemas[name] = jsonObject{} // placeholder, so recursive types terminate
+		o.schemas[name] = o.structSchema(t)
+	}
+	return jsonObject{"$ref": "#/components/schemas/" + name}
+}
+
+// structSchema describes the fields of a struct type.
+func (o *openAPISpec) structSchema(t reflect.Type) jsonObject {
+	meta := metaFor(t)
+	properties := jsonObject{}
+	var required []string
+	for _, f := range meta.fields {
+		if f.jsonName == "-" {
+			continue
+		}
+		schema := o.schema(f.typ)
+		switch {
+		case f == meta.id:
+			schema = jsonObject{"type": "integer", "readOnly": true}
+		case f.tag.Get("key") == "true":
+			required = append(required, f.jsonName)
+		}
+		if f.crudOption("unique") {
+			schema = withDescription(schema, "Unique among the items of the model")
+		}
+		for _, relation := range meta.belongsTo {
+			if relation.foreignKey == f {
+				schema = withDescription(schema, "ID of the "+strings.Join(relation.parents, " or ")+" the item belongs to")
+			}
+		}
+		properties[f.jsonName] = schema
+	}
+	schema := jsonObject{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// schema describes a Go type.
+func (o *openAPISpec) schema(t reflect.Type) jsonObject {
+	if t == reflect.TypeOf(time.Time{}) {
+		return jsonObject{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := o.schema(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if t.Bits() <= 32 {
+			return jsonObject{"type": "integer", "format": "int32"}
+		}
+		return jsonObject{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer", "minimum": 0}
+	case reflect.Float32:
+		return jsonObject{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return jsonObject{"type": "number", "format": "double"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonObject{"type": "string", "format": "byte"}
+		}
+		return jsonObject{"type": "array", "items": o.schema(t.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": o.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return o.structSchema(t)
+		}
+		return o.schemaRef(t)
+	}
+	return jsonObject{}
+}
+
+// withDescription adds a description to a schema, which must not be a reference.
+func withDescription(schema jsonObject, description string) jsonObject {
+	if _, ref := schema["$ref"]; ref {
+		return jsonObject{"allOf": []interface{}{schema}, "description": description}
+	}
+	schema["description"] = description
+	return schema
+}
+
+// operation describes an operation on a path.
+func operation(summary string, parameters []interface{}, body, answers jsonObject, headers ...interface{}) jsonObject {
+	op := jsonObject{"summary": summary, "responses": answers}
+	if params := append(append([]interface{}(nil), parameters...), headers...); len(params) > 0 {
+		op["parameters"] = params
+	}
+	if body != nil {
+		op["requestBody"] = jsonObject{"required": true, "content": body}
+	}
+	return op
+}
+
+// responses builds the responses of an operation from status and response pairs.
+func responses(pairs ...interface{}) jsonObject {
+	result := jsonObject{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		result[pairs[i].(string)] = pairs[i+1]
+	}
+	return result
+}
+
+// content describes a JSON body of the given schema.
+func content(schema jsonObject) jsonObject {
+	return jsonObject{"application/json": jsonObject{"schema": schema}}
+}
+
+// problemSchema describes the RFC 7807 problem details of error responses.
+var problemSchema = jsonObject{
+	"type":     "object",
+	"required": []string{"type", "title", "status", "code"},
+	"properties": jsonObject{
+		"type":      jsonObject{"type": "string", "description": "URI identifying the problem type"},
+		"title":     jsonObject{"type": "string", "description": "Summary of the problem type"},
+		"status":    jsonObject{"type": "integer", "description": "HTTP status code"},
+		"code":      jsonObject{"type": "string", "description": "Machine-readable error code, such as ITEM_NOT_FOUND"},
+		"detail":    jsonObject{"type": "string", "description": "Explanation of this occurrence of the problem"},
+		"instance":  jsonObject{"type": "string", "description": "Path of the request"},
+		"requestId": jsonObject{"type": "string", "description": "ID of the request, also sent as X-Request-ID"},
+		"errors": jsonObject{
+			"type":        "array",
+			"description": "Fields of the submitted item violating their rules",
+			"items": jsonObject{
+				"type":     "object",
+				"required": []string{"field", "rule", "message"},
+				"properties": jsonObject{
+					"field":   jsonObject{"type": "string", "description": "JSON name of the field"},
+					"rule":    jsonObject{"type": "string", "description": "Rule violated, such as required, email or type"},
+					"value":   jsonObject{"description": "Submitted value, redacted for sensitive fields"},
+					"message": jsonObject{"type": "string", "description": "Explanation of the violation"},
+				},
+			},
+		},
+	},
+}
+
+// errorResponse describes an error response, answered with problem details.
+func errorResponse(description string) jsonObject {
+	return jsonObject{
+		"description": description,
+		"content":     jsonObject{problemContentType: jsonObject{"schema": jsonObject{"$ref": "#/components/schemas/Problem"}}},
+	}
+}
+
+// queryParam describes an optional query parameter.
+func queryParam(name, description string, schema jsonObject) jsonObject {
+	return jsonObject{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+// pathParam describes a path parameter.
+func pathParam(name, description string, schema jsonObject) jsonObject {
+	return jsonObject{"name": name, "in": "path", "required": true, "description": description, "schema": schema}
+}
+
+// paramRef refers to a parameter of the components.
+func paramRef(name string) jsonObject {
+	return jsonObject{"$ref": "#/components/parameters/" + name}
+}
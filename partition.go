@@ -0,0 +1,711 @@
+// File: partition.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the partitioned mode. Items are spread over a consistent-hashing
+// ring of nodes, each node owning the items whose (model, ID) key hashes onto its share of the ring,
+// and every item is stored on ReplicationFactor consecutive owners. Requests for an item are routed to
+// its owners, creates pick a cluster-unique ID and are written to the new item's owners, and changes
+// made on an owner are pushed to the other owners in order. Collection queries are scattered to every
+// node and the results gathered into one logical collection. When the membership changes (PUT
+// /_partition/ring, an admin route), every node hands the items it no longer owns over to their new
+// owners. The changes are only accepted from signed nodes, travel with their encrypted fields sealed
+// and are written through the checked paths, held to the checks of their model like local writes.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Partitioning settings.
+const (
+	partitionVirtualNodes = 128
+	partitionIDStride     = 1024 // IDs are counter*stride + slot, so up to stride-1 nodes create IDs
+	partitionQueueSize    = 10000
+	partitionMaxBatch     = 256
+	partitionClientTime   = 5 * time.Second
+	partitionMaxBody      = 32 << 20
+)
+
+// partitionOrigin marks the change events written by the partitioning protocol.
+const partitionOrigin = "partition"
+
+// partitionForwardedHeader marks a request routed to an owner, so it is served there and never
+// routed again.
+const partitionForwardedHeader = "X-Partition-Forwarded"
+
+// partitionStats holds the routing and replication counters.
+var partitionStats = expvar.NewMap("partition")
+
+// Ring is a consistent-hashing ring with virtual nodes.
+type Ring struct {
+	nodes  []string
+	points []ringPoint
+}
+
+// ringPoint is one virtual node.
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// NewRing creates a ring of the given nodes.
+func NewRing(nodes []string) *Ring {
+	ring := &Ring{}
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if node = strings.TrimRight(strings.TrimSpace(node), "/"); node == "" || seen[node] {
+			continue
+		}
+		seen[node] = true
+		ring.nodes = append(ring.nodes, node)
+		for i := 0; i < partitionVirtualNodes; i++ {
+			ring.points = append(ring.points, ringPoint{hash: ringHash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Strings(ring.nodes)
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i].hash < ring.points[j].hash })
+	return ring
+}
+
+// ringHash places a key on the ring.
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// Mix the bits so keys differing in their last characters land far apart
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// Nodes returns the members of the ring in order.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// Owners returns the n distinct nodes owning a key, starting with the first node clockwise from it.
+func (r *Ring) Owners(key string, n int) []string {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil
+	}
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+
+	owners := make([]string, 0, n)
+	for i := 0; len(owners) < n; i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if !containsString(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
+
+// containsString reports whether a list holds a string.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// partitionKey is the ring key of an item.
+func partitionKey(model string, id int) string {
+	return model + "#" + strconv.Itoa(id)
+}
+
+// partitionChange is a change sent to an owner.
+type partitionChange struct {
+	Op    string          `json:"op"`
+	Model string          `json:"model"`
+	ID    int             `json:"id"`
+	Item  json.RawMessage `json:"item,omitempty"`
+	Time  time.Time       `json:"time"`
+}
+
+// Partitioner routes the items of a store to their owners on a ring.
+type Partitioner struct {
+	// Self is the advertised base URL of this node.
+	Self string
+	// ReplicationFactor is the number of nodes each item is stored on.
+	ReplicationFactor int
+	// Slot makes the IDs created by this node unique in the cluster; it must differ between nodes
+	// and lie between 1 and 1023. It defaults to the position of Self among the initial nodes.
+	Slot int
+	// Auth signs the requests sent to the other nodes.
+	Auth *ClusterAuth
+	// AdminToken lets operators change the members of the ring.
+	AdminToken string
+
+	store   *Store
+	client  *http.Client
+	ring    *Ring
+	counter int64
+	queues  map[string]chan partitionChange
+	mux     sync.Mutex
+}
+
+// NewPartitioner creates the partitioner of the node advertised at self, in a ring of the given
+// nodes (self is added when missing).
+func NewPartitioner(store *Store, self string, nodes []string) *Partitioner {
+	self = strings.TrimRight(self, "/")
+	ring := NewRing(append(nodes, self))
+	slot := 1
+	for i, node := range ring.nodes {
+		if node == self {
+			slot = i + 1
+		}
+	}
+	return &Partitioner{
+		Self:              self,
+		ReplicationFactor: 2,
+		Slot:              slot,
+		store:             store,
+		client:            &http.Client{Timeout: partitionClientTime},
+		ring:              ring,
+		queues:            make(map[string]chan partitionChange),
+	}
+}
+
+// Start routes the store's requests through the partitioner and pushes local changes to the other
+// owners of the changed items.
+func (p *Partitioner) Start() error {
+	if p.Slot < 1 || p.Slot >= partitionIDStride {
+		return fmt.Errorf("partition slot must be between 1 and %d", partitionIDStride-1)
+	}
+	p.store.partition = p
+	p.store.Subscribe(p.publish)
+	return nil
+}
+
+// Ring returns the current ring.
+func (p *Partitioner) Ring() *Ring {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return p.ring
+}
+
+// Owners returns the nodes owning an item.
+func (p *Partitioner) Owners(model string, id int) []string {
+	return p.Ring().Owners(partitionKey(model, id), p.ReplicationFactor)
+}
+
+// nextID returns a cluster-unique ID: the counter follows the clock in milliseconds so IDs keep
+// increasing across restarts, and the slot tells the creating nodes apart.
+func (p *Partitioner) nextID() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.counter++
+	if now := time.Now().UnixMilli(); now > p.counter {
+		p.counter = now
+	}
+	return int(p.counter)*partitionIDStride + p.Slot
+}
+
+// route serves a model request that involves other nodes and reports whether it did. Requests
+// for items this node owns and requests already routed here are left to the regular handler.
+func (p *Partitioner) route(model string, meta *modelMeta, w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(partitionForwardedHeader) != "" {
+		return false
+	}
+	if r.Method == http.MethodPost {
+		p.create(model, meta, w, r)
+		return true
+	}
+	if r.Method == http.MethodGet && r.URL.Query().Get("id") == "" && meta.id != nil {
+		p.gather(model, meta, w, r)
+		return true
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return false
+	}
+	owners := p.Owners(model, id)
+	if containsString(owners, p.Self) {
+		return false
+	}
+	p.forward(w, r, owners)
+	return true
+}
+
+// create stores a new item on its owners under a cluster-unique ID.
+func (p *Partitioner) create(model string, meta *modelMeta, w http.ResponseWriter, r *http.Request) {
+	item := reflect.New(meta.typ).Interface()
+	if err := decodeItem(r.Body, item); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, decodeError(meta, err))
+		return
+	}
+	if err := validate(meta, item); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		ttl, err := parseTTL(v)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid TTL")
+			return
+		}
+		if meta.expiresAt == nil {
+			writeProblem(w, r, http.StatusBadRequest, "TTL requires an ExpiresAt field in partitioned mode")
+			return
+		}
+		meta.setExpiry(item, time.Now().Add(ttl))
+	}
+
+	id := p.nextID()
+	if meta.id != nil {
+		meta.id.value(item).SetInt(int64(id))
+	}
+	data, err := marshalSealed(model, id, item)
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Cannot encode item")
+		return
+	}
+
+	change := partitionChange{Op: OpCreate, Model: model, ID: id, Item: data, Time: time.Now()}
+	stored := 0
+	for _, owner := range p.Owners(model, id) {
+		if owner == p.Self {
+			if err := p.apply(change); err != nil {
+				writeError(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+			stored++
+		} else if err := p.send(owner, []partitionChange{change}); err == nil {
+			stored++
+		} else {
+			log.Printf("partition: cannot store %s %d on %s: %v", model, id, owner, err)
+		}
+	}
+	if stored == 0 {
+		writeProblem(w, r, http.StatusServiceUnavailable, "No owner of the item is reachable")
+		return
+	}
+	writeJSON(w, http.StatusCreated, item)
+}
+
+// forward proxies a request to the first reachable owner.
+func (p *Partitioner) forward(w http.ResponseWriter, r *http.Request, owners []string) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, partitionMaxBody))
+	if err != nil {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+		return
+	}
+
+	for _, owner := range owners {
+		req, err := http.NewRequest(r.Method, owner+r.URL.RequestURI(), bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header = r.Header.Clone()
+		req.Header.Set(partitionForwardedHeader, p.Self)
+		resp, err := p.client.Do(req)
+		if err != nil {
+			partitionStats.Add("owner_errors", 1)
+			continue
+		}
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+		partitionStats.Add("requests_routed", 1)
+		return
+	}
+	writeProblem(w, r, http.StatusServiceUnavailable, "No owner of the item is reachable")
+}
+
+// gather answers a collection query from every node of the ring concurrently, merging the partial
+// results by ID so replicated items appear once and pages are cut from the merged order. Nodes that
+// cannot be reached are listed in the X-Partition-Missing header; their items are still included
+// when another owner holds a copy.
+func (p *Partitioner) gather(model string, meta *modelMeta, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filters, err := parseFilters(meta, query)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	page, err := parsePage(query)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	count := query.Get("count") == "true"
+
+	// Every node returns its matches up to the end of the page; only the merged order is paged
+	shardQuery := r.URL.Query()
+	shardQuery.Del("count")
+	shardQuery.Del("offset")
+	shardQuery.Del("limit")
+	need := 0
+	if page.Limit > 0 && !count {
+		need = page.Offset + page.Limit
+		shardQuery.Set("limit", strconv.Itoa(need))
+	}
+
+	local, err := p.store.matching(model, filters)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if need > 0 && len(local) > need {
+		local = local[:need]
+	}
+	merged := make(map[int]interface{}, len(local))
+	for _, m := range local {
+		merged[m.id] = m.item
+	}
+
+	var (
+		missing []string
+		wg      sync.WaitGroup
+		mux     sync.Mutex
+	)
+	for _, node := range p.Ring().Nodes() {
+		if node == p.Self {
+			continue
+		}
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			items, err := p.fetch(node, r, shardQuery, meta)
+
+			mux.Lock()
+			defer mux.Unlock()
+			if err != nil {
+				partitionStats.Add("owner_errors", 1)
+				missing = append(missing, node)
+				return
+			}
+			for _, item := range items {
+				merged[int(meta.id.value(item).Int())] = item
+			}
+		}(node)
+	}
+	wg.Wait()
+	partitionStats.Add("queries_gathered", 1)
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		w.Header().Set("X-Partition-Missing", strings.Join(missing, ","))
+	}
+	if count {
+		writeJSON(w, http.StatusOK, map[string]int{"count": len(merged)})
+		return
+	}
+	ids := make([]int, 0, len(merged))
+	for id := range merged {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	start, end := page.bounds(len(ids))
+	items := make([]interface{}, 0, end-start)
+	for _, id := range ids[start:end] {
+		items = append(items, merged[id])
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// fetch runs a collection query on one node only and decodes the items it answers with.
+func (p *Partitioner) fetch(node string, r *http.Request, query url.Values, meta *modelMeta) ([]interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, node+r.URL.Path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(partitionForwardedHeader, p.Self)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("partition: %s answered %s", node, resp.Status)
+	}
+	var raw []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	items := make([]interface{}, len(raw))
+	for i, data := range raw {
+		items[i] = reflect.New(meta.typ).Interface()
+		if err := unmarshalItem(data, items[i]); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// publish queues the local changes of owned items for the item's other owners. It is meant to be
+// passed to Store.Subscribe; changes received from other nodes are not sent on again.
+func (p *Partitioner) publish(event ChangeEvent) {
+	if event.Origin != "" {
+		return
+	}
+	owners := p.Owners(event.Model, event.ID)
+	if !containsString(owners, p.Self) {
+		return
+	}
+
+	change := partitionChange{Op: event.Op, Model: event.Model, ID: event.ID, Time: event.Time}
+	if event.Item != nil {
+		data, err := marshalSealed(event.Model, event.ID, event.Item)
+		if err != nil {
+			log.Printf("partition: cannot encode %s %d: %v", event.Model, event.ID, err)
+			return
+		}
+		change.Item = data
+	}
+	for _, owner := range owners {
+		if owner == p.Self {
+			continue
+		}
+		select {
+		case p.queue(owner) <- change:
+		default:
+			partitionStats.Add("changes_dropped", 1)
+		}
+	}
+}
+
+// queue returns the queue of changes for a node, starting its sender on first use. Each node has a
+// single sender so it receives the changes in the order they were made.
+func (p *Partitioner) queue(node string) chan partitionChange {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	queue, ok := p.queues[node]
+	if !ok {
+		queue = make(chan partitionChange, partitionQueueSize)
+		p.queues[node] = queue
+		go p.sendLoop(node, queue)
+	}
+	return queue
+}
+
+// sendLoop sends the queued changes to a node in batches.
+func (p *Partitioner) sendLoop(node string, queue chan partitionChange) {
+	for change := range queue {
+		batch := []partitionChange{change}
+		for len(batch) < partitionMaxBatch && len(queue) > 0 {
+			batch = append(batch, <-queue)
+		}
+		if err := p.send(node, batch); err != nil {
+			partitionStats.Add("send_errors", 1)
+			log.Printf("partition: cannot replicate %d changes to %s: %v", len(batch), node, err)
+			continue
+		}
+		partitionStats.Add("changes_sent", int64(len(batch)))
+	}
+}
+
+// send posts a batch of changes to a node.
+func (p *Partitioner) send(node string, changes []partitionChange) error {
+	body, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	resp, err := p.Auth.Do(p.client, http.MethodPost, node+"/_partition/apply", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("partition: %s answered %s", node, resp.Status)
+	}
+	return nil
+}
+
+// apply writes a change received from another node to the local store through the checked paths.
+func (p *Partitioner) apply(change partitionChange) error {
+	ctx := withOrigin(context.Background(), partitionOrigin)
+	return p.store.applyReplicated(ctx, change.Op, change.Model, change.ID, change.Item)
+}
+
+// SetNodes replaces the members of the ring and hands the local items the new ring assigns to other
+// nodes over to them. A node left out of the ring hands over all of its items.
+func (p *Partitioner) SetNodes(nodes []string) {
+	ring := NewRing(nodes)
+
+	p.mux.Lock()
+	old := p.ring
+	p.ring = ring
+	p.mux.Unlock()
+
+	log.Printf("partition: ring changed to %s", strings.Join(ring.Nodes(), ", "))
+	go p.rebalance(old, ring)
+}
+
+// rebalance copies local items to the nodes that became their owners, then drops the items this node
+// no longer owns once another owner is known to have them.
+func (p *Partitioner) rebalance(old, ring *Ring) {
+	moved := 0
+	for _, c := range p.store.allCollections() {
+		transfers := make(map[string][]partitionChange)
+		var leaving []int
+		delivered := make(map[int]bool)
+		c.each(func(id int, item interface{}) error {
+			key := partitionKey(c.name, id)
+			before, after := old.Owners(key, p.ReplicationFactor), ring.Owners(key, p.ReplicationFactor)
+			data, err := marshalSealed(c.name, id, item)
+			if err != nil {
+				return nil
+			}
+			for _, owner := range after {
+				if containsString(before, owner) && owner != p.Self {
+					delivered[id] = true
+				} else if owner != p.Self {
+					transfers[owner] = append(transfers[owner], partitionChange{Op: OpCreate, Model: c.name, ID: id, Item: data, Time: time.Now()})
+				}
+			}
+			if !containsString(after, p.Self) {
+				leaving = append(leaving, id)
+			}
+			return nil
+		})
+
+		for owner, changes := range transfers {
+			for start := 0; start < len(changes); start += partitionMaxBatch {
+				end := start + partitionMaxBatch
+				if end > len(changes) {
+					end = len(changes)
+				}
+				if err := p.send(owner, changes[start:end]); err != nil {
+					log.Printf("partition: cannot hand %s items over to %s: %v", c.name, owner, err)
+					continue
+				}
+				for _, change := range changes[start:end] {
+					delivered[change.ID] = true
+				}
+			}
+		}
+		for _, id := range leaving {
+			if !delivered[id] {
+				continue
+			}
+			if err := p.apply(partitionChange{Op: OpDelete, Model: c.name, ID: id, Time: time.Now()}); err != nil {
+				log.Printf("partition: cannot drop %s %d handed over: %v", c.name, id, err)
+				continue
+			}
+			moved++
+		}
+	}
+	partitionStats.Add("items_moved", int64(moved))
+	log.Printf("partition: rebalanced, %d items moved to other nodes", moved)
+}
+
+// handlePartition serves the partitioning endpoints: POST /_partition/apply receives changes from
+// the signed nodes, GET /_partition/ring describes the ring and PUT /_partition/ring, sent by an
+// operator with the admin token, changes its members on every node.
+func (p *Partitioner) handlePartition(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/_partition/apply" && r.Method == http.MethodPost:
+		if !fromPeer(r) {
+			writeProblem(w, r, http.StatusUnauthorized, "A valid cluster signature is required in the "+ClusterSignatureHeader+" header")
+			return
+		}
+		var changes []partitionChange
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, partitionMaxBody)).Decode(&changes); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		refused := 0
+		for _, change := range changes {
+			if err := p.apply(change); err != nil {
+				log.Printf("partition: refused %s %s %d: %v", change.Op, change.Model, change.ID, err)
+				refused++
+			}
+		}
+		partitionStats.Add("changes_applied", int64(len(changes)-refused))
+		partitionStats.Add("changes_refused", int64(refused))
+		if refused > 0 {
+			writeProblem(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("%d of %d changes were refused", refused, len(changes)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case r.URL.Path == "/_partition/ring" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"self":              p.Self,
+			"nodes":             p.Ring().Nodes(),
+			"replicationFactor": p.ReplicationFactor,
+		})
+
+	case r.URL.Path == "/_partition/ring" && r.Method == http.MethodPut:
+		if !fromPeer(r) {
+			adminOnly(p.AdminToken, p.changeRing)(w, r)
+			return
+		}
+		p.changeRing(w, r)
+
+	default:
+		notFound(w, r, "Not found")
+	}
+}
+
+// changeRing serves PUT /_partition/ring. The ring is changed on every old and new member when the
+// request comes from an operator, and on this node only when another node sent it on.
+func (p *Partitioner) changeRing(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Nodes []string `json:"nodes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Nodes) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// Tell every old and new member, unless this request was sent on by another node
+	if !fromPeer(r) {
+		members := NewRing(append(request.Nodes, p.Ring().Nodes()...)).Nodes()
+		body, _ := json.Marshal(request)
+		for _, node := range members {
+			if node == p.Self {
+				continue
+			}
+			req, err := http.NewRequest(http.MethodPut, node+"/_partition/ring", bytes.NewReader(body))
+			if err != nil {
+				continue
+			}
+			req.Header.Set(partitionForwardedHeader, p.Self)
+			p.Auth.Sign(req, body)
+			if resp, err := p.client.Do(req); err != nil {
+				log.Printf("partition: cannot update the ring of %s: %v", node, err)
+			} else {
+				resp.Body.Close()
+			}
+		}
+	}
+	p.SetNodes(request.Nodes)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"nodes": p.Ring().Nodes()})
+}
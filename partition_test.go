@@ -0,0 +1,53 @@
+// File: partition_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the routes of the partitioned mode: only signed nodes push changes,
+// which are held to the checks of their model, and only operators holding the admin token change
+// the ring.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPartitionRoutesRequireNodesOrTheAdmin(t *testing.T) {
+	auth := NewClusterAuth("secret")
+	store := newTestStore()
+	store.Create("user", &User{Name: "local", Email: "taken@example.com"})
+	p := NewPartitioner(store, "http://a", nil)
+	p.AdminToken = "admin"
+	handler := auth.Handler(http.HandlerFunc(p.handlePartition))
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	change := `[{"op":"create","model":"user","id":1025,"item":{"name":"remote","email":"remote@example.com"}}]`
+	if w := serve(httptest.NewRequest(http.MethodPost, "/_partition/apply", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned changes: status %d, want 401", w.Code)
+	}
+	if w := serve(signedRequest(auth, "/_partition/apply", change)); w.Code != http.StatusOK || !store.exists("user", 1025) {
+		t.Fatalf("signed change: status %d, want 200 and the user stored", w.Code)
+	}
+	duplicate := `[{"op":"create","model":"user","id":2049,"item":{"name":"duplicate","email":"taken@example.com"}}]`
+	if w := serve(signedRequest(auth, "/_partition/apply", duplicate)); w.Code != http.StatusUnprocessableEntity || store.exists("user", 2049) {
+		t.Errorf("change taking a unique email: status %d, want 422 and nothing stored", w.Code)
+	}
+
+	ring := `{"nodes":["http://a","http://b"]}`
+	if w := serveTest(handler.ServeHTTP, http.MethodPut, "/_partition/ring", ring); w.Code != http.StatusUnauthorized {
+		t.Errorf("ring change without the admin token: status %d, want 401", w.Code)
+	}
+	if got := p.Ring().Nodes(); len(got) != 1 {
+		t.Fatalf("ring changed to %v without the admin token", got)
+	}
+	if w := serveTest(handler.ServeHTTP, http.MethodPut, "/_partition/ring", `{"nodes":["http://a"]}`, "Authorization", "Bearer admin"); w.Code != http.StatusOK {
+		t.Errorf("ring change with the admin token: status %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,121 @@
+// File: paths.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file normalizes request paths (-paths). Duplicate slashes and dot segments
+// are removed (//item/./_schema is /item/_schema), and a trailing slash is dropped from paths
+// that only match a route without it (/openapi.json/ is /openapi.json); the model routes
+// already serve /item/ like /item. In rewrite mode (the default) the normalized path is served
+// directly, in redirect mode the client is sent to it with 308 Permanent Redirect (which keeps
+// the method and body, unlike the 301 of http.ServeMux), and in strict mode paths are left as
+// they are.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// PathNormalization is how non-canonical request paths are handled.
+type PathNormalization int
+
+const (
+	PathRewrite  PathNormalization = iota // serve the normalized path
+	PathRedirect                          // redirect to the normalized path
+	PathStrict                            // serve the path as it is
+)
+
+// pathNormalization is how non-canonical request paths are handled.
+var pathNormalization = PathRewrite
+
+// SetPathNormalization sets how non-canonical request paths are handled.
+func SetPathNormalization(mode PathNormalization) {
+	pathNormalization = mode
+}
+
+// ParsePathNormalization parses a path normalization mode: rewrite, redirect or strict.
+func ParsePathNormalization(s string) (PathNormalization, error) {
+	switch s {
+	case "", "rewrite":
+		return PathRewrite, nil
+	case "redirect":
+		return PathRedirect, nil
+	case "strict":
+		return PathStrict, nil
+	}
+	return PathRewrite, fmt.Errorf("invalid path normalization %q (expected rewrite, redirect or strict)", s)
+}
+
+// withPathNormalization normalizes the paths of the requests routed by mux before serving them
+// with next.
+func withPathNormalization(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pathNormalization == PathStrict {
+			next.ServeHTTP(w, r)
+			return
+		}
+		normalized := normalizePath(mux, r)
+		switch {
+		case normalized == r.URL.Path:
+			next.ServeHTTP(w, r)
+		case pathNormalization == PathRedirect:
+			redirectToPath(w, r, normalized)
+		default:
+			r.URL.Path, r.URL.RawPath = normalized, ""
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// normalizePath returns the normalized path of a request.
+func normalizePath(mux *http.ServeMux, r *http.Request) string {
+	p := r.URL.Path
+	if p == "" || p == "/" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if strings.HasSuffix(cleaned, "/") && cleaned != "/" && !routed(mux, r, cleaned) {
+		if trimmed := strings.TrimSuffix(cleaned, "/"); routed(mux, r, trimmed) {
+			cleaned = trimmed
+		}
+	}
+	return cleaned
+}
+
+// routed reports whether a request would match a route other than the catch-all one with another
+// path.
+func routed(mux *http.ServeMux, r *http.Request, p string) bool {
+	probe := *r
+	u := *r.URL
+	u.Path, u.RawPath = p, ""
+	probe.URL = &u
+	_, pattern := mux.Handler(&probe)
+	return pattern != "" && pattern != "/"
+}
+
+// redirectTrailingSlash redirects the requests to a model route ending with a slash to the route
+// without it in redirect mode, reporting whether it did.
+func redirectTrailingSlash(w http.ResponseWriter, r *http.Request) bool {
+	if pathNormalization != PathRedirect || !strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+	redirectToPath(w, r, strings.TrimRight(r.URL.Path, "/"))
+	return true
+}
+
+// redirectToPath redirects a request to another path, keeping its query and the prefix of the API
+// version serving it.
+func redirectToPath(w http.ResponseWriter, r *http.Request, p string) {
+	target := versionPrefix(r) + p
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusPermanentRedirect)
+}
@@ -0,0 +1,183 @@
+// File: peer_auth.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file authenticates the requests the nodes of a cluster send each other over
+// HTTP; the Raft transport authenticates its own connections (see raft_transport.go). The nodes
+// share the secret of -cluster-secret and sign every request with an HMAC-SHA256 of its method,
+// path, timestamp, a nonce and its body. The peer routes (heartbeats, votes, replicated changes and
+// member lists) are only served to requests whose signature is valid, at most 30 seconds old and
+// never seen before, and are refused to everyone on a node started without a secret. Only the
+// requests authenticated this way are exempt from API keys and rate limits.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterSignatureHeader is the header carrying the signature of a request between cluster nodes.
+const ClusterSignatureHeader = "X-Cluster-Signature"
+
+// ClusterSecretEnv is the environment variable the cluster secret is read from.
+const ClusterSecretEnv = "CRUD_CLUSTER_SECRET"
+
+// Signature limits.
+const (
+	clusterSignatureAge = 30 * time.Second
+	clusterMaxBody      = 32 << 20
+)
+
+// peerPaths are the routes the nodes of a cluster call each other on. Their writes must be signed by
+// a node, and are then neither metered by API keys nor rate limited, so heartbeats and replication
+// keep flowing.
+var peerPaths = map[string]bool{
+	"/_election/heartbeat": true, "/_election/vote": true,
+	"/_gossip/changes": true, "/_gossip/members": true, "/_partition/apply": true,
+}
+
+// peerKey is the context key marking the requests signed by a node of the cluster.
+type peerKey struct{}
+
+// fromPeer reports whether a request was signed by a node of the cluster.
+func fromPeer(r *http.Request) bool {
+	peer, _ := r.Context().Value(peerKey{}).(bool)
+	return peer
+}
+
+// ClusterAuth signs the requests sent to the other nodes of a cluster and verifies the ones they
+// send. A nil or secretless ClusterAuth signs nothing and verifies nothing.
+type ClusterAuth struct {
+	secret []byte
+	nonces map[string]time.Time
+	swept  time.Time
+	mux    sync.Mutex
+}
+
+// NewClusterAuth creates the authenticator of a cluster sharing secret, read from ClusterSecretEnv
+// when empty. It returns nil when there is no secret.
+func NewClusterAuth(secret string) *ClusterAuth {
+	if secret == "" {
+		secret = os.Getenv(ClusterSecretEnv)
+	}
+	if secret == "" {
+		return nil
+	}
+	return &ClusterAuth{secret: []byte(secret), nonces: make(map[string]time.Time)}
+}
+
+// signature computes the signature of a request.
+func (a *ClusterAuth) signature(method, uri, stamp, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", method, uri, stamp, nonce, sum)
+	return mac.Sum(nil)
+}
+
+// Sign adds the signature of a request with the given body to its headers.
+func (a *ClusterAuth) Sign(req *http.Request, body []byte) {
+	if a == nil {
+		return
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	stamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := a.signature(req.Method, req.URL.RequestURI(), stamp, hex.EncodeToString(nonce), body)
+	req.Header.Set(ClusterSignatureHeader, fmt.Sprintf("t=%s,n=%x,s=%x", stamp, nonce, sig))
+}
+
+// Do sends a signed JSON request to another node.
+func (a *ClusterAuth) Do(client *http.Client, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	a.Sign(req, body)
+	return client.Do(req)
+}
+
+// verify checks the signature of a request, leaving its body to be read again.
+func (a *ClusterAuth) verify(w http.ResponseWriter, r *http.Request) error {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(r.Header.Get(ClusterSignatureHeader), ",") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(part), "="); ok {
+			fields[name] = value
+		}
+	}
+	seconds, err := strconv.ParseInt(fields["t"], 10, 64)
+	if err != nil || fields["n"] == "" {
+		return errors.New("malformed signature")
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > clusterSignatureAge || age < -clusterSignatureAge {
+		return errors.New("expired signature")
+	}
+	sig, err := hex.DecodeString(fields["s"])
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, clusterMaxBody))
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal(sig, a.signature(r.Method, r.URL.RequestURI(), fields["t"], fields["n"], body)) {
+		return errors.New("invalid signature")
+	}
+
+	// A signature is only accepted once, so a recorded request cannot be replayed
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	now := time.Now()
+	if now.Sub(a.swept) > clusterSignatureAge {
+		for nonce, seen := range a.nonces {
+			if now.Sub(seen) > 2*clusterSignatureAge {
+				delete(a.nonces, nonce)
+			}
+		}
+		a.swept = now
+	}
+	if _, seen := a.nonces[fields["n"]]; seen {
+		return errors.New("replayed signature")
+	}
+	a.nonces[fields["n"]] = now
+	return nil
+}
+
+// Handler verifies the signature of the requests carrying one, marking them as sent by a node of
+// the cluster, and refuses the writes to the peer routes that carry none. Other requests are passed
+// on untouched.
+func (a *ClusterAuth) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signed := r.Header.Get(ClusterSignatureHeader) != ""
+		peerWrite := peerPaths[r.URL.Path] && r.Method != http.MethodGet && r.Method != http.MethodHead
+		if !signed && !peerWrite {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if a == nil {
+			writeProblem(w, r, http.StatusForbidden, "Cluster routes are disabled; start the nodes with -cluster-secret")
+			return
+		}
+		if !signed || a.verify(w, r) != nil {
+			writeProblem(w, r, http.StatusUnauthorized, "A valid cluster signature is required in the "+ClusterSignatureHeader+" header")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerKey{}, true)))
+	})
+}
@@ -0,0 +1,95 @@
+// File: peer_auth_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the signatures of the requests between cluster nodes: only signed,
+// fresh and unreplayed requests reach the peer routes, and only they skip the API keys and the
+// rate limits.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// signedRequest builds a request to a peer route signed by auth.
+func signedRequest(auth *ClusterAuth, path, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	auth.Sign(r, []byte(body))
+	return r
+}
+
+func TestClusterAuthGuardsThePeerRoutes(t *testing.T) {
+	auth := NewClusterAuth("secret")
+	keys := NewAPIKeys()
+	reached := 0
+	handler := auth.Handler(keys.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+		w.WriteHeader(http.StatusOK)
+	})))
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	r := signedRequest(auth, "/_gossip/changes", `[]`)
+	if code := serve(r); code != http.StatusOK || reached != 1 {
+		t.Fatalf("signed peer request: status %d, want 200 without an API key", code)
+	}
+	replay := signedRequest(auth, "/_gossip/changes", `[]`)
+	replay.Header.Set(ClusterSignatureHeader, r.Header.Get(ClusterSignatureHeader))
+	if code := serve(replay); code != http.StatusUnauthorized {
+		t.Errorf("replayed signature: status %d, want 401", code)
+	}
+
+	tampered := signedRequest(auth, "/_partition/apply", `[]`)
+	tampered.Body = io.NopCloser(strings.NewReader(`[{"op":"delete"}]`))
+	if code := serve(tampered); code != http.StatusUnauthorized {
+		t.Errorf("request with another body than the signed one: status %d, want 401", code)
+	}
+	if code := serve(signedRequest(NewClusterAuth("other"), "/_election/vote", `{}`)); code != http.StatusUnauthorized {
+		t.Errorf("request signed with another secret: status %d, want 401", code)
+	}
+	if code := serve(httptest.NewRequest(http.MethodPost, "/_election/heartbeat", strings.NewReader(`{}`))); code != http.StatusUnauthorized {
+		t.Errorf("unsigned peer write: status %d, want 401", code)
+	}
+	if code := serve(httptest.NewRequest(http.MethodGet, "/_gossip/members", nil)); code != http.StatusUnauthorized || reached != 1 {
+		t.Errorf("unsigned read of a peer route: status %d, want the API key to be required", code)
+	}
+
+	var none *ClusterAuth
+	w := httptest.NewRecorder()
+	none.Handler(handler).ServeHTTP(w, signedRequest(auth, "/_gossip/changes", `[]`))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("peer route of a node without a secret: status %d, want 403", w.Code)
+	}
+}
+
+func TestRateLimitExemptsOnlySignedPeers(t *testing.T) {
+	auth := NewClusterAuth("secret")
+	handler := auth.Handler(withRateLimit(NewMemoryLimiter(0.001, 1), LimitByIP, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve(httptest.NewRequest(http.MethodGet, "/_gossip/members", nil)); code != want {
+			t.Errorf("unsigned read %d of a peer route: status %d, want %d", i+1, code, want)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if code := serve(signedRequest(auth, "/_gossip/changes", `[]`)); code != http.StatusOK {
+			t.Errorf("signed peer request %d: status %d, want 200 past the empty bucket", i+1, code)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// File: postman.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file exports the model routes as a Postman collection (format v2.1, which
+// Insomnia imports as well) at GET /_postman.json. The collection has a folder per model with its
+// list, get, create, update and delete requests, the key, lookup, nested and many-to-many routes,
+// and example bodies generated from the model's struct. The server address, tenant and item IDs
+// are collection variables ({{baseUrl}}, {{tenant}}, {{id}}), the address defaulting to the one
+// the collection was downloaded from.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// postmanSchema is the schema URL identifying Postman v2.1 collections.
+const postmanSchema = "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"
+
+// PostmanCollection builds a Postman collection of the routes of the given models, calling the
+// server at baseURL.
+func (s *Store) PostmanCollection(name, baseURL string, models []string) jsonObject {
+	var folders []interface{}
+	for _, model := range models {
+		if folder, ok := s.postmanFolder(model); ok {
+			folders = append(folders, folder)
+		}
+	}
+	return jsonObject{
+		"info": jsonObject{"name": name, "schema": postmanSchema},
+		"variable": []interface{}{
+			jsonObject{"key": "baseUrl", "value": baseURL},
+			jsonObject{"key": "tenant", "value": ""},
+			jsonObject{"key": "id", "value": "1"},
+		},
+		"item": folders,
+	}
+}
+
+// handlePostman serves GET /_postman.json.
+func handlePostman(store *Store, models []string, w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="go-crud-helper.postman_collection.json"`)
+	writeJSON(w, http.StatusOK, store.PostmanCollection("go-crud-helper", scheme+"://"+r.Host, models))
+}
+
+// postmanFolder returns the folder of the requests of a model.
+func (s *Store) postmanFolder(model string) (jsonObject, bool) {
+	meta, ok := s.meta(model)
+	if !ok {
+		return nil, false
+	}
+	body := exampleBody(meta.typ)
+	base := "/" + model
+	requests := []interface{}{
+		postmanRequest("List "+model, http.MethodGet, base, map[string]string{"limit": "10"}, ""),
+		postmanRequest("Count "+model, http.MethodGet, base, map[string]string{"count": "true"}, ""),
+		postmanRequest("Create "+model, http.MethodPost, base, nil, body),
+	}
+	if meta.id != nil || len(meta.key) == 0 {
+		byID := map[string]string{"id": "{{id}}"}
+		requests = append(requests,
+			postmanRequest("Get "+model+" by ID", http.MethodGet, base, byID, ""),
+			postmanRequest("Update "+model+" by ID", http.MethodPut, base, byID, body),
+			postmanRequest("Delete "+model+" by ID", http.MethodDelete, base, byID, ""))
+	}
+	if len(meta.key) > 0 {
+		parts := make([]string, len(meta.key))
+		for i, f := range meta.key {
+			parts[i] = exampleKeyPart(f.typ)
+		}
+		byKey := map[string]string{"key": strings.Join(parts, ",")}
+		requests = append(requests,
+			postmanRequest("Get "+model+" by key", http.MethodGet, base, byKey, ""),
+			postmanRequest("Update "+model+" by key", http.MethodPut, base, byKey, body),
+			postmanRequest("Delete "+model+" by key", http.MethodDelete, base, byKey, ""))
+	}
+	for _, f := range meta.lookups {
+		requests = append(requests, postmanRequest("Get "+model+" by "+f.jsonName, http.MethodGet, base+"/by-"+f.jsonName+"/example", nil, ""))
+	}
+	for _, relation := range s.children(model) {
+		childMeta, ok := s.meta(relation.Child)
+		if !ok {
+			continue
+		}
+		nested := base + "/:id/" + relation.Child
+		requests = append(requests,
+			postmanRequest("List the "+relation.Child+" items of "+model, http.MethodGet, nested, nil, ""),
+			postmanRequest("Create "+relation.Child+" of "+model, http.MethodPost, nested, nil, exampleBody(childMeta.typ)))
+	}
+	s.typeMux.RLock()
+	manyToMany := append([]*ManyToMany(nil), s.manyToMany...)
+	s.typeMux.RUnlock()
+	for _, relation := range manyToMany {
+		other := relation.To
+		if model == relation.To {
+			other = relation.From
+		} else if model != relation.From {
+			continue
+		}
+		related := base + "/:id/" + other
+		relationships := base + "/:id/relationships/" + other
+		requests = append(requests,
+			postmanRequest("List the "+other+" items of "+model, http.MethodGet, related, nil, ""),
+			postmanRequest("Replace the "+other+" items of "+model, http.MethodPut, related, nil, "[1, 2]"),
+			postmanRequest("Link "+other+" items to "+model, http.MethodPost, relationships, nil, "[1]"),
+			postmanRequest("Unlink "+other+" from "+model, http.MethodDelete, relationships+"/:otherId", nil, ""))
+	}
+	requests = append(requests, postmanRequest("Describe the "+model+" model", http.MethodGet, base+"/_schema", nil, ""))
+	return jsonObject{"name": model, "item": requests}, true
+}
+
+// postmanRequest describes one request of a collection. Path segments starting with ":" are path
+// variables, which default to {{id}}.
+func postmanRequest(name, method, path string, query map[string]string, body string) jsonObject {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	var variables []interface{}
+	for _, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			variables = append(variables, jsonObject{"key": segment[1:], "value": "{{id}}"})
+		}
+	}
+	raw := "{{baseUrl}}" + path
+	var params []interface{}
+	var encoded []string
+	for _, key := range []string{"id", "key", "limit", "count"} {
+		if value, ok := query[key]; ok {
+			params = append(params, jsonObject{"key": key, "value": value})
+			encoded = append(encoded, key+"="+value)
+		}
+	}
+	if len(encoded) > 0 {
+		raw += "?" + strings.Join(encoded, "&")
+	}
+
+	url := jsonObject{"raw": raw, "host": []string{"{{baseUrl}}"}, "path": segments}
+	if params != nil {
+		url["query"] = params
+	}
+	if variables != nil {
+		url["variable"] = variables
+	}
+	request := jsonObject{
+		"method": method,
+		"header": []interface{}{jsonObject{"key": TenantHeader, "value": "{{tenant}}", "disabled": true}},
+		"url":    url,
+	}
+	if body != "" {
+		request["header"] = append(request["header"].([]interface{}), jsonObject{"key": "Content-Type", "value": "application/json"})
+		request["body"] = jsonObject{"mode": "raw", "raw": body, "options": jsonObject{"raw": jsonObject{"language": "json"}}}
+	}
+	return jsonObject{"name": name, "request": request}
+}
+
+// exampleBody returns an indented example JSON body of a model, without its ID. The fields keep
+// the order of the struct.
+func exampleBody(t reflect.Type) string {
+	meta := metaFor(t)
+	example := reflect.New(t).Elem()
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, f := range meta.fields {
+		if f == meta.id || f.jsonName == "-" {
+			continue
+		}
+		v := example.FieldByIndex(f.index)
+		setExample(v, f.jsonName, 0)
+		name, _ := json.Marshal(f.jsonName)
+		value, err := json.Marshal(v.Interface())
+		if err != nil {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	var indented bytes.Buffer
+	json.Indent(&indented, buf.Bytes(), "", "  ")
+	return indented.String()
+}
+
+// setExample fills a value with an example of its type.
+func setExample(v reflect.Value, name string, depth int) {
+	if _, ok := v.Interface().(time.Time); ok {
+		v.Set(reflect.ValueOf(time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)))
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("example " + name)
+	case reflect.Bool:
+		v.SetBool(false)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.Ptr:
+		if depth < 3 {
+			v.Set(reflect.New(v.Type().Elem()))
+			setExample(v.Elem(), name, depth+1)
+		}
+	case reflect.Slice:
+		if depth < 3 && v.Type().Elem().Kind() != reflect.Uint8 {
+			v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+			setExample(v.Index(0), name, depth+1)
+		}
+	case reflect.Struct:
+		if depth < 3 {
+			for _, f := range metaFor(v.Type()).fields {
+				setExample(v.FieldByIndex(f.index), f.jsonName, depth+1)
+			}
+		}
+	}
+}
+
+// exampleKeyPart returns an example key component of a type.
+func exampleKeyPart(t reflect.Type) string {
+	v := reflect.New(t).Elem()
+	setExample(v, "key", 0)
+	return strings.ReplaceAll(formatKeyValue(v), " ", "-")
+}
@@ -0,0 +1,337 @@
+// File: privacy.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the data-subject requests of the GDPR. GET
+// /_privacy/export?field=UserID&value=42 gathers every item of every registered model whose field
+// (a Go or JSON field name) holds the subject, along with the items that field references through a
+// relation (the user 42 itself), and answers them as a JSON archive grouped by model. Models without
+// the field are left out. Masked fields stay masked for callers that are not privileged.
+// POST /_privacy/erase?field=UserID&value=42 erases the same items in one transaction: the items of
+// models with fields tagged `privacy:"anonymize"` (or `privacy:"anonymize=<replacement>"` for
+// strings) are kept with those fields and the subject field cleared, the others are deleted. The
+// erasure is recorded in the audit log and answered with a receipt signed with HMAC-SHA256, which
+// names the subject by a digest only, so neither keeps the data that was erased.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Actions of the audit log.
+const AuditErase = "privacy.erase"
+
+// SubjectExport is the archive of the data of one subject.
+type SubjectExport struct {
+	Field    string                   `json:"field"`
+	Value    string                   `json:"value"`
+	Exported time.Time                `json:"exported"`
+	Records  int                      `json:"records"`
+	Models   map[string][]interface{} `json:"models"` // items by model, ordered by ID
+}
+
+// ExportSubject gathers the items of every model whose field holds value, and the items the field
+// references through a relation. It fails when no registered model has the field.
+func (s *Store) ExportSubject(ctx context.Context, field, value string) (SubjectExport, error) {
+	export := SubjectExport{Field: field, Value: value, Exported: time.Now().UTC(), Models: make(map[string][]interface{})}
+	found, err := s.subjectItems(ctx, field, value)
+	if err != nil {
+		return export, err
+	}
+	for model, items := range found {
+		for _, m := range items {
+			export.Models[model] = append(export.Models[model], m.item)
+		}
+		export.Records += len(items)
+	}
+	return export, nil
+}
+
+// subjectItems returns the items of a subject by model, ordered by ID.
+func (s *Store) subjectItems(ctx context.Context, field, value string) (map[string][]match, error) {
+	found := make(map[string][]match)
+	referenced := make(map[string]int)
+	known := false
+	for _, c := range s.allCollections() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		f, ok := c.meta.field(field)
+		if !ok || c.meta.id == f {
+			continue
+		}
+		known = true
+		parsed, err := parseFieldValue(f.typ, value)
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("invalid value for field %s of %s: %v", field, c.name, err)}
+		}
+		matches, err := s.matching(c.name, []Filter{{Field: f.name, Op: FilterEq, Value: parsed}})
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) > 0 {
+			found[c.name] = matches
+		}
+
+		// The field may reference the subject itself, such as the user an item belongs to
+		for _, relation := range s.parents(c.name) {
+			if relation.ForeignKey == f && relation.Type == nil && isIntKind(f.typ.Kind()) {
+				referenced[relation.Parent] = int(reflect.ValueOf(parsed).Int())
+			}
+		}
+	}
+	if !known {
+		return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("no model has a field %s", field)}
+	}
+
+	now := time.Now()
+	for model, id := range referenced {
+		c, ok := s.collection(model)
+		if !ok || id == 0 {
+			continue
+		}
+		e, exists := c.shard(id).snapshot().get(id)
+		if !exists || e.expired(now) || containsMatch(found[model], id) {
+			continue
+		}
+		found[model] = append([]match{{id, e.item}}, found[model]...)
+	}
+	return found, nil
+}
+
+// containsMatch reports whether a match of the given ID is in a list.
+func containsMatch(matches []match, id int) bool {
+	for _, m := range matches {
+		if m.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePrivacyExport serves GET /_privacy/export?field=UserID&value=42, answering the archive of
+// the data of a subject.
+func handlePrivacyExport(store *Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	query := r.URL.Query()
+	field, value := query.Get("field"), query.Get("value")
+	if field == "" || value == "" {
+		writeProblem(w, r, http.StatusBadRequest, "The field and value parameters are required")
+		return
+	}
+	export, err := store.ExportSubject(r.Context(), field, value)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !store.isPrivileged(r) {
+		for model, items := range export.Models {
+			export.Models[model] = maskItem(items).([]interface{})
+		}
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="subject-export.json"`)
+	writeJSON(w, http.StatusOK, export)
+}
+
+// anonymizedFields returns the fields of a model tagged `privacy:"anonymize"`, cleared when the
+// items of a subject are erased. Replacements are only valid for strings; other tags are logged and
+// ignored.
+func anonymizedFields(m *modelMeta) []*fieldMeta {
+	var fields []*fieldMeta
+	for _, f := range m.fields {
+		tag := f.tag.Get("privacy")
+		if tag == "" {
+			continue
+		}
+		action, _, replaced := strings.Cut(tag, "=")
+		if action != "anonymize" || m.id == f || (replaced && f.typ.Kind() != reflect.String) {
+			log.Printf("privacy: ignoring invalid tag privacy:%q on %s.%s", tag, m.typ.Name(), f.name)
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// anonymize returns a copy of an item whose anonymized fields, and the field holding the subject,
+// are cleared or replaced.
+func anonymize(meta *modelMeta, item interface{}, subject string) interface{} {
+	anonymized := copyItem(meta, item)
+	for _, f := range meta.anonymized {
+		v := f.value(anonymized)
+		if _, replacement, replaced := strings.Cut(f.tag.Get("privacy"), "="); replaced {
+			v.SetString(replacement)
+		} else {
+			v.Set(reflect.Zero(f.typ))
+		}
+	}
+	if f, ok := meta.field(subject); ok && meta.id != f {
+		f.value(anonymized).Set(reflect.Zero(f.typ))
+	}
+	return anonymized
+}
+
+// ErasureReceipt proves the erasure of the data of a subject.
+type ErasureReceipt struct {
+	ID         string         `json:"id"`
+	Field      string         `json:"field"`
+	Subject    string         `json:"subject"` // SHA-256 digest of field=value
+	Erased     time.Time      `json:"erased"`
+	Deleted    map[string]int `json:"deleted"`    // number of deleted items, by model
+	Anonymized map[string]int `json:"anonymized"` // number of anonymized items, by model
+	Signature  string         `json:"signature"`  // HMAC-SHA256 of the receipt without its signature
+}
+
+// AuditEntry is an entry of the audit log.
+type AuditEntry struct {
+	Action  string          `json:"action"`
+	At      time.Time       `json:"at"`
+	Receipt *ErasureReceipt `json:"receipt,omitempty"`
+}
+
+// errNoReceiptKey is returned by EraseSubject when no key signs the receipts.
+var errNoReceiptKey = errors.New("privacy: no receipt key is set")
+
+// SetAuditLog sets the writer the audit entries of privacy actions are appended to as JSON lines.
+// Without one, they are logged.
+func (s *Store) SetAuditLog(w io.Writer) {
+	s.auditMux.Lock()
+	defer s.auditMux.Unlock()
+	s.auditLog = w
+}
+
+// SetReceiptKey sets the key signing erasure receipts, which EraseSubject requires.
+func (s *Store) SetReceiptKey(key []byte) {
+	s.receiptKey = key
+}
+
+// audit records an entry in the audit log.
+func (s *Store) audit(entry AuditEntry) error {
+	s.auditMux.Lock()
+	defer s.auditMux.Unlock()
+	if s.auditLog == nil {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		log.Printf("audit: %s", data)
+		return nil
+	}
+	return json.NewEncoder(s.auditLog).Encode(entry)
+}
+
+// subjectDigest returns the digest naming a subject in receipts.
+func subjectDigest(field, value string) string {
+	sum := sha256.Sum256([]byte(field + "=" + value))
+	return hex.EncodeToString(sum[:])
+}
+
+// sign returns the signature of a receipt.
+func (s *Store) sign(receipt ErasureReceipt) (string, error) {
+	receipt.Signature = ""
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, s.receiptKey)
+	mac.Write(data)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifyReceipt reports whether a receipt was signed with the receipt key of the store.
+func (s *Store) VerifyReceipt(receipt ErasureReceipt) bool {
+	if len(s.receiptKey) == 0 {
+		return false
+	}
+	expected, err := s.sign(receipt)
+	return err == nil && hmac.Equal([]byte(expected), []byte(receipt.Signature))
+}
+
+// EraseSubject erases the items of a subject, those ExportSubject gathers, in a single
+// transaction: the items of models with anonymized fields are anonymized and the others deleted.
+// The erasure is recorded in the audit log and the signed receipt returned.
+func (s *Store) EraseSubject(ctx context.Context, field, value string) (ErasureReceipt, error) {
+	receipt := ErasureReceipt{
+		ID:         newRequestID(),
+		Field:      field,
+		Subject:    subjectDigest(field, value),
+		Deleted:    make(map[string]int),
+		Anonymized: make(map[string]int),
+	}
+	if len(s.receiptKey) == 0 {
+		return receipt, errNoReceiptKey
+	}
+	found, err := s.subjectItems(ctx, field, value)
+	if err != nil {
+		return receipt, err
+	}
+	err = s.TxContext(ctx, func(tx StoreTx) error {
+		for model, items := range found {
+			c, _ := s.collection(model)
+			for _, m := range items {
+				if len(c.meta.anonymized) == 0 {
+					if err := tx.Delete(model, m.id); err != nil {
+						return err
+					}
+					receipt.Deleted[model]++
+					continue
+				}
+				if err := tx.Update(model, m.id, anonymize(c.meta, m.item, field)); err != nil {
+					return err
+				}
+				receipt.Anonymized[model]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return receipt, err
+	}
+
+	receipt.Erased = time.Now().UTC()
+	if receipt.Signature, err = s.sign(receipt); err != nil {
+		return receipt, err
+	}
+	if err := s.audit(AuditEntry{Action: AuditErase, At: receipt.Erased, Receipt: &receipt}); err != nil {
+		log.Printf("privacy: erasure %s is not recorded in the audit log: %v", receipt.ID, err)
+	}
+	return receipt, nil
+}
+
+// handlePrivacyErase serves POST /_privacy/erase?field=UserID&value=42, erasing the data of a
+// subject and answering the signed receipt.
+func handlePrivacyErase(store *Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	query := r.URL.Query()
+	field, value := query.Get("field"), query.Get("value")
+	if field == "" || value == "" {
+		writeProblem(w, r, http.StatusBadRequest, "The field and value parameters are required")
+		return
+	}
+	receipt, err := store.EraseSubject(r.Context(), field, value)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, receipt)
+}
@@ -0,0 +1,102 @@
+// File: problem.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements structured error responses. Errors are written as RFC 7807
+// "problem details" (Content-Type application/problem+json) holding a type, the title of the
+// status, the status, an error code (see errors.go), a detail message, the path of the request as
+// instance and its request ID, so clients can handle errors programmatically instead of parsing
+// text. Every request gets an ID, taken from its X-Request-ID header when it has a valid one and
+// generated otherwise, which is echoed in the X-Request-ID response header.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+)
+
+// RequestIDHeader carries the ID of a request, in requests and responses.
+const RequestIDHeader = "X-Request-ID"
+
+// problemContentType is the media type of problem details.
+const problemContentType = "application/problem+json"
+
+// validRequestID matches the request IDs accepted from clients.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+
+	Errors []FieldError `json:"errors,omitempty"` // the offending fields of validation problems
+}
+
+// Error implements error, returning the detail of the problem.
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+// withRequestID assigns an ID to every request, echoed in the X-Request-ID response header where
+// the problems written for the request find it.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newProblem returns a problem of the given status and detail.
+func newProblem(status int, detail string) *Problem {
+	return &Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Code: statusCode(status), Detail: detail}
+}
+
+// writeProblem answers a request with a problem of the given status and detail.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	p := newProblem(status, detail)
+	p.Instance = versionPrefix(r) + r.URL.Path
+	localizeProblem(w, r, p, nil)
+	writeProblemDetails(w, p)
+}
+
+// writeProblemDetails writes a problem as the response body, with the ID of the request.
+func writeProblemDetails(w http.ResponseWriter, p *Problem) {
+	h := w.Header()
+	if p.RequestID == "" {
+		p.RequestID = h.Get(RequestIDHeader)
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, p.Error(), p.Status)
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Type", problemContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(append(body, '\n'))
+}
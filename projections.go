@@ -0,0 +1,135 @@
+// File: projections.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements CQRS-style read-model projections. A projection consumes the
+// store's mutation stream and maintains an alternative, read-optimised view of the data (for example
+// a denormalised summary). Projections are registered by name and served read-only under
+// GET /_projections/{name}.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Projection maintains a read model derived from change events.
+type Projection interface {
+	// Apply updates the read model with a change event.
+	Apply(event ChangeEvent)
+	// State returns the current read model encoded as JSON.
+	State() (json.RawMessage, error)
+}
+
+// ReduceProjection is a Projection that folds every event into a state value using a reducer.
+type ReduceProjection struct {
+	state  interface{}
+	reduce func(state interface{}, event ChangeEvent) interface{}
+	mux    sync.RWMutex
+}
+
+// NewProjection creates a projection starting from initial and updated by reduce for every event.
+// The reducer may modify the state in place; it is never called concurrently with State.
+func NewProjection(initial interface{}, reduce func(state interface{}, event ChangeEvent) interface{}) *ReduceProjection {
+	return &ReduceProjection{state: initial, reduce: reduce}
+}
+
+// Apply folds an event into the projection state.
+func (p *ReduceProjection) Apply(event ChangeEvent) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.state = p.reduce(p.state, event)
+}
+
+// State encodes the current projection state.
+func (p *ReduceProjection) State() (json.RawMessage, error) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	return json.Marshal(p.state)
+}
+
+// Projections is a registry of named projections fed from a store's change stream.
+type Projections struct {
+	byName map[string]Projection
+	mux    sync.RWMutex
+}
+
+// NewProjections creates an empty projection registry.
+func NewProjections() *Projections {
+	return &Projections{byName: make(map[string]Projection)}
+}
+
+// Register adds a projection under the given name.
+func (p *Projections) Register(name string, projection Projection) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.byName[name] = projection
+}
+
+// Get returns the projection registered under name.
+func (p *Projections) Get(name string) (Projection, bool) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	projection, ok := p.byName[name]
+	return projection, ok
+}
+
+// Names returns the registered projection names in alphabetical order.
+func (p *Projections) Names() []string {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	names := make([]string, 0, len(p.byName))
+	for name := range p.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply feeds an event to every registered projection. It is meant to be passed to Store.Subscribe.
+func (p *Projections) Apply(event ChangeEvent) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	for _, projection := range p.byName {
+		projection.Apply(event)
+	}
+}
+
+// handleProjection serves read-only projection endpoints mounted under prefix (e.g. "/_projections"):
+// GET {prefix} lists the registered names and GET {prefix}/{name} returns a read model.
+func handleProjection(projections *Projections, prefix string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if name == "" {
+		writeJSON(w, http.StatusOK, projections.Names())
+		return
+	}
+
+	projection, ok := projections.Get(name)
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, "Projection not found")
+		return
+	}
+	state, err := projection.State()
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "Cannot encode projection")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(state)
+}
@@ -0,0 +1,300 @@
+// File: query.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements filtered lookups on the Store. Filters compare a field against a
+// value (equal, greater-or-equal, less-or-equal) and are resolved through a secondary index when one
+// exists, falling back to a scan of the collection otherwise. On collection GETs, query parameters
+// named after JSON fields become filters: ?title=Go, ?price_gte=10, ?price_lte=20; ?offset= and
+// ?limit= select a page of the results and ?count=true returns how many items match.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter operators.
+const (
+	FilterEq  = "eq"
+	FilterGte = "gte"
+	FilterLte = "lte"
+)
+
+// Filter restricts a lookup to items whose field compares to Value according to Op.
+type Filter struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+// Find retrieves the items of a model matching every filter into result (a pointer to a slice),
+// ordered by ID. It answers from an index when one covers a filter and scans otherwise.
+func (s *Store) Find(model string, filters []Filter, result interface{}) error {
+	found, err := s.matching(model, filters)
+	if err != nil {
+		return err
+	}
+
+	itemSlice := reflect.ValueOf(result).Elem()
+	for _, m := range found {
+		elem := reflect.New(itemSlice.Type().Elem()).Elem()
+		assignItem(elem, m.item)
+		itemSlice.Set(reflect.Append(itemSlice, elem))
+	}
+	return nil
+}
+
+// match is an item matched by a query.
+type match struct {
+	id   int
+	item interface{}
+}
+
+// matching returns the stored items of a model matching every filter, ordered by ID.
+func (s *Store) matching(model string, filters []Filter) ([]match, error) {
+	return s.matchingAmong(model, filters, nil)
+}
+
+// matchingAmong is matching restricted to the items of the given IDs, unless among is nil.
+func (s *Store) matchingAmong(model string, filters []Filter, among []int) ([]match, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return nil, fmt.Errorf("model %q is not registered", model)
+	}
+
+	// Resolve the filtered fields and convert the values to the field types
+	type resolved struct {
+		op    string
+		index []int
+		name  string
+		value reflect.Value
+	}
+	checks := make([]resolved, len(filters))
+	for i, f := range filters {
+		field, ok := c.meta.field(f.Field)
+		if !ok {
+			return nil, fmt.Errorf("model %q has no field %q", model, f.Field)
+		}
+		v := reflect.ValueOf(f.Value)
+		if !v.IsValid() || !v.Type().ConvertibleTo(field.typ) {
+			return nil, fmt.Errorf("invalid value for field %q", f.Field)
+		}
+		if f.Op != FilterEq && !orderable(field.typ) {
+			return nil, fmt.Errorf("field %q cannot be compared", f.Field)
+		}
+		// Equality compares the values themselves, which panics for slices, maps and funcs
+		if f.Op == FilterEq && (!field.typ.Comparable() || !v.Type().Comparable()) {
+			return nil, fmt.Errorf("field %q cannot be compared", f.Field)
+		}
+		checks[i] = resolved{op: f.Op, index: field.index, name: field.name, value: v.Convert(field.typ)}
+	}
+
+	// Narrow the candidates with the first filter an index can answer, starting with the key index
+	// when every key field is filtered on
+	var candidates []int
+	indexed := false
+	if c.keys != nil {
+		keyed := make(map[string]reflect.Value)
+		for _, check := range checks {
+			if check.op == FilterEq {
+				keyed[check.name] = check.value
+			}
+		}
+		if parts, ok := c.keys.components(keyed); ok {
+			candidates, indexed = nil, true
+			if id, found := c.keys.lookup(encodeKey(parts)); found {
+				candidates = []int{id}
+			}
+		}
+	}
+	for _, check := range checks {
+		if indexed {
+			break
+		}
+		idx, ok := c.index(check.name)
+		if !ok {
+			continue
+		}
+		switch {
+		case check.op == FilterEq:
+			candidates, indexed = idx.lookup(check.value), true
+		case idx.ordered && check.op == FilterGte:
+			candidates, indexed = idx.lookupRange(check.value, reflect.Value{}), true
+		case idx.ordered && check.op == FilterLte:
+			candidates, indexed = idx.lookupRange(reflect.Value{}, check.value), true
+		}
+	}
+	if among != nil && indexed {
+		allowed := make(map[int]bool, len(among))
+		for _, id := range among {
+			allowed[id] = true
+		}
+		narrowed := candidates[:0:0]
+		for _, id := range candidates {
+			if allowed[id] {
+				narrowed = append(narrowed, id)
+			}
+		}
+		candidates = narrowed
+	} else if among != nil {
+		candidates, indexed = among, true
+	}
+
+	matches := func(item interface{}) bool {
+		v := reflect.Indirect(reflect.ValueOf(item))
+		for _, check := range checks {
+			field := v.FieldByIndex(check.index)
+			switch check.op {
+			case FilterEq:
+				if hashKey(field) != hashKey(check.value) {
+					return false
+				}
+			case FilterGte:
+				if compareValues(field, check.value) < 0 {
+					return false
+				}
+			case FilterLte:
+				if compareValues(field, check.value) > 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	var found []match
+	if !indexed {
+		c.eachEntry(func(id int, e entry) error {
+			if matches(e.item) {
+				found = append(found, match{id, e.item})
+			}
+			return nil
+		})
+		return found, nil
+	}
+	now := time.Now()
+	for _, id := range candidates {
+		e, exists := c.shard(id).snapshot().get(id)
+		if exists && !e.expired(now) && matches(e.item) {
+			found = append(found, match{id, e.item})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].id < found[j].id })
+	return found, nil
+}
+
+// Count returns the number of items of a model matching every filter.
+func (s *Store) Count(model string, filters []Filter) (int, error) {
+	found, err := s.matching(model, filters)
+	return len(found), err
+}
+
+// Page selects a window of the items of a collection query, which are ordered by ID.
+type Page struct {
+	Offset int
+	Limit  int // 0 means no limit
+}
+
+// errPageDone stops a scan once the page is complete.
+var errPageDone = errors.New("page done")
+
+// parsePage reads the offset and limit query parameters.
+func parsePage(query url.Values) (Page, error) {
+	var page Page
+	for param, target := range map[string]*int{"offset": &page.Offset, "limit": &page.Limit} {
+		if v := query.Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return page, fmt.Errorf("invalid %s", param)
+			}
+			*target = n
+		}
+	}
+	return page, nil
+}
+
+// bounds returns the part of n ordered results that falls inside the page.
+func (p Page) bounds(n int) (int, int) {
+	start, end := p.Offset, n
+	if start > n {
+		start = n
+	}
+	if p.Limit > 0 && start+p.Limit < end {
+		end = start + p.Limit
+	}
+	return start, end
+}
+
+// parseFilters turns the query parameters naming fields of the model into filters.
+// Parameters that do not name a field (such as id or ttl) are ignored.
+func parseFilters(meta *modelMeta, query url.Values) ([]Filter, error) {
+	var filters []Filter
+	for param, values := range query {
+		name, op := param, FilterEq
+		if strings.HasSuffix(param, "_gte") {
+			name, op = strings.TrimSuffix(param, "_gte"), FilterGte
+		} else if strings.HasSuffix(param, "_lte") {
+			name, op = strings.TrimSuffix(param, "_lte"), FilterLte
+		}
+
+		field, ok := meta.jsonField(name)
+		if !ok || field == meta.id {
+			continue
+		}
+		value, err := parseFieldValue(field.typ, values[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", param, err)
+		}
+		filters = append(filters, Filter{Field: field.name, Op: op, Value: value})
+	}
+	return filters, nil
+}
+
+// parseFieldValue converts a query string value into a value of the field's type.
+func parseFieldValue(t reflect.Type, s string) (interface{}, error) {
+	if t == reflect.TypeOf(time.Time{}) {
+		return time.Parse(time.RFC3339, s)
+	}
+
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		v.SetFloat(f)
+	default:
+		return nil, fmt.Errorf("unsupported field type %s", t)
+	}
+	return v.Interface(), nil
+}
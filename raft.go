@@ -0,0 +1,461 @@
+// File: raft.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the clustered mode, a Raft consensus group built on
+// hashicorp/raft. Every write request is appended to the replicated log by the leader and only
+// acknowledged once a quorum of nodes has stored it; each node then applies the committed requests
+// in log order to its own store by running them through the regular handlers, so all nodes end up
+// with the same data and any of them can serve reads. Writes sent to a follower are forwarded to
+// the leader. The nodes talk over an authenticated TCP transport (see raft_transport.go). Commands
+// are logged without the credentials of their caller: the leader records the rights it verified
+// them to grant (the admin token, the privileged token) instead, and seals the request body with
+// the field keys. The store is snapshotted regularly, so the log is truncated and a restarted or
+// lagging node restores the latest snapshot before replaying the entries after it.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Raft roles.
+const (
+	RaftFollower  = "follower"
+	RaftCandidate = "candidate"
+	RaftLeader    = "leader"
+)
+
+// Raft settings.
+const (
+	raftCommitTimeout    = 5 * time.Second
+	raftMaxBody          = 4 << 20
+	raftMaxAppend        = 16 // entries per AppendEntries RPC, so one holds at most 64MB of bodies
+	raftSnapshotsKept    = 2
+	raftTransportPool    = 3
+	raftTransportTimeout = 10 * time.Second
+)
+
+// raftForwardedHeader marks a write forwarded from a follower, so it is never forwarded twice.
+const raftForwardedHeader = "X-Raft-Forwarded"
+
+// raftSealName is the additional data binding the sealed bodies to the Raft log.
+var raftSealName = []byte("raft")
+
+// raftCredentialHeaders are the headers removed from the logged commands.
+var raftCredentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", APIKeyHeader, ClusterSignatureHeader}
+
+// RaftCommand is a replicated write request. It holds the rights its caller was verified to have
+// instead of their credentials, and its body is sealed when field keys are set.
+type RaftCommand struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Grants []string    `json:"grants,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	Sealed bool        `json:"sealed,omitempty"`
+}
+
+// RaftNode is a member of a Raft cluster. Nodes are identified by their advertised base URL and
+// reached at the address of their Raft transport.
+type RaftNode struct {
+	// ID is the advertised base URL of this node, Addr the host:port its Raft transport listens at.
+	ID   string
+	Addr string
+	// Peers maps the base URLs of the other members to the addresses of their Raft transport.
+	Peers map[string]string
+
+	// Dir, when set, persists the log, term, vote and snapshots of the node.
+	Dir string
+	// Auth authenticates the connections between the nodes; it is required.
+	Auth *ClusterAuth
+	// AdminToken is the admin token of the cluster, granted to the replayed writes of its holders.
+	AdminToken string
+
+	store   *Store
+	handler http.Handler
+	raft    *raft.Raft
+	db      *raftStore
+}
+
+// RaftStatus describes the state of a node.
+type RaftStatus struct {
+	ID          string   `json:"id"`
+	Role        string   `json:"role"`
+	Term        uint64   `json:"term"`
+	Leader      string   `json:"leader,omitempty"`
+	Peers       []string `json:"peers"`
+	LastIndex   int      `json:"last_index"`
+	CommitIndex int      `json:"commit_index"`
+	LastApplied int      `json:"last_applied"`
+}
+
+// NewRaftNode creates the member of a cluster advertised at id (e.g. "http://10.0.0.1:8080") whose
+// Raft transport listens at addr (e.g. "10.0.0.1:7000"). The other members are given as
+// url=addr pairs.
+func NewRaftNode(store *Store, id, addr string, peers []string) (*RaftNode, error) {
+	r := &RaftNode{
+		ID:    strings.TrimRight(id, "/"),
+		Addr:  addr,
+		Peers: make(map[string]string),
+		store: store,
+	}
+	for _, peer := range peers {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		peerID, peerAddr, ok := strings.Cut(peer, "=")
+		if !ok || peerAddr == "" {
+			return nil, fmt.Errorf("raft: peer %q is not a url=host:port pair", peer)
+		}
+		if peerID = strings.TrimRight(peerID, "/"); peerID != r.ID {
+			r.Peers[peerID] = peerAddr
+		}
+	}
+	return r, nil
+}
+
+// Start opens the log, restores the latest snapshot and joins the cluster, bootstrapping it with
+// every member on first start. Committed entries are applied by running them through handler.
+func (r *RaftNode) Start(handler http.Handler) error {
+	r.handler = handler
+	stream, err := newRaftStream(r.Addr, r.Auth)
+	if err != nil {
+		return err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(r.ID)
+	config.MaxAppendEntries = raftMaxAppend
+	config.LogOutput = log.Writer()
+	config.LogLevel = "WARN"
+
+	var (
+		logs   raft.LogStore
+		stable raft.StableStore
+		snaps  raft.SnapshotStore
+	)
+	if r.Dir != "" {
+		if err := os.MkdirAll(r.Dir, 0700); err != nil {
+			return err
+		}
+		if legacy := filepath.Join(r.Dir, "raft-log.jsonl"); fileExists(legacy) {
+			log.Printf("raft: %s is no longer read and holds the credentials of past writes in plaintext; delete it", legacy)
+		}
+		if r.db, err = openRaftStore(filepath.Join(r.Dir, "raft.db")); err != nil {
+			return err
+		}
+		if snaps, err = raft.NewFileSnapshotStore(r.Dir, raftSnapshotsKept, log.Writer()); err != nil {
+			return err
+		}
+		logs, stable = r.db, r.db
+	} else {
+		memory := raft.NewInmemStore()
+		logs, stable, snaps = memory, memory, raft.NewInmemSnapshotStore()
+	}
+	transport := raft.NewNetworkTransport(stream, raftTransportPool, raftTransportTimeout, log.Writer())
+
+	existing, err := raft.HasExistingState(logs, stable, snaps)
+	if err != nil {
+		return err
+	}
+	if !existing {
+		servers := []raft.Server{{ID: config.LocalID, Address: raft.ServerAddress(stream.Addr().String())}}
+		for id, addr := range r.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(addr)})
+		}
+		if err := raft.BootstrapCluster(config, logs, stable, snaps, transport, raft.Configuration{Servers: servers}); err != nil {
+			return err
+		}
+	}
+	r.raft, err = raft.NewRaft(config, &raftFSM{node: r}, logs, stable, snaps, transport)
+	return err
+}
+
+// Shutdown leaves the cluster and closes the log.
+func (r *RaftNode) Shutdown() error {
+	err := r.raft.Shutdown().Error()
+	if r.db != nil {
+		if closeErr := r.db.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// command builds the logged command of a write: the credentials of the caller are replaced by the
+// rights they were verified to hold, and the body is sealed.
+func (r *RaftNode) command(req *http.Request, body []byte) ([]byte, error) {
+	command := RaftCommand{Method: req.Method, URL: req.URL.RequestURI(), Header: req.Header.Clone(), Body: body}
+	command.Header.Del(raftForwardedHeader)
+	for _, name := range raftCredentialHeaders {
+		command.Header.Del(name)
+	}
+	if r.AdminToken != "" && holdsAdminToken(r.AdminToken, req) {
+		command.Grants = append(command.Grants, grantAdmin)
+	}
+	if r.store.isPrivileged(req) {
+		command.Grants = append(command.Grants, grantPrivileged)
+	}
+	if fieldKeys != nil && len(body) > 0 {
+		sealed, err := fieldKeys.seal(body, raftSealName)
+		if err != nil {
+			return nil, err
+		}
+		command.Body, command.Sealed = sealed, true
+	}
+	return json.Marshal(command)
+}
+
+// execute applies a committed write by running it through the handler with the rights it was
+// granted.
+func (r *RaftNode) execute(command RaftCommand) *bufferedResponse {
+	response := newBufferedResponse()
+	body := command.Body
+	if command.Sealed {
+		var err error
+		if fieldKeys == nil {
+			err = errors.New("the body is sealed and no field keys are set")
+		} else {
+			body, _, err = fieldKeys.open(body, raftSealName)
+		}
+		if err != nil {
+			log.Printf("raft: cannot apply %s %s: %v", command.Method, command.URL, err)
+			response.WriteHeader(http.StatusInternalServerError)
+			return response
+		}
+	}
+	request, err := http.NewRequest(command.Method, command.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("raft: cannot apply %s %s: %v", command.Method, command.URL, err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return response
+	}
+	request.Header = command.Header.Clone()
+	if request.Header == nil {
+		request.Header = make(http.Header)
+	}
+	request.RequestURI = command.URL
+	r.handler.ServeHTTP(response, request.WithContext(withGrants(request.Context(), command.Grants)))
+	return response
+}
+
+// Handler wraps the application handler: reads are served locally and writes are replicated
+// through the log, or forwarded to the leader. GET /_raft/status describes the node.
+func (r *RaftNode) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/_raft/status" {
+			writeJSON(w, http.StatusOK, r.Status())
+			return
+		}
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			r.handler.ServeHTTP(w, req)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, raftMaxBody))
+		if err != nil {
+			writeProblem(w, req, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		if r.raft.State() != raft.Leader {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			r.forward(w, req)
+			return
+		}
+		command, err := r.command(req, body)
+		if err != nil {
+			log.Printf("raft: cannot log %s %s: %v", req.Method, req.URL.RequestURI(), err)
+			writeProblem(w, req, http.StatusInternalServerError, "Cannot log the write")
+			return
+		}
+
+		future := r.raft.Apply(command, raftCommitTimeout)
+		switch err := future.Error(); {
+		case errors.Is(err, raft.ErrNotLeader):
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			r.forward(w, req)
+		case errors.Is(err, raft.ErrLeadershipLost):
+			writeProblem(w, req, http.StatusServiceUnavailable, "Leadership was lost before the write was committed")
+		case err != nil:
+			writeProblem(w, req, http.StatusServiceUnavailable, "Write was not committed by a quorum")
+		default:
+			response, ok := future.Response().(*bufferedResponse)
+			if !ok {
+				writeProblem(w, req, http.StatusInternalServerError, "Write was committed but could not be applied")
+				return
+			}
+			response.writeTo(w)
+		}
+	})
+}
+
+// forward proxies a write to the current leader.
+func (r *RaftNode) forward(w http.ResponseWriter, req *http.Request) {
+	_, leader := r.raft.LeaderWithID()
+	if leader == "" || req.Header.Get(raftForwardedHeader) != "" {
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, req, http.StatusServiceUnavailable, "No leader elected")
+		return
+	}
+	target, err := url.Parse(string(leader))
+	if err != nil {
+		writeProblem(w, req, http.StatusBadGateway, "Invalid leader address")
+		return
+	}
+	req.Header.Set(raftForwardedHeader, r.ID)
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, req)
+}
+
+// Status reports the state of the node.
+func (r *RaftNode) Status() RaftStatus {
+	status := RaftStatus{ID: r.ID, Role: RaftFollower, Peers: []string{}}
+	switch r.raft.State() {
+	case raft.Leader:
+		status.Role = RaftLeader
+	case raft.Candidate:
+		status.Role = RaftCandidate
+	}
+	_, leader := r.raft.LeaderWithID()
+	status.Leader = string(leader)
+
+	stats := r.raft.Stats()
+	status.Term, _ = strconv.ParseUint(stats["term"], 10, 64)
+	status.LastIndex, _ = strconv.Atoi(stats["last_log_index"])
+	status.CommitIndex, _ = strconv.Atoi(stats["commit_index"])
+	status.LastApplied, _ = strconv.Atoi(stats["applied_index"])
+	if future := r.raft.GetConfiguration(); future.Error() == nil {
+		for _, server := range future.Configuration().Servers {
+			if string(server.ID) != r.ID {
+				status.Peers = append(status.Peers, string(server.ID))
+			}
+		}
+	}
+	sort.Strings(status.Peers)
+	return status
+}
+
+// fileExists reports whether a file exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// raftFSM applies the committed commands of a node to its store.
+type raftFSM struct {
+	node *RaftNode
+}
+
+// Apply runs a committed command through the handler, returning its response to the leader.
+func (f *raftFSM) Apply(entry *raft.Log) interface{} {
+	var command RaftCommand
+	if err := json.Unmarshal(entry.Data, &command); err != nil {
+		log.Printf("raft: cannot decode entry %d: %v", entry.Index, err)
+		return nil
+	}
+	return f.node.execute(command)
+}
+
+// Snapshot captures the items of every collection. The item trees are persistent, so capturing
+// them is cheap and later writes do not change the snapshot while it is persisted.
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	collections := f.node.store.allCollections()
+	sort.Slice(collections, func(i, j int) bool { return collections[i].name < collections[j].name })
+
+	snapshot := &raftSnapshot{}
+	for _, c := range collections {
+		model := raftSnapshotModel{name: c.name, nextID: atomic.LoadInt64(&c.nextID)}
+		for _, sh := range c.shards {
+			model.trees = append(model.trees, sh.snapshot())
+		}
+		snapshot.models = append(snapshot.models, model)
+	}
+	return snapshot, nil
+}
+
+// Restore replaces the items of the store with those of a snapshot.
+func (f *raftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	_, err := f.node.store.Import(snapshot, ImportReplace)
+	return err
+}
+
+// raftSnapshot is the state of the store at an index of the log.
+type raftSnapshot struct {
+	models []raftSnapshotModel
+}
+
+// raftSnapshotModel holds the items of one collection of a snapshot.
+type raftSnapshotModel struct {
+	name   string
+	nextID int64
+	trees  []*entryTree
+}
+
+// Persist writes the snapshot in the format of /_export, with the encrypted fields sealed.
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.write(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// write writes the snapshot as a dump.
+func (s *raftSnapshot) write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, `{"format":%d,"models":[`, ExportFormat); err != nil {
+		return err
+	}
+	for i, model := range s.models {
+		name, err := json.Marshal(model.name)
+		if err != nil {
+			return err
+		}
+		separator := ""
+		if i > 0 {
+			separator = ","
+		}
+		if _, err := fmt.Fprintf(w, `%s{"name":%s,"nextId":%d,"items":[`, separator, name, model.nextID); err != nil {
+			return err
+		}
+		first := true
+		for _, tree := range model.trees {
+			tree.ascend(func(id int, e entry) bool {
+				err = writeExportItem(w, model.name, id, e, first)
+				first = false
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, "]}"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]}\n")
+	return err
+}
+
+// Release is called once the snapshot is persisted.
+func (s *raftSnapshot) Release() {}
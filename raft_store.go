@@ -0,0 +1,178 @@
+// File: raft_store.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the persistent storage of the clustered mode. The Raft log and
+// the term and vote of the node are kept in a bbolt database in the Raft directory, each write
+// synced to disk before Raft acknowledges it, so a restarted node resumes from its latest snapshot
+// and the entries after it. Raft deletes the entries a snapshot covers, so the log stays bounded.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the Raft database.
+var (
+	raftLogsBucket   = []byte("logs")
+	raftStableBucket = []byte("stable")
+)
+
+// errRaftKeyNotFound is the error Raft expects for the keys missing from its stable store.
+var errRaftKeyNotFound = errors.New("not found")
+
+// raftStore is the LogStore and StableStore of a node, in a bbolt database.
+type raftStore struct {
+	db *bolt.DB
+}
+
+// openRaftStore opens the Raft database at path, creating it when missing.
+func openRaftStore(path string) (*raftStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{raftLogsBucket, raftStableBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &raftStore{db: db}, nil
+}
+
+// Close closes the database.
+func (s *raftStore) Close() error {
+	return s.db.Close()
+}
+
+// raftIndexKey encodes a log index so keys sort in index order.
+func raftIndexKey(index uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, index)
+	return key
+}
+
+// FirstIndex returns the index of the first entry of the log, 0 when it is empty.
+func (s *raftStore) FirstIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if key, _ := tx.Bucket(raftLogsBucket).Cursor().First(); key != nil {
+			index = binary.BigEndian.Uint64(key)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// LastIndex returns the index of the last entry of the log, 0 when it is empty.
+func (s *raftStore) LastIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if key, _ := tx.Bucket(raftLogsBucket).Cursor().Last(); key != nil {
+			index = binary.BigEndian.Uint64(key)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// GetLog reads the entry at index into entry.
+func (s *raftStore) GetLog(index uint64, entry *raft.Log) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(raftLogsBucket).Get(raftIndexKey(index))
+		if data == nil {
+			return raft.ErrLogNotFound
+		}
+		return json.Unmarshal(data, entry)
+	})
+}
+
+// StoreLog appends an entry to the log.
+func (s *raftStore) StoreLog(entry *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{entry})
+}
+
+// StoreLogs appends entries to the log in a single transaction.
+func (s *raftStore) StoreLogs(entries []*raft.Log) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(raftLogsBucket)
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(raftIndexKey(entry.Index), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteRange deletes the entries from min to max included.
+func (s *raftStore) DeleteRange(min, max uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(raftLogsBucket)
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for key, _ := cursor.Seek(raftIndexKey(min)); key != nil && binary.BigEndian.Uint64(key) <= max; key, _ = cursor.Next() {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Set stores a value of the stable store.
+func (s *raftStore) Set(key, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(raftStableBucket).Put(key, value)
+	})
+}
+
+// Get reads a value of the stable store.
+func (s *raftStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(raftStableBucket).Get(key)
+		if data == nil {
+			return errRaftKeyNotFound
+		}
+		value = append([]byte(nil), data...)
+		return nil
+	})
+	return value, err
+}
+
+// SetUint64 stores a number of the stable store.
+func (s *raftStore) SetUint64(key []byte, value uint64) error {
+	return s.Set(key, raftIndexKey(value))
+}
+
+// GetUint64 reads a number of the stable store.
+func (s *raftStore) GetUint64(key []byte) (uint64, error) {
+	value, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
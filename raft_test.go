@@ -0,0 +1,261 @@
+// File: raft_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the clustered mode: writes sent to any node are committed on every
+// node, admin writes are replayed with the grant of their caller instead of its token, the logged
+// commands hold no credentials, snapshots restore the store, and the transport refuses nodes
+// without the cluster secret.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// freeAddr returns a local address nothing listens at.
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// raftCluster starts n nodes serving the item model and /_import behind the admin token "admin".
+func raftCluster(t *testing.T, n int) ([]*RaftNode, []*Store, []*httptest.Server) {
+	auth := NewClusterAuth("secret")
+	stores := make([]*Store, n)
+	servers := make([]*httptest.Server, n)
+	handlers := make([]http.Handler, n)
+	addrs := make([]string, n)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlers[i].ServeHTTP(w, r) }))
+		addrs[i] = freeAddr(t)
+	}
+
+	nodes := make([]*RaftNode, n)
+	for i := range nodes {
+		var peers []string
+		for j := range servers {
+			peers = append(peers, servers[j].URL+"="+addrs[j])
+		}
+		stores[i] = newTestStore()
+		store := stores[i]
+		tenants := NewTenants(store)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/item", func(w http.ResponseWriter, r *http.Request) { handleTenantRequest(tenants, "item", w, r) })
+		mux.HandleFunc("/_import", adminOnly("admin", func(w http.ResponseWriter, r *http.Request) { handleImport(store, w, r) }))
+
+		node, err := NewRaftNode(store, servers[i].URL, addrs[i], peers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Auth = auth
+		node.AdminToken = "admin"
+		if err := node.Start(mux); err != nil {
+			t.Fatal(err)
+		}
+		handlers[i] = node.Handler()
+		nodes[i] = node
+	}
+	t.Cleanup(func() {
+		for i, node := range nodes {
+			node.Shutdown()
+			servers[i].Close()
+		}
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for nodes[0].Status().Leader == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader was elected")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nodes, stores, servers
+}
+
+// waitFor polls until ok reports true.
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !ok(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestRaftReplicatesWrites(t *testing.T) {
+	nodes, stores, servers := raftCluster(t, 3)
+	follower := 0
+	for i, node := range nodes {
+		if node.Status().Role != RaftLeader {
+			follower = i
+		}
+	}
+
+	resp, err := http.Post(servers[follower].URL+"/item", "application/json", strings.NewReader(`{"title":"replicated"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("write sent to a follower: status %d, want 201", resp.StatusCode)
+	}
+	for _, store := range stores {
+		waitFor(t, "the write on every node", func() bool { return store.exists("item", 1) })
+	}
+
+	dump := `{"format":1,"models":[{"name":"item","nextId":3,"items":[{"id":2,"created":"2024-11-01T00:00:00Z","modified":"2024-11-01T00:00:00Z","item":{"id":2,"title":"imported"}}]}]}`
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "admin": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodPost, servers[follower].URL+"/_import", strings.NewReader(dump))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("import with token %q: status %d, want %d", token, resp.StatusCode, want)
+		}
+	}
+	for _, store := range stores {
+		waitFor(t, "the admin write on every node", func() bool { return store.exists("item", 2) })
+	}
+}
+
+func TestRaftCommandsHoldNoCredentials(t *testing.T) {
+	keys, err := NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{7}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetFieldKeys(keys)
+	defer SetFieldKeys(nil)
+
+	store := newTestStore()
+	store.SetPrivileged(func(r *http.Request) bool { return r.Header.Get("Authorization") == "Bearer admin" })
+	node, err := NewRaftNode(store, "http://a", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.AdminToken = "admin"
+	r := httptest.NewRequest(http.MethodPost, "/item", nil)
+	for name, value := range map[string]string{"Authorization": "Bearer admin", APIKeyHeader: "key", "Cookie": "session=1", "Content-Type": "application/json"} {
+		r.Header.Set(name, value)
+	}
+
+	data, err := node.command(r, []byte(`{"title":"secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("Bearer")) || bytes.Contains(data, []byte("session")) || bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("logged command holds a credential or the plaintext body: %s", data)
+	}
+	var command RaftCommand
+	if err := json.Unmarshal(data, &command); err != nil {
+		t.Fatal(err)
+	}
+	if command.Header.Get(APIKeyHeader) != "" || command.Header.Get("Content-Type") == "" || !command.Sealed {
+		t.Errorf("logged command is %+v, want the API key removed and the body sealed", command)
+	}
+	if !containsString(command.Grants, grantAdmin) || !containsString(command.Grants, grantPrivileged) {
+		t.Errorf("logged command grants %v, want admin and privileged", command.Grants)
+	}
+
+	var replayed *http.Request
+	node.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { replayed = r })
+	node.execute(command)
+	if replayed == nil || !granted(replayed, grantAdmin) || !store.isPrivileged(replayed) {
+		t.Fatal("replayed command lost the grants of its caller")
+	}
+}
+
+func TestRaftSnapshotRestoresTheStore(t *testing.T) {
+	store := newTestStore()
+	store.Create("item", &Item{Title: "first"})
+	store.Create("item", &Item{Title: "second"})
+	store.Delete("item", 1)
+	node := &RaftNode{store: store}
+	fsm := &raftFSM{node: node}
+
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Create("item", &Item{Title: "after the snapshot"})
+	var dump bytes.Buffer
+	if err := snapshot.(*raftSnapshot).write(&dump); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestStore()
+	restored.Create("item", &Item{Title: "discarded"})
+	if err := (&raftFSM{node: &RaftNode{store: restored}}).Restore(io.NopCloser(&dump)); err != nil {
+		t.Fatal(err)
+	}
+	var items []Item
+	restored.Find("item", nil, &items)
+	if len(items) != 1 || items[0].ID != 2 || items[0].Title != "second" {
+		t.Fatalf("restored items are %+v, want only the second item", items)
+	}
+	if item := restored.Create("item", &Item{Title: "next"}); !restored.exists("item", 3) {
+		t.Fatalf("restored ID counter gave %v", item)
+	}
+}
+
+func TestRaftTransportRefusesOtherSecrets(t *testing.T) {
+	stream, err := newRaftStream("127.0.0.1:0", NewClusterAuth("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	go func() {
+		for {
+			conn, err := stream.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	intruder, err := newRaftStream("127.0.0.1:0", NewClusterAuth("guess"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.Close()
+	if _, err := intruder.Dial(raftAddress(stream), time.Second); err == nil {
+		t.Error("node with another secret connected")
+	}
+	member, err := newRaftStream("127.0.0.1:0", NewClusterAuth("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer member.Close()
+	conn, err := member.Dial(raftAddress(stream), time.Second)
+	if err != nil {
+		t.Fatalf("node with the secret: %v", err)
+	}
+	conn.Close()
+}
+
+// raftAddress returns the address of a stream as a Raft server address.
+func raftAddress(s *raftStream) raft.ServerAddress {
+	return raft.ServerAddress(s.Addr().String())
+}
@@ -0,0 +1,210 @@
+// File: rate_limit.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements per-client rate limiting. Every request takes a token from the
+// bucket of its client, identified by IP address or by the API key of its X-API-Key header, and is
+// answered 429 with a Retry-After header when the bucket is empty. Buckets are kept in memory by a
+// MemoryLimiter, or in Redis by a RedisLimiter so the instances of a deployment share them.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// APIKeyHeader is the header carrying the API key of a client.
+const APIKeyHeader = "X-API-Key"
+
+// Limiter takes tokens from the rate-limit buckets of clients.
+type Limiter interface {
+	// Allow takes a token from the bucket of a client, returning how long to wait for one when it
+	// is empty.
+	Allow(client string) (bool, time.Duration, error)
+}
+
+// MemoryLimiter keeps the token buckets of clients in memory.
+type MemoryLimiter struct {
+	Rate  float64 // tokens per second
+	Burst int     // bucket capacity, the rate (at least 1) when 0
+
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	mux     sync.Mutex
+}
+
+// memoryLimiterSweep is how often the buckets refilled to capacity are dropped.
+const memoryLimiterSweep = time.Minute
+
+// NewMemoryLimiter creates a limiter allowing rate requests per second per client, in bursts of up
+// to burst requests.
+func NewMemoryLimiter(rate float64, burst int) *MemoryLimiter {
+	return &MemoryLimiter{Rate: rate, Burst: burst, buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+// Allow takes a token from the bucket of a client.
+func (l *MemoryLimiter) Allow(client string) (bool, time.Duration, error) {
+	now := time.Now()
+	burst := bucketSize(l.Rate, l.Burst)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	// A bucket refilled to capacity is the same as a new one, so idle clients are forgotten
+	if now.Sub(l.swept) >= memoryLimiterSweep {
+		for key, bucket := range l.buckets {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*l.Rate >= burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = bucket
+	}
+	ok, wait := bucket.take(l.Rate, burst, now)
+	return ok, wait, nil
+}
+
+// redisTakeScript takes a token from a bucket kept as a Redis hash, atomically, on the clock of the
+// Redis server so every instance agrees. It returns whether the token was taken and the seconds to
+// wait otherwise.
+const redisTakeScript = `
+redis.replicate_commands()
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens, allowed = tokens - 1, 1
+else
+	wait = (1 - tokens) / rate
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, tostring(wait)}
+`
+
+// RedisLimiter keeps the token buckets of clients in Redis, shared by the instances using the same
+// server and prefix.
+type RedisLimiter struct {
+	Addr     string
+	Password string
+	Prefix   string  // prefix of the bucket keys
+	Rate     float64 // tokens per second
+	Burst    int     // bucket capacity, the rate (at least 1) when 0
+
+	conn   *redisConn
+	redial time.Time // when a failed connection may be retried
+	mux    sync.Mutex
+}
+
+// Timeouts of the Redis limiter: the round trip of a token taken from Redis, and how long the
+// limiter waits before reconnecting after a failed connection.
+const (
+	redisLimiterTimeout = 2 * time.Second
+	redisLimiterRedial  = time.Second
+)
+
+// errRedisLimiterDown is returned while the Redis limiter waits to reconnect, the failure having
+// been reported already.
+var errRedisLimiterDown = errors.New("redis: not connected")
+
+// NewRedisLimiter creates a limiter allowing rate requests per second per client, in bursts of up
+// to burst requests, with buckets kept in the Redis server at addr.
+func NewRedisLimiter(addr string, rate float64, burst int) *RedisLimiter {
+	return &RedisLimiter{Addr: addr, Prefix: "crud:ratelimit:", Rate: rate, Burst: burst}
+}
+
+// Allow takes a token from the bucket of a client. The connection is reopened after an error, at
+// most once a second.
+func (l *RedisLimiter) Allow(client string) (bool, time.Duration, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.conn == nil {
+		if time.Now().Before(l.redial) {
+			return false, 0, errRedisLimiterDown
+		}
+		conn, err := dialRedis(l.Addr, l.Password)
+		if err != nil {
+			l.redial = time.Now().Add(redisLimiterRedial)
+			return false, 0, err
+		}
+		l.conn = conn
+	}
+	l.conn.conn.SetDeadline(time.Now().Add(redisLimiterTimeout))
+	burst := bucketSize(l.Rate, l.Burst)
+	reply, err := l.conn.do("EVAL", redisTakeScript, "1", l.Prefix+client,
+		strconv.FormatFloat(l.Rate, 'f', -1, 64), strconv.FormatFloat(burst, 'f', -1, 64))
+	if err != nil {
+		l.conn.Close()
+		l.conn = nil
+		return false, 0, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, errors.New("redis: unexpected rate limit reply")
+	}
+	allowed, _ := values[0].(int64)
+	text, _ := values[1].(string)
+	seconds, _ := strconv.ParseFloat(text, 64)
+	return allowed == 1, time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Ways clients are identified by the rate limiter.
+const (
+	LimitByIP  = "ip"  // the IP address of the connection
+	LimitByKey = "key" // the API key of the X-API-Key header, the IP address without one
+)
+
+// clientOf identifies the client of a request: by API key when by is LimitByKey and the request
+// carries one, by IP address otherwise.
+func clientOf(r *http.Request, by string) string {
+	if by == LimitByKey {
+		if key := r.Header.Get(APIKeyHeader); key != "" {
+			return "key:" + key
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// withRateLimit answers 429 with a Retry-After header to the requests of clients whose bucket is
+// empty. Requests are let through when the limiter fails, so an unreachable Redis server does not
+// take the API down. The requests signed by a node of the cluster are not limited, so heartbeats and
+// replication keep flowing.
+func withRateLimit(limiter Limiter, by string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fromPeer(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait, err := limiter.Allow(clientOf(r, by))
+		if err != nil {
+			if err != errRedisLimiterDown {
+				log.Printf("rate limit: %v", err)
+			}
+		} else if !ok {
+			setRetryAfter(w, wait)
+			writeProblem(w, r, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,263 @@
+// File: redis_pubsub.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements broadcasting of store change events over Redis Pub/Sub.
+// Every local mutation is published to a Redis channel, and events published by other replicas
+// are delivered to a handler so they can invalidate caches or react to remote writes. It speaks
+// the Redis protocol (RESP) directly, so no third-party client library is required.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RedisBroadcaster publishes change events to a Redis channel and listens for events from other replicas.
+type RedisBroadcaster struct {
+	Addr     string
+	Password string
+	Channel  string
+	NodeID   string
+
+	queue chan ChangeEvent
+	once  sync.Once
+}
+
+// NewRedisBroadcaster creates a broadcaster for the given Redis address and channel.
+// Events are published asynchronously from a bounded queue so slow Redis round trips never block writes.
+func NewRedisBroadcaster(addr, channel string) *RedisBroadcaster {
+	return &RedisBroadcaster{
+		Addr:    addr,
+		Channel: channel,
+		NodeID:  newNodeID(),
+		queue:   make(chan ChangeEvent, 1024),
+	}
+}
+
+// Publish queues a local change event for broadcasting. It is meant to be passed to Store.Subscribe.
+func (b *RedisBroadcaster) Publish(event ChangeEvent) {
+	b.once.Do(func() { go b.publishLoop() })
+
+	if event.Origin == "" {
+		event.Origin = b.NodeID
+	}
+	select {
+	case b.queue <- event:
+	default:
+		log.Printf("redis: publish queue full, dropping %s event for %s %d", event.Op, event.Model, event.ID)
+	}
+}
+
+// Listen subscribes to the channel in the background and calls handler for every event published
+// by another replica. Events originating from this node are skipped, and the encrypted fields of the
+// items received are left sealed.
+func (b *RedisBroadcaster) Listen(handler func(ChangeEvent)) {
+	go func() {
+		for {
+			if err := b.subscribe(handler); err != nil {
+				log.Printf("redis: subscription to %s lost: %v", b.Channel, err)
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+// publishLoop drains the queue, reconnecting to Redis whenever the connection fails.
+func (b *RedisBroadcaster) publishLoop() {
+	var conn *redisConn
+	for event := range b.queue {
+		sealed, err := sealEvent(event)
+		var payload []byte
+		if err == nil {
+			payload, err = json.Marshal(sealed)
+		}
+		if err != nil {
+			log.Printf("redis: cannot encode event: %v", err)
+			continue
+		}
+
+		for attempt := 0; attempt < 3; attempt++ {
+			if conn == nil {
+				if conn, err = dialRedis(b.Addr, b.Password); err != nil {
+					log.Printf("redis: connect %s: %v", b.Addr, err)
+					time.Sleep(time.Duration(attempt+1) * 200 * time.Millisecond)
+					continue
+				}
+			}
+			if _, err = conn.do("PUBLISH", b.Channel, string(payload)); err == nil {
+				break
+			}
+			log.Printf("redis: publish failed: %v", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// subscribe runs a single SUBSCRIBE session until the connection fails.
+func (b *RedisBroadcaster) subscribe(handler func(ChangeEvent)) error {
+	conn, err := dialRedis(b.Addr, b.Password)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.send("SUBSCRIBE", b.Channel); err != nil {
+		return err
+	}
+	for {
+		reply, err := conn.readReply()
+		if err != nil {
+			return err
+		}
+
+		// Messages arrive as ["message", channel, payload]
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		payload, _ := parts[2].(string)
+
+		var event ChangeEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			log.Printf("redis: ignoring malformed event: %v", err)
+			continue
+		}
+		if event.Origin == b.NodeID {
+			continue
+		}
+		handler(event)
+	}
+}
+
+// redisConn is a minimal RESP connection supporting the commands used by the broadcaster.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialRedis connects to Redis and authenticates when a password is set.
+func dialRedis(addr, password string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and waits for its reply.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// send writes a command encoded as a RESP array of bulk strings.
+func (c *redisConn) send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// readReply decodes a single RESP reply.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.New("redis: short reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// Close closes the underlying connection.
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// newNodeID returns a random identifier used to recognise events published by this process.
+func newNodeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// invalidateRemote drops what the store answers from caches about an item changed by another
+// replica: the cached responses of its model, a remembered miss of the item, and the ETag and
+// Last-Modified of its collection, whose shard version is bumped.
+func (s *Store) invalidateRemote(event ChangeEvent) {
+	if s.responses != nil {
+		s.responses.invalidate(event.Model)
+	}
+	if s.misses != nil {
+		s.misses.forget(cacheKey{event.Model, event.ID})
+	}
+	s.typeMux.RLock()
+	c, ok := s.collections[event.Model]
+	s.typeMux.RUnlock()
+	if ok {
+		sh := c.shard(event.ID)
+		atomic.AddUint64(&sh.version, 1)
+		atomic.StoreInt64(&sh.modified, time.Now().UnixNano())
+	}
+}
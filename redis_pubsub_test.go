@@ -0,0 +1,105 @@
+// File: redis_pubsub_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the change events received over Redis Pub/Sub: the events of other
+// replicas invalidate the response cache, the negative cache and the ETags of the local store.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves a single subscriber, sending it the payloads as messages of channel once it
+// subscribes, and returns its address.
+func fakeRedis(t *testing.T, channel string, payloads ...string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.TrimSpace(line) == channel {
+				break
+			}
+		}
+		for _, payload := range payloads {
+			fmt.Fprintf(conn, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(payload), payload)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// putQuietly stores an item without a change event, as a change of another replica reaching the
+// storage shared by the replicas.
+func putQuietly(store *Store, model string, id int, item interface{}) {
+	c, _ := store.collection(model)
+	sh := c.shard(id)
+	sh.itemMux.Lock()
+	defer sh.itemMux.Unlock()
+	items := sh.edit()
+	items.set(id, entry{item: item, created: time.Now(), modified: time.Now()})
+	sh.items.Store(items)
+}
+
+func TestRemoteChangesInvalidateCaches(t *testing.T) {
+	store := newTestStore()
+	store.SetResponseCache(NewResponseCache(time.Minute, 100))
+	store.SetNegativeCache(NewNegativeCache(time.Minute))
+	store.Create("item", &Item{Title: "local"})
+	handler := func(w http.ResponseWriter, r *http.Request) { handleRequest(store, "item", w, r) }
+
+	list := serveTest(handler, http.MethodGet, "/item", "")
+	etag := list.Header().Get("ETag")
+	if w := serveTest(handler, http.MethodGet, "/item?id=2", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("missing item: status %d, want 404", w.Code)
+	}
+	putQuietly(store, "item", 2, &Item{ID: 2, Title: "remote"})
+	if w := serveTest(handler, http.MethodGet, "/item", ""); strings.Contains(w.Body.String(), "remote") {
+		t.Fatalf("the cached list was not served before the event: %s", w.Body)
+	}
+
+	addr := fakeRedis(t, "changes", `{"op":"create","model":"item","id":2,"origin":"replica-2"}`)
+	NewRedisBroadcaster(addr, "changes").Listen(store.invalidateRemote)
+	deadline := time.Now().Add(2 * time.Second)
+	for serveTest(handler, http.MethodGet, "/item?id=2", "").Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("the remembered miss of the item was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if w := serveTest(handler, http.MethodGet, "/item", ""); !strings.Contains(w.Body.String(), "remote") {
+		t.Errorf("the cached list was served after the event: %s", w.Body)
+	}
+	if w := serveTest(handler, http.MethodGet, "/item", "", "If-None-Match", etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("the ETag of the list did not change: status %d, ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestInvalidateRemoteOfUnknownModel(t *testing.T) {
+	store := newTestStore()
+	store.invalidateRemote(ChangeEvent{Op: OpCreate, Model: "acme/item", ID: 1})
+	if store.registered("acme/item") {
+		t.Fatal("the event created the collection")
+	}
+}
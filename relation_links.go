@@ -0,0 +1,98 @@
+// File: relation_links.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements lazy relation links. When enabled, every item returned by a GET
+// carries a link to each of its relations that was not requested with ?include=, so clients can
+// follow references without the server loading them: an item of user 7 gets "user": {"href":
+// "/user?id=7"} and user 7 gets "item": {"href": "/user/7/item"}. Links keep the /t/{tenant} prefix
+// of the request path, and a polymorphic parent the item does not reference is linked as null.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SetRelationLinks makes GETs link the relations of the returned items that were not included.
+// It must be called before the store is used concurrently.
+func (s *Store) SetRelationLinks(enabled bool) {
+	s.relationLinks = enabled
+}
+
+// children returns the relations of the registered models to a parent model (which may be
+// tenant-scoped).
+func (s *Store) children(model string) []*Relation {
+	_, base, _ := splitTenantModel(model)
+	var children []*Relation
+	for _, c := range s.allCollections() {
+		if _, _, scoped := splitTenantModel(c.name); scoped {
+			continue
+		}
+		for _, relation := range s.parents(c.name) {
+			if relation.Parent == base {
+				children = append(children, relation)
+			}
+		}
+	}
+	return children
+}
+
+// withRelationLinks adds to the includes of a GET on a model a link to every relation it does not
+// include, when relation links are enabled.
+func (s *Store) withRelationLinks(model string, r *http.Request, includes []include) []include {
+	if !s.relationLinks {
+		return includes
+	}
+	meta, ok := s.meta(model)
+	if !ok {
+		return includes
+	}
+	tenant, _, _ := splitTenantModel(model)
+	prefix := ""
+	if tenant != "" && strings.HasPrefix(r.URL.Path, "/t/"+tenant+"/") {
+		prefix = "/t/" + tenant
+	}
+	prefix = versionPrefix(r) + prefix
+	included := make(map[string]bool, len(includes))
+	for _, inc := range includes {
+		included[inc.name] = true
+	}
+
+	byName := make(map[string]int)
+	add := func(name string, relation *Relation, children bool) {
+		if included[name] {
+			return
+		}
+		if i, ok := byName[name]; ok {
+			includes[i].relations = append(includes[i].relations, relation)
+			return
+		}
+		byName[name] = len(includes)
+		includes = append(includes, include{name: name, tenant: tenant, relations: []*Relation{relation}, children: children, linked: true, prefix: prefix})
+	}
+	for _, relation := range s.parents(model) {
+		name := relation.Parent
+		if relation.As != "" {
+			name = relation.As
+		}
+		add(name, relation, false)
+	}
+	if meta.id != nil {
+		for _, relation := range s.children(model) {
+			add(relation.Child, relation, true)
+		}
+	}
+	return includes
+}
+
+// href returns the link to the items an item includes through a relation.
+func (inc include) href(relation *Relation, key cacheKey) map[string]string {
+	if inc.children {
+		return map[string]string{"href": inc.prefix + "/" + relation.Parent + "/" + strconv.Itoa(key.id) + "/" + relation.Child}
+	}
+	return map[string]string{"href": inc.prefix + "/" + relation.Parent + "?id=" + strconv.Itoa(key.id)}
+}
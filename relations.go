@@ -0,0 +1,324 @@
+// File: relations.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements parent/child relations between models and their nested routes.
+// Once a child model is registered under a parent with the field holding the parent's ID, the
+// child collection can be reached below a parent item: GET /user/7/item lists the items whose
+// foreign key is 7 (accepting the usual filters and paging), POST /user/7/item creates one with the
+// foreign key set, and ?id= requests only reach the children of that parent. Nested requests are
+// rewritten into plain requests on the child model, so they behave exactly like them.
+//
+// Relations are registered with RegisterChild or declared on the model with a rel tag, either on the
+// foreign key itself (UserID int `rel:"belongsTo=user"`) or on another field naming it
+// (`rel:"belongsTo=user,field=UserID"`). Creates and updates are rejected with 422 when a non-zero
+// foreign key does not reference an existing parent.
+//
+// A polymorphic relation lets a child belong to one of several parent models, named by a string
+// field next to the foreign key: SubjectID int `rel:"belongsTo=item|user,type=SubjectType,as=subject"`
+// makes a comment belong to the item or the user named by SubjectType, served at both
+// /item/{id}/comment and /user/{id}/comment and included as "subject". Adding onDelete=cascade to a
+// tag deletes the children along with their parent.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// belongsTo is a relation declared with a rel tag: the model belongs to an item of parent, or of
+// one of several parents for a polymorphic relation.
+type belongsTo struct {
+	parents    []string
+	foreignKey *fieldMeta
+	typeField  *fieldMeta // for a polymorphic relation, the field naming the parent model
+	as         string     // include name of a polymorphic parent
+	cascade    bool       // whether deleting the parent deletes the model's items
+}
+
+// parseRelationTags returns the relations declared by the rel tags of a model's fields. Malformed
+// tags are logged and ignored.
+func parseRelationTags(m *modelMeta) []belongsTo {
+	var relations []belongsTo
+	for _, f := range m.fields {
+		tag, ok := f.tag.Lookup("rel")
+		if !ok {
+			continue
+		}
+		relation := belongsTo{foreignKey: f}
+		valid := true
+		for _, option := range strings.Split(tag, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+			switch key {
+			case "belongsTo":
+				relation.parents = strings.Split(value, "|")
+			case "field":
+				relation.foreignKey = m.byName[value]
+			case "type":
+				relation.typeField = m.byName[value]
+				valid = valid && relation.typeField != nil && relation.typeField.typ.Kind() == reflect.String
+			case "as":
+				relation.as = value
+			case "onDelete":
+				relation.cascade = value == "cascade"
+				valid = valid && (value == "cascade" || value == "restrict")
+			}
+		}
+		polymorphic := len(relation.parents) > 1
+		valid = valid && len(relation.parents) > 0 && !containsString(relation.parents, "") &&
+			relation.foreignKey != nil && isIntKind(relation.foreignKey.typ.Kind()) &&
+			polymorphic == (relation.typeField != nil)
+		if !valid {
+			log.Printf("relations: ignoring invalid tag rel:%q on %s.%s", tag, m.typ.Name(), f.name)
+			continue
+		}
+		relations = append(relations, relation)
+	}
+	return relations
+}
+
+// isIntKind reports whether a kind is a signed integer, the type of IDs and foreign keys.
+func isIntKind(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Int64
+}
+
+// Relation links a child model to its parent through a foreign key field of the child.
+type Relation struct {
+	Parent     string
+	Child      string
+	ForeignKey *fieldMeta
+	// Type is the field of a polymorphic child naming the model its foreign key references. The
+	// child only belongs to the parent when it holds Parent.
+	Type *fieldMeta
+	// As is the include name of a polymorphic parent, shared by the relations to every parent model.
+	As string
+}
+
+// references returns the ID of the parent an item of the child references, if any.
+func (r *Relation) references(item interface{}) (int, bool) {
+	if r.Type != nil && r.Type.value(item).String() != r.Parent {
+		return 0, false
+	}
+	id := int(r.ForeignKey.value(item).Int())
+	return id, id != 0
+}
+
+// RegisterChild declares that the items of child belong to an item of parent, whose ID they hold in
+// the foreignKey field (a Go or JSON field name), and serves them at /{parent}/{id}/{child}.
+// It must be called before the store is used concurrently.
+func (s *Store) RegisterChild(parent, child, foreignKey string) error {
+	if _, ok := s.meta(parent); !ok {
+		return fmt.Errorf("model %q is not registered", parent)
+	}
+	meta, ok := s.meta(child)
+	if !ok {
+		return fmt.Errorf("model %q is not registered", child)
+	}
+	field, ok := meta.field(foreignKey)
+	if !ok {
+		return fmt.Errorf("model %q has no field %q", child, foreignKey)
+	}
+	if !isIntKind(field.typ.Kind()) {
+		return fmt.Errorf("foreign key %s.%s must be an integer", child, field.name)
+	}
+
+	s.typeMux.Lock()
+	defer s.typeMux.Unlock()
+	if s.relations == nil {
+		s.relations = make(map[string]map[string]*Relation)
+	}
+	if s.relations[parent] == nil {
+		s.relations[parent] = make(map[string]*Relation)
+	}
+	s.relations[parent][child] = &Relation{Parent: parent, Child: child, ForeignKey: field}
+	return nil
+}
+
+// relation returns the relation between a parent model (which may be tenant-scoped) and a child,
+// registered or declared by a tag of the child.
+func (s *Store) relation(parent, child string) (*Relation, bool) {
+	_, base, _ := splitTenantModel(parent)
+	for _, relation := range s.parents(child) {
+		if relation.Parent == base {
+			return relation, true
+		}
+	}
+	return nil, false
+}
+
+// parents returns the relations of a model (which may be tenant-scoped) to its parents.
+func (s *Store) parents(model string) []*Relation {
+	_, base, _ := splitTenantModel(model)
+	meta, ok := s.meta(base)
+	if !ok {
+		return nil
+	}
+
+	s.typeMux.RLock()
+	var relations []*Relation
+	for _, children := range s.relations {
+		if relation, ok := children[base]; ok {
+			relations = append(relations, relation)
+		}
+	}
+	s.typeMux.RUnlock()
+	for _, tag := range meta.belongsTo {
+		for _, parent := range tag.parents {
+			relations = append(relations, &Relation{Parent: parent, Child: base, ForeignKey: tag.foreignKey, Type: tag.typeField, As: tag.as})
+		}
+	}
+	return relations
+}
+
+// checkParents verifies that every non-zero foreign key of an item references an existing parent
+// in the same tenant. In partitioned mode parents may live on other nodes and are not checked.
+func (s *Store) checkParents(model string, item interface{}) error {
+	if s.partition != nil {
+		return nil
+	}
+	tenant, base, _ := splitTenantModel(model)
+	if meta, ok := s.meta(base); ok {
+		for _, tag := range meta.belongsTo {
+			if tag.typeField == nil || tag.foreignKey.value(item).Int() == 0 {
+				continue
+			}
+			if value := tag.typeField.value(item).String(); !containsString(tag.parents, value) {
+				return fieldError(tag.typeField, "oneof", value, localizef("%s must be one of %s", tag.typeField.jsonName, strings.Join(tag.parents, ", ")))
+			}
+		}
+	}
+	for _, relation := range s.parents(model) {
+		id, ok := relation.references(item)
+		if !ok {
+			continue
+		}
+		if !s.exists(tenantModel(tenant, relation.Parent), id) {
+			return fieldError(relation.ForeignKey, "exists", id, localizef("%s %d does not exist", relation.Parent, id))
+		}
+	}
+	return nil
+}
+
+// watchCascades deletes the items of a model whose parent is deleted, for the relations declared
+// with onDelete=cascade. Deleted children cascade in turn to their own children.
+func (s *Store) watchCascades(model string, meta *modelMeta) {
+	var cascades []belongsTo
+	for _, tag := range meta.belongsTo {
+		if tag.cascade {
+			cascades = append(cascades, tag)
+		}
+	}
+	if len(cascades) == 0 {
+		return
+	}
+	s.Subscribe(func(event ChangeEvent) {
+		if event.Op != OpDelete {
+			return
+		}
+		tenant, parent, _ := splitTenantModel(event.Model)
+		child := tenantModel(tenant, model)
+		for _, tag := range cascades {
+			if !containsString(tag.parents, parent) {
+				continue
+			}
+			id := reflect.ValueOf(event.ID).Convert(tag.foreignKey.typ).Interface()
+			filters := []Filter{{Field: tag.foreignKey.name, Op: FilterEq, Value: id}}
+			if tag.typeField != nil {
+				filters = append(filters, Filter{Field: tag.typeField.name, Op: FilterEq, Value: parent})
+			}
+			found, err := s.matching(child, filters)
+			if err != nil {
+				continue
+			}
+			for _, m := range found {
+				s.Delete(child, m.id)
+			}
+		}
+	})
+}
+
+// exists reports whether a live item of a model has the given ID.
+func (s *Store) exists(model string, id int) bool {
+	c, ok := s.collection(model)
+	if !ok {
+		return false
+	}
+	e, exists := c.shard(id).snapshot().get(id)
+	return exists && !e.expired(time.Now())
+}
+
+// handleChildren serves /{parent}/{id}/{child} by rewriting it into a request on the child model
+// restricted to the parent item. It reports false when rest does not name a nested route.
+func handleChildren(store *Store, model, rest string, w http.ResponseWriter, r *http.Request) bool {
+	parentID, child, ok := strings.Cut(rest, "/")
+	if !ok {
+		return false
+	}
+	id, err := strconv.Atoi(parentID)
+	if err != nil {
+		return false
+	}
+	relation, ok := store.relation(model, child)
+	if !ok {
+		return false
+	}
+	tenant, _, _ := splitTenantModel(model)
+	childModel := tenantModel(tenant, child)
+
+	if !store.exists(model, id) {
+		writeProblem(w, r, http.StatusNotFound, "Parent not found")
+		return true
+	}
+	childMeta, _ := store.meta(childModel)
+
+	// Requests on one child only reach the children of this parent
+	query := r.URL.Query()
+	if childID, err := strconv.Atoi(query.Get("id")); err == nil {
+		current := reflect.New(childMeta.typ).Interface()
+		found := store.Get(childModel, childID, current)
+		if parent, ok := relation.references(current); !found || !ok || parent != id {
+			writeError(w, r, http.StatusNotFound, ErrItemNotFound)
+			return true
+		}
+	}
+
+	nested := r.Clone(context.WithValue(r.Context(), subpathKey{}, ""))
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		query.Set(relation.ForeignKey.jsonName, parentID)
+		if relation.Type != nil {
+			query.Set(relation.Type.jsonName, relation.Parent)
+		}
+		nested.URL.RawQuery = query.Encode()
+	case http.MethodPost, http.MethodPut:
+		// Set the foreign key of the submitted item to the parent
+		item := reflect.New(childMeta.typ).Interface()
+		if err := decodeItem(r.Body, item); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, decodeError(childMeta, err))
+			return true
+		}
+		relation.ForeignKey.value(item).SetInt(int64(id))
+		if relation.Type != nil {
+			relation.Type.value(item).SetString(relation.Parent)
+		}
+		body, err := marshalItem(item)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+			return true
+		}
+		nested.Body = io.NopCloser(bytes.NewReader(body))
+		nested.ContentLength = int64(len(body))
+	}
+	handleRequest(store, childModel, w, nested)
+	return true
+}
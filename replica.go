@@ -0,0 +1,425 @@
+// File: replica.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the read-replica mode. A replica copies the primary's items from
+// GET /_replica/snapshot, then keeps its copy in sync by tailing the primary's change feed (/_cdc),
+// starting over from a fresh snapshot whenever it falls too far behind. Reads are served from the
+// local copy while every other request is proxied to the primary, so replicas can be placed close to
+// readers to scale read throughput. A write forwarded through a replica is visible on that replica by
+// the time its response is returned.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replica timings and limits.
+const (
+	replicaPageSize   = 1000
+	replicaClientTime = 30 * time.Second
+)
+
+// replicaStats holds the replication counters and lag of a replica.
+var replicaStats = expvar.NewMap("replica")
+
+// errReplicaGone reports that the primary discarded changes the replica has not seen yet.
+var errReplicaGone = errors.New("replica: changes are no longer available on the primary")
+
+// ReplicaSnapshot is a copy of every item of a store, taken at a sequence number of its change feed.
+type ReplicaSnapshot struct {
+	Seq         uint64                           `json:"seq"`
+	Collections map[string][]ReplicaSnapshotItem `json:"collections"`
+}
+
+// ReplicaSnapshotItem is one item of a snapshot.
+type ReplicaSnapshotItem struct {
+	ID   int             `json:"id"`
+	Item json.RawMessage `json:"item"`
+}
+
+// replicaRecord is a change record read from the primary's change feed.
+type replicaRecord struct {
+	Seq    uint64          `json:"seq"`
+	Op     string          `json:"op"`
+	Model  string          `json:"model"`
+	ID     int             `json:"id"`
+	Item   json.RawMessage `json:"item,omitempty"`
+	Time   time.Time       `json:"time"`
+	Origin string          `json:"origin,omitempty"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+// ReplicaStatus describes how far behind the primary a replica is.
+type ReplicaStatus struct {
+	Primary  string    `json:"primary"`
+	Ready    bool      `json:"ready"`
+	Cursor   uint64    `json:"cursor"`
+	Latest   uint64    `json:"latest"`
+	LagMs    int64     `json:"lagMs"`
+	LastSync time.Time `json:"lastSync"`
+}
+
+// Replica keeps a store in sync with a primary instance.
+type Replica struct {
+	// Interval is how often the change feed is polled.
+	Interval time.Duration
+	// Token is the admin token of the primary, sent to its snapshot and change feed routes.
+	Token string
+
+	store   *Store
+	client  *http.Client
+	proxy   *httputil.ReverseProxy
+	ready   int32
+	synced  bool
+	status  ReplicaStatus
+	wake    chan struct{}
+	syncMux sync.Mutex
+	mux     sync.Mutex
+}
+
+// NewReplica creates a replica of the primary at the given base URL (e.g. "http://10.0.0.1:8080").
+// An empty primary creates a replica that waits for SetPrimary.
+func NewReplica(store *Store, primary string) (*Replica, error) {
+	r := &Replica{
+		Interval: 500 * time.Millisecond,
+		store:    store,
+		client:   &http.Client{Timeout: replicaClientTime},
+		wake:     make(chan struct{}, 1),
+	}
+	if err := r.SetPrimary(primary); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Primary returns the base URL of the primary, empty when there is none.
+func (r *Replica) Primary() string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.status.Primary
+}
+
+// SetPrimary switches the replica over to another primary, copying a fresh snapshot from it on the
+// next sync. An empty primary stops the replication.
+func (r *Replica) SetPrimary(primary string) error {
+	primary = strings.TrimRight(primary, "/")
+	var proxy *httputil.ReverseProxy
+	if primary != "" {
+		target, err := url.Parse(primary)
+		if err != nil || target.Host == "" {
+			return fmt.Errorf("invalid primary address %q", primary)
+		}
+		proxy = httputil.NewSingleHostReverseProxy(target)
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.synced, r.proxy = false, proxy
+	r.status = ReplicaStatus{Primary: primary}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start copies the primary's items and follows its change feed in the background.
+func (r *Replica) Start() {
+	go func() {
+		for {
+			if err := r.Sync(); err != nil {
+				replicaStats.Add("sync_errors", 1)
+				log.Printf("replica: %v", err)
+			}
+			select {
+			case <-time.After(r.Interval):
+			case <-r.wake:
+			}
+		}
+	}()
+}
+
+// Sync applies the changes made on the primary since the last sync, copying a fresh snapshot first
+// when the replica has not synced yet or has fallen behind the primary's change log.
+func (r *Replica) Sync() error {
+	r.syncMux.Lock()
+	defer r.syncMux.Unlock()
+
+	for {
+		r.mux.Lock()
+		primary, synced := r.status.Primary, r.synced
+		r.mux.Unlock()
+		if primary == "" {
+			return nil
+		}
+
+		if !synced {
+			if err := r.bootstrap(primary); err != nil {
+				return err
+			}
+			atomic.StoreInt32(&r.ready, 1)
+			continue
+		}
+
+		page, err := r.pull(primary)
+		if errors.Is(err, errReplicaGone) {
+			log.Printf("replica: fell behind %s, copying a new snapshot", primary)
+			replicaStats.Add("resyncs", 1)
+			r.mux.Lock()
+			r.synced = false
+			r.mux.Unlock()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !page {
+			return nil
+		}
+	}
+}
+
+// pull applies one page of the change feed and reports whether more changes may be waiting.
+func (r *Replica) pull(primary string) (bool, error) {
+	r.mux.Lock()
+	cursor := r.status.Cursor
+	r.mux.Unlock()
+
+	var page struct {
+		Records []replicaRecord `json:"records"`
+		Next    uint64          `json:"next"`
+		Latest  uint64          `json:"latest"`
+	}
+	if err := r.get(primary, fmt.Sprintf("/_cdc?since=%d&limit=%d", cursor, replicaPageSize), &page); err != nil {
+		return false, err
+	}
+
+	for _, record := range page.Records {
+		if err := r.apply(primary, record); err != nil {
+			return false, err
+		}
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.status.Primary != primary {
+		// Switched over to another primary meanwhile
+		return false, nil
+	}
+	r.status.Cursor, r.status.Latest, r.status.LastSync = page.Next, page.Latest, time.Now()
+	if page.Next >= page.Latest {
+		r.status.LagMs = 0
+	} else if len(page.Records) > 0 {
+		r.status.LagMs = time.Since(page.Records[len(page.Records)-1].Time).Milliseconds()
+	}
+	replicaStats.Set("cursor", intVar(int64(page.Next)))
+	replicaStats.Set("lag_ms", intVar(r.status.LagMs))
+	return len(page.Records) == replicaPageSize, nil
+}
+
+// apply writes one change record of the primary to the local store.
+func (r *Replica) apply(primary string, record replicaRecord) error {
+	event := ChangeEvent{Op: record.Op, Model: record.Model, ID: record.ID, Time: record.Time, Origin: record.Origin, Reason: record.Reason}
+	if event.Origin == "" {
+		event.Origin = primary
+	}
+	if record.Op != OpDelete {
+		meta, ok := r.store.meta(record.Model)
+		if !ok {
+			return nil
+		}
+		item := reflect.New(meta.typ).Interface()
+		if err := json.Unmarshal(record.Item, item); err != nil {
+			return fmt.Errorf("replica: cannot decode %s %d: %w", record.Model, record.ID, err)
+		}
+		event.Item = item
+	}
+	r.store.notify(r.store.apply(event))
+	replicaStats.Add("records_applied", 1)
+	return nil
+}
+
+// bootstrap replaces the local items with a snapshot of the primary, only writing the items that
+// differ, and moves the cursor to the snapshot's sequence number.
+func (r *Replica) bootstrap(primary string) error {
+	var snapshot ReplicaSnapshot
+	if err := r.get(primary, "/_replica/snapshot", &snapshot); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for model, items := range snapshot.Collections {
+		meta, ok := r.store.meta(model)
+		if !ok {
+			continue
+		}
+		for _, snap := range items {
+			current := reflect.New(meta.typ).Interface()
+			exists := r.store.Get(model, snap.ID, current)
+			if exists {
+				if data, err := json.Marshal(current); err == nil && bytes.Equal(bytes.TrimSpace(snap.Item), data) {
+					continue
+				}
+			}
+			op := OpCreate
+			if exists {
+				op = OpUpdate
+			}
+			if err := r.apply(primary, replicaRecord{Op: op, Model: model, ID: snap.ID, Item: snap.Item, Time: now}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Drop the local items the primary no longer has
+	for _, c := range r.store.allCollections() {
+		keep := make(map[int]bool)
+		for _, snap := range snapshot.Collections[c.name] {
+			keep[snap.ID] = true
+		}
+		var stale []int
+		c.each(func(id int, item interface{}) error {
+			if !keep[id] {
+				stale = append(stale, id)
+			}
+			return nil
+		})
+		for _, id := range stale {
+			r.apply(primary, replicaRecord{Op: OpDelete, Model: c.name, ID: id, Time: now})
+		}
+	}
+
+	r.mux.Lock()
+	if r.status.Primary == primary {
+		r.status.Cursor, r.status.Latest, r.status.LastSync = snapshot.Seq, snapshot.Seq, now
+		r.synced = true
+	}
+	r.mux.Unlock()
+	return nil
+}
+
+// get fetches a JSON document from the primary.
+func (r *Replica) get(primary, path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, primary+path, nil)
+	if err != nil {
+		return err
+	}
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusGone:
+		return errReplicaGone
+	}
+	return fmt.Errorf("replica: %s%s answered %s", primary, path, resp.Status)
+}
+
+// Status returns the replication position of the replica.
+func (r *Replica) Status() ReplicaStatus {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	status := r.status
+	status.Ready = atomic.LoadInt32(&r.ready) == 1
+	return status
+}
+
+// Handler serves reads from the local store through next and proxies every other request to the
+// primary. Reads are refused until the first snapshot has been copied.
+func (r *Replica) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/_replica/status" {
+			writeJSON(w, http.StatusOK, r.Status())
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if atomic.LoadInt32(&r.ready) == 0 {
+				w.Header().Set("Retry-After", "1")
+				writeProblem(w, req, http.StatusServiceUnavailable, "Replica is copying the primary")
+				return
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		r.mux.Lock()
+		proxy := r.proxy
+		r.mux.Unlock()
+		if proxy == nil {
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, req, http.StatusServiceUnavailable, "No primary to forward the write to")
+			return
+		}
+
+		// Catch up before answering so the client reads its own write from this replica
+		response := newBufferedResponse()
+		proxy.ServeHTTP(response, req)
+		if response.status < http.StatusBadRequest {
+			if err := r.Sync(); err != nil {
+				log.Printf("replica: %v", err)
+				select {
+				case r.wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+		response.writeTo(w)
+	})
+}
+
+// handleReplicaSnapshot serves GET /_replica/snapshot, a copy of every item for replicas to start from.
+// The sequence number is read first, so replaying the change feed from it covers every change the
+// copy may have missed.
+func handleReplicaSnapshot(store *Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	snapshot := ReplicaSnapshot{Seq: store.LastSeq(), Collections: make(map[string][]ReplicaSnapshotItem)}
+	for _, c := range store.allCollections() {
+		items := []ReplicaSnapshotItem{}
+		err := c.each(func(id int, item interface{}) error {
+			data, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			items = append(items, ReplicaSnapshotItem{ID: id, Item: data})
+			return nil
+		})
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "Cannot encode snapshot")
+			return
+		}
+		snapshot.Collections[c.name] = items
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
@@ -0,0 +1,170 @@
+// File: response.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file contains the helpers used to write JSON responses. Responses are encoded
+// into pooled buffers with reused encoders, so serving large collections under load does not
+// allocate a new buffer (and the garbage that comes with growing it) for every request. Whole
+// collections are streamed element by element instead of being built up as a slice first.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// streamFlushSize is how much encoded output writeJSONArray buffers before writing it out.
+const streamFlushSize = 32 << 10
+
+// maxPooledBufferSize is the largest buffer kept in the pool; bigger ones are left to the GC so a
+// single huge response does not pin its memory forever.
+const maxPooledBufferSize = 8 << 20
+
+// jsonBuffer is a reusable buffer with an encoder writing into it.
+type jsonBuffer struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+// jsonBufferPool holds idle response buffers.
+var jsonBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := &jsonBuffer{}
+		b.enc = json.NewEncoder(&b.buf)
+		return b
+	},
+}
+
+// getJSONBuffer takes an empty buffer from the pool.
+func getJSONBuffer() *jsonBuffer {
+	b := jsonBufferPool.Get().(*jsonBuffer)
+	b.buf.Reset()
+	return b
+}
+
+// putJSONBuffer returns a buffer to the pool.
+func putJSONBuffer(b *jsonBuffer) {
+	if b.buf.Cap() <= maxPooledBufferSize {
+		jsonBufferPool.Put(b)
+	}
+}
+
+// encode appends v to the buffer followed by a newline, naming the fields of items by the JSON
+// naming convention.
+func (b *jsonBuffer) encode(v interface{}) error {
+	if jsonNaming == GoNames {
+		return b.enc.Encode(v)
+	}
+	data, err := marshalItem(v)
+	if err != nil {
+		return err
+	}
+	b.buf.Write(data)
+	b.buf.WriteByte('\n')
+	return nil
+}
+
+// writeJSON encodes v and writes it as the response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b := getJSONBuffer()
+	defer putJSONBuffer(b)
+
+	if masking(w) {
+		v = maskItem(v)
+	}
+	if err := b.encode(v); err != nil {
+		writeProblemDetails(w, newProblem(http.StatusInternalServerError, "Cannot encode response"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(b.buf.Len()))
+	w.WriteHeader(status)
+	w.Write(b.buf.Bytes())
+}
+
+// writeJSONArray streams a JSON array to the response, encoding the elements one at a time as each
+// emits them, so a large collection is never materialised in memory. Once the first bytes are sent
+// the status can no longer change; an error then simply truncates the response.
+func writeJSONArray(w http.ResponseWriter, status int, each func(emit func(item interface{}) error) error) {
+	b := getJSONBuffer()
+	defer putJSONBuffer(b)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	b.buf.WriteByte('[')
+	first := true
+	err := each(func(item interface{}) error {
+		if !first {
+			b.buf.WriteByte(',')
+		}
+		first = false
+		if masking(w) {
+			item = maskItem(item)
+		}
+		if err := b.encode(item); err != nil {
+			return err
+		}
+		b.buf.Truncate(b.buf.Len() - 1) // drop the encoder's trailing newline
+		if b.buf.Len() >= streamFlushSize {
+			if _, err := w.Write(b.buf.Bytes()); err != nil {
+				return err
+			}
+			b.buf.Reset()
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	b.buf.WriteString("]\n")
+	w.Write(b.buf.Bytes())
+}
+
+// bufferedResponse is an http.ResponseWriter recording a response in memory so it can be replayed
+// to the client later (or discarded).
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// newBufferedResponse creates an empty recorded response.
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+// Header returns the recorded headers.
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+// WriteHeader records the status code; only the first call counts.
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// Write records part of the body.
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// writeTo sends the recorded response to w.
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
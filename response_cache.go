@@ -0,0 +1,150 @@
+// File: response_cache.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements an in-process cache of GET responses, meant to absorb bursts of
+// identical list queries. Successful responses are kept for a TTL, keyed by model (which includes the
+// tenant), method, path, query and the caller's credentials, so clients never see each other's
+// responses. Every change to a model, local or replicated, invalidates its cached responses.
+// Conditional requests bypass the cache since they are cheap to answer anyway. Hits and misses are
+// published through expvar.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// responseCacheStats counts the hits and misses of the response cache.
+var responseCacheStats = expvar.NewMap("response_cache")
+
+// responseEntry is a cached response.
+type responseEntry struct {
+	key      string
+	gen      uint64 // generation of the model when the response was produced
+	expires  time.Time
+	response *bufferedResponse
+}
+
+// ResponseCache holds recent GET responses of the model routes.
+type ResponseCache struct {
+	// TTL is how long a response is served from the cache.
+	TTL time.Duration
+	// MaxEntries bounds the cache; the least recently used responses are evicted first.
+	MaxEntries int
+
+	order   *list.List // front is the least recently used
+	entries map[string]*list.Element
+	gens    map[string]uint64 // bumped on every change to a model
+	mux     sync.Mutex
+}
+
+// NewResponseCache creates a cache keeping up to maxEntries responses for ttl.
+func NewResponseCache(ttl time.Duration, maxEntries int) *ResponseCache {
+	return &ResponseCache{
+		TTL:        ttl,
+		MaxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		gens:       make(map[string]uint64),
+	}
+}
+
+// SetResponseCache makes the store's model routes answer GETs from the cache, which the store's
+// changes invalidate. It must be called before the store is used concurrently.
+func (s *Store) SetResponseCache(cache *ResponseCache) {
+	s.responses = cache
+	s.Subscribe(func(event ChangeEvent) {
+		cache.invalidate(event.Model)
+	})
+}
+
+// invalidate drops the cached responses of a model.
+func (c *ResponseCache) invalidate(model string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	// Entries of older generations are never served again and age out of the LRU order
+	c.gens[model]++
+}
+
+// requestIdentity returns a digest of the caller's credentials, or "" for anonymous requests.
+func requestIdentity(r *http.Request) string {
+	credentials := r.Header.Get("Authorization")
+	if credentials == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(credentials))
+	return hex.EncodeToString(sum[:])
+}
+
+// responseKey returns the cache key of a request to a model.
+func responseKey(model string, r *http.Request) string {
+	return model + "\x00" + r.Method + "\x00" + subpath(r) + "?" + r.URL.Query().Encode() + "\x00" + requestIdentity(r)
+}
+
+// serve answers a request from the cache, or calls next and caches its response when successful.
+func (c *ResponseCache) serve(model string, w http.ResponseWriter, r *http.Request, next func(w http.ResponseWriter, r *http.Request)) {
+	// Sub-resources and included items depend on other models; nested routes are cached as
+	// requests on theirs
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || subpath(r) != "" || r.URL.Query().Get("include") != "" ||
+		r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		next(w, r)
+		return
+	}
+	key := responseKey(model, r)
+
+	c.mux.Lock()
+	gen := c.gens[model]
+	if element, ok := c.entries[key]; ok {
+		e := element.Value.(*responseEntry)
+		if e.gen == gen && time.Now().Before(e.expires) {
+			c.order.MoveToBack(element)
+			c.mux.Unlock()
+			responseCacheStats.Add("hits", 1)
+			e.response.writeTo(w)
+			return
+		}
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+	c.mux.Unlock()
+	responseCacheStats.Add("misses", 1)
+
+	response := newBufferedResponse()
+	next(response, r)
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+
+	if response.status == http.StatusOK && c.MaxEntries > 0 {
+		c.mux.Lock()
+		// A change made while the response was produced may not be in it
+		if c.gens[model] == gen {
+			c.add(&responseEntry{key: key, gen: gen, expires: time.Now().Add(c.TTL), response: response})
+		}
+		c.mux.Unlock()
+	}
+	response.writeTo(w)
+}
+
+// add caches a response, evicting the least recently used ones over the limit. It must be called
+// while holding the lock.
+func (c *ResponseCache) add(e *responseEntry) {
+	if element, ok := c.entries[e.key]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[e.key] = c.order.PushBack(e)
+	for c.order.Len() > c.MaxEntries {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*responseEntry).key)
+	}
+}
@@ -0,0 +1,243 @@
+// File: retention.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements data retention policies. Each policy deletes (or archives, then
+// deletes) the items of a model older than a maximum age, based on the model's CreatedAt field or
+// the time the store created the item. A policy of a model applies to its collection in the default
+// namespace and in every tenant; the policies of immutable models fail without purging anything.
+// Policies run on a schedule inside the server, support a dry-run mode that only reports what
+// would be purged, and publish their counts through expvar.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retention actions.
+const (
+	RetentionDelete  = "delete"
+	RetentionArchive = "archive"
+)
+
+// Retention metrics, keyed by model name.
+var (
+	retentionPurged   = expvar.NewMap("retention_purged")
+	retentionArchived = expvar.NewMap("retention_archived")
+	retentionMatched  = expvar.NewMap("retention_dry_run_matched")
+)
+
+// RetentionPolicy removes the items of a model once they are older than MaxAge.
+type RetentionPolicy struct {
+	Model  string
+	MaxAge time.Duration
+	Action string
+	DryRun bool
+}
+
+// RetentionResult reports the outcome of running one policy.
+type RetentionResult struct {
+	Model   string `json:"model"`
+	Matched int    `json:"matched"`
+	Purged  int    `json:"purged"`
+	DryRun  bool   `json:"dry_run"`
+}
+
+// RetentionJob runs a set of retention policies against a store.
+type RetentionJob struct {
+	store    *Store
+	policies []RetentionPolicy
+
+	// Archive receives archived items as JSON lines before they are deleted.
+	Archive    io.Writer
+	archiveMux sync.Mutex
+}
+
+// NewRetentionJob creates a job applying the given policies to the store.
+func NewRetentionJob(store *Store, policies ...RetentionPolicy) *RetentionJob {
+	return &RetentionJob{store: store, policies: policies}
+}
+
+// Run applies every policy once.
+func (j *RetentionJob) Run() []RetentionResult {
+	results := make([]RetentionResult, 0, len(j.policies))
+	for _, policy := range j.policies {
+		result, err := j.runPolicy(policy)
+		if err != nil {
+			log.Printf("retention: %s: %v", policy.Model, err)
+		}
+		if result.Matched > 0 {
+			log.Printf("retention: %s: matched %d, purged %d (dry run: %t)", result.Model, result.Matched, result.Purged, result.DryRun)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Start runs the job every interval in the background until the returned stop function is called.
+func (j *RetentionJob) Start(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				j.Run()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// runPolicy purges the items matched by a single policy, in the default namespace and in every
+// tenant.
+func (j *RetentionJob) runPolicy(policy RetentionPolicy) (RetentionResult, error) {
+	result := RetentionResult{Model: policy.Model, DryRun: policy.DryRun}
+	cutoff := time.Now().Add(-policy.MaxAge)
+	for _, name := range j.store.namespacedCollections(policy.Model) {
+		if err := j.store.checkMutable(name); err != nil {
+			return result, err
+		}
+		candidates := j.store.createdBefore(name, cutoff)
+		result.Matched += len(candidates)
+		if policy.DryRun {
+			retentionMatched.Add(policy.Model, int64(len(candidates)))
+			continue
+		}
+
+		if policy.Action == RetentionArchive {
+			if err := j.archive(name, candidates); err != nil {
+				return result, err
+			}
+			retentionArchived.Add(policy.Model, int64(len(candidates)))
+		}
+
+		purged := j.store.removeIfUnchanged(name, candidates, "retention")
+		result.Purged += purged
+		retentionPurged.Add(policy.Model, int64(purged))
+	}
+	return result, nil
+}
+
+// archive writes the candidates to the archive writer as JSON lines.
+func (j *RetentionJob) archive(model string, items map[int]interface{}) error {
+	if j.Archive == nil {
+		return fmt.Errorf("archive action requires an archive writer")
+	}
+
+	j.archiveMux.Lock()
+	defer j.archiveMux.Unlock()
+
+	encoder := json.NewEncoder(j.Archive)
+	for id, item := range items {
+		sealed, err := sealFields(model, id, item)
+		if err != nil {
+			return err
+		}
+		record := map[string]interface{}{"model": model, "id": id, "archived_at": time.Now(), "item": sealed}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createdBefore returns the items of a model created before cutoff, using the model's CreatedAt
+// field when it has one and the store's creation time otherwise.
+func (s *Store) createdBefore(model string, cutoff time.Time) map[int]interface{} {
+	items := make(map[int]interface{})
+	c, ok := s.collection(model)
+	if !ok {
+		return items
+	}
+	for _, sh := range c.shards {
+		sh.snapshot().ascend(func(id int, e entry) bool {
+			created := e.created
+			if c.meta.createdAt != nil {
+				if t := c.meta.createdAt.value(e.item).Interface().(time.Time); !t.IsZero() {
+					created = t
+				}
+			}
+			if !created.IsZero() && created.Before(cutoff) {
+				items[id] = e.item
+			}
+			return true
+		})
+	}
+	return items
+}
+
+// removeIfUnchanged deletes the given items unless they were replaced since they were read,
+// and returns how many were deleted.
+func (s *Store) removeIfUnchanged(model string, items map[int]interface{}, reason string) int {
+	c, ok := s.collection(model)
+	if !ok {
+		return 0
+	}
+	// Group the items by shard so each shard is locked and published only once
+	byShard := make(map[*storeShard][]int)
+	for id := range items {
+		sh := c.shard(id)
+		byShard[sh] = append(byShard[sh], id)
+	}
+
+	var events []ChangeEvent
+	for sh, ids := range byShard {
+		sh.itemMux.Lock()
+		edited := sh.edit()
+		for _, id := range ids {
+			if current, ok := edited.get(id); ok && current.item == items[id] {
+				events = append(events, s.removeLocked(context.Background(), c, edited, id, items[id], reason))
+			}
+		}
+		sh.publish(edited)
+		sh.itemMux.Unlock()
+	}
+
+	for _, event := range events {
+		s.notify(event)
+	}
+	return len(events)
+}
+
+// ParseRetentionPolicies parses a comma-separated list of "model=maxAge[:action]" rules,
+// e.g. "item=90d,session=24h:archive". Ages are Go durations, or whole days (d) or weeks (w).
+func ParseRetentionPolicies(spec string, dryRun bool) ([]RetentionPolicy, error) {
+	var policies []RetentionPolicy
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		model, rest, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention rule %q", rule)
+		}
+		age, action, _ := strings.Cut(rest, ":")
+		maxAge, err := parseInterval(age)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention age in %q", rule)
+		}
+		if action == "" {
+			action = RetentionDelete
+		}
+		if action != RetentionDelete && action != RetentionArchive {
+			return nil, fmt.Errorf("invalid retention action in %q", rule)
+		}
+		policies = append(policies, RetentionPolicy{Model: model, MaxAge: maxAge, Action: action, DryRun: dryRun})
+	}
+	return policies, nil
+}
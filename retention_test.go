@@ -0,0 +1,79 @@
+// File: retention_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the parsing of retention rules, that the policies of a model purge
+// its items in every tenant, and that neither retention nor expiry removes the items of immutable
+// models.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicies(t *testing.T) {
+	policies, err := ParseRetentionPolicies("item=90d, session=2w:archive,log=36h,tmp=1h30m:delete", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RetentionPolicy{
+		{Model: "item", MaxAge: 90 * 24 * time.Hour, Action: RetentionDelete, DryRun: true},
+		{Model: "session", MaxAge: 14 * 24 * time.Hour, Action: RetentionArchive, DryRun: true},
+		{Model: "log", MaxAge: 36 * time.Hour, Action: RetentionDelete, DryRun: true},
+		{Model: "tmp", MaxAge: 90 * time.Minute, Action: RetentionDelete, DryRun: true},
+	}
+	if !reflect.DeepEqual(policies, want) {
+		t.Fatalf("policies:\n%+v\nwant:\n%+v", policies, want)
+	}
+
+	for _, spec := range []string{"item", "item=", "item=d", "item=0d", "item=-3d", "item=5y", "item=1.5d", "item=0", "item=1d:drop", "item=106752d", "item=15251w", "item=9223372036854775807d"} {
+		if _, err := ParseRetentionPolicies(spec, false); err == nil {
+			t.Errorf("rule %q accepted", spec)
+		}
+	}
+}
+
+func TestRetentionPurgesEveryTenant(t *testing.T) {
+	store := newTestStore()
+	store.Create("item", &Item{Title: "default"})
+	store.Create("acme/item", &Item{Title: "acme"})
+	store.Create("acme/tag", &Tag{Name: "kept"})
+	time.Sleep(time.Millisecond)
+
+	results := NewRetentionJob(store, RetentionPolicy{Model: "item", MaxAge: time.Nanosecond, Action: RetentionDelete}).Run()
+	if len(results) != 1 || results[0].Matched != 2 || results[0].Purged != 2 {
+		t.Fatalf("results are %+v, want the items of both namespaces purged", results)
+	}
+	if store.exists("item", 1) || store.exists("acme/item", 1) || !store.exists("acme/tag", 1) {
+		t.Error("retention left an item of the model or purged another model")
+	}
+}
+
+func TestImmutableItemsOutliveRetentionAndExpiry(t *testing.T) {
+	store := newTestStore()
+	store.Register("entry", Entry{})
+	if err := store.SetImmutable("entry", ImmutableReject); err != nil {
+		t.Fatal(err)
+	}
+	store.Create("entry", &Entry{Account: "cash", Amount: 100})
+	time.Sleep(time.Millisecond)
+
+	results := NewRetentionJob(store, RetentionPolicy{Model: "entry", MaxAge: time.Nanosecond, Action: RetentionDelete}).Run()
+	if len(results) != 1 || results[0].Purged != 0 || !store.exists("entry", 1) {
+		t.Errorf("retention of an immutable model: %+v", results)
+	}
+	if item := store.CreateWithTTL("entry", &Entry{Account: "cash", Amount: 5}, time.Nanosecond); item != nil || store.exists("entry", 2) {
+		t.Error("immutable entry created with a TTL")
+	}
+	if err := store.SetCapacity("entry", Capacity{MaxItems: 1}); err == nil {
+		t.Error("capacity limit accepted for an immutable model")
+	}
+	store.SetCapacity("tag", Capacity{MaxItems: 1})
+	if err := store.SetImmutable("tag", ImmutableReject); err == nil {
+		t.Error("model with a capacity limit made immutable")
+	}
+}
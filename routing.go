@@ -0,0 +1,74 @@
+// File: routing.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file answers the requests that match no route and those whose method the
+// route they match does not serve. By default they are answered with 404 and 405 problem details;
+// applications plug their own handlers (to serve an HTML page, log probes, ...) with
+// SetNotFoundHandler and SetMethodNotAllowedHandler. 405 responses carry an Allow header listing
+// the methods of the route, which OPTIONS requests to the model routes also answer with.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// modelMethods are the methods served by the routes of the models.
+var modelMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+	http.MethodOptions,
+}
+
+// routeHandlers are the handlers registered for unmatched routes and methods.
+var routeHandlers struct {
+	sync.RWMutex
+	notFound         http.Handler
+	methodNotAllowed http.Handler
+}
+
+// SetNotFoundHandler sets the handler of the requests matching no route, replacing the default
+// 404 problem response. A nil handler restores the default.
+func SetNotFoundHandler(handler http.Handler) {
+	routeHandlers.Lock()
+	defer routeHandlers.Unlock()
+	routeHandlers.notFound = handler
+}
+
+// SetMethodNotAllowedHandler sets the handler of the requests whose method their route does not
+// serve, replacing the default 405 problem response. The Allow header is set when it runs. A nil
+// handler restores the default.
+func SetMethodNotAllowedHandler(handler http.Handler) {
+	routeHandlers.Lock()
+	defer routeHandlers.Unlock()
+	routeHandlers.methodNotAllowed = handler
+}
+
+// notFound answers a request matching no route.
+func notFound(w http.ResponseWriter, r *http.Request, detail string) {
+	routeHandlers.RLock()
+	handler := routeHandlers.notFound
+	routeHandlers.RUnlock()
+	if handler != nil {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	writeProblem(w, r, http.StatusNotFound, detail)
+}
+
+// methodNotAllowed answers a request whose method its route does not serve, listing the allowed
+// methods in the Allow header.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	routeHandlers.RLock()
+	handler := routeHandlers.methodNotAllowed
+	routeHandlers.RUnlock()
+	if handler != nil {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	writeProblem(w, r, http.StatusMethodNotAllowed, "Unsupported method")
+}
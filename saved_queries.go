@@ -0,0 +1,463 @@
+// File: saved_queries.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements saved queries, named query definitions kept on the server so
+// complex client queries are written once and reused. A saved query names a model, the filters of
+// a collection GET, a sort order and the fields returned. POST /_views saves one, GET /_views/{name}
+// returns it, DELETE /_views/{name} removes it and GET /_views/{name}/run?offset=&limit= answers a
+// page of its results. Saved queries belong to the namespace of the X-Tenant-ID tenant they are
+// saved in and run on its collections only. They share /_views with the materialized aggregate
+// views of the default namespace (see views.go) and are persisted to the file of the -views-file
+// flag when one is given.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// validQueryName matches the names of saved queries.
+var validQueryName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// SavedQuery is a named query definition.
+type SavedQuery struct {
+	Name    string            `json:"name"`
+	Tenant  string            `json:"tenant,omitempty"`  // namespace of the query, the default one when empty
+	Model   string            `json:"model"`             // base model, resolved in the namespace of the query
+	Filters map[string]string `json:"filters,omitempty"` // query parameters of a collection GET, e.g. {"done": "false", "amount_gte": "10"}
+	Sort    string            `json:"sort,omitempty"`    // as ?sort=, e.g. "title,-id"
+	Fields  []string          `json:"fields,omitempty"`  // JSON names of the fields returned besides the ID, all when empty
+	Limit   int               `json:"limit,omitempty"`   // page size of the runs naming none, no limit when 0
+	Created time.Time         `json:"created"`
+}
+
+// SavedQueries is a registry of saved queries on a store.
+type SavedQueries struct {
+	store   *Store
+	path    string                 // file the queries are persisted to, none when empty
+	queries map[string]*SavedQuery // by name inside the namespace of their tenant (see tenantModel)
+	mux     sync.RWMutex
+}
+
+// OpenSavedQueries creates a registry of saved queries on a store, loading the queries persisted
+// to path. Queries are kept in memory only when path is empty.
+func OpenSavedQueries(store *Store, path string) (*SavedQueries, error) {
+	q := &SavedQueries{store: store, path: path, queries: make(map[string]*SavedQuery)}
+	if path == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var queries []*SavedQuery
+	if err := json.Unmarshal(data, &queries); err != nil {
+		return nil, fmt.Errorf("saved queries %s: %w", path, err)
+	}
+	for _, query := range queries {
+		q.queries[tenantModel(query.Tenant, query.Name)] = query
+	}
+	return q, nil
+}
+
+// Save validates and saves a query, replacing the query of the same name.
+func (q *SavedQueries) Save(query SavedQuery) error {
+	if !validQueryName.MatchString(query.Name) {
+		return &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("invalid name %q", query.Name)}
+	}
+	if query.Tenant != "" && !validTenant(query.Tenant) {
+		return &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("invalid tenant %q", query.Tenant)}
+	}
+	if _, _, err := q.compile(&query); err != nil {
+		return err
+	}
+	if query.Created.IsZero() {
+		query.Created = time.Now().UTC()
+	}
+
+	key := tenantModel(query.Tenant, query.Name)
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	previous, existed := q.queries[key]
+	q.queries[key] = &query
+	if err := q.persist(); err != nil {
+		if existed {
+			q.queries[key] = previous
+		} else {
+			delete(q.queries, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the saved query of a name in the namespace of a tenant, reporting whether it
+// existed.
+func (q *SavedQueries) Delete(tenant, name string) (bool, error) {
+	key := tenantModel(tenant, name)
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	query, ok := q.queries[key]
+	if !ok {
+		return false, nil
+	}
+	delete(q.queries, key)
+	if err := q.persist(); err != nil {
+		q.queries[key] = query
+		return false, err
+	}
+	return true, nil
+}
+
+// Get returns the saved query of a name in the namespace of a tenant.
+func (q *SavedQueries) Get(tenant, name string) (SavedQuery, bool) {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	query, ok := q.queries[tenantModel(tenant, name)]
+	if !ok {
+		return SavedQuery{}, false
+	}
+	return *query, true
+}
+
+// List returns the saved queries of the namespace of a tenant in alphabetical order of name.
+func (q *SavedQueries) List(tenant string) []SavedQuery {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+	queries := make([]SavedQuery, 0, len(q.queries))
+	for _, query := range q.queries {
+		if query.Tenant == tenant {
+			queries = append(queries, *query)
+		}
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i].Name < queries[j].Name })
+	return queries
+}
+
+// persist writes the saved queries to the file of the registry, replacing it atomically. It must
+// be called while holding the lock.
+func (q *SavedQueries) persist() error {
+	if q.path == "" {
+		return nil
+	}
+	queries := make([]*SavedQuery, 0, len(q.queries))
+	for _, query := range q.queries {
+		queries = append(queries, query)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		return tenantModel(queries[i].Tenant, queries[i].Name) < tenantModel(queries[j].Tenant, queries[j].Name)
+	})
+	data, err := json.MarshalIndent(queries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(q.path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(q.path+".tmp", q.path)
+}
+
+// modelMeta resolves the model of a query in the namespace of its tenant. Queries name base
+// models: a tenant-scoped name would reach another tenant's namespace.
+func (q *SavedQueries) modelMeta(query *SavedQuery) (*modelMeta, error) {
+	if strings.Contains(query.Model, "/") || !q.store.registered(query.Model) {
+		return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("model %s is not registered", query.Model)}
+	}
+	meta, ok := q.store.meta(tenantModel(query.Tenant, query.Model))
+	if !ok {
+		return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("model %s is not registered", query.Model)}
+	}
+	return meta, nil
+}
+
+// compile resolves the filters and the sort order of a query against its model.
+func (q *SavedQueries) compile(query *SavedQuery) ([]Filter, []*fieldMeta, error) {
+	meta, err := q.modelMeta(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make(url.Values, len(query.Filters))
+	for param, value := range query.Filters {
+		name := strings.TrimSuffix(strings.TrimSuffix(param, "_gte"), "_lte")
+		if f, ok := meta.jsonField(name); !ok || f == meta.id {
+			return nil, nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", name)}
+		}
+		values.Set(param, value)
+	}
+	filters, err := parseFilters(meta, values)
+	if err != nil {
+		return nil, nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: err}
+	}
+	order, err := sortFields(meta, ParseSort(query.Sort))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range query.Fields {
+		if f, ok := meta.jsonField(name); !ok || f.jsonName == "-" {
+			return nil, nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", name)}
+		}
+	}
+	return filters, order, nil
+}
+
+// Run answers a page of the results of the saved query of a name in the namespace of a tenant,
+// encoded with the fields of the query only, and the number of items matching it. The page limit
+// defaults to the limit of the query.
+func (q *SavedQueries) Run(tenant, name string, page Page) ([]json.RawMessage, int, error) {
+	return q.run(nil, tenant, name, page)
+}
+
+// run answers a page of the results of a saved query, with the fields masked for the caller of w
+// when it is not nil.
+func (q *SavedQueries) run(w http.ResponseWriter, tenant, name string, page Page) ([]json.RawMessage, int, error) {
+	query, ok := q.Get(tenant, name)
+	if !ok {
+		return nil, 0, &Error{Status: http.StatusNotFound, Code: CodeNotFound, Err: localizef("saved query %s not found", name)}
+	}
+	filters, order, err := q.compile(&query)
+	if err != nil {
+		return nil, 0, err
+	}
+	meta, _ := q.modelMeta(&query)
+	found, err := q.store.matching(tenantModel(query.Tenant, query.Model), filters)
+	if err != nil {
+		return nil, 0, err
+	}
+	sortMatches(found, order, ParseSort(query.Sort), q.store.collation())
+
+	if page.Limit == 0 {
+		page.Limit = query.Limit
+	}
+	start, end := page.bounds(len(found))
+	selected := make([]interface{}, 0, end-start)
+	for _, m := range found[start:end] {
+		selected = append(selected, m.item)
+	}
+	encoded, err := q.store.expandFor(w, meta, selected, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(query.Fields) > 0 {
+		for i := range encoded {
+			if encoded[i], err = projectFields(encoded[i], meta, query.Fields); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	return encoded, len(found), nil
+}
+
+// projectFields keeps the ID, for models with one, and the named fields of an encoded item, in
+// that order.
+func projectFields(data json.RawMessage, meta *modelMeta, names []string) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	var keys []string
+	if meta.id != nil {
+		keys = append(keys, meta.id.jsonName)
+	}
+	for _, name := range names {
+		if f, ok := meta.jsonField(name); ok && f != meta.id {
+			keys = append(keys, f.jsonName)
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, key := range keys {
+		value, ok := fields[key]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// refuseMaskedQuery answers 403 when a saved query filters or sorts by fields masked for the
+// caller, as running it would reveal their values.
+func (q *SavedQueries) refuseMaskedQuery(w http.ResponseWriter, r *http.Request, tenant, name string) bool {
+	query, ok := q.Get(tenant, name)
+	if !ok {
+		return false
+	}
+	meta, err := q.modelMeta(&query)
+	if err != nil {
+		return false
+	}
+	var fields []*fieldMeta
+	for param := range query.Filters {
+		if f, ok := meta.jsonField(strings.TrimSuffix(strings.TrimSuffix(param, "_gte"), "_lte")); ok {
+			fields = append(fields, f)
+		}
+	}
+	for _, o := range ParseSort(query.Sort) {
+		if f, ok := meta.field(o.Field); ok {
+			fields = append(fields, f)
+		}
+	}
+	return refuseMasked(w, r, meta, fields)
+}
+
+// handleViews serves /_views: the saved queries of the namespace of the X-Tenant-ID tenant
+// alongside the materialized views, which are read-only and only served in the default namespace.
+// GET /_views lists the names of both, POST /_views saves a query, GET /_views/{name} returns a
+// saved query or the state of a view, PUT /_views/{name} replaces a saved query,
+// DELETE /_views/{name} removes it and GET /_views/{name}/run?offset=&limit= runs it.
+func handleViews(views *Projections, saved *SavedQueries, w http.ResponseWriter, r *http.Request) {
+	tenant := r.Header.Get(TenantHeader)
+	if tenant != "" && !validTenant(tenant) {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid tenant")
+		return
+	}
+	if tenant != "" {
+		views = NewProjections() // the materialized views aggregate the default namespace
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_views"), "/")
+	name, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+	if _, ok := views.Get(name); ok && action == "" {
+		handleProjection(views, "/_views", w, r)
+		return
+	}
+
+	switch {
+	case name == "":
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			names := views.Names()
+			for _, query := range saved.List(tenant) {
+				names = append(names, query.Name)
+			}
+			sort.Strings(names)
+			writeJSON(w, http.StatusOK, names)
+		case http.MethodPost:
+			saveQuery(views, saved, tenant, "", w, r)
+		default:
+			methodNotAllowed(w, r, http.MethodGet, http.MethodHead, http.MethodPost)
+		}
+
+	case action == "run":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+			return
+		}
+		page, err := parsePage(r.URL.Query())
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if saved.refuseMaskedQuery(w, r, tenant, name) {
+			return
+		}
+		results, total, err := saved.run(w, tenant, name, page)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		setTotalCount(w, r, total)
+		writeJSON(w, http.StatusOK, results)
+
+	case action != "":
+		notFound(w, r, "Not found")
+
+	default:
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			query, ok := saved.Get(tenant, name)
+			if !ok {
+				writeProblem(w, r, http.StatusNotFound, "View not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, query)
+		case http.MethodPut:
+			saveQuery(views, saved, tenant, name, w, r)
+		case http.MethodDelete:
+			deleted, err := saved.Delete(tenant, name)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if !deleted {
+				writeProblem(w, r, http.StatusNotFound, "View not found")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, r, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+		}
+	}
+}
+
+// saveQuery saves the query of a request body in the namespace of a tenant: a new one for
+// POST /_views (name empty), answering 201 or 409 when the name is taken, or the query of the path
+// for PUT /_views/{name}.
+func saveQuery(views *Projections, saved *SavedQueries, tenant, name string, w http.ResponseWriter, r *http.Request) {
+	var query SavedQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if query.Tenant != "" && query.Tenant != tenant {
+		writeProblem(w, r, http.StatusBadRequest, "The tenant of the payload differs from the request")
+		return
+	}
+	query.Tenant = tenant
+	status := http.StatusOK
+	if name == "" {
+		if _, ok := saved.Get(tenant, query.Name); ok {
+			writeProblem(w, r, http.StatusConflict, fmt.Sprintf("View %s already exists", query.Name))
+			return
+		}
+		query.Created, status = time.Time{}, http.StatusCreated
+	} else {
+		if query.Name != "" && query.Name != name {
+			writeProblem(w, r, http.StatusBadRequest, "The name of the payload differs from the path")
+			return
+		}
+		query.Name = name
+		if previous, ok := saved.Get(tenant, name); ok {
+			query.Created = previous.Created
+		} else {
+			status = http.StatusCreated
+		}
+	}
+	if _, ok := views.Get(query.Name); ok {
+		writeProblem(w, r, http.StatusConflict, fmt.Sprintf("View %s already exists", query.Name))
+		return
+	}
+	if err := saved.Save(query); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	query, _ = saved.Get(tenant, query.Name)
+	if status == http.StatusCreated {
+		w.Header().Set("Location", "/_views/"+query.Name)
+	}
+	writeJSON(w, status, query)
+}
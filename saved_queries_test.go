@@ -0,0 +1,102 @@
+// File: saved_queries_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the saved queries of /_views: their validation, their runs with
+// filters, sort order, projection and paging, and models without an ID field.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func viewsHandler(saved *SavedQueries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) { handleViews(NewProjections(), saved, w, r) }
+}
+
+func TestSavedQueryRun(t *testing.T) {
+	store := newTestStore()
+	for _, title := range []string{"cherry", "apple", "banana", "done"} {
+		store.Create("item", &Item{Title: title, Done: title == "done"})
+	}
+	saved, _ := OpenSavedQueries(store, "")
+	handler := viewsHandler(saved)
+
+	w := serveTest(handler, http.MethodPost, "/_views",
+		`{"name":"open","model":"item","filters":{"done":"false"},"sort":"title","fields":["title"],"limit":2}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("save: status %d, want 201: %s", w.Code, w.Body)
+	}
+	w = serveTest(handler, http.MethodGet, "/_views/open/run", "")
+	if got, want := w.Body.String(), `[{"id":2,"title":"apple"},{"id":3,"title":"banana"}]`+"\n"; got != want {
+		t.Fatalf("run: got %s, want %s", got, want)
+	}
+	w = serveTest(handler, http.MethodGet, "/_views/open/run?offset=2&limit=5", "")
+	if got, want := w.Body.String(), `[{"id":1,"title":"cherry"}]`+"\n"; got != want {
+		t.Fatalf("run of the last page: got %s, want %s", got, want)
+	}
+}
+
+func TestSavedQueryValidation(t *testing.T) {
+	saved, _ := OpenSavedQueries(newTestStore(), "")
+	handler := viewsHandler(saved)
+	for _, body := range []string{
+		`{"name":"x","model":"nope"}`,
+		`{"name":"x","model":"item","filters":{"nope":"1"}}`,
+		`{"name":"x","model":"item","filters":{"done":"maybe"}}`,
+		`{"name":"x","model":"item","sort":"nope"}`,
+		`{"name":"x","model":"item","fields":["nope"]}`,
+		`{"name":"bad name","model":"item"}`,
+	} {
+		if w := serveTest(handler, http.MethodPost, "/_views", body); w.Code != http.StatusBadRequest {
+			t.Errorf("save %s: status %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestSavedQueryOfModelWithoutID(t *testing.T) {
+	store := newTestStore()
+	store.Create("orderline", &OrderLine{OrderID: 1, LineNo: 1, Product: "tea", Quantity: 2})
+	saved, _ := OpenSavedQueries(store, "")
+	handler := viewsHandler(saved)
+
+	if w := serveTest(handler, http.MethodPost, "/_views", `{"name":"ol","model":"orderline","fields":["product"]}`); w.Code != http.StatusCreated {
+		t.Fatalf("save: status %d, want 201: %s", w.Code, w.Body)
+	}
+	w := serveTest(handler, http.MethodGet, "/_views/ol/run", "")
+	if got, want := w.Body.String(), `[{"product":"tea"}]`+"\n"; w.Code != http.StatusOK || got != want {
+		t.Fatalf("run: status %d, got %s, want %s", w.Code, got, want)
+	}
+}
+
+func TestSavedQueriesStayInTheTenantNamespace(t *testing.T) {
+	store := newTestStore()
+	store.Create("victim/item", &Item{Title: "theirs"})
+	store.Create("acme/item", &Item{Title: "ours"})
+	saved, _ := OpenSavedQueries(store, "")
+	handler := viewsHandler(saved)
+
+	for _, body := range []string{`{"name":"spy","model":"victim/item"}`, `{"name":"spy","model":"item","tenant":"victim"}`} {
+		if w := serveTest(handler, http.MethodPost, "/_views", body, TenantHeader, "acme"); w.Code != http.StatusBadRequest {
+			t.Errorf("save %s: status %d, want 400", body, w.Code)
+		}
+	}
+	if w := serveTest(handler, http.MethodPost, "/_views", `{"name":"all","model":"item"}`, TenantHeader, "acme"); w.Code != http.StatusCreated {
+		t.Fatalf("save: status %d, want 201: %s", w.Code, w.Body)
+	}
+	w := serveTest(handler, http.MethodGet, "/_views/all/run", "", TenantHeader, "acme")
+	if got, want := w.Body.String(), `[{"id":1,"title":"ours","done":false}]`+"\n"; got != want {
+		t.Fatalf("run in the tenant: got %s, want %s", got, want)
+	}
+	for _, tenant := range []string{"", "victim"} {
+		if w := serveTest(handler, http.MethodGet, "/_views/all/run", "", TenantHeader, tenant); w.Code != http.StatusNotFound {
+			t.Errorf("run from tenant %q: status %d, want 404", tenant, w.Code)
+		}
+	}
+	if w := serveTest(handler, http.MethodGet, "/_views", "", TenantHeader, "victim"); w.Body.String() != "[]\n" {
+		t.Errorf("list of another tenant: got %s, want []", w.Body)
+	}
+}
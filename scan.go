@@ -0,0 +1,59 @@
+// File: scan.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements scans of large collections. Store.Scan walks the items of a
+// model one shard at a time, reading each shard from its snapshot, so jobs going over every item
+// (hooks, exporters, retention) neither copy the whole collection nor block writers, and can stop
+// as soon as they found what they need.
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Scan calls fn for every live item of a model, in no particular order, until fn returns false.
+// Each shard is read from its snapshot when the scan reaches it, so items written during the scan
+// may or may not be seen. The items are the stored ones and must not be modified. Scan reports
+// whether every item was visited.
+func (s *Store) Scan(model string, fn func(id int, item interface{}) bool) bool {
+	c, ok := s.collection(model)
+	if !ok {
+		return true
+	}
+	return c.scan(func(id int, e entry) bool {
+		return fn(id, e.item)
+	})
+}
+
+// ScanContext walks the items of a model like Scan, stopping with the error of ctx once it is done.
+func (s *Store) ScanContext(ctx context.Context, model string, fn func(id int, item interface{}) bool) error {
+	var err error
+	s.Scan(model, func(id int, item interface{}) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		return fn(id, item)
+	})
+	return err
+}
+
+// scan calls fn for every live entry of the collection, shard by shard, until fn returns false. It
+// reports whether every entry was visited.
+func (c *collection) scan(fn func(id int, e entry) bool) bool {
+	complete := true
+	for _, sh := range c.shards {
+		now := time.Now()
+		sh.snapshot().ascend(func(id int, e entry) bool {
+			complete = e.expired(now) || fn(id, e)
+			return complete
+		})
+		if !complete {
+			return false
+		}
+	}
+	return true
+}
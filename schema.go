@@ -0,0 +1,176 @@
+// File: schema.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements model introspection at GET /{model}/_schema, which describes
+// the fields of a model (JSON names, JSON types, struct tags, and whether they are read-only,
+// unique, indexed or restricted to an enum), its ID, key and lookup fields and its relations, so
+// admin frontends can generate forms for any model. A field is read-only when it is the ID or is
+// tagged `crud:"readonly"`, and enumerated with an `enum:"a|b|c"` tag.
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ModelSchema describes a model.
+type ModelSchema struct {
+	Model     string           `json:"model"`
+	Type      string           `json:"type"`
+	ID        string           `json:"id,omitempty"`
+	Key       []string         `json:"key,omitempty"`
+	Lookups   []string         `json:"lookups,omitempty"`
+	Fields    []FieldSchema    `json:"fields"`
+	Relations []RelationSchema `json:"relations,omitempty"`
+}
+
+// FieldSchema describes a field of a model.
+type FieldSchema struct {
+	Name     string            `json:"name"`
+	JSON     string            `json:"json"`
+	Type     string            `json:"type"`
+	Format   string            `json:"format,omitempty"`
+	GoType   string            `json:"goType"`
+	ReadOnly bool              `json:"readOnly,omitempty"`
+	Unique   bool              `json:"unique,omitempty"`
+	Index    string            `json:"index,omitempty"`
+	Enum     []string          `json:"enum,omitempty"`
+	Validate string            `json:"validate,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// RelationSchema describes a relation of a model to a parent or child model.
+type RelationSchema struct {
+	Kind       string `json:"kind"` // belongsTo, hasMany or manyToMany
+	Model      string `json:"model"`
+	ForeignKey string `json:"foreignKey,omitempty"`
+	Type       string `json:"typeField,omitempty"`
+	As         string `json:"as,omitempty"`
+}
+
+// Schema describes a registered model (which may be tenant-scoped).
+func (s *Store) Schema(model string) (ModelSchema, bool) {
+	meta, ok := s.meta(model)
+	if !ok {
+		return ModelSchema{}, false
+	}
+	_, base, _ := splitTenantModel(model)
+	schema := ModelSchema{Model: base, Type: meta.typ.Name(), Fields: []FieldSchema{}}
+	if meta.id != nil {
+		schema.ID = meta.id.jsonName
+	}
+	for _, f := range meta.key {
+		schema.Key = append(schema.Key, f.jsonName)
+	}
+	for _, f := range meta.lookups {
+		schema.Lookups = append(schema.Lookups, f.jsonName)
+	}
+
+	c, _ := s.collection(model)
+	describe := &openAPISpec{store: s, schemas: jsonObject{}}
+	for _, f := range meta.fields {
+		if f.jsonName == "-" {
+			continue
+		}
+		types := describe.schema(f.typ)
+		field := FieldSchema{
+			Name:     f.name,
+			JSON:     f.jsonName,
+			GoType:   f.typ.String(),
+			ReadOnly: f == meta.id || f.crudOption("readonly"),
+			Unique:   f.crudOption("unique"),
+			Validate: f.tag.Get("validate"),
+			Tags:     structTags(f.tag),
+		}
+		field.Type, _ = types["type"].(string)
+		field.Format, _ = types["format"].(string)
+		if _, ref := types["$ref"]; ref {
+			field.Type = "object"
+		}
+		if enum := f.tag.Get("enum"); enum != "" {
+			field.Enum = strings.Split(enum, "|")
+		}
+		if idx, ok := c.index(f.name); ok {
+			field.Index = "hash"
+			if idx.ordered {
+				field.Index = "ordered"
+			}
+		}
+		schema.Fields = append(schema.Fields, field)
+	}
+
+	for _, relation := range s.parents(model) {
+		r := RelationSchema{Kind: "belongsTo", Model: relation.Parent, ForeignKey: relation.ForeignKey.jsonName, As: relation.As}
+		if relation.Type != nil {
+			r.Type = relation.Type.jsonName
+		}
+		schema.Relations = append(schema.Relations, r)
+	}
+	for _, relation := range s.children(model) {
+		schema.Relations = append(schema.Relations, RelationSchema{Kind: "hasMany", Model: relation.Child, ForeignKey: relation.ForeignKey.jsonName})
+	}
+	s.typeMux.RLock()
+	for _, relation := range s.manyToMany {
+		switch base {
+		case relation.From:
+			schema.Relations = append(schema.Relations, RelationSchema{Kind: "manyToMany", Model: relation.To})
+		case relation.To:
+			schema.Relations = append(schema.Relations, RelationSchema{Kind: "manyToMany", Model: relation.From})
+		}
+	}
+	s.typeMux.RUnlock()
+	return schema, true
+}
+
+// structTags returns the key:"value" pairs of a struct tag.
+func structTags(tag reflect.StructTag) map[string]string {
+	tags := make(map[string]string)
+	rest := string(tag)
+	for {
+		rest = strings.TrimLeft(rest, " ")
+		name, value, ok := strings.Cut(rest, ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \"") || !strings.HasPrefix(value, `"`) {
+			break
+		}
+		// Find the closing quote, skipping escaped ones
+		end := 1
+		for end < len(value) && value[end] != '"' {
+			if value[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(value) {
+			break
+		}
+		unquoted, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			break
+		}
+		tags[name] = unquoted
+		rest = value[end+1:]
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// handleSchema serves GET /{model}/_schema.
+func handleSchema(store *Store, model string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	schema, ok := store.Schema(model)
+	if !ok {
+		notFound(w, r, "Unknown model")
+		return
+	}
+	writeJSON(w, http.StatusOK, schema)
+}
@@ -0,0 +1,418 @@
+// File: sdk_go.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file generates a typed Go client of the API, served at GET /_sdk/go (the
+// package name can be chosen with ?package=). The client declares a struct per model with the same
+// JSON encoding as the server's, and a client per model matching the server routes:
+// client.Items().Get(ctx, id), List(ctx, opts) with filters and paging, Count, Create, Update and
+// Delete, GetByKey for models keyed by several fields, GetBy{Field} for lookup fields and the
+// nested child routes. Error responses are returned as *APIError, with helpers for the common
+// statuses.
+
+package main
+
+import (
+	"fmt"
+	"go/format"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// goIdentifier matches valid Go package names.
+var goIdentifier = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// GoClient returns the source of a Go client package for the given models.
+func (s *Store) GoClient(pkg string, models []string) ([]byte, error) {
+	g := &goClientGenerator{store: s, types: make(map[reflect.Type]bool)}
+	for _, model := range models {
+		if meta, ok := s.meta(model); ok {
+			g.models = append(g.models, model)
+			g.declare(meta.typ)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Code generated by go-crud-helper; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "// Package %s is a typed client of the go-crud-helper API.\npackage %s\n\n", pkg, pkg)
+	b.WriteString("import (\n\t\"bytes\"\n\t\"context\"\n\t\"encoding/json\"\n\t\"errors\"\n\t\"fmt\"\n\t\"io\"\n\t\"net/http\"\n\t\"net/url\"\n\t\"strconv\"\n\t\"strings\"\n")
+	if g.usesTime {
+		b.WriteString("\t\"time\"\n")
+	}
+	b.WriteString(")\n\n")
+	b.WriteString(goClientRuntime)
+	b.WriteString(g.typeDecls.String())
+	for _, model := range g.models {
+		g.writeModelClient(&b, model)
+	}
+	return format.Source([]byte(b.String()))
+}
+
+// handleGoClient serves GET /_sdk/go.
+func handleGoClient(store *Store, models []string, w http.ResponseWriter, r *http.Request) {
+	pkg := r.URL.Query().Get("package")
+	if pkg == "" {
+		pkg = "crudclient"
+	}
+	if !goIdentifier.MatchString(pkg) {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid package name")
+		return
+	}
+	source, err := store.GoClient(pkg, models)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-go; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+pkg+`.go"`)
+	w.Write(source)
+}
+
+// goClientGenerator accumulates the declarations of a generated client.
+type goClientGenerator struct {
+	store     *Store
+	models    []string
+	types     map[reflect.Type]bool // struct types already declared
+	typeDecls strings.Builder
+	usesTime  bool
+}
+
+// declare writes the declaration of a struct type and of the named structs it uses. Promoted fields
+// of embedded structs are declared as direct fields, encoded the same way.
+func (g *goClientGenerator) declare(t reflect.Type) {
+	if g.types[t] {
+		return
+	}
+	g.types[t] = true
+	meta := metaFor(t)
+	var fields strings.Builder
+	for _, f := range meta.fields {
+		tag := ""
+		if json, ok := f.tag.Lookup("json"); ok {
+			tag = fmt.Sprintf(" `json:%q`", json)
+		} else if name, ok := meta.renamed[f.name]; ok {
+			tag = fmt.Sprintf(" `json:%q`", name)
+		}
+		fmt.Fprintf(&fields, "\t%s %s%s\n", f.name, g.goType(f.typ), tag)
+	}
+	fmt.Fprintf(&g.typeDecls, "// %s mirrors the %s type of the server.\ntype %s struct {\n%s}\n\n", t.Name(), t.Name(), t.Name(), fields.String())
+}
+
+// goType returns the source of a type in the client package.
+func (g *goClientGenerator) goType(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Time{}) {
+		g.usesTime = true
+		return "time.Time"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + g.goType(t.Elem())
+	case reflect.Slice:
+		return "[]" + g.goType(t.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), g.goType(t.Elem()))
+	case reflect.Map:
+		return "map[" + g.goType(t.Key()) + "]" + g.goType(t.Elem())
+	case reflect.Struct:
+		if t.Name() == "" {
+			return "struct{}"
+		}
+		g.declare(t)
+		return t.Name()
+	case reflect.Interface:
+		return "interface{}"
+	}
+	// Named scalars of the server (e.g. type Status string) become their underlying kind
+	return t.Kind().String()
+}
+
+// writeModelClient writes the client of one model.
+func (g *goClientGenerator) writeModelClient(b *strings.Builder, model string) {
+	meta, _ := g.store.meta(model)
+	typ := meta.typ.Name()
+	client := typ + "Client"
+	fmt.Fprintf(b, "// %s calls the routes of the %q model.\ntype %s struct {\n\tc *Client\n}\n\n", client, model, client)
+	fmt.Fprintf(b, "// %s returns the client of the %q model.\nfunc (c *Client) %s() *%s {\n\treturn &%s{c: c}\n}\n\n", plural(typ), model, plural(typ), client, client)
+
+	fmt.Fprintf(b, `// List returns the items matching the options.
+func (m *%[1]s) List(ctx context.Context, opts ListOptions) ([]%[2]s, error) {
+	var items []%[2]s
+	err := m.c.do(ctx, http.MethodGet, "/%[3]s", opts.query(), nil, &items)
+	return items, err
+}
+
+// Count returns the number of items matching the filters of the options.
+func (m *%[1]s) Count(ctx context.Context, opts ListOptions) (int, error) {
+	query := opts.query()
+	query.Set("count", "true")
+	var result struct {
+		Count int `+"`json:\"count\"`"+`
+	}
+	err := m.c.do(ctx, http.MethodGet, "/%[3]s", query, nil, &result)
+	return result.Count, err
+}
+
+// Create stores a new item and returns it as stored.
+func (m *%[1]s) Create(ctx context.Context, item *%[2]s) (*%[2]s, error) {
+	var created %[2]s
+	if err := m.c.do(ctx, http.MethodPost, "/%[3]s", nil, item, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+`, client, typ, model)
+
+	// Items are addressed by ID, unless the model is keyed by other fields
+	addresses := []struct{ suffix, params, key, doc string }{}
+	if meta.id != nil || len(meta.key) == 0 {
+		addresses = append(addresses, struct{ suffix, params, key, doc string }{"", "id int", `url.Values{"id": {strconv.Itoa(id)}}`, "with the given ID"})
+	}
+	if len(meta.key) > 0 {
+		var names []string
+		for _, f := range meta.key {
+			names = append(names, f.jsonName)
+		}
+		addresses = append(addresses, struct{ suffix, params, key, doc string }{"ByKey", "key []string", `url.Values{"key": {encodeKey(key)}}`, "with the given key (" + strings.Join(names, ", ") + ")"})
+	}
+	for _, a := range addresses {
+		fmt.Fprintf(b, `// Get%[4]s returns the item %[6]s.
+func (m *%[1]s) Get%[4]s(ctx context.Context, %[5]s) (*%[2]s, error) {
+	var item %[2]s
+	if err := m.c.do(ctx, http.MethodGet, "/%[3]s", %[7]s, nil, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Update%[4]s replaces the item %[6]s and returns it as stored.
+func (m *%[1]s) Update%[4]s(ctx context.Context, %[5]s, item *%[2]s) (*%[2]s, error) {
+	var updated %[2]s
+	if err := m.c.do(ctx, http.MethodPut, "/%[3]s", %[7]s, item, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// Delete%[4]s deletes the item %[6]s.
+func (m *%[1]s) Delete%[4]s(ctx context.Context, %[5]s) error {
+	return m.c.do(ctx, http.MethodDelete, "/%[3]s", %[7]s, nil, nil)
+}
+
+`, client, typ, model, a.suffix, a.params, a.doc, a.key)
+	}
+
+	for _, f := range meta.lookups {
+		name := exportedName(f.jsonName)
+		fmt.Fprintf(b, `// GetBy%[4]s returns the item with the given %[5]s.
+func (m *%[1]s) GetBy%[4]s(ctx context.Context, value string) (*%[2]s, error) {
+	var item %[2]s
+	if err := m.c.do(ctx, http.MethodGet, "/%[3]s/by-%[5]s/"+url.PathEscape(value), nil, nil, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+`, client, typ, model, name, f.jsonName)
+	}
+
+	children := g.store.children(model)
+	sort.Slice(children, func(i, j int) bool { return children[i].Child < children[j].Child })
+	for _, relation := range children {
+		childMeta, ok := g.store.meta(relation.Child)
+		if !ok || !containsString(g.models, relation.Child) {
+			continue
+		}
+		childType := childMeta.typ.Name()
+		fmt.Fprintf(b, `// List%[4]s returns the %[5]s items of the item with the given ID.
+func (m *%[1]s) List%[4]s(ctx context.Context, id int, opts ListOptions) ([]%[6]s, error) {
+	var items []%[6]s
+	err := m.c.do(ctx, http.MethodGet, "/%[3]s/"+strconv.Itoa(id)+"/%[5]s", opts.query(), nil, &items)
+	return items, err
+}
+
+`, client, typ, model, plural(childType), relation.Child, childType)
+	}
+}
+
+// plural returns the English plural of a type name, for the model accessors of the client.
+func plural(name string) string {
+	switch {
+	case strings.HasSuffix(name, "y") && !strings.HasSuffix(name, "ay") && !strings.HasSuffix(name, "ey"):
+		return strings.TrimSuffix(name, "y") + "ies"
+	case strings.HasSuffix(name, "s"), strings.HasSuffix(name, "x"), strings.HasSuffix(name, "ch"), strings.HasSuffix(name, "sh"):
+		return name + "es"
+	}
+	return name + "s"
+}
+
+// exportedName turns a JSON name into an exported Go identifier (slug → Slug).
+func exportedName(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// goClientRuntime is the model-independent part of the generated client.
+const goClientRuntime = `// Client calls the CRUD API served at BaseURL.
+type Client struct {
+	BaseURL       string
+	HTTPClient    *http.Client
+	Tenant        string // sent as X-Tenant-ID when set
+	Authorization string // sent as the Authorization header when set
+}
+
+// NewClient creates a client of the API served at baseURL (e.g. http://localhost:8080).
+func NewClient(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: http.DefaultClient}
+}
+
+// APIError is an error response of the API, decoded from its problem details.
+type APIError struct {
+	StatusCode int
+	Message    string // the detail of the problem
+	Code       string // the machine-readable error code, e.g. ITEM_NOT_FOUND
+	Type       string
+	RequestID  string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// hasStatus reports whether err is an API error with the given status.
+func hasStatus(err error, status int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+// IsNotFound reports whether err is a 404 response.
+func IsNotFound(err error) bool { return hasStatus(err, http.StatusNotFound) }
+
+// IsConflict reports whether err is a 409 response, e.g. for a key already taken.
+func IsConflict(err error) bool { return hasStatus(err, http.StatusConflict) }
+
+// IsPreconditionFailed reports whether err is a 412 response to a conditional write.
+func IsPreconditionFailed(err error) bool { return hasStatus(err, http.StatusPreconditionFailed) }
+
+// IsInvalid reports whether err is a 400 or 422 response to an invalid request.
+func IsInvalid(err error) bool {
+	return hasStatus(err, http.StatusBadRequest) || hasStatus(err, http.StatusUnprocessableEntity)
+}
+
+// ListOptions selects the items of a list.
+type ListOptions struct {
+	// Filters holds field filters by JSON name; suffix a name with _gte or _lte for ranges.
+	Filters url.Values
+	Offset  int
+	Limit   int      // 0 means no limit
+	Include []string // relations to embed in the items
+}
+
+// query encodes the options as query parameters.
+func (o ListOptions) query() url.Values {
+	query := url.Values{}
+	for name, values := range o.Filters {
+		query[name] = append([]string(nil), values...)
+	}
+	if o.Offset > 0 {
+		query.Set("offset", strconv.Itoa(o.Offset))
+	}
+	if o.Limit > 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if len(o.Include) > 0 {
+		query.Set("include", strings.Join(o.Include, ","))
+	}
+	return query
+}
+
+// encodeKey joins the components of a key, escaping their separators.
+func encodeKey(parts []string) string {
+	escaper := strings.NewReplacer("%", "%25", ",", "%2C")
+	escaped := make([]string, len(parts))
+	for i, part := range parts {
+		escaped[i] = escaper.Replace(part)
+	}
+	return strings.Join(escaped, ",")
+}
+
+// do sends a request and decodes its JSON response into result, unless result is nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, result interface{}) error {
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, payload)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.Tenant)
+	}
+	if c.Authorization != "" {
+		req.Header.Set("Authorization", c.Authorization)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+		var problem struct {
+			Type      string ` + "`json:\"type\"`" + `
+			Title     string ` + "`json:\"title\"`" + `
+			Code      string ` + "`json:\"code\"`" + `
+			Detail    string ` + "`json:\"detail\"`" + `
+			RequestID string ` + "`json:\"requestId\"`" + `
+		}
+		if json.Unmarshal(message, &problem) == nil && (problem.Detail != "" || problem.Title != "") {
+			apiErr.Message, apiErr.Code, apiErr.Type, apiErr.RequestID = problem.Detail, problem.Code, problem.Type, problem.RequestID
+			if apiErr.Message == "" {
+				apiErr.Message = problem.Title
+			}
+		}
+		return apiErr
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+`
@@ -0,0 +1,284 @@
+// File: search.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements text search across the string fields of a model, for
+// user-facing search boxes. A collection GET with ?q=golang answers the items matching the usual
+// filters whose string fields contain every word of the query, ignoring case. With ?fuzzy=true,
+// words also match the words of the fields they resemble, so typos are forgiven: the similarity of
+// two words is the better of their trigram similarity and of their Levenshtein distance relative to
+// their length, and items are kept when their score, the average similarity of the words of the
+// query, reaches ?min_score= (0.6 by default). Results are ordered by relevance, each item holding
+// its score in "_score". Masked fields are not searched for callers who see them masked.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultMinScore is the score fuzzy matches must reach by default.
+const defaultMinScore = 0.6
+
+// SearchQuery describes a text search.
+type SearchQuery struct {
+	Text     string
+	Fuzzy    bool     // match the words resembling those of the text, not only the words containing them
+	MinScore float64  // score fuzzy matches must reach, defaultMinScore when zero
+	Fields   []string // string fields searched, by Go or JSON name; every string field when empty
+}
+
+// SearchResult is an item matched by a search and its relevance, from 0 to 1.
+type SearchResult struct {
+	ID    int
+	Item  interface{}
+	Score float64
+}
+
+// Search finds the items of a model matching every filter and the text of query, most relevant
+// first (ties in ID order).
+func (s *Store) Search(model string, filters []Filter, query SearchQuery) ([]SearchResult, error) {
+	meta, ok := s.meta(model)
+	if !ok {
+		return nil, fmt.Errorf("model %q is not registered", model)
+	}
+	fields, err := searchFields(meta, query.Fields)
+	if err != nil {
+		return nil, err
+	}
+	if query.MinScore <= 0 {
+		query.MinScore = defaultMinScore
+	}
+	terms := searchWords(query.Text)
+	if len(terms) == 0 {
+		return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("the search has no words")}
+	}
+	found, err := s.matching(model, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	for _, m := range found {
+		var text []string
+		item := reflect.ValueOf(m.item).Elem()
+		for _, f := range fields {
+			text = append(text, strings.ToLower(item.FieldByIndex(f.index).String()))
+		}
+		if score, ok := searchScore(terms, text, query); ok {
+			results = append(results, SearchResult{ID: m.id, Item: m.item, Score: score})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	return results, nil
+}
+
+// searchFields resolves the string fields searched, every string field of the model when names is
+// empty.
+func searchFields(meta *modelMeta, names []string) ([]*fieldMeta, error) {
+	var fields []*fieldMeta
+	if len(names) == 0 {
+		for _, f := range meta.fields {
+			if f.typ.Kind() == reflect.String && f.jsonName != "-" {
+				fields = append(fields, f)
+			}
+		}
+		return fields, nil
+	}
+	for _, name := range names {
+		f, ok := meta.field(name)
+		if !ok {
+			return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", name)}
+		}
+		if f.typ.Kind() != reflect.String {
+			return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("field %s cannot be searched", name)}
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// searchWords splits a text into lowercase words of letters and digits.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchScore scores the lowercased string fields of an item against the words of a search,
+// reporting whether they match. Words contained in a field score 1; otherwise fuzzy searches score
+// each word by its best similarity to the words of the fields.
+func searchScore(terms, text []string, query SearchQuery) (float64, bool) {
+	var words []string
+	total := 0.0
+	for _, term := range terms {
+		best := 0.0
+		for _, t := range text {
+			if strings.Contains(t, term) {
+				best = 1
+				break
+			}
+		}
+		if best < 1 && !query.Fuzzy {
+			return 0, false
+		}
+		if best < 1 {
+			if words == nil {
+				for _, t := range text {
+					words = append(words, searchWords(t)...)
+				}
+			}
+			for _, word := range words {
+				if sim := similarity(term, word); sim > best {
+					best = sim
+				}
+			}
+		}
+		total += best
+	}
+	score := total / float64(len(terms))
+	return score, score >= query.MinScore
+}
+
+// similarity rates how much two words resemble each other, from 0 to 1.
+func similarity(a, b string) float64 {
+	sim := trigramSimilarity(a, b)
+	longest := utf8.RuneCountInString(a)
+	if n := utf8.RuneCountInString(b); n > longest {
+		longest = n
+	}
+	if longest > 0 {
+		if lev := 1 - float64(levenshtein(a, b))/float64(longest); lev > sim {
+			sim = lev
+		}
+	}
+	return sim
+}
+
+// trigrams returns the set of trigrams of a word padded with spaces, as pg_trgm does.
+func trigrams(word string) map[string]bool {
+	runes := []rune("  " + word + " ")
+	set := make(map[string]bool, len(runes))
+	for i := 0; i+3 <= len(runes); i++ {
+		set[string(runes[i:i+3])] = true
+	}
+	return set
+}
+
+// trigramSimilarity is the number of trigrams two words share over the number of their distinct
+// trigrams.
+func trigramSimilarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	shared := 0
+	for t := range ta {
+		if tb[t] {
+			shared++
+		}
+	}
+	if union := len(ta) + len(tb) - shared; union > 0 {
+		return float64(shared) / float64(union)
+	}
+	return 0
+}
+
+// levenshtein is the number of single-rune insertions, deletions and substitutions turning a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// withMetric adds a metric of a result, such as its search score, rounded to three decimals, to
+// its encoded item.
+func withMetric(data json.RawMessage, name string, value float64) json.RawMessage {
+	encoded := strconv.AppendFloat(nil, math.Round(value*1000)/1000, 'f', -1, 64)
+	out := append([]byte(nil), strings.TrimSuffix(string(data), "}")...)
+	if len(out) > 1 {
+		out = append(out, ',')
+	}
+	out = append(append(append(out, '"'), name...), `":`...)
+	out = append(append(out, encoded...), '}')
+	return out
+}
+
+// handleSearch answers a collection GET with ?q=: the page of the items matching the filters and
+// the search, expanded with their includes, each with its score.
+func handleSearch(store *Store, model string, meta *modelMeta, filters []Filter, page Page, includes []include, w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query := SearchQuery{Text: values.Get("q"), Fuzzy: values.Get("fuzzy") == "true"}
+	if v := values.Get("min_score"); v != "" {
+		score, err := strconv.ParseFloat(v, 64)
+		if err != nil || score <= 0 || score > 1 {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid min_score")
+			return
+		}
+		query.MinScore = score
+	}
+	if masking(w) {
+		fields, _ := searchFields(meta, nil)
+		for _, f := range fields {
+			if !containsField(meta.masked, f) {
+				query.Fields = append(query.Fields, f.name)
+			}
+		}
+		if len(query.Fields) == 0 {
+			setTotalCount(w, r, 0)
+			writeJSON(w, http.StatusOK, []interface{}{})
+			return
+		}
+	}
+
+	results, err := store.Search(model, filters, query)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	setTotalCount(w, r, len(results))
+	start, end := page.bounds(len(results))
+	selected := make([]interface{}, 0, end-start)
+	for _, result := range results[start:end] {
+		selected = append(selected, result.Item)
+	}
+	expanded, err := store.expandFor(w, meta, selected, includes)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range expanded {
+		expanded[i] = withMetric(expanded[i], "_score", results[start+i].Score)
+	}
+	writeJSON(w, http.StatusOK, expanded)
+}
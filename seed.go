@@ -0,0 +1,401 @@
+// File: seed.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements fake data seeding at POST /{model}/_seed?count=100, which fills
+// a model with generated items for demos and load testing. Values are chosen by field type and
+// name (names, emails, titles, slugs, URLs, dates, ...), honor `enum:"a|b"` and the email, url,
+// min, max, len and oneof rules of validate tags, are unique for unique, lookup and key fields,
+// and foreign keys reference existing parents, or are left zero when the parent model has none. Passing ?seed=42 makes the generated items
+// deterministic for a given store state.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// seedEpoch is the end of the period seeded times fall in.
+var seedEpoch = time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+
+// maxSeedCount is the largest number of items a seed request creates.
+const maxSeedCount = 10000
+
+// seedAttempts is the number of times an item is regenerated when its unique fields are taken.
+const seedAttempts = 10
+
+var (
+	fakeFirstNames = []string{"Alice", "Omar", "Sofia", "Liam", "Yuki", "Amara", "Noah", "Lina", "Mateo", "Chloe", "Karim", "Emma", "Ravi", "Nora", "Hugo", "Zara"}
+	fakeLastNames  = []string{"Smith", "Hassan", "Rossi", "Novak", "Tanaka", "Okafor", "Garcia", "Meyer", "Dubois", "Kim", "Silva", "Larsen", "Patel", "Cohen", "Ivanova", "Moreau"}
+	fakeWords      = []string{"alpha", "river", "quiet", "orbit", "maple", "signal", "copper", "harbor", "lunar", "pixel", "meadow", "vector", "ember", "summit", "cobalt", "prairie", "delta", "echo", "willow", "canyon"}
+	fakeCities     = []string{"Cairo", "Lisbon", "Osaka", "Nairobi", "Toronto", "Berlin", "Lima", "Oslo", "Seoul", "Austin", "Lyon", "Perth"}
+	fakeCountries  = []string{"Egypt", "Portugal", "Japan", "Kenya", "Canada", "Germany", "Peru", "Norway", "Korea", "Australia", "France", "Brazil"}
+	fakeCompanies  = []string{"Acme", "Globex", "Initech", "Umbrella", "Hooli", "Stark", "Wayne", "Soylent", "Vandelay", "Cyberdyne"}
+	fakeProducts   = []string{"Keyboard", "Lamp", "Backpack", "Notebook", "Headphones", "Mug", "Chair", "Monitor", "Bottle", "Jacket"}
+	fakeColors     = []string{"red", "green", "blue", "amber", "teal", "violet", "black", "white"}
+)
+
+// Seed creates count generated items of a model from the given random seed and returns them.
+// It stops at the first item that cannot be stored, returning the items created so far.
+func (s *Store) Seed(model string, count int, seed int64) ([]interface{}, error) {
+	meta, ok := s.meta(model)
+	if !ok {
+		return nil, fmt.Errorf("model %q is not registered", model)
+	}
+	g := &seeder{rand: rand.New(rand.NewSource(seed)), parents: s.seedParents(model)}
+	var created []interface{}
+	for len(created) < count {
+		var err error
+		for attempt := 0; attempt < seedAttempts; attempt++ {
+			item := reflect.New(meta.typ)
+			g.fill(meta, item.Elem())
+			if err = s.checkParents(model, item.Interface()); err != nil {
+				break
+			}
+			var stored interface{}
+			if stored, err = s.createChecked(context.Background(), model, item.Interface(), 0); err != nil {
+				// A taken unique value is generated again; other errors, like an exceeded quota, end the seeding
+				if asError(err, 0).Status == http.StatusConflict {
+					continue
+				}
+				break
+			}
+			created = append(created, stored)
+			break
+		}
+		if err != nil {
+			return created, fmt.Errorf("seeded %d of %d items: %w", len(created), count, err)
+		}
+	}
+	return created, nil
+}
+
+// seedParent is an existing parent an item can reference through a foreign key.
+type seedParent struct {
+	relation *Relation
+	id       int
+}
+
+// seedParents returns the existing parents of each foreign key of a model, in a stable order. Every
+// foreign key has an entry, empty when there is no parent to reference, so it is never given a
+// generated value.
+func (s *Store) seedParents(model string) map[*fieldMeta][]seedParent {
+	tenant, _, _ := splitTenantModel(model)
+	relations := s.parents(model)
+	sort.SliceStable(relations, func(i, j int) bool { return relations[i].Parent < relations[j].Parent })
+	parents := make(map[*fieldMeta][]seedParent)
+	for _, relation := range relations {
+		if _, ok := parents[relation.ForeignKey]; !ok {
+			parents[relation.ForeignKey] = nil
+		}
+		matches, err := s.matching(tenantModel(tenant, relation.Parent), nil)
+		if err != nil {
+			continue
+		}
+		for _, m := range matches {
+			parents[relation.ForeignKey] = append(parents[relation.ForeignKey], seedParent{relation, m.id})
+		}
+	}
+	return parents
+}
+
+// seeder generates the values of seeded items.
+type seeder struct {
+	rand    *rand.Rand
+	parents map[*fieldMeta][]seedParent
+	seq     int
+
+	// first and last are the names of the person of the current item, so its name and email
+	// fields agree
+	first, last string
+}
+
+// fill sets the fields of a new item. The ID and the fields managed by the store are left zero.
+func (g *seeder) fill(meta *modelMeta, item reflect.Value) {
+	g.seq++
+	g.first = fakeFirstNames[g.rand.Intn(len(fakeFirstNames))]
+	g.last = fakeLastNames[g.rand.Intn(len(fakeLastNames))]
+	for _, f := range meta.fields {
+		if f == meta.id || f == meta.expiresAt || f == meta.createdAt || f.jsonName == "-" {
+			continue
+		}
+		v := item.FieldByIndex(f.index)
+		if parents, ok := g.parents[f]; ok {
+			if len(parents) > 0 {
+				parent := parents[g.rand.Intn(len(parents))]
+				v.SetInt(int64(parent.id))
+				if parent.relation.Type != nil {
+					item.FieldByIndex(parent.relation.Type.index).SetString(parent.relation.Parent)
+				}
+			}
+			continue
+		}
+		if isPolymorphicType(meta, f) {
+			continue
+		}
+		unique := f.crudOption("unique") || f.crudOption("lookup") || containsField(meta.key, f)
+		g.value(v, strings.ToLower(f.jsonName), parseFieldRules(f.tag), unique, 0)
+	}
+}
+
+// isPolymorphicType reports whether a field names the parent model of a polymorphic relation,
+// which fill sets along with the foreign key.
+func isPolymorphicType(meta *modelMeta, f *fieldMeta) bool {
+	for _, tag := range meta.belongsTo {
+		if tag.typeField == f {
+			return true
+		}
+	}
+	return false
+}
+
+// containsField reports whether fields holds f.
+func containsField(fields []*fieldMeta, f *fieldMeta) bool {
+	for _, field := range fields {
+		if field == f {
+			return true
+		}
+	}
+	return false
+}
+
+// value sets a value of any type, named name, to a generated one.
+func (g *seeder) value(v reflect.Value, name string, rules fieldRules, unique bool, depth int) {
+	if v.Type() == reflect.TypeOf(time.Time{}) {
+		v.Set(reflect.ValueOf(g.time(name)))
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(g.string(name, rules, unique))
+	case reflect.Bool:
+		v.SetBool(g.rand.Intn(2) == 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		lo, hi := g.bounds(name, rules, unique)
+		if bits := v.Type().Bits(); bits < 64 {
+			hi = math.Min(hi, float64(int64(1)<<(bits-1)-1))
+		}
+		hi = math.Max(hi, lo)
+		v.SetInt(int64(lo) + g.rand.Int63n(int64(hi-lo)+1))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		lo, hi := g.bounds(name, rules, unique)
+		lo = math.Max(lo, 0)
+		if bits := v.Type().Bits(); bits < 64 {
+			hi = math.Min(hi, float64(uint64(1)<<bits-1))
+		}
+		hi = math.Max(hi, lo)
+		v.SetUint(uint64(lo) + uint64(g.rand.Int63n(int64(hi-lo)+1)))
+	case reflect.Float32, reflect.Float64:
+		lo, hi := g.bounds(name, rules, false)
+		v.SetFloat(float64(int((lo+g.rand.Float64()*(hi-lo))*100)) / 100)
+	case reflect.Ptr:
+		if depth < 3 {
+			v.Set(reflect.New(v.Type().Elem()))
+			g.value(v.Elem(), name, rules, unique, depth+1)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, 8)
+			g.rand.Read(b)
+			v.SetBytes(b)
+		} else if depth < 3 {
+			n := 1 + g.rand.Intn(3)
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+			for i := 0; i < n; i++ {
+				g.value(v.Index(i), name, fieldRules{}, false, depth+1)
+			}
+		}
+	case reflect.Struct:
+		if depth < 3 {
+			for _, f := range metaFor(v.Type()).fields {
+				g.value(v.FieldByIndex(f.index), strings.ToLower(f.jsonName), parseFieldRules(f.tag), false, depth+1)
+			}
+		}
+	}
+}
+
+// bounds returns the range of a number named name.
+func (g *seeder) bounds(name string, rules fieldRules, unique bool) (float64, float64) {
+	lo, hi := 0.0, 1000.0
+	switch {
+	case unique:
+		lo, hi = 1, 100000
+	case strings.Contains(name, "age"):
+		lo, hi = 18, 90
+	case strings.Contains(name, "year"):
+		lo, hi = 1970, 2024
+	case strings.Contains(name, "quantity") || strings.Contains(name, "count"):
+		lo, hi = 1, 20
+	case strings.Contains(name, "price") || strings.Contains(name, "amount") || strings.Contains(name, "total"):
+		lo, hi = 1, 500
+	case strings.Contains(name, "percent") || strings.Contains(name, "score"):
+		lo, hi = 0, 100
+	case strings.Contains(name, "rating"):
+		lo, hi = 1, 5
+	}
+	if rules.min != nil {
+		lo = *rules.min
+		hi = math.Max(hi, lo)
+	}
+	if rules.max != nil {
+		hi = *rules.max
+		lo = math.Min(lo, hi)
+	}
+	return lo, hi
+}
+
+// time returns a time named name: a birth date for birthdays, otherwise a time of the year before
+// seedEpoch, which keeps seeded times independent of the clock.
+func (g *seeder) time(name string) time.Time {
+	if strings.Contains(name, "birth") {
+		return time.Date(1950+g.rand.Intn(55), time.Month(1+g.rand.Intn(12)), 1+g.rand.Intn(28), 0, 0, 0, 0, time.UTC)
+	}
+	return seedEpoch.Add(-time.Duration(g.rand.Int63n(int64(365 * 24 * time.Hour)))).Truncate(time.Second)
+}
+
+// string returns a string named name honoring the rules. Unique strings get a numeric suffix.
+func (g *seeder) string(name string, rules fieldRules, unique bool) string {
+	if len(rules.oneOf) > 0 {
+		return rules.oneOf[g.rand.Intn(len(rules.oneOf))]
+	}
+	pick := func(values []string) string { return values[g.rand.Intn(len(values))] }
+	suffix := ""
+	if unique {
+		suffix = strconv.Itoa(g.seq*1000 + g.rand.Intn(1000))
+	}
+
+	var value string
+	first, last := g.first, g.last
+	switch {
+	case rules.email || strings.Contains(name, "email"):
+		value = strings.ToLower(first+"."+last) + suffix + "@example.com"
+		suffix = ""
+	case rules.url || strings.Contains(name, "url") || strings.Contains(name, "website") || strings.Contains(name, "link"):
+		value = "https://example.com/" + pick(fakeWords) + "/" + pick(fakeWords)
+	case strings.Contains(name, "slug"):
+		value = pick(fakeWords) + "-" + pick(fakeWords)
+		if unique {
+			value += "-"
+		}
+	case strings.Contains(name, "firstname"):
+		value = first
+	case strings.Contains(name, "lastname") || strings.Contains(name, "surname"):
+		value = last
+	case strings.Contains(name, "username") || strings.Contains(name, "login"):
+		value = strings.ToLower(first) + strconv.Itoa(g.rand.Intn(100))
+	case strings.Contains(name, "company"):
+		value = pick(fakeCompanies) + " Inc."
+	case strings.Contains(name, "product"):
+		value = capitalize(pick(fakeColors)) + " " + pick(fakeProducts)
+	case strings.Contains(name, "name"):
+		value = first + " " + last
+	case strings.Contains(name, "city"):
+		value = pick(fakeCities)
+	case strings.Contains(name, "country"):
+		value = pick(fakeCountries)
+	case strings.Contains(name, "address") || strings.Contains(name, "street"):
+		value = strconv.Itoa(1+g.rand.Intn(200)) + " " + capitalize(pick(fakeWords)) + " Street"
+	case strings.Contains(name, "phone"):
+		value = fmt.Sprintf("+1-555-%03d-%04d", g.rand.Intn(1000), g.rand.Intn(10000))
+	case strings.Contains(name, "color") || strings.Contains(name, "colour"):
+		value = pick(fakeColors)
+	case strings.Contains(name, "title"):
+		words := make([]string, 2+g.rand.Intn(3))
+		for i := range words {
+			words[i] = pick(fakeWords)
+		}
+		for i, word := range words {
+			words[i] = capitalize(word)
+		}
+		value = strings.Join(words, " ")
+	default:
+		words := make([]string, 4+g.rand.Intn(8))
+		for i := range words {
+			words[i] = pick(fakeWords)
+		}
+		words[0] = capitalize(words[0])
+		value = strings.Join(words, " ") + "."
+	}
+	if suffix != "" {
+		if strings.Contains(value, " ") {
+			value += " " + suffix
+		} else {
+			value += suffix
+		}
+	}
+
+	// Pad or cut the value to the length rules
+	minLen, maxLen := 0, -1
+	if rules.length != nil {
+		minLen, maxLen = *rules.length, *rules.length
+	}
+	if rules.min != nil {
+		minLen = int(*rules.min)
+	}
+	if rules.max != nil {
+		maxLen = int(*rules.max)
+	}
+	for len(value) < minLen {
+		value += pick(fakeWords)
+	}
+	if maxLen >= 0 && len(value) > maxLen {
+		value = value[len(value)-maxLen:]
+	}
+	return value
+}
+
+// capitalize upper-cases the first letter of a word.
+func capitalize(word string) string {
+	if word == "" {
+		return word
+	}
+	return strings.ToUpper(word[:1]) + word[1:]
+}
+
+// handleSeed serves POST /{model}/_seed?count=N&seed=S. The count defaults to 10 and the seed to
+// a random one, which is returned so the data can be generated again.
+func handleSeed(store *Store, model string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	query := r.URL.Query()
+	count := 10
+	if v := query.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSeedCount {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("count must be between 1 and %d", maxSeedCount))
+			return
+		}
+		count = n
+	}
+	seed := time.Now().UnixNano()
+	if v := query.Get("seed"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid seed")
+			return
+		}
+		seed = n
+	}
+	created, err := store.Seed(model, count, seed)
+	if err != nil && len(created) == 0 {
+		writeError(w, r, http.StatusConflict, err)
+		return
+	}
+	result := map[string]interface{}{"model": model, "count": len(created), "seed": seed}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	writeJSON(w, http.StatusCreated, result)
+}
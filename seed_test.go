@@ -0,0 +1,88 @@
+// File: seed_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests fake data seeding: seeded items are stored like created ones,
+// reference existing parents, hold unique values and are deterministic for a seed.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func seedHandler(store *Store, model string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) { handleSeed(store, model, w, r) }
+}
+
+func TestSeedWithoutParents(t *testing.T) {
+	store := newTestStore()
+	w := serveTest(seedHandler(store, "item"), http.MethodPost, "/item/_seed?count=3&seed=1", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("seed: status %d, want 201: %s", w.Code, w.Body)
+	}
+	var items []Item
+	store.Find("item", nil, &items)
+	if len(items) != 3 {
+		t.Fatalf("seeded %d items, want 3", len(items))
+	}
+	for _, item := range items {
+		if item.UserID != 0 {
+			t.Errorf("item %d references user %d, which does not exist", item.ID, item.UserID)
+		}
+	}
+}
+
+func TestSeedReferencesExistingParents(t *testing.T) {
+	store := newTestStore()
+	if _, err := store.Seed("user", 4, 1); err != nil {
+		t.Fatal(err)
+	}
+	items, err := store.Seed("item", 20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slugs := make(map[string]bool)
+	for _, created := range items {
+		item := created.(*Item)
+		if !store.exists("user", item.UserID) {
+			t.Errorf("item %d references user %d, which does not exist", item.ID, item.UserID)
+		}
+		if slugs[item.Slug] {
+			t.Errorf("slug %q seeded twice", item.Slug)
+		}
+		slugs[item.Slug] = true
+	}
+}
+
+func TestSeedIsDeterministic(t *testing.T) {
+	seeded := func() []json.RawMessage {
+		store := newTestStore()
+		items, err := store.Seed("user", 5, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var encoded []json.RawMessage
+		for _, item := range items {
+			data, _ := json.Marshal(item)
+			encoded = append(encoded, data)
+		}
+		return encoded
+	}
+	if first, second := seeded(), seeded(); !reflect.DeepEqual(first, second) {
+		t.Fatalf("the same seed generated different items:\n%s\n%s", first, second)
+	}
+}
+
+func TestSeedRejectsInvalidCounts(t *testing.T) {
+	store := newTestStore()
+	for _, count := range []string{"0", "-1", "abc", "10001"} {
+		if w := serveTest(seedHandler(store, "item"), http.MethodPost, "/item/_seed?count="+count, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("count %s: status %d, want 400", count, w.Code)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+// File: signing.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements tamper-evident record signing. Every mutation of the store is
+// recorded, under the lock of its shard, in a signature chain: a file of JSON lines, one signed
+// record per write naming the model, the ID and the SHA-256 digest of the item written (none for
+// deletes), and the hash of the previous record, so no record can be altered, removed or inserted
+// without breaking the chain. Records are signed with HMAC-SHA256 or with an Ed25519 key, whose
+// public key auditors can verify the chain with (VerifyChain). POST /_signatures/verify checks the
+// chain, then the items in memory and in the backend against the digests it last recorded for
+// them, which proves the data was not modified out of band. Items that predate the chain are
+// reported as unexpected until they are next written.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordSigner signs the hashes of the records of a signature chain.
+type RecordSigner interface {
+	// Algorithm names the signature algorithm.
+	Algorithm() string
+	// Sign returns the signature of a hash.
+	Sign(hash []byte) ([]byte, error)
+	// Verify reports whether a signature of a hash is valid.
+	Verify(hash, signature []byte) bool
+}
+
+// HMACSigner signs records with HMAC-SHA256. Whoever verifies them holds the key, and so could sign.
+type HMACSigner struct {
+	Key []byte
+}
+
+// Algorithm returns HMAC-SHA256.
+func (h *HMACSigner) Algorithm() string {
+	return "HMAC-SHA256"
+}
+
+// Sign returns the HMAC of a hash.
+func (h *HMACSigner) Sign(hash []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, h.Key)
+	mac.Write(hash)
+	return mac.Sum(nil), nil
+}
+
+// Verify reports whether a signature is the HMAC of a hash.
+func (h *HMACSigner) Verify(hash, signature []byte) bool {
+	expected, _ := h.Sign(hash)
+	return hmac.Equal(expected, signature)
+}
+
+// Ed25519Signer signs records with an Ed25519 private key. Without one, it only verifies them with
+// the public key.
+type Ed25519Signer struct {
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+// Algorithm returns Ed25519.
+func (e *Ed25519Signer) Algorithm() string {
+	return "Ed25519"
+}
+
+// Sign returns the Ed25519 signature of a hash.
+func (e *Ed25519Signer) Sign(hash []byte) ([]byte, error) {
+	if e.PrivateKey == nil {
+		return nil, errors.New("signatures: no private key")
+	}
+	return ed25519.Sign(e.PrivateKey, hash), nil
+}
+
+// Verify reports whether a signature of a hash is valid for the public key.
+func (e *Ed25519Signer) Verify(hash, signature []byte) bool {
+	return len(e.PublicKey) == ed25519.PublicKeySize && ed25519.Verify(e.PublicKey, hash, signature)
+}
+
+// ParseRecordSigner parses a signing key: hmac:<base64 key>, ed25519:<base64 seed or private key>,
+// or ed25519-public:<base64 public key> to verify only.
+func ParseRecordSigner(spec string) (RecordSigner, error) {
+	kind, encoded, ok := strings.Cut(spec, ":")
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if !ok || err != nil {
+		return nil, fmt.Errorf("signatures: invalid key %q (expected hmac:, ed25519: or ed25519-public: and a base64 key)", kind)
+	}
+	switch {
+	case kind == "hmac" && len(key) >= 16:
+		return &HMACSigner{Key: key}, nil
+	case kind == "ed25519" && len(key) == ed25519.SeedSize:
+		private := ed25519.NewKeyFromSeed(key)
+		return &Ed25519Signer{PrivateKey: private, PublicKey: private.Public().(ed25519.PublicKey)}, nil
+	case kind == "ed25519" && len(key) == ed25519.PrivateKeySize:
+		private := ed25519.PrivateKey(key)
+		return &Ed25519Signer{PrivateKey: private, PublicKey: private.Public().(ed25519.PublicKey)}, nil
+	case kind == "ed25519-public" && len(key) == ed25519.PublicKeySize:
+		return &Ed25519Signer{PublicKey: ed25519.PublicKey(key)}, nil
+	}
+	return nil, fmt.Errorf("signatures: invalid %s key of %d bytes", kind, len(key))
+}
+
+// SignedRecord is a record of a signature chain.
+type SignedRecord struct {
+	Index     uint64    `json:"index"` // position in the chain, from 1
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	Model     string    `json:"model"`
+	ID        int       `json:"id"`
+	Digest    string    `json:"digest,omitempty"` // SHA-256 of the item written, none for deletes
+	Prev      string    `json:"prev"`             // hash of the previous record, none for the first
+	Hash      string    `json:"hash,omitempty"`   // SHA-256 of the record without its hash and signature
+	Signature string    `json:"signature,omitempty"`
+}
+
+// hash returns the hash of a record, in hex and raw.
+func (r SignedRecord) hash() (string, []byte, error) {
+	r.Hash, r.Signature = "", ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), sum[:], nil
+}
+
+// ChainBreak is the first record of a chain failing verification.
+type ChainBreak struct {
+	Index   uint64 `json:"index"`
+	Problem string `json:"problem"`
+}
+
+// readChain decodes the records of a chain read from r, at most limit of them unless it is 0.
+func readChain(r io.Reader, limit uint64, fn func(record SignedRecord) error) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for n := uint64(0); limit == 0 || n < limit; n++ {
+		var record SignedRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("signatures: record %d: %w", n+1, err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyChain verifies the records of a chain read from r, at most limit of them unless it is 0:
+// each must follow the previous one, hash to its hash and carry a valid signature of it. It
+// returns the number of records verified and the hash of the last, or the first record failing
+// verification.
+func VerifyChain(r io.Reader, signer RecordSigner, limit uint64) (uint64, string, *ChainBreak) {
+	var n uint64
+	head := ""
+	err := readChain(r, limit, func(record SignedRecord) error {
+		hash, sum, err := record.hash()
+		signature, decodeErr := base64.StdEncoding.DecodeString(record.Signature)
+		switch {
+		case err != nil:
+			return err
+		case record.Index != n+1:
+			return fmt.Errorf("index %d out of sequence", record.Index)
+		case record.Prev != head:
+			return errors.New("does not follow the previous record")
+		case record.Hash != hash:
+			return errors.New("hash does not match the record")
+		case decodeErr != nil || !signer.Verify(sum, signature):
+			return errors.New("invalid signature")
+		}
+		n, head = n+1, hash
+		return nil
+	})
+	if err != nil {
+		return n, head, &ChainBreak{Index: n + 1, Problem: err.Error()}
+	}
+	if limit != 0 && n < limit {
+		return n, head, &ChainBreak{Index: n + 1, Problem: "missing"}
+	}
+	return n, head, nil
+}
+
+// SignatureChain appends signed records to a file.
+type SignatureChain struct {
+	path   string
+	file   *os.File
+	signer RecordSigner
+
+	mux   sync.Mutex
+	head  string // hash of the last record
+	count uint64 // number of records
+}
+
+// OpenSignatureChain opens (creating it if needed) the chain file at path, continuing it from its
+// last record. The records already in the file are verified by Verify, not here.
+func OpenSignatureChain(path string, signer RecordSigner) (*SignatureChain, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	chain := &SignatureChain{path: path, file: file, signer: signer}
+	err = readChain(file, 0, func(record SignedRecord) error {
+		chain.head, chain.count = record.Hash, record.Index
+		return nil
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return chain, nil
+}
+
+// each decodes the records of the chain file, at most limit of them unless it is 0.
+func (c *SignatureChain) each(limit uint64, fn func(record SignedRecord) error) error {
+	file, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return readChain(file, limit, fn)
+}
+
+// append signs a record of an event and appends it to the chain.
+func (c *SignatureChain) append(event ChangeEvent, digest string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	record := SignedRecord{
+		Index:  c.count + 1,
+		Seq:    event.Seq,
+		Time:   event.Time.UTC(),
+		Op:     event.Op,
+		Model:  event.Model,
+		ID:     event.ID,
+		Digest: digest,
+		Prev:   c.head,
+	}
+	hash, sum, err := record.hash()
+	if err != nil {
+		return err
+	}
+	signature, err := c.signer.Sign(sum)
+	if err != nil {
+		return err
+	}
+	record.Hash, record.Signature = hash, base64.StdEncoding.EncodeToString(signature)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	c.head, c.count = hash, record.Index
+	return nil
+}
+
+// state returns the number of records of the chain and the hash of the last.
+func (c *SignatureChain) state() (uint64, string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.count, c.head
+}
+
+// Close closes the chain file.
+func (c *SignatureChain) Close() error {
+	return c.file.Close()
+}
+
+// SetSignatureChain makes the store sign every mutation in a chain, and recalls the digests the
+// chain last recorded for the items of the registered models. It must be called after the models
+// are registered and before the store is used concurrently.
+func (s *Store) SetSignatureChain(chain *SignatureChain) error {
+	err := chain.each(0, func(record SignedRecord) error {
+		c, ok := s.collection(record.Model)
+		if !ok {
+			return nil
+		}
+		sh := c.shard(record.ID)
+		sh.itemMux.Lock()
+		defer sh.itemMux.Unlock()
+		if record.Digest == "" {
+			delete(sh.signed, record.ID)
+			return nil
+		}
+		var digest checksum
+		if n, err := hex.Decode(digest[:], []byte(record.Digest)); err != nil || n != len(digest) {
+			return fmt.Errorf("signatures: record %d: invalid digest", record.Index)
+		}
+		if sh.signed == nil {
+			sh.signed = make(map[int]checksum)
+		}
+		sh.signed[record.ID] = digest
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.chain = chain
+	return nil
+}
+
+// signRecord records a mutation in the signature chain, if any. It must be called while holding
+// the lock of the shard being changed, after the event got its sequence number.
+func (s *Store) signRecord(event ChangeEvent) {
+	if s.chain == nil {
+		return
+	}
+	c, ok := s.collection(event.Model)
+	if !ok {
+		return
+	}
+	sh := c.shard(event.ID)
+	var digest checksum
+	encoded := ""
+	if event.Op != OpDelete {
+		data, err := json.Marshal(event.Item)
+		if err != nil {
+			log.Printf("signatures: %s %d: %v", event.Model, event.ID, err)
+			return
+		}
+		digest = sha256.Sum256(data)
+		encoded = hex.EncodeToString(digest[:])
+	}
+	if err := s.chain.append(event, encoded); err != nil {
+		log.Printf("signatures: %s %d: %v", event.Model, event.ID, err)
+		return
+	}
+	if encoded == "" {
+		delete(sh.signed, event.ID)
+		return
+	}
+	if sh.signed == nil {
+		sh.signed = make(map[int]checksum)
+	}
+	sh.signed[event.ID] = digest
+}
+
+// signed selects the digests of the items as last recorded in the signature chain.
+func signed(sh *storeShard) map[int]checksum {
+	return sh.signed
+}
+
+// SignatureReport is the result of the verification of the signature chain and of the items.
+type SignatureReport struct {
+	Valid     bool        `json:"valid"` // the chain and every item verified
+	Algorithm string      `json:"algorithm"`
+	Records   uint64      `json:"records"` // number of records of the chain verified
+	Head      string      `json:"head"`    // hash of the last record
+	Broken    *ChainBreak `json:"broken,omitempty"`
+	IntegrityReport
+}
+
+// VerifySignatures verifies the signature chain, then the items of every model in memory and in
+// the backend against the digests it last recorded for them.
+func (s *Store) VerifySignatures(ctx context.Context) (SignatureReport, error) {
+	if s.chain == nil {
+		return SignatureReport{}, &Error{Status: http.StatusNotFound, Code: CodeNotFound, Err: localizef("records are not signed")}
+	}
+	report := SignatureReport{Algorithm: s.chain.signer.Algorithm(), IntegrityReport: IntegrityReport{Mismatches: []IntegrityMismatch{}}}
+	count, head := s.chain.state()
+	file, err := os.Open(s.chain.path)
+	if err != nil {
+		return report, err
+	}
+	report.Records, report.Head, report.Broken = VerifyChain(file, s.chain.signer, count)
+	file.Close()
+	if report.Broken == nil && report.Head != head {
+		report.Broken = &ChainBreak{Index: count, Problem: "does not end with the last record signed"}
+	}
+
+	collections := s.allCollections()
+	sort.Slice(collections, func(i, j int) bool { return collections[i].name < collections[j].name })
+	for _, c := range collections {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Mismatches = append(report.Mismatches, s.verifyMemory(c, &report.Checked)...)
+	}
+	if s.storage != nil {
+		if err := s.verifyBackend(ctx, &report.IntegrityReport, "storage", uncached(s.storage), collections, signed); err != nil {
+			return report, err
+		}
+	}
+	report.Valid = report.Broken == nil && len(report.Mismatches) == 0 && len(report.Incomplete) == 0
+	return report, nil
+}
+
+// verifyMemory checks the items of a collection in memory against the digests of the chain, adding
+// the number of items checked to checked, and returns the mismatches ordered by ID.
+func (s *Store) verifyMemory(c *collection, checked *int) []IntegrityMismatch {
+	var mismatches []IntegrityMismatch
+	for _, sh := range c.shards {
+		sh.itemMux.Lock()
+		items := sh.snapshot()
+		items.ascend(func(id int, e entry) bool {
+			*checked++
+			expected, known := sh.signed[id]
+			data, err := json.Marshal(e.item)
+			switch {
+			case err != nil:
+				mismatches = append(mismatches, IntegrityMismatch{Backend: "memory", Model: c.name, ID: id, Problem: IntegrityCorrupt, Error: err.Error()})
+			case !known:
+				mismatches = append(mismatches, IntegrityMismatch{Backend: "memory", Model: c.name, ID: id, Problem: IntegrityUnexpected})
+			case sha256.Sum256(data) != expected:
+				mismatches = append(mismatches, IntegrityMismatch{Backend: "memory", Model: c.name, ID: id, Problem: IntegrityModified})
+			}
+			return true
+		})
+		for id := range sh.signed {
+			if _, ok := items.get(id); !ok {
+				*checked++
+				mismatches = append(mismatches, IntegrityMismatch{Backend: "memory", Model: c.name, ID: id, Problem: IntegrityMissing})
+			}
+		}
+		sh.itemMux.Unlock()
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].ID < mismatches[j].ID })
+	return mismatches
+}
+
+// handleSignatures serves GET /_signatures, describing the chain and the public key records are
+// verified with, and POST /_signatures/verify, verifying the chain and the items.
+func handleSignatures(store *Store, w http.ResponseWriter, r *http.Request) {
+	if strings.TrimPrefix(r.URL.Path, "/_signatures") == "/verify" {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, r, http.MethodPost)
+			return
+		}
+		report, err := store.VerifySignatures(r.Context())
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	count, head := store.chain.state()
+	info := map[string]interface{}{"algorithm": store.chain.signer.Algorithm(), "records": count, "head": head}
+	if signer, ok := store.chain.signer.(*Ed25519Signer); ok {
+		info["publicKey"] = base64.StdEncoding.EncodeToString(signer.PublicKey)
+	}
+	writeJSON(w, http.StatusOK, info)
+}
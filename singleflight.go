@@ -0,0 +1,89 @@
+// File: singleflight.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the coalescing of concurrent identical reads. While a GET of a
+// model route is being answered, every identical GET (same route, query and credentials, as for the
+// response cache) waits for it and receives a copy of its response instead of running the same
+// lookup again, so a burst of clients polling a hot item or list costs a single read of the store
+// and its backend.
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+)
+
+// coalescingStats counts the reads answered with the response of an identical one.
+var coalescingStats = expvar.NewMap("coalescing")
+
+// flight is a read in progress.
+type flight struct {
+	done     chan struct{} // closed once response is set
+	response *bufferedResponse
+}
+
+// Coalescer shares the response of a GET with the identical GETs arriving while it runs.
+type Coalescer struct {
+	flights map[string]*flight
+	mux     sync.Mutex
+}
+
+// NewCoalescer creates an empty coalescer.
+func NewCoalescer() *Coalescer {
+	return &Coalescer{flights: make(map[string]*flight)}
+}
+
+// SetCoalescer makes concurrent identical GETs of the store's model routes share one read.
+// It must be called before the store is used concurrently.
+func (s *Store) SetCoalescer(coalescer *Coalescer) {
+	s.coalescer = coalescer
+}
+
+// serve runs next for the first of concurrent identical GETs and replays its response to the others.
+func (c *Coalescer) serve(model string, w http.ResponseWriter, r *http.Request, next func(w http.ResponseWriter, r *http.Request)) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		next(w, r)
+		return
+	}
+	key := responseKey(model, r)
+
+	c.mux.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.mux.Unlock()
+		<-f.done
+		coalescingStats.Add("shared", 1)
+		f.response.writeTo(w)
+		return
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mux.Unlock()
+
+	response := newBufferedResponse()
+	func() {
+		completed := false
+		defer func() {
+			// Release the waiters before answering, and with an error if the handler panicked
+			shared := response
+			if !completed {
+				shared = newBufferedResponse()
+				shared.status = http.StatusInternalServerError
+			} else if response.status == 0 {
+				response.status = http.StatusOK
+			}
+			c.mux.Lock()
+			delete(c.flights, key)
+			c.mux.Unlock()
+			f.response = shared
+			close(f.done)
+		}()
+		next(response, r)
+		completed = true
+	}()
+	response.writeTo(w)
+}
@@ -0,0 +1,327 @@
+// File: snapshot.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the copy-on-write storage of a shard. The items of a shard live
+// in a persistent tree published through an atomic pointer: readers load the current snapshot and
+// read it without taking any lock, while writers (serialized by the shard lock) derive a new tree
+// from it and atomically swap it in. Reads therefore never wait for writes, and a write copies only
+// the O(log n) nodes on the path to its item, sharing the rest with the snapshots readers hold. The
+// tree keeps the items in ID order, so lists merge the shards instead of sorting every ID.
+
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// entry is a stored item together with its bookkeeping. Entries are never modified in place.
+type entry struct {
+	item     interface{}
+	created  time.Time
+	modified time.Time
+	expires  time.Time
+}
+
+// expired reports whether the entry has passed its expiration time.
+func (e entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// storeShard holds the items whose IDs hash to it.
+type storeShard struct {
+	items    atomic.Value // *entryTree, never modified once published
+	itemMux  sync.Mutex   // serializes writers
+	version  uint64       // number of snapshots published
+	modified int64        // when the last snapshot was published, in Unix nanoseconds
+
+	checksums map[int]checksum // of the items as last written through to the backends; guarded by itemMux
+	signed    map[int]checksum // of the items as last recorded in the signature chain; guarded by itemMux
+}
+
+// newStoreShard creates an empty shard.
+func newStoreShard() *storeShard {
+	sh := &storeShard{}
+	sh.items.Store(&entryTree{})
+	return sh
+}
+
+// snapshot returns the current items of the shard. The tree must not be modified.
+func (sh *storeShard) snapshot() *entryTree {
+	return sh.items.Load().(*entryTree)
+}
+
+// edit returns a private copy of the current items for a writer to modify, in constant time.
+// It must be called while holding the shard lock.
+func (sh *storeShard) edit() *entryTree {
+	current := *sh.snapshot()
+	return &current
+}
+
+// publish atomically replaces the shard's items with an edited copy.
+// It must be called while holding the shard lock.
+func (sh *storeShard) publish(items *entryTree) {
+	sh.items.Store(items)
+	atomic.AddUint64(&sh.version, 1)
+	atomic.StoreInt64(&sh.modified, time.Now().UnixNano())
+}
+
+// version returns a number that grows every time an item of the collection changes.
+func (c *collection) version() uint64 {
+	var version uint64
+	for _, sh := range c.shards {
+		version += atomic.LoadUint64(&sh.version)
+	}
+	return version
+}
+
+// lastModified returns when an item of the collection last changed, or the zero time if none has.
+func (c *collection) lastModified() time.Time {
+	var latest int64
+	for _, sh := range c.shards {
+		if modified := atomic.LoadInt64(&sh.modified); modified > latest {
+			latest = modified
+		}
+	}
+	if latest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, latest)
+}
+
+// each calls fn for every live item of the collection in ID order, stopping at the first error.
+// The shards are read from their snapshots, so fn may run for as long as it needs without blocking
+// writers.
+func (c *collection) each(fn func(id int, item interface{}) error) error {
+	return c.eachEntry(func(id int, e entry) error {
+		return fn(id, e.item)
+	})
+}
+
+// eachEntry calls fn for every live entry of the collection in ID order, like each. The shards are
+// each in ID order, so they are merged through a heap of their cursors.
+func (c *collection) eachEntry(fn func(id int, e entry) error) error {
+	now := time.Now()
+	cursors := make(cursorHeap, 0, len(c.shards))
+	for _, sh := range c.shards {
+		if cursor := sh.snapshot().cursor(); cursor.node() != nil {
+			cursors = append(cursors, cursor)
+		}
+	}
+	heap.Init(&cursors)
+
+	for len(cursors) > 0 {
+		cursor := cursors[0]
+		if n := cursor.node(); !n.entry.expired(now) {
+			if err := fn(n.id, n.entry); err != nil {
+				return err
+			}
+		}
+		if cursor.next(); cursor.node() == nil {
+			heap.Pop(&cursors)
+		} else {
+			heap.Fix(&cursors, 0)
+		}
+	}
+	return nil
+}
+
+// cursorHeap orders the cursors of shards by the ID of their current entry.
+type cursorHeap []*entryCursor
+
+func (h cursorHeap) Len() int            { return len(h) }
+func (h cursorHeap) Less(i, j int) bool  { return h[i].node().id < h[j].node().id }
+func (h cursorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x interface{}) { *h = append(*h, x.(*entryCursor)) }
+func (h *cursorHeap) Pop() interface{} {
+	old := *h
+	cursor := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cursor
+}
+
+// entryNode is a node of an entryTree. Nodes are never modified once created.
+type entryNode struct {
+	id          int
+	entry       entry
+	left, right *entryNode
+	height      int
+}
+
+// entryTree is a persistent AVL tree of the entries of a shard by ID. The tree of a snapshot never
+// changes: set and remove replace the root of the writer's copy with new nodes along the path to
+// the ID, sharing every other node.
+type entryTree struct {
+	root *entryNode
+	size int
+}
+
+// get returns the entry of an ID.
+func (t *entryTree) get(id int) (entry, bool) {
+	for n := t.root; n != nil; {
+		switch {
+		case id < n.id:
+			n = n.left
+		case id > n.id:
+			n = n.right
+		default:
+			return n.entry, true
+		}
+	}
+	return entry{}, false
+}
+
+// len returns the number of entries.
+func (t *entryTree) len() int {
+	return t.size
+}
+
+// ascend calls fn for every entry in ID order until it returns false.
+func (t *entryTree) ascend(fn func(id int, e entry) bool) {
+	for cursor := t.cursor(); cursor.node() != nil; cursor.next() {
+		if n := cursor.node(); !fn(n.id, n.entry) {
+			return
+		}
+	}
+}
+
+// set adds or replaces the entry of an ID.
+func (t *entryTree) set(id int, e entry) {
+	var added bool
+	t.root, added = t.root.with(id, e)
+	if added {
+		t.size++
+	}
+}
+
+// remove deletes the entry of an ID, if any.
+func (t *entryTree) remove(id int) {
+	var removed bool
+	t.root, removed = t.root.without(id)
+	if removed {
+		t.size--
+	}
+}
+
+// depth returns the height of a subtree, 0 when it is empty.
+func (n *entryNode) depth() int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+// joinEntries returns a new node of an entry over two subtrees whose heights differ by at most one.
+func joinEntries(id int, e entry, left, right *entryNode) *entryNode {
+	height := left.depth()
+	if right.depth() > height {
+		height = right.depth()
+	}
+	return &entryNode{id: id, entry: e, left: left, right: right, height: height + 1}
+}
+
+// balanceEntries returns a new node of an entry over two subtrees whose heights differ by at most
+// two, rotating them so they differ by at most one.
+func balanceEntries(id int, e entry, left, right *entryNode) *entryNode {
+	switch {
+	case left.depth() > right.depth()+1:
+		if left.left.depth() >= left.right.depth() {
+			return joinEntries(left.id, left.entry, left.left, joinEntries(id, e, left.right, right))
+		}
+		lr := left.right
+		return joinEntries(lr.id, lr.entry, joinEntries(left.id, left.entry, left.left, lr.left), joinEntries(id, e, lr.right, right))
+	case right.depth() > left.depth()+1:
+		if right.right.depth() >= right.left.depth() {
+			return joinEntries(right.id, right.entry, joinEntries(id, e, left, right.left), right.right)
+		}
+		rl := right.left
+		return joinEntries(rl.id, rl.entry, joinEntries(id, e, left, rl.left), joinEntries(right.id, right.entry, rl.right, right.right))
+	}
+	return joinEntries(id, e, left, right)
+}
+
+// with returns the subtree holding the entry of an ID, and whether the ID is new to it.
+func (n *entryNode) with(id int, e entry) (*entryNode, bool) {
+	if n == nil {
+		return joinEntries(id, e, nil, nil), true
+	}
+	switch {
+	case id < n.id:
+		left, added := n.left.with(id, e)
+		return balanceEntries(n.id, n.entry, left, n.right), added
+	case id > n.id:
+		right, added := n.right.with(id, e)
+		return balanceEntries(n.id, n.entry, n.left, right), added
+	}
+	return joinEntries(id, e, n.left, n.right), false
+}
+
+// without returns the subtree without the entry of an ID, and whether it held one.
+func (n *entryNode) without(id int) (*entryNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+	switch {
+	case id < n.id:
+		left, removed := n.left.without(id)
+		if !removed {
+			return n, false
+		}
+		return balanceEntries(n.id, n.entry, left, n.right), true
+	case id > n.id:
+		right, removed := n.right.without(id)
+		if !removed {
+			return n, false
+		}
+		return balanceEntries(n.id, n.entry, n.left, right), true
+	case n.left == nil:
+		return n.right, true
+	case n.right == nil:
+		return n.left, true
+	}
+	// Replace the entry with the first one of the right subtree
+	first := n.right
+	for first.left != nil {
+		first = first.left
+	}
+	right, _ := n.right.without(first.id)
+	return balanceEntries(first.id, first.entry, n.left, right), true
+}
+
+// entryCursor walks an entryTree in ID order.
+type entryCursor struct {
+	path []*entryNode // the nodes still to visit whose left subtrees are done, the current one last
+}
+
+// cursor returns a cursor on the first entry of the tree.
+func (t *entryTree) cursor() *entryCursor {
+	cursor := &entryCursor{}
+	cursor.descend(t.root)
+	return cursor
+}
+
+// descend stacks a subtree and its leftmost path.
+func (c *entryCursor) descend(n *entryNode) {
+	for ; n != nil; n = n.left {
+		c.path = append(c.path, n)
+	}
+}
+
+// node returns the current node, nil past the last one.
+func (c *entryCursor) node() *entryNode {
+	if len(c.path) == 0 {
+		return nil
+	}
+	return c.path[len(c.path)-1]
+}
+
+// next moves to the following entry.
+func (c *entryCursor) next() {
+	n := c.path[len(c.path)-1]
+	c.path = c.path[:len(c.path)-1]
+	c.descend(n.right)
+}
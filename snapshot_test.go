@@ -0,0 +1,169 @@
+// File: snapshot_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the copy-on-write storage of the shards against a map, checks that
+// snapshots never change and that lists are in ID order, and benchmarks the cost of a write and of
+// a list as the number of stored items grows.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// checkTree fails unless a tree holds exactly the entries of want, in ID order and balanced.
+func checkTree(t *testing.T, tree *entryTree, want map[int]entry) {
+	t.Helper()
+	if tree.len() != len(want) {
+		t.Fatalf("tree holds %d entries, want %d", tree.len(), len(want))
+	}
+	var ids []int
+	tree.ascend(func(id int, e entry) bool {
+		if e != want[id] {
+			t.Fatalf("entry %d is %+v, want %+v", id, e, want[id])
+		}
+		ids = append(ids, id)
+		return true
+	})
+	if len(ids) != len(want) || !sort.IntsAreSorted(ids) {
+		t.Fatalf("tree visits %v, want the %d IDs in order", ids, len(want))
+	}
+	var balanced func(n *entryNode) bool
+	balanced = func(n *entryNode) bool {
+		if n == nil {
+			return true
+		}
+		left, right := n.left.depth(), n.right.depth()
+		height := left
+		if right > height {
+			height = right
+		}
+		return left-right >= -1 && left-right <= 1 && n.height == height+1 && balanced(n.left) && balanced(n.right)
+	}
+	if !balanced(tree.root) {
+		t.Fatal("tree is not balanced")
+	}
+}
+
+func TestEntryTreeMatchesMap(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	tree, want := &entryTree{}, make(map[int]entry)
+	for i := 0; i < 5000; i++ {
+		id := random.Intn(500)
+		if random.Intn(3) == 0 {
+			tree.remove(id)
+			delete(want, id)
+		} else {
+			e := entry{item: i}
+			tree.set(id, e)
+			want[id] = e
+		}
+		if e, ok := tree.get(id); ok != (want[id].item != nil) || e != want[id] {
+			t.Fatalf("get(%d) = %+v, %v after operation %d", id, e, ok, i)
+		}
+	}
+	checkTree(t, tree, want)
+}
+
+func TestSnapshotsNeverChange(t *testing.T) {
+	sh := newStoreShard()
+	want := make(map[int]entry)
+	for id := 1; id <= 100; id++ {
+		items := sh.edit()
+		items.set(id, entry{item: id})
+		sh.publish(items)
+		want[id] = entry{item: id}
+	}
+	before := sh.snapshot()
+
+	items := sh.edit()
+	for id := 1; id <= 100; id += 2 {
+		items.remove(id)
+	}
+	items.set(50, entry{item: "changed"})
+	items.set(101, entry{item: 101})
+	sh.publish(items)
+
+	checkTree(t, before, want)
+	if e, _ := sh.snapshot().get(50); e.item != "changed" || sh.snapshot().len() != 51 {
+		t.Fatalf("published tree holds %d entries and %v at 50", sh.snapshot().len(), e.item)
+	}
+}
+
+func TestListsAreInIDOrder(t *testing.T) {
+	store := NewShardedStore(7)
+	store.Register("tag", Tag{})
+	for i := 0; i < 200; i++ {
+		store.Create("tag", &Tag{Name: "tag"})
+	}
+	for id := 3; id <= 200; id += 3 {
+		store.Delete("tag", id)
+	}
+	var tags []Tag
+	store.Find("tag", nil, &tags)
+	if len(tags) != 134 {
+		t.Fatalf("listed %d tags, want 134", len(tags))
+	}
+	for i := 1; i < len(tags); i++ {
+		if tags[i-1].ID >= tags[i].ID {
+			t.Fatalf("tag %d listed before tag %d", tags[i-1].ID, tags[i].ID)
+		}
+	}
+}
+
+// benchmarkSizes are the numbers of items stored before measuring.
+var benchmarkSizes = []int{1000, 10000, 100000}
+
+// filledStore creates a store holding n tags.
+func filledStore(n int) *Store {
+	store := newTestStore()
+	for i := 0; i < n; i++ {
+		store.Create("tag", &Tag{Name: "tag"})
+	}
+	return store
+}
+
+func BenchmarkCreate(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("items=%d", n), func(b *testing.B) {
+			store := filledStore(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.Create("tag", &Tag{Name: "new"})
+			}
+		})
+	}
+}
+
+func BenchmarkUpdate(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("items=%d", n), func(b *testing.B) {
+			store := filledStore(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.Update("tag", 1+i%n, &Tag{Name: "updated"})
+			}
+		})
+	}
+}
+
+func BenchmarkList(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("items=%d", n), func(b *testing.B) {
+			store := filledStore(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var tags []Tag
+				store.Find("tag", nil, &tags)
+			}
+		})
+	}
+}
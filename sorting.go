@@ -0,0 +1,156 @@
+// File: sorting.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements sorted lists. A collection GET with ?sort=title,-id answers the
+// items matching the usual filters ordered by the listed fields, those prefixed with - in
+// descending order, then by ID, before the page is selected. Strings are compared with the
+// collator of the store (see collation.go and the -collation flag), in byte order without one, and
+// ?locale=sv sorts a request in the order of another locale. Masked fields cannot be sorted by
+// callers who see them masked.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// SortField orders items by a field, in descending order when Desc.
+type SortField struct {
+	Field string // Go or JSON name
+	Desc  bool
+}
+
+// ParseSort parses a sort order of the form "title,-id": fields separated by commas, those
+// prefixed with - descending.
+func ParseSort(spec string) []SortField {
+	var order []SortField
+	for _, name := range splitFields(spec) {
+		desc := strings.HasPrefix(name, "-")
+		order = append(order, SortField{Field: strings.TrimPrefix(name, "-"), Desc: desc})
+	}
+	return order
+}
+
+// SetCollator sets the collator strings are sorted with; they are sorted in byte order when it is
+// nil.
+func (s *Store) SetCollator(collator Collator) {
+	s.typeMux.Lock()
+	defer s.typeMux.Unlock()
+	s.collator = collator
+}
+
+// collation returns the collator strings are sorted with, nil for byte order.
+func (s *Store) collation() Collator {
+	s.typeMux.RLock()
+	defer s.typeMux.RUnlock()
+	return s.collator
+}
+
+// sortFields resolves the fields of a sort order, checking they can be ordered.
+func sortFields(meta *modelMeta, order []SortField) ([]*fieldMeta, error) {
+	fields := make([]*fieldMeta, len(order))
+	for i, o := range order {
+		f, ok := meta.field(o.Field)
+		if !ok {
+			return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", o.Field)}
+		}
+		if !orderable(f.typ) || f.jsonName == "-" {
+			return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("field %s cannot be sorted", o.Field)}
+		}
+		fields[i] = f
+	}
+	return fields, nil
+}
+
+// sortMatches orders matched items by the fields of a sort order, keeping the ID order of items
+// holding the same values. Strings are compared with collator, in byte order when it is nil.
+func sortMatches(found []match, fields []*fieldMeta, order []SortField, collator Collator) {
+	sort.SliceStable(found, func(i, j int) bool {
+		for k, f := range fields {
+			a, b := f.value(found[i].item), f.value(found[j].item)
+			var c int
+			if collator != nil && f.typ.Kind() == reflect.String {
+				c = collator.CompareString(a.String(), b.String())
+			} else {
+				c = compareValues(a, b)
+			}
+			if c != 0 {
+				return (c < 0) != order[k].Desc
+			}
+		}
+		return false
+	})
+}
+
+// FindSorted retrieves the items of a model matching every filter into result (a pointer to a
+// slice) like Find, ordered by the fields of order, then by ID.
+func (s *Store) FindSorted(model string, filters []Filter, order []SortField, result interface{}) error {
+	meta, ok := s.meta(model)
+	if !ok {
+		return fmt.Errorf("model %q is not registered", model)
+	}
+	fields, err := sortFields(meta, order)
+	if err != nil {
+		return err
+	}
+	found, err := s.matching(model, filters)
+	if err != nil {
+		return err
+	}
+	sortMatches(found, fields, order, s.collation())
+
+	itemSlice := reflect.ValueOf(result).Elem()
+	for _, m := range found {
+		elem := reflect.New(itemSlice.Type().Elem()).Elem()
+		assignItem(elem, m.item)
+		itemSlice.Set(reflect.Append(itemSlice, elem))
+	}
+	return nil
+}
+
+// handleSorted answers a collection GET with ?sort=: the page of the items matching the filters in
+// the order asked for, expanded with their includes.
+func handleSorted(store *Store, model string, meta *modelMeta, filters []Filter, page Page, includes []include, w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	order := ParseSort(values.Get("sort"))
+	fields, err := sortFields(meta, order)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if refuseMasked(w, r, meta, fields) {
+		return
+	}
+	collator := store.collation()
+	if locale := values.Get("locale"); locale != "" {
+		if collator, err = NewCollator(locale); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid locale")
+			return
+		}
+	}
+
+	found, err := store.matching(model, filters)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	sortMatches(found, fields, order, collator)
+	setTotalCount(w, r, len(found))
+	start, end := page.bounds(len(found))
+	selected := make([]interface{}, 0, end-start)
+	for _, m := range found[start:end] {
+		selected = append(selected, m.item)
+	}
+	expanded, err := store.expandFor(w, meta, selected, includes)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, expanded)
+}
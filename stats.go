@@ -0,0 +1,248 @@
+// File: stats.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements per-model statistics for dashboards, without a separate
+// analytics pipeline. GET /{model}/_stats answers the number of items, when the model last changed,
+// how many items were created in each time bucket of a recent window (?bucket=1h&window=24h, the
+// defaults; buckets without items are included with a count of zero) and, for the fields named by
+// ?fields=done,userId, the distribution of their values: the most frequent ones (?top=10) with
+// their counts, the number of distinct values and how many items hold the others. Masked fields
+// have no distribution for callers that see them masked.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Limits of the statistics.
+const (
+	defaultStatsBucket = time.Hour
+	defaultStatsWindow = 24 * time.Hour
+	defaultStatsTop    = 10
+	maxStatsBuckets    = 1000
+)
+
+// StatsQuery describes the statistics computed for a model.
+type StatsQuery struct {
+	Fields []string      // fields whose value distribution is computed, by Go or JSON name
+	Bucket time.Duration // width of the creation-rate buckets
+	Window time.Duration // how far back the creation rate goes
+	Top    int           // number of most frequent values listed per field
+}
+
+// ModelStats are the statistics of a model.
+type ModelStats struct {
+	Model         string                       `json:"model"`
+	Count         int                          `json:"count"`
+	Modified      *time.Time                   `json:"modified,omitempty"` // when the model last changed
+	Created       []StatsBucket                `json:"created"`            // items created per bucket, oldest first
+	Bucket        string                       `json:"bucket"`
+	Distributions map[string]ValueDistribution `json:"distributions,omitempty"` // by JSON field name
+}
+
+// StatsBucket counts the items created in a time bucket.
+type StatsBucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// ValueDistribution describes the values a field holds.
+type ValueDistribution struct {
+	Values   []ValueCount `json:"values"` // the most frequent values, most frequent first
+	Distinct int          `json:"distinct"`
+	Other    int          `json:"other"` // number of items holding the values not listed
+}
+
+// ValueCount is the number of items holding a value.
+type ValueCount struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+}
+
+// Stats computes the statistics of a model. Zero values of the query take their defaults.
+func (s *Store) Stats(model string, query StatsQuery) (ModelStats, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return ModelStats{}, fmt.Errorf("model %q is not registered", model)
+	}
+	if query.Bucket <= 0 {
+		query.Bucket = defaultStatsBucket
+	}
+	if query.Window <= 0 {
+		query.Window = defaultStatsWindow
+	}
+	if query.Top <= 0 {
+		query.Top = defaultStatsTop
+	}
+	if query.Window/query.Bucket > maxStatsBuckets {
+		return ModelStats{}, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("a window of %s holds more than %d buckets of %s", query.Window, maxStatsBuckets, query.Bucket)}
+	}
+	fields, err := distributionFields(c.meta, query.Fields)
+	if err != nil {
+		return ModelStats{}, err
+	}
+
+	stats := ModelStats{Model: model, Bucket: query.Bucket.String()}
+	if modified := c.lastModified().UTC(); !modified.IsZero() {
+		stats.Modified = &modified
+	}
+	now := time.Now()
+	end := now.Truncate(query.Bucket).Add(query.Bucket)
+	start := end.Add(-query.Window).Truncate(query.Bucket)
+	stats.Created = make([]StatsBucket, 0, int(end.Sub(start)/query.Bucket))
+	for t := start; t.Before(end); t = t.Add(query.Bucket) {
+		stats.Created = append(stats.Created, StatsBucket{Start: t.UTC()})
+	}
+
+	counts := newValueCounts(fields)
+	for _, sh := range c.shards {
+		sh.snapshot().ascend(func(_ int, e entry) bool {
+			if e.expired(now) {
+				return true
+			}
+			stats.Count++
+			if !e.created.Before(start) && e.created.Before(end) {
+				stats.Created[int(e.created.Sub(start)/query.Bucket)].Count++
+			}
+			counts.add(e.item)
+			return true
+		})
+	}
+	stats.Distributions = counts.distributions(query.Top)
+	return stats, nil
+}
+
+// distributionFields resolves the fields named by their Go or JSON names whose value distribution
+// is computed.
+func distributionFields(meta *modelMeta, names []string) ([]*fieldMeta, error) {
+	var fields []*fieldMeta
+	for _, name := range names {
+		f, ok := meta.field(name)
+		if !ok {
+			return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", name)}
+		}
+		if !orderable(f.typ) {
+			return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("field %s has no distribution", name)}
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// countedValue is a value of a field and the number of items holding it.
+type countedValue struct {
+	value reflect.Value
+	count int
+}
+
+// valueCounts counts the values fields hold across items.
+type valueCounts struct {
+	fields []*fieldMeta
+	counts []map[interface{}]*countedValue
+}
+
+// newValueCounts creates counts of the values of fields.
+func newValueCounts(fields []*fieldMeta) *valueCounts {
+	vc := &valueCounts{fields: fields, counts: make([]map[interface{}]*countedValue, len(fields))}
+	for i := range vc.counts {
+		vc.counts[i] = make(map[interface{}]*countedValue)
+	}
+	return vc
+}
+
+// add counts the values of an item.
+func (vc *valueCounts) add(item interface{}) {
+	v := reflect.ValueOf(item).Elem()
+	for i, f := range vc.fields {
+		value := v.FieldByIndex(f.index)
+		key := hashKey(value)
+		if n, ok := vc.counts[i][key]; ok {
+			n.count++
+		} else {
+			vc.counts[i][key] = &countedValue{value: value, count: 1}
+		}
+	}
+}
+
+// distributions returns the distribution of the values of each field by JSON name, listing the top
+// most frequent values (ties in value order), or nil without fields.
+func (vc *valueCounts) distributions(top int) map[string]ValueDistribution {
+	if len(vc.fields) == 0 {
+		return nil
+	}
+	distributions := make(map[string]ValueDistribution, len(vc.fields))
+	for i, f := range vc.fields {
+		values := make([]*countedValue, 0, len(vc.counts[i]))
+		for _, n := range vc.counts[i] {
+			values = append(values, n)
+		}
+		sort.Slice(values, func(a, b int) bool {
+			if values[a].count != values[b].count {
+				return values[a].count > values[b].count
+			}
+			return compareValues(values[a].value, values[b].value) < 0
+		})
+		distribution := ValueDistribution{Values: []ValueCount{}, Distinct: len(values)}
+		for j, n := range values {
+			if j < top {
+				distribution.Values = append(distribution.Values, ValueCount{Value: n.value.Interface(), Count: n.count})
+			} else {
+				distribution.Other += n.count
+			}
+		}
+		distributions[f.jsonName] = distribution
+	}
+	return distributions
+}
+
+// handleStats serves GET /{model}/_stats?bucket=1h&window=24h&fields=...&top=10, answering the
+// statistics of a model.
+func handleStats(store *Store, model string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	values := r.URL.Query()
+	query := StatsQuery{Fields: splitFields(values.Get("fields"))}
+	for param, target := range map[string]*time.Duration{"bucket": &query.Bucket, "window": &query.Window} {
+		if v := values.Get(param); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				writeProblem(w, r, http.StatusBadRequest, "Invalid "+param)
+				return
+			}
+			*target = d
+		}
+	}
+	if v := values.Get("top"); v != "" {
+		top, err := strconv.Atoi(v)
+		if err != nil || top <= 0 {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid top")
+			return
+		}
+		query.Top = top
+	}
+	meta, _ := store.meta(model)
+	fields, err := distributionFields(meta, query.Fields)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if refuseMasked(w, r, meta, fields) {
+		return
+	}
+	stats, err := store.Stats(model, query)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
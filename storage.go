@@ -0,0 +1,188 @@
+// File: storage.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file defines the Storage interface implemented by persistent backends. The
+// in-memory store stays the primary copy of the data: every mutation is written through to the
+// configured backend while the shard lock is held, so the backend always sees the writes of an item
+// in order, and the store is loaded back from the backend on startup.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// Storage is a persistent backend holding the encoded items of each model.
+type Storage interface {
+	// Put stores the encoded item under its model and ID, replacing any previous version.
+	Put(model string, id int, data []byte) error
+	// Get returns the encoded item stored under its model and ID.
+	Get(model string, id int) ([]byte, bool, error)
+	// Delete removes an item. Deleting a missing item is not an error.
+	Delete(model string, id int) error
+	// Models returns the names of the models that have stored items.
+	Models() ([]string, error)
+	// Scan calls fn for every item of a model in ID order, stopping at the first error.
+	Scan(model string, fn func(id int, data []byte) error) error
+	// Close flushes and releases the backend.
+	Close() error
+}
+
+// ContextStorage is a Storage whose operations also receive the context of the store operation
+// they serve, for backends propagating deadlines and traces (a database driver, a remote service).
+// Writes receive a context that is never canceled: a write applied in memory is always written
+// through, so the backend cannot fall behind the store when a client disconnects.
+type ContextStorage interface {
+	Storage
+	// PutContext stores the encoded item like Put.
+	PutContext(ctx context.Context, model string, id int, data []byte) error
+	// DeleteContext removes an item like Delete.
+	DeleteContext(ctx context.Context, model string, id int) error
+	// ScanContext calls fn for every item of a model like Scan, stopping when ctx is done.
+	ScanContext(ctx context.Context, model string, fn func(id int, data []byte) error) error
+}
+
+// SetStorage makes the store write every mutation through to a persistent backend.
+// It must be called before the store is used concurrently.
+func (s *Store) SetStorage(storage Storage) {
+	s.storage = storage
+}
+
+// Load adds the items stored in a backend, recording a create event for each so listeners
+// (projections, views) see them. Models must be registered beforehand so items can be decoded into
+// their types; stored models that are not registered are skipped.
+func (s *Store) Load(storage Storage) error {
+	return s.LoadContext(context.Background(), storage)
+}
+
+// LoadContext adds the items stored in a backend like Load, stopping with the error of ctx once it
+// is done.
+func (s *Store) LoadContext(ctx context.Context, storage Storage) error {
+	models, err := storage.Models()
+	if err != nil {
+		return err
+	}
+	for _, model := range models {
+		c, ok := s.collection(model)
+		if !ok {
+			continue
+		}
+		err := scanStorage(ctx, storage, c.name, func(id int, data []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := reflect.New(c.meta.typ).Interface()
+			if err := json.Unmarshal(data, item); err != nil {
+				return fmt.Errorf("storage: %s %d: %w", c.name, id, err)
+			}
+			if err := openFields(c.name, id, item); err != nil {
+				return fmt.Errorf("storage: %w", err)
+			}
+			s.notify(s.load(c, id, item, data))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanStorage scans the items of a model in a backend, passing ctx to those accepting one.
+func scanStorage(ctx context.Context, storage Storage, model string, fn func(id int, data []byte) error) error {
+	if cs, ok := storage.(ContextStorage); ok {
+		return cs.ScanContext(ctx, model, fn)
+	}
+	return storage.Scan(model, fn)
+}
+
+// load inserts an item read from a backend without writing it back (nor to the WAL), keeping the
+// model's ID counter ahead of it.
+func (s *Store) load(c *collection, id int, item interface{}, data []byte) ChangeEvent {
+	sh := c.shard(id)
+	sh.itemMux.Lock()
+	items := sh.edit()
+	old, exists := items.get(id)
+	if exists {
+		c.reindex(id, old.item, nil)
+	}
+	now := time.Now()
+	items.set(id, entry{item: item, created: now, modified: now, expires: c.meta.expiryFor(item, time.Time{})})
+	sh.publish(items)
+	c.reindex(id, nil, item)
+	c.track(id)
+	s.remember(c.name, id, item, data)
+	event := s.sequence(ChangeEvent{Op: OpCreate, Model: c.name, ID: id, Item: item})
+	sh.itemMux.Unlock()
+
+	for {
+		next := atomic.LoadInt64(&c.nextID)
+		if int64(id) < next || atomic.CompareAndSwapInt64(&c.nextID, next, int64(id)+1) {
+			break
+		}
+	}
+	return event
+}
+
+// persist writes a mutation through to the backend and the mirror, if they are configured; a nil
+// item deletes. It must be called while holding the shard lock so writes to an item reach the
+// backend in order. The values of ctx reach the backends, but not its cancellation.
+func (s *Store) persist(ctx context.Context, model string, id int, item interface{}) {
+	if s.storage == nil && s.mirror == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	var data []byte
+	if item != nil {
+		var err error
+		if data, err = encodeItem(model, id, item); err != nil {
+			log.Printf("storage: cannot encode %s %d: %v", model, id, err)
+			return
+		}
+	}
+	s.remember(model, id, item, data)
+	if s.storage != nil {
+		if err := writeStorage(ctx, s.storage, model, id, data); err != nil {
+			log.Printf("storage: cannot persist %s %d: %v", model, id, err)
+		}
+	}
+	if s.mirror != nil {
+		if err := writeStorage(ctx, s.mirror, model, id, data); err != nil {
+			mirrorStats.Add("write_errors", 1)
+			log.Printf("mirror: cannot persist %s %d: %v", model, id, err)
+		}
+	}
+}
+
+// encodeItem returns the encoding of an item written to the backends, its encrypted fields sealed.
+func encodeItem(model string, id int, item interface{}) ([]byte, error) {
+	sealed, err := sealFields(model, id, item)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed)
+}
+
+// writeStorage stores an encoded item in a backend, or deletes it when data is nil, passing ctx to
+// the backends accepting one.
+func writeStorage(ctx context.Context, storage Storage, model string, id int, data []byte) error {
+	if cs, ok := storage.(ContextStorage); ok {
+		if data == nil {
+			return cs.DeleteContext(ctx, model, id)
+		}
+		return cs.PutContext(ctx, model, id, data)
+	}
+	if data == nil {
+		return storage.Delete(model, id)
+	}
+	return storage.Put(model, id, data)
+}
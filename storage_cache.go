@@ -0,0 +1,144 @@
+// File: storage_cache.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements a read-through cache in front of a Storage backend. CachedStorage
+// implements Storage itself: reads of recently used items are answered from a bounded in-memory LRU
+// cache and only misses reach the backend, while every write goes to the backend and invalidates the
+// cached copy. Hits, misses and evictions are published through expvar.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"sync"
+)
+
+// storageCacheStats counts the hits, misses and evictions of storage caches.
+var storageCacheStats = expvar.NewMap("storage_cache")
+
+// cacheKey identifies a cached item.
+type cacheKey struct {
+	model string
+	id    int
+}
+
+// cacheEntry is a cached encoded item.
+type cacheEntry struct {
+	key  cacheKey
+	data []byte
+}
+
+// CachedStorage is a Storage answering reads from an LRU cache of up to MaxItems encoded items.
+type CachedStorage struct {
+	Storage
+	MaxItems int
+
+	order    *list.List // front is the least recently used
+	elements map[cacheKey]*list.Element
+	gen      uint64 // bumped on every invalidation, so a slow miss cannot cache a stale read
+	mux      sync.Mutex
+}
+
+// NewCachedStorage wraps a backend with a read-through cache of up to maxItems items.
+func NewCachedStorage(backend Storage, maxItems int) *CachedStorage {
+	return &CachedStorage{
+		Storage:  backend,
+		MaxItems: maxItems,
+		order:    list.New(),
+		elements: make(map[cacheKey]*list.Element),
+	}
+}
+
+// Get returns an item from the cache, reading it from the backend on a miss.
+func (c *CachedStorage) Get(model string, id int) ([]byte, bool, error) {
+	key := cacheKey{model, id}
+
+	c.mux.Lock()
+	if element, ok := c.elements[key]; ok {
+		c.order.MoveToBack(element)
+		data := append([]byte(nil), element.Value.(*cacheEntry).data...)
+		c.mux.Unlock()
+		storageCacheStats.Add("hits", 1)
+		return data, true, nil
+	}
+	gen := c.gen
+	c.mux.Unlock()
+	storageCacheStats.Add("misses", 1)
+
+	data, ok, err := c.Storage.Get(model, id)
+	if err != nil || !ok {
+		return data, ok, err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.gen == gen {
+		c.add(key, append([]byte(nil), data...))
+	}
+	return data, true, nil
+}
+
+// Put stores an item in the backend and invalidates its cached copy.
+func (c *CachedStorage) Put(model string, id int, data []byte) error {
+	defer c.invalidate(cacheKey{model, id})
+	return c.Storage.Put(model, id, data)
+}
+
+// Delete removes an item from the backend and the cache.
+func (c *CachedStorage) Delete(model string, id int) error {
+	defer c.invalidate(cacheKey{model, id})
+	return c.Storage.Delete(model, id)
+}
+
+// PutContext stores an item like Put, passing ctx to a backend accepting one.
+func (c *CachedStorage) PutContext(ctx context.Context, model string, id int, data []byte) error {
+	defer c.invalidate(cacheKey{model, id})
+	return writeStorage(ctx, c.Storage, model, id, data)
+}
+
+// DeleteContext removes an item like Delete, passing ctx to a backend accepting one.
+func (c *CachedStorage) DeleteContext(ctx context.Context, model string, id int) error {
+	defer c.invalidate(cacheKey{model, id})
+	return writeStorage(ctx, c.Storage, model, id, nil)
+}
+
+// ScanContext scans the items of a model in the backend, passing ctx to a backend accepting one.
+func (c *CachedStorage) ScanContext(ctx context.Context, model string, fn func(id int, data []byte) error) error {
+	return scanStorage(ctx, c.Storage, model, fn)
+}
+
+// add caches an item, evicting the least recently used ones over the limit. It must be called while
+// holding the lock.
+func (c *CachedStorage) add(key cacheKey, data []byte) {
+	if c.MaxItems <= 0 {
+		return
+	}
+	if element, ok := c.elements[key]; ok {
+		element.Value.(*cacheEntry).data = data
+		c.order.MoveToBack(element)
+		return
+	}
+	c.elements[key] = c.order.PushBack(&cacheEntry{key: key, data: data})
+	for c.order.Len() > c.MaxItems {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.elements, oldest.Value.(*cacheEntry).key)
+		storageCacheStats.Add("evictions", 1)
+	}
+}
+
+// invalidate drops the cached copy of an item.
+func (c *CachedStorage) invalidate(key cacheKey) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.gen++
+	if element, ok := c.elements[key]; ok {
+		c.order.Remove(element)
+		delete(c.elements, key)
+	}
+}
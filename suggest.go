@@ -0,0 +1,210 @@
+// File: suggest.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements suggestions for typeahead components. A prefix index keeps the
+// distinct values of a string field, ignoring case, sorted with the number of items holding each,
+// and is updated on every mutation like the other indexes. Prefix indexes are created with
+// Store.CreateSuggestIndex or declared with a `suggest:"true"` struct tag, and
+// GET /{model}/_suggest?field=Title&prefix=re&limit=10 answers the values starting with the prefix,
+// the most common first.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Limits of suggestions.
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 100
+)
+
+// prefixIndex keeps the distinct values of a string field by lowercase value, sorted.
+type prefixIndex struct {
+	field  *fieldMeta
+	keys   []string                // lowercase values, sorted
+	values map[string]*countedText // by lowercase value
+	mux    sync.RWMutex
+}
+
+// countedText is a value of a field, as first stored, and the number of items holding it.
+type countedText struct {
+	value string
+	count int
+}
+
+// CreateSuggestIndex adds a prefix index on a string field of a model, answering the suggestions
+// of /{model}/_suggest. The field may be given by its Go name or its JSON name.
+func (s *Store) CreateSuggestIndex(model, field string) error {
+	c, ok := s.collection(model)
+	if !ok {
+		return fmt.Errorf("model %q is not registered", model)
+	}
+	f, ok := c.meta.field(field)
+	if !ok {
+		return fmt.Errorf("model %q has no field %q", model, field)
+	}
+	if f.typ.Kind() != reflect.String {
+		return fmt.Errorf("field %q of model %q is not a string", field, model)
+	}
+
+	idx := &prefixIndex{field: f, values: make(map[string]*countedText)}
+
+	// Hold every shard lock while building so no mutation is missed
+	for _, sh := range c.shards {
+		sh.itemMux.Lock()
+	}
+	defer func() {
+		for _, sh := range c.shards {
+			sh.itemMux.Unlock()
+		}
+	}()
+	for _, sh := range c.shards {
+		sh.snapshot().ascend(func(_ int, e entry) bool {
+			idx.add(e.item)
+			return true
+		})
+	}
+
+	c.indexMux.Lock()
+	defer c.indexMux.Unlock()
+	if c.prefixes == nil {
+		c.prefixes = make(map[string]*prefixIndex)
+	}
+	c.prefixes[f.name] = idx
+	return nil
+}
+
+// createSuggestIndexes creates the prefix indexes declared with `suggest` struct tags on a model.
+func (s *Store) createSuggestIndexes(model string, meta *modelMeta) {
+	for _, f := range meta.fields {
+		if f.tag.Get("suggest") == "true" {
+			s.CreateSuggestIndex(model, f.name)
+		}
+	}
+}
+
+// add counts the value of an item.
+func (idx *prefixIndex) add(item interface{}) {
+	value := idx.field.value(item).String()
+	if value == "" {
+		return
+	}
+	key := strings.ToLower(value)
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	if v, ok := idx.values[key]; ok {
+		v.count++
+		return
+	}
+	idx.values[key] = &countedText{value: value, count: 1}
+	pos := sort.SearchStrings(idx.keys, key)
+	idx.keys = append(idx.keys, "")
+	copy(idx.keys[pos+1:], idx.keys[pos:])
+	idx.keys[pos] = key
+}
+
+// remove uncounts the value of an item, dropping values no item holds anymore.
+func (idx *prefixIndex) remove(item interface{}) {
+	key := strings.ToLower(idx.field.value(item).String())
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	v, ok := idx.values[key]
+	if !ok {
+		return
+	}
+	if v.count--; v.count > 0 {
+		return
+	}
+	delete(idx.values, key)
+	if pos := sort.SearchStrings(idx.keys, key); pos < len(idx.keys) && idx.keys[pos] == key {
+		idx.keys = append(idx.keys[:pos], idx.keys[pos+1:]...)
+	}
+}
+
+// suggest returns up to limit values starting with a prefix, ignoring case, the most common first
+// (ties in value order).
+func (idx *prefixIndex) suggest(prefix string, limit int) []ValueCount {
+	prefix = strings.ToLower(prefix)
+	idx.mux.RLock()
+	var matches []*countedText
+	for pos := sort.SearchStrings(idx.keys, prefix); pos < len(idx.keys) && strings.HasPrefix(idx.keys[pos], prefix); pos++ {
+		matches = append(matches, idx.values[idx.keys[pos]])
+	}
+	idx.mux.RUnlock()
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].count > matches[j].count
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	suggestions := make([]ValueCount, len(matches))
+	for i, m := range matches {
+		suggestions[i] = ValueCount{Value: m.value, Count: m.count}
+	}
+	return suggestions
+}
+
+// Suggest returns up to limit distinct values of a field of a model starting with a prefix,
+// ignoring case, the most common first. The field needs a prefix index.
+func (s *Store) Suggest(model, field, prefix string, limit int) ([]ValueCount, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return nil, fmt.Errorf("model %q is not registered", model)
+	}
+	f, ok := c.meta.field(field)
+	if !ok {
+		return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", field)}
+	}
+	c.indexMux.RLock()
+	idx, ok := c.prefixes[f.name]
+	c.indexMux.RUnlock()
+	if !ok {
+		return nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("field %s has no prefix index", field)}
+	}
+	if limit <= 0 {
+		limit = defaultSuggestLimit
+	}
+	return idx.suggest(prefix, limit), nil
+}
+
+// handleSuggest serves GET /{model}/_suggest?field=...&prefix=...&limit=10, answering the values of
+// the field starting with the prefix as {"suggestions": [{"value": "Read docs", "count": 2}]}.
+func handleSuggest(store *Store, model string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	values := r.URL.Query()
+	limit := defaultSuggestLimit
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxSuggestLimit {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+	meta, _ := store.meta(model)
+	if f, ok := meta.field(values.Get("field")); ok && refuseMasked(w, r, meta, []*fieldMeta{f}) {
+		return
+	}
+	suggestions, err := store.Suggest(model, values.Get("field"), values.Get("prefix"), limit)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]ValueCount{"suggestions": suggestions})
+}
@@ -0,0 +1,181 @@
+// File: tenancy.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements multi-tenancy. A request selects a tenant with the X-Tenant-ID
+// header or a /t/{tenant}/{model} path prefix, and each tenant gets its own collection of every
+// model, named "{tenant}/{model}" inside the store. Tenant collections are created from the base
+// model on the first write, with their own ID sequence, indexes and limits, so tenants never see (or
+// number) each other's items; reads of a tenant without items answer empty without creating any.
+// Only the known tenants are served: those allowed by the operator or given a quota, those bound to
+// an API key and those already holding items. The admin token creates other tenants. An API key
+// bound to a tenant only reaches that tenant.
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// TenantHeader is the request header selecting the tenant.
+const TenantHeader = "X-Tenant-ID"
+
+// maxTenantLength is the longest tenant ID accepted.
+const maxTenantLength = 64
+
+// tenantModel returns the name of a model inside a tenant's namespace. The empty tenant is the
+// default namespace.
+func tenantModel(tenant, model string) string {
+	if tenant == "" {
+		return model
+	}
+	return tenant + "/" + model
+}
+
+// splitTenantModel splits a tenant-scoped model name into its tenant and base model.
+func splitTenantModel(name string) (tenant, model string, ok bool) {
+	tenant, model, ok = strings.Cut(name, "/")
+	if !ok || !validTenant(tenant) || model == "" {
+		return "", name, false
+	}
+	return tenant, model, true
+}
+
+// validTenant reports whether a tenant ID only uses letters, digits, '-', '_' and '.'.
+func validTenant(tenant string) bool {
+	if tenant == "" || len(tenant) > maxTenantLength {
+		return false
+	}
+	for _, r := range tenant {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// tenantCollection creates the collection of a tenant-scoped model name (e.g. "acme/item") from its
+// registered base model, carrying over the base model's item limit.
+func (s *Store) tenantCollection(name string) (*collection, bool) {
+	_, model, ok := splitTenantModel(name)
+	if !ok {
+		return nil, false
+	}
+	s.typeMux.RLock()
+	base, ok := s.collections[model]
+	s.typeMux.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	s.Register(name, reflect.Zero(base.meta.typ).Interface())
+	if limit := base.capacity(); limit != nil {
+		s.SetCapacity(name, limit.Capacity)
+	}
+
+	s.typeMux.RLock()
+	defer s.typeMux.RUnlock()
+	c, ok := s.collections[name]
+	return c, ok
+}
+
+// hasTenant reports whether a tenant holds collections in the store.
+func (s *Store) hasTenant(tenant string) bool {
+	s.typeMux.RLock()
+	defer s.typeMux.RUnlock()
+	for name := range s.collections {
+		if owner, _, ok := splitTenantModel(name); ok && owner == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// namespacedCollections returns the names of the collections of a base model: its own and those of
+// every tenant, in order.
+func (s *Store) namespacedCollections(model string) []string {
+	s.typeMux.RLock()
+	defer s.typeMux.RUnlock()
+	var names []string
+	for name := range s.collections {
+		if _, base, _ := splitTenantModel(name); base == model {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readingMethod reports whether a request only reads.
+func readingMethod(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// serveAbsentCollection answers a read of a model a tenant has no collection of yet as the empty
+// collection it would be, without creating it.
+func serveAbsentCollection(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case subpath(r) != "" || query.Get("id") != "" && !query.Has("ids"):
+		notFound(w, r, "Not found")
+	case query.Get("count") == "true":
+		writeJSON(w, http.StatusOK, map[string]int{"count": 0})
+	default:
+		writeJSON(w, http.StatusOK, []interface{}{})
+	}
+}
+
+// handleTenantRequest serves a model in the namespace of the tenant named by the X-Tenant-ID
+// header, or in the default namespace when the header is absent.
+func handleTenantRequest(tenants *Tenants, model string, w http.ResponseWriter, r *http.Request) {
+	if redirectTrailingSlash(w, r) {
+		return
+	}
+	tenant := r.Header.Get(TenantHeader)
+	if tenant != "" && !validTenant(tenant) {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid tenant")
+		return
+	}
+	tenants.serve(tenant, model, w, withSubpath(r, strings.TrimPrefix(r.URL.Path, "/"+model)))
+}
+
+// handleTenantBatch serves POST /_batch in the namespace of the tenant named by the X-Tenant-ID
+// header, under the tenant's quota like its model routes.
+func handleTenantBatch(tenants *Tenants, w http.ResponseWriter, r *http.Request) {
+	tenant := r.Header.Get(TenantHeader)
+	if tenant != "" && !validTenant(tenant) {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid tenant")
+		return
+	}
+	tenants.admit(tenant, w, r, func(w http.ResponseWriter, r *http.Request) {
+		handleBatch(tenants.store, w, r)
+	})
+}
+
+// handleTenantPath serves /t/{tenant}/{model}[/...] routes in the tenant's namespace.
+func handleTenantPath(tenants *Tenants, w http.ResponseWriter, r *http.Request) {
+	if redirectTrailingSlash(w, r) {
+		return
+	}
+	tenant, route, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/t/"), "/")
+	model, rest, _ := strings.Cut(route, "/")
+	if !ok || model == "" {
+		notFound(w, r, "Not found")
+		return
+	}
+	if !validTenant(tenant) {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid tenant")
+		return
+	}
+	if header := r.Header.Get(TenantHeader); header != "" && header != tenant {
+		writeProblem(w, r, http.StatusBadRequest, "Tenant header does not match path")
+		return
+	}
+	tenants.serve(tenant, model, w, withSubpath(r, rest))
+}
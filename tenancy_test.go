@@ -0,0 +1,140 @@
+// File: tenancy_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the isolation of the tenants: whether selected by the X-Tenant-ID
+// header or the /t/{tenant} path, a tenant numbers its own items and can neither read, list,
+// update nor delete the items of another tenant or of the default namespace. Unknown tenants are
+// refused without creating collections, and API keys bound to a tenant stay in it.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTenantsAreIsolated(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	tenants.Allow("acme", "other")
+	byPath := tenantPathHandler(tenants)
+	byHeader := func(w http.ResponseWriter, r *http.Request) { handleTenantRequest(tenants, "item", w, r) }
+
+	if w := serveTest(byHeader, http.MethodPost, "/item", `{"title":"default"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create in the default namespace: status %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(byPath, http.MethodPost, "/t/acme/item", `{"title":"acme"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create of acme: status %d: %s", w.Code, w.Body)
+	}
+	w := serveTest(byHeader, http.MethodPost, "/item", `{"title":"other"}`, TenantHeader, "other")
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"id":1`) {
+		t.Fatalf("create of other: status %d, want 201 with ID 1 of its own sequence: %s", w.Code, w.Body)
+	}
+
+	// The path and the header select the same namespace
+	if w := serveTest(byHeader, http.MethodGet, "/item?id=1", "", TenantHeader, "acme"); !strings.Contains(w.Body.String(), `"acme"`) {
+		t.Errorf("acme by header reads %s, want its own item", w.Body)
+	}
+	for tenant, title := range map[string]string{"": "default", "acme": "acme", "other": "other"} {
+		w := serveTest(byHeader, http.MethodGet, "/item", "", TenantHeader, tenant)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list of tenant %q: status %d", tenant, w.Code)
+		}
+		for _, theirs := range []string{"default", "acme", "other"} {
+			if listed := strings.Contains(w.Body.String(), `"`+theirs+`"`); listed != (theirs == title) {
+				t.Errorf("list of tenant %q: %s", tenant, w.Body)
+			}
+		}
+	}
+
+	// Writes of a tenant never reach the items of another
+	if w := serveTest(byPath, http.MethodPut, "/t/acme/item?id=1", `{"title":"changed"}`); w.Code != http.StatusOK {
+		t.Fatalf("update of acme: status %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(byPath, http.MethodDelete, "/t/acme/item?id=1", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete of acme: status %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(byPath, http.MethodGet, "/t/acme/item?id=1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleted item of acme: status %d, want 404", w.Code)
+	}
+	for tenant, title := range map[string]string{"": "default", "other": "other"} {
+		w := serveTest(byHeader, http.MethodGet, "/item?id=1", "", TenantHeader, tenant)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"`+title+`"`) {
+			t.Errorf("item 1 of tenant %q after the writes of acme: status %d: %s", tenant, w.Code, w.Body)
+		}
+	}
+}
+
+func TestTenantSelection(t *testing.T) {
+	tenants := NewTenants(newTestStore())
+	tenants.Allow("acme", "other")
+	byPath := tenantPathHandler(tenants)
+	byHeader := func(w http.ResponseWriter, r *http.Request) { handleTenantRequest(tenants, "item", w, r) }
+
+	if w := serveTest(byPath, http.MethodGet, "/t/acme/item", "", TenantHeader, "other"); w.Code != http.StatusBadRequest {
+		t.Errorf("header naming another tenant than the path: status %d, want 400", w.Code)
+	}
+	if w := serveTest(byPath, http.MethodGet, "/t/acme/item", "", TenantHeader, "acme"); w.Code != http.StatusOK {
+		t.Errorf("header naming the tenant of the path: status %d, want 200", w.Code)
+	}
+	for _, tenant := range []string{"a b", "acme/other", strings.Repeat("a", maxTenantLength+1)} {
+		if w := serveTest(byHeader, http.MethodGet, "/item", "", TenantHeader, tenant); w.Code != http.StatusBadRequest {
+			t.Errorf("tenant %q: status %d, want 400", tenant, w.Code)
+		}
+	}
+	if w := serveTest(byPath, http.MethodGet, "/t/a%20b/item", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid tenant in the path: status %d, want 400", w.Code)
+	}
+	if w := serveTest(byPath, http.MethodGet, "/t/acme/unknown", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unregistered model of a tenant: status %d, want 404", w.Code)
+	}
+}
+
+func TestUnknownTenantsCreateNothing(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	tenants.AdminToken = "admin"
+	tenants.Allow("acme")
+	byHeader := func(w http.ResponseWriter, r *http.Request) { handleTenantRequest(tenants, "item", w, r) }
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		if w := serveTest(byHeader, method, "/item", `{"title":"x"}`, TenantHeader, "random"); w.Code != http.StatusNotFound {
+			t.Errorf("%s of an unknown tenant: status %d, want 404", method, w.Code)
+		}
+	}
+	if w := serveTest(byHeader, http.MethodGet, "/item", "", TenantHeader, "acme"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("list of a known tenant without items: status %d: %s", w.Code, w.Body)
+	}
+	if store.registered("random/item") || store.registered("acme/item") {
+		t.Fatal("a read or a refused write created a tenant collection")
+	}
+
+	if w := serveTest(byHeader, http.MethodPost, "/item", `{"title":"new"}`, TenantHeader, "fresh", "Authorization", "Bearer admin"); w.Code != http.StatusCreated {
+		t.Fatalf("admin create of a new tenant: status %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(byHeader, http.MethodGet, "/item?id=1", "", TenantHeader, "fresh"); w.Code != http.StatusOK {
+		t.Errorf("tenant created by the admin: status %d, want 200", w.Code)
+	}
+}
+
+func TestAPIKeysBindTheirTenant(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	keys := NewAPIKeys()
+	keys.Add("acme-key", APIKey{Tenant: "acme"})
+	tenants.Allow(keys.Tenants()...)
+	handler := keys.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handleTenantRequest(tenants, "item", w, r) }))
+
+	if w := serveTest(handler.ServeHTTP, http.MethodPost, "/item", `{"title":"bound"}`, APIKeyHeader, "acme-key"); w.Code != http.StatusCreated || !store.exists("acme/item", 1) {
+		t.Fatalf("create with a bound key: status %d, want 201 in the namespace of acme", w.Code)
+	}
+	if w := serveTest(handler.ServeHTTP, http.MethodGet, "/item", "", APIKeyHeader, "acme-key", TenantHeader, "other"); w.Code != http.StatusForbidden {
+		t.Errorf("bound key selecting another tenant: status %d, want 403", w.Code)
+	}
+	if store.exists("item", 1) {
+		t.Error("bound key wrote to the default namespace")
+	}
+}
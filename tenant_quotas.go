@@ -0,0 +1,419 @@
+// File: tenant_quotas.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements per-tenant quotas and usage accounting. Every tenant request,
+// those of the default namespace included, is checked against its quota (request rate and payload
+// size) before it reaches the CRUD handler, the total items of the quota are enforced where items
+// are created, and the requests, writes, rejections and bytes read from the bodies, chunked ones
+// included, are counted per tenant so SaaS operators can meter usage through the admin route GET
+// /_tenants/{tenant}. The default namespace is reported as the tenant "".
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantQuota limits what a tenant may use; zero values are unlimited.
+type TenantQuota struct {
+	MaxItems   int     `json:"max_items,omitempty"`
+	Rate       float64 `json:"rate,omitempty"` // requests per second
+	Burst      int     `json:"burst,omitempty"`
+	MaxPayload int64   `json:"max_payload,omitempty"` // bytes per request body
+}
+
+// TenantUsage reports the consumption of a tenant.
+type TenantUsage struct {
+	Tenant   string      `json:"tenant"`
+	Items    int         `json:"items"`
+	Requests int64       `json:"requests"`
+	Writes   int64       `json:"writes"`
+	Rejected int64       `json:"rejected"`
+	BytesIn  int64       `json:"bytes_in"`
+	Quota    TenantQuota `json:"quota"`
+}
+
+// Tenants enforces quotas and accounts usage for the tenants of a store.
+type Tenants struct {
+	store *Store
+
+	// Default is the quota of tenants without one of their own.
+	Default TenantQuota
+	// AdminToken lets its holders create the tenants that are not known yet.
+	AdminToken string
+
+	allowed map[string]bool
+	quotas  map[string]TenantQuota
+	usage   map[string]*TenantUsage
+	buckets map[string]*tokenBucket
+	mux     sync.Mutex
+}
+
+// tokenBucket is the state of a token-bucket rate limiter.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTenants creates the tenant registry of a store.
+func NewTenants(store *Store) *Tenants {
+	t := &Tenants{
+		store:   store,
+		allowed: make(map[string]bool),
+		quotas:  make(map[string]TenantQuota),
+		usage:   make(map[string]*TenantUsage),
+		buckets: make(map[string]*tokenBucket),
+	}
+	store.SetItemQuota(func(tenant string) int {
+		t.mux.Lock()
+		defer t.mux.Unlock()
+		return t.quota(tenant).MaxItems
+	})
+	return t
+}
+
+// SetQuota overrides the default quota of a tenant.
+func (t *Tenants) SetQuota(tenant string, quota TenantQuota) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.quotas[tenant] = quota
+}
+
+// Allow makes tenants known, so their callers may use them before they hold any item.
+func (t *Tenants) Allow(tenants ...string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	for _, tenant := range tenants {
+		t.allowed[tenant] = true
+	}
+}
+
+// known reports whether a tenant is served: it was allowed, given a quota or holds items. Callers
+// holding the admin token may also write to unknown tenants, creating them.
+func (t *Tenants) known(tenant string, r *http.Request) bool {
+	t.mux.Lock()
+	_, quota := t.quotas[tenant]
+	allowed := t.allowed[tenant] || quota
+	t.mux.Unlock()
+	if allowed || t.store.hasTenant(tenant) {
+		return true
+	}
+	return !readingMethod(r) && (granted(r, grantAdmin) || t.AdminToken != "" && holdsAdminToken(t.AdminToken, r))
+}
+
+// quota returns the quota of a tenant. It must be called while holding the lock.
+func (t *Tenants) quota(tenant string) TenantQuota {
+	if quota, ok := t.quotas[tenant]; ok {
+		return quota
+	}
+	return t.Default
+}
+
+// account returns the usage counters of a tenant. It must be called while holding the lock.
+func (t *Tenants) account(tenant string) *TenantUsage {
+	usage, ok := t.usage[tenant]
+	if !ok {
+		usage = &TenantUsage{Tenant: tenant}
+		t.usage[tenant] = usage
+	}
+	return usage
+}
+
+// serve checks a tenant request against the tenant's quota, counts it and passes it to the CRUD
+// handler.
+func (t *Tenants) serve(tenant, model string, w http.ResponseWriter, r *http.Request) {
+	t.admit(tenant, w, r, func(w http.ResponseWriter, r *http.Request) {
+		name := tenantModel(tenant, model)
+		if tenant != "" && readingMethod(r) && !t.store.registered(name) && t.store.registered(model) {
+			serveAbsentCollection(w, r)
+			return
+		}
+		handleRequest(t.store, name, w, r)
+	})
+}
+
+// admit checks a tenant request against the tenant's quota, counts it and passes it to next. The
+// default namespace is held to the default quota, or to the one set for the tenant "".
+func (t *Tenants) admit(tenant string, w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if tenant != "" && !t.known(tenant, r) {
+		notFound(w, r, "Unknown tenant")
+		return
+	}
+
+	write := r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch || r.Method == http.MethodDelete
+	t.mux.Lock()
+	quota := t.quota(tenant)
+	usage := t.account(tenant)
+	usage.Requests++
+	status, message, retryAfter := 0, "", time.Duration(0)
+	if ok, wait := t.take(tenant, quota, time.Now()); !ok {
+		status, message, retryAfter = http.StatusTooManyRequests, "Tenant rate limit exceeded", wait
+	} else if quota.MaxPayload > 0 && r.ContentLength > quota.MaxPayload {
+		status, message = http.StatusRequestEntityTooLarge, "Payload exceeds the tenant quota"
+	}
+	if status != 0 {
+		usage.Rejected++
+	} else {
+		if write {
+			usage.Writes++
+		}
+	}
+	t.mux.Unlock()
+
+	if status != 0 {
+		if retryAfter > 0 {
+			setRetryAfter(w, retryAfter)
+		}
+		writeProblem(w, r, status, message)
+		return
+	}
+
+	if quota.MaxPayload > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, quota.MaxPayload)
+	}
+	r.Body = &meteredBody{ReadCloser: r.Body, tenants: t, usage: usage}
+	next(w, r)
+}
+
+// meteredBody counts the bytes read from a request body in the usage of its tenant, whether or not
+// the request announced its length.
+type meteredBody struct {
+	io.ReadCloser
+	tenants *Tenants
+	usage   *TenantUsage
+}
+
+// Read reads from the body and counts the bytes read.
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.tenants.mux.Lock()
+		b.usage.BytesIn += int64(n)
+		b.tenants.mux.Unlock()
+	}
+	return n, err
+}
+
+// take removes a token from the tenant's bucket, returning how long to wait when it is empty.
+// It must be called while holding the lock.
+func (t *Tenants) take(tenant string, quota TenantQuota, now time.Time) (bool, time.Duration) {
+	if quota.Rate <= 0 {
+		return true, 0
+	}
+	burst := bucketSize(quota.Rate, quota.Burst)
+	bucket, ok := t.buckets[tenant]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		t.buckets[tenant] = bucket
+	}
+	return bucket.take(quota.Rate, burst, now)
+}
+
+// bucketSize returns the capacity of a token bucket: burst, or the rate (at least 1) without one.
+func bucketSize(rate float64, burst int) float64 {
+	if burst < 1 {
+		return math.Max(1, rate)
+	}
+	return float64(burst)
+}
+
+// take removes a token from the bucket, refilled with rate tokens per second up to burst,
+// returning how long to wait for one when it is empty.
+func (b *tokenBucket) take(rate, burst float64, now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// setRetryAfter sets the Retry-After header of a response to a wait, in whole seconds.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// Usage returns the usage of a tenant.
+func (t *Tenants) Usage(tenant string) TenantUsage {
+	t.mux.Lock()
+	usage := *t.account(tenant)
+	usage.Quota = t.quota(tenant)
+	t.mux.Unlock()
+
+	usage.Items = t.store.tenantItems(tenant)
+	return usage
+}
+
+// All returns the usage of every tenant seen so far, ordered by tenant.
+func (t *Tenants) All() []TenantUsage {
+	t.mux.Lock()
+	names := make([]string, 0, len(t.usage))
+	for tenant := range t.usage {
+		names = append(names, tenant)
+	}
+	t.mux.Unlock()
+	sort.Strings(names)
+
+	all := make([]TenantUsage, 0, len(names))
+	for _, tenant := range names {
+		all = append(all, t.Usage(tenant))
+	}
+	return all
+}
+
+// errTenantItemQuota is the error of a create exceeding the item quota of its tenant.
+var errTenantItemQuota = &Error{Status: http.StatusForbidden, Code: CodeForbidden, Message: "Tenant item quota exceeded"}
+
+// SetItemQuota sets the function returning the most items a tenant may hold across its models,
+// unlimited when it returns 0. The checked creates (those of the model routes, FindOrCreate and
+// transactions) enforce it.
+func (s *Store) SetItemQuota(quota func(tenant string) int) {
+	s.typeMux.Lock()
+	defer s.typeMux.Unlock()
+	s.itemQuota = quota
+}
+
+// modelTenant returns the tenant owning the collection of a model name, "" for the default
+// namespace.
+func modelTenant(name string) string {
+	tenant, _, _ := splitTenantModel(name)
+	return tenant
+}
+
+// reserveItems checks that creating n items in the collections of models stays within the item
+// quotas of their tenants. It returns the function to call once the items are stored, until which
+// the other creates of the same tenants wait, so concurrent creates cannot overshoot a quota. The
+// tenants are locked in order, so batches spanning several tenants cannot deadlock.
+func (s *Store) reserveItems(created map[string]int) (release func(), err error) {
+	s.typeMux.RLock()
+	quota := s.itemQuota
+	s.typeMux.RUnlock()
+	limits := make(map[string]int)
+	if quota != nil {
+		for model := range created {
+			if max := quota(modelTenant(model)); max > 0 {
+				limits[modelTenant(model)] = max
+			}
+		}
+	}
+	if len(limits) == 0 {
+		return func() {}, nil
+	}
+
+	tenants := make([]string, 0, len(limits))
+	for tenant := range limits {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	locks := make([]*sync.Mutex, len(tenants))
+	s.quotaMux.Lock()
+	if s.quotaLocks == nil {
+		s.quotaLocks = make(map[string]*sync.Mutex)
+	}
+	for i, tenant := range tenants {
+		if s.quotaLocks[tenant] == nil {
+			s.quotaLocks[tenant] = new(sync.Mutex)
+		}
+		locks[i] = s.quotaLocks[tenant]
+	}
+	s.quotaMux.Unlock()
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	release = func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+	}
+
+	wanted := make(map[string]int)
+	for model, n := range created {
+		wanted[modelTenant(model)] += n
+	}
+	for tenant, max := range limits {
+		if s.tenantItems(tenant)+wanted[tenant] > max {
+			release()
+			return nil, errTenantItemQuota
+		}
+	}
+	return release, nil
+}
+
+// tenantItems counts the items of a tenant across all models, those of the default namespace for
+// the tenant "".
+func (s *Store) tenantItems(tenant string) int {
+	count := 0
+	for _, c := range s.allCollections() {
+		if modelTenant(c.name) == tenant {
+			for _, sh := range c.shards {
+				count += sh.snapshot().len()
+			}
+		}
+	}
+	return count
+}
+
+// handleTenantUsage serves GET /_tenants (every tenant, the default namespace as "") and GET
+// /_tenants/{tenant}.
+func handleTenantUsage(tenants *Tenants, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	tenant := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_tenants"), "/")
+	if tenant == "" {
+		writeJSON(w, http.StatusOK, tenants.All())
+		return
+	}
+	if !validTenant(tenant) {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid tenant")
+		return
+	}
+	writeJSON(w, http.StatusOK, tenants.Usage(tenant))
+}
+
+// ParseTenantQuota parses a quota of the form "items=1000,rate=10,burst=20,payload=65536".
+func ParseTenantQuota(spec string) (TenantQuota, error) {
+	var quota TenantQuota
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(rule, "=")
+		if !ok {
+			return quota, fmt.Errorf("invalid quota rule %q", rule)
+		}
+		var err error
+		switch key {
+		case "items":
+			quota.MaxItems, err = strconv.Atoi(value)
+		case "rate":
+			quota.Rate, err = strconv.ParseFloat(value, 64)
+		case "burst":
+			quota.Burst, err = strconv.Atoi(value)
+		case "payload":
+			quota.MaxPayload, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return quota, fmt.Errorf("unknown quota %q", key)
+		}
+		if err != nil {
+			return quota, fmt.Errorf("invalid quota value in %q", rule)
+		}
+	}
+	return quota, nil
+}
@@ -0,0 +1,148 @@
+// File: tenant_quotas_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests the tenant quotas: the item quota holds for every way items are
+// created, concurrent creates included, the rate quota answers 429 with Retry-After, and the
+// default namespace and chunked bodies are metered like the rest.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func tenantPathHandler(tenants *Tenants) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) { handleTenantPath(tenants, w, r) }
+}
+
+func TestTenantItemQuotaHoldsForEveryCreate(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	tenants.Allow("acme", "other")
+	tenants.Default = TenantQuota{MaxItems: 5}
+	handler := tenantPathHandler(tenants)
+
+	w := serveTest(handler, http.MethodPost, "/t/acme/tag/_seed?count=50", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("seed: status %d, want 201: %s", w.Code, w.Body)
+	}
+	if n := store.tenantItems("acme"); n != 5 {
+		t.Fatalf("seed created %d items, want the quota of 5", n)
+	}
+
+	if w := serveTest(handler, http.MethodPost, "/t/acme/tag", `{"name":"a"}`); w.Code != http.StatusForbidden {
+		t.Errorf("create beyond the quota: status %d, want 403", w.Code)
+	}
+	if w := serveTest(handler, http.MethodPost, "/t/acme/tag/_find_or_create?match=name", `{"name":"new"}`); w.Code != http.StatusForbidden {
+		t.Errorf("find or create beyond the quota: status %d, want 403", w.Code)
+	}
+	if w := serveTest(handler, http.MethodPost, "/t/acme/tag/_seed", ""); w.Code != http.StatusForbidden {
+		t.Errorf("seed beyond the quota: status %d, want 403", w.Code)
+	}
+	w = serveTest(batchHandler(tenants), http.MethodPost, "/_batch",
+		`{"operations":[{"op":"create","model":"tag","item":{"name":"a"}}]}`, TenantHeader, "acme")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("batch beyond the quota: status %d, want 403: %s", w.Code, w.Body)
+	}
+	if n := store.tenantItems("acme"); n != 5 {
+		t.Fatalf("tenant holds %d items, want the quota of 5", n)
+	}
+
+	// Other tenants have their own quota
+	if w := serveTest(handler, http.MethodPost, "/t/other/tag", `{"name":"a"}`); w.Code != http.StatusCreated {
+		t.Errorf("create of another tenant: status %d, want 201", w.Code)
+	}
+}
+
+func TestTenantItemQuotaCountsTheBatch(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	tenants.Default = TenantQuota{MaxItems: 3}
+	store.Create("acme/tag", &Tag{Name: "a"})
+	store.Create("acme/item", &Item{Title: "b"})
+
+	w := serveTest(batchHandler(tenants), http.MethodPost, "/_batch",
+		`{"operations":[{"op":"create","model":"tag","item":{"name":"c"}},{"op":"create","model":"item","item":{"title":"d"}}]}`, TenantHeader, "acme")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("batch beyond the quota: status %d, want 403: %s", w.Code, w.Body)
+	}
+	if n := store.tenantItems("acme"); n != 2 {
+		t.Fatalf("failed batch left %d items, want 2", n)
+	}
+	w = serveTest(batchHandler(tenants), http.MethodPost, "/_batch",
+		`{"operations":[{"op":"create","model":"tag","item":{"name":"c"}}]}`, TenantHeader, "acme")
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch within the quota: status %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestTenantItemQuotaUnderConcurrentCreates(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	tenants.SetQuota("acme", TenantQuota{MaxItems: 10})
+	handler := tenantPathHandler(tenants)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			serveTest(handler, http.MethodPost, "/t/acme/tag", fmt.Sprintf(`{"name":"tag %d"}`, i))
+		}(i)
+	}
+	wg.Wait()
+	if n := store.tenantItems("acme"); n != 10 {
+		t.Fatalf("concurrent creates left %d items, want the quota of 10", n)
+	}
+}
+
+func TestTenantRateQuota(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	tenants.Allow("acme", "other")
+	tenants.Default = TenantQuota{Rate: 1, Burst: 2}
+	handler := tenantPathHandler(tenants)
+
+	for i := 0; i < 2; i++ {
+		if w := serveTest(handler, http.MethodGet, "/t/acme/tag", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i, w.Code)
+		}
+	}
+	w := serveTest(handler, http.MethodGet, "/t/acme/tag", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("request beyond the burst: status %d, Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serveTest(handler, http.MethodGet, "/t/other/tag", ""); w.Code != http.StatusOK {
+		t.Fatalf("request of another tenant: status %d, want 200", w.Code)
+	}
+}
+
+func TestDefaultNamespaceAndChunkedBodiesAreMetered(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	tenants.Default = TenantQuota{MaxItems: 1}
+	byHeader := func(w http.ResponseWriter, r *http.Request) { handleTenantRequest(tenants, "tag", w, r) }
+
+	body := `{"name":"chunked"}`
+	r := httptest.NewRequest(http.MethodPost, "/tag", strings.NewReader(body))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	byHeader(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("chunked create: status %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(byHeader, http.MethodPost, "/tag", `{"name":"second"}`); w.Code != http.StatusForbidden {
+		t.Errorf("create beyond the item quota of the default namespace: status %d, want 403", w.Code)
+	}
+	usage := tenants.Usage("")
+	if usage.Requests != 2 || usage.Items != 1 || usage.BytesIn < int64(len(body)) {
+		t.Errorf("usage of the default namespace is %+v, want 2 requests, 1 item and the chunked body counted", usage)
+	}
+}
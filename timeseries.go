@@ -0,0 +1,304 @@
+// File: timeseries.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements time-bucketed queries, so activity-over-time charts can be
+// served from the store. GET /{model}/_timeseries?field=CreatedAt&interval=1d&metric=count buckets
+// the items matching the usual filters by a time field and computes a metric per bucket: count,
+// or sum, avg, min or max of the field named by ?value=. Items are bucketed by a time field, or by
+// the time the store recorded their creation (field=created, the default, also used for a CreatedAt
+// field the model lacks) or last change (field=modified). Intervals are Go durations or days and weeks (1d, 2w);
+// buckets are aligned on UTC midnights for whole days, weeks starting on Monday, and are listed
+// oldest first from ?from= up to ?to= (the range of the items by default), empty ones included.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timeseries metrics.
+const (
+	MetricCount = "count"
+	MetricSum   = "sum"
+	MetricAvg   = "avg"
+	MetricMin   = "min"
+	MetricMax   = "max"
+)
+
+// Recorded times items can be bucketed by.
+const (
+	timeCreated  = "created"
+	timeModified = "modified"
+)
+
+// TimeseriesQuery describes the buckets of a time series.
+type TimeseriesQuery struct {
+	Field    string        // time field, by Go or JSON name, or created (the default) or modified
+	Interval time.Duration // width of the buckets
+	Metric   string        // MetricCount (the default), MetricSum, MetricAvg, MetricMin or MetricMax
+	Value    string        // field the metric is computed over, except for counts
+	From, To time.Time     // range of the buckets, To excluded; that of the items when zero
+}
+
+// Timeseries is a metric computed per time bucket.
+type Timeseries struct {
+	Field    string       `json:"field"`
+	Interval string       `json:"interval"`
+	Metric   string       `json:"metric"`
+	Value    string       `json:"value,omitempty"`
+	Buckets  []TimeBucket `json:"buckets"` // oldest first
+}
+
+// TimeBucket holds the metric of the items of a bucket; averages, minimums and maximums of empty
+// buckets are null.
+type TimeBucket struct {
+	Start time.Time   `json:"start"`
+	Value interface{} `json:"value"`
+}
+
+// timeBucket accumulates the metric of a bucket.
+type timeBucket struct {
+	count    int
+	sum      float64
+	intSum   int64
+	min, max reflect.Value
+}
+
+// parseInterval parses the width of buckets: a Go duration, or a number of days or weeks short
+// enough to be a duration.
+func parseInterval(v string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, err := strconv.ParseInt(strings.TrimSuffix(v, suffix), 10, 64); err == nil && strings.HasSuffix(v, suffix) {
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				return 0, fmt.Errorf("invalid interval %q", v)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid interval %q", v)
+	}
+	return d, nil
+}
+
+// timeseriesFields resolves the time field and the value field of a time series. The time field is
+// nil for the recorded times, which query.Field then names.
+func timeseriesFields(meta *modelMeta, query *TimeseriesQuery) (timeField, value *fieldMeta, err error) {
+	timeType := reflect.TypeOf(time.Time{})
+	switch f, ok := meta.field(query.Field); {
+	case query.Field == "":
+		query.Field = timeCreated
+	case ok && f.typ == timeType:
+		timeField = f
+	case ok:
+		return nil, nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("field %s is not a time", query.Field)}
+	case query.Field == timeCreated || query.Field == timeModified:
+	case strings.EqualFold(query.Field, "createdAt"):
+		query.Field = timeCreated
+	default:
+		return nil, nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", query.Field)}
+	}
+
+	switch query.Metric {
+	case "", MetricCount:
+		query.Metric = MetricCount
+		return timeField, nil, nil
+	case MetricSum, MetricAvg, MetricMin, MetricMax:
+	default:
+		return nil, nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown metric %s", query.Metric)}
+	}
+	f, ok := meta.field(query.Value)
+	switch {
+	case query.Value == "":
+		return nil, nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("the %s metric needs a value field", query.Metric)}
+	case !ok:
+		return nil, nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("unknown field %s", query.Value)}
+	case (query.Metric == MetricSum || query.Metric == MetricAvg) && !isNumericKind(f.typ.Kind()):
+		return nil, nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("field %s cannot be summed", query.Value)}
+	case !orderable(f.typ):
+		return nil, nil, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("field %s cannot be compared", query.Value)}
+	}
+	return timeField, f, nil
+}
+
+// Timeseries computes a metric per time bucket over the items of a model matching every filter.
+func (s *Store) Timeseries(model string, filters []Filter, query TimeseriesQuery) (Timeseries, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return Timeseries{}, fmt.Errorf("model %q is not registered", model)
+	}
+	if query.Interval <= 0 {
+		return Timeseries{}, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("the interval must be positive")}
+	}
+	timeField, value, err := timeseriesFields(c.meta, &query)
+	if err != nil {
+		return Timeseries{}, err
+	}
+	found, err := s.matching(model, filters)
+	if err != nil {
+		return Timeseries{}, err
+	}
+
+	// Find when each item falls, and the range of the buckets
+	times := make([]time.Time, len(found))
+	first, last := query.From, query.To
+	for i, m := range found {
+		switch {
+		case timeField != nil:
+			times[i] = timeField.value(m.item).Interface().(time.Time)
+		case query.Field == timeModified:
+			e, _ := c.shard(m.id).snapshot().get(m.id)
+			times[i] = e.modified
+		default:
+			e, _ := c.shard(m.id).snapshot().get(m.id)
+			times[i] = e.created
+		}
+		if times[i].IsZero() {
+			continue
+		}
+		if query.From.IsZero() && (first.IsZero() || times[i].Before(first)) {
+			first = times[i]
+		}
+		if query.To.IsZero() && times[i].After(last) {
+			last = times[i]
+		}
+	}
+	series := Timeseries{Field: query.Field, Interval: query.Interval.String(), Metric: query.Metric, Buckets: []TimeBucket{}}
+	if value != nil {
+		series.Value = value.jsonName
+	}
+	if first.IsZero() || last.Before(first) || !query.To.IsZero() && !last.After(first) {
+		return series, nil
+	}
+	start := first.UTC().Truncate(query.Interval)
+	n := int(last.Sub(start)/query.Interval) + 1
+	if !query.To.IsZero() {
+		// The end of the range is excluded
+		n = int((last.Sub(start) + query.Interval - 1) / query.Interval)
+	}
+	if n > maxStatsBuckets {
+		return Timeseries{}, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("the range holds more than %d buckets of %s", maxStatsBuckets, query.Interval)}
+	}
+
+	buckets := make([]timeBucket, n)
+	for i, m := range found {
+		if times[i].IsZero() || times[i].Before(first) || times[i].After(last) || !query.To.IsZero() && !times[i].Before(last) {
+			continue
+		}
+		b := &buckets[int(times[i].Sub(start)/query.Interval)]
+		b.count++
+		if value == nil {
+			continue
+		}
+		v := value.value(m.item)
+		switch {
+		case query.Metric == MetricMin:
+			if !b.min.IsValid() || compareValues(v, b.min) < 0 {
+				b.min = v
+			}
+		case query.Metric == MetricMax:
+			if !b.max.IsValid() || compareValues(v, b.max) > 0 {
+				b.max = v
+			}
+		case isIntKind(v.Kind()):
+			b.intSum += v.Int()
+		case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+			b.intSum += int64(v.Uint())
+		default:
+			b.sum += v.Float()
+		}
+	}
+
+	for i, b := range buckets {
+		bucket := TimeBucket{Start: start.Add(time.Duration(i) * query.Interval)}
+		switch query.Metric {
+		case MetricCount:
+			bucket.Value = b.count
+		case MetricSum:
+			if kind := value.typ.Kind(); kind == reflect.Float32 || kind == reflect.Float64 {
+				bucket.Value = b.sum
+			} else {
+				bucket.Value = b.intSum
+			}
+		case MetricAvg:
+			if b.count > 0 {
+				bucket.Value = (b.sum + float64(b.intSum)) / float64(b.count)
+			}
+		case MetricMin:
+			if b.min.IsValid() {
+				bucket.Value = b.min.Interface()
+			}
+		case MetricMax:
+			if b.max.IsValid() {
+				bucket.Value = b.max.Interface()
+			}
+		}
+		series.Buckets = append(series.Buckets, bucket)
+	}
+	return series, nil
+}
+
+// handleTimeseries serves GET /{model}/_timeseries?field=...&interval=1d&metric=count&value=...
+// &from=...&to=..., computing a metric per time bucket over the items matching the filters.
+func handleTimeseries(store *Store, model string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	values := r.URL.Query()
+	query := TimeseriesQuery{Field: values.Get("field"), Metric: values.Get("metric"), Value: values.Get("value"), Interval: 24 * time.Hour}
+	if v := values.Get("interval"); v != "" {
+		interval, err := parseInterval(v)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid interval")
+			return
+		}
+		query.Interval = interval
+	}
+	for param, target := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if v := values.Get(param); v != "" {
+			t, err := parsePointInTime(v)
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, "Invalid "+param)
+				return
+			}
+			*target = t
+		}
+	}
+	meta, _ := store.meta(model)
+	checked := query
+	timeField, value, err := timeseriesFields(meta, &checked)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var fields []*fieldMeta
+	for _, f := range []*fieldMeta{timeField, value} {
+		if f != nil {
+			fields = append(fields, f)
+		}
+	}
+	if refuseMasked(w, r, meta, fields) {
+		return
+	}
+	filters, err := parseFilters(meta, values)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	series, err := store.Timeseries(model, filters, query)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, series)
+}
@@ -0,0 +1,436 @@
+// File: transactions.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements multi-operation transactions. Store.Tx stages the creates,
+// updates and deletes made through a StoreTx, across any number of models, and applies them
+// together once the function returns nil: the shards they touch are locked (in a fixed order, so
+// concurrent transactions cannot deadlock), every updated or deleted item is checked to still
+// exist, and only then is any write published. A transaction whose function fails, or one of whose
+// items was deleted in the meantime, changes nothing. POST /_batch applies a list of operations in
+// a transaction, validating each like the model routes do; relations and keys are checked against
+// the items stored before the batch.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxBatchOperations is the largest number of operations accepted by POST /_batch.
+const maxBatchOperations = 1000
+
+// StoreTx stages the writes of a transaction. Its reads see the writes staged before them.
+type StoreTx interface {
+	// Get retrieves an item like Store.Get.
+	Get(model string, id int, result interface{}) bool
+	// Create stages the creation of an item, assigning its ID right away.
+	Create(model string, item interface{}) (interface{}, error)
+	// Update stages the update of an existing item, keeping its ID.
+	Update(model string, id int, item interface{}) error
+	// Delete stages the deletion of an existing item.
+	Delete(model string, id int) error
+}
+
+// storeTx is the StoreTx of Store.Tx.
+type storeTx struct {
+	ctx    context.Context
+	store  *Store
+	writes map[cacheKey]*txWrite
+	order  []cacheKey // keys of the writes, in the order they were first staged
+}
+
+// txWrite is the staged write of an item: its creation, update or deletion (item is nil).
+type txWrite struct {
+	c    *collection
+	id   int
+	op   string
+	item interface{}
+}
+
+// Tx runs fn and applies the writes it staged atomically, all or nothing. It returns the error of
+// fn, or the one preventing the commit, in which case none of the writes is applied. Listeners are
+// notified of the writes once they are all applied.
+func (s *Store) Tx(fn func(tx StoreTx) error) error {
+	return s.TxContext(context.Background(), fn)
+}
+
+// TxContext runs a transaction like Tx, applying none of its writes once ctx is done. The values
+// of ctx reach the backends the writes are persisted to.
+func (s *Store) TxContext(ctx context.Context, fn func(tx StoreTx) error) error {
+	tx := &storeTx{ctx: ctx, store: s, writes: make(map[cacheKey]*txWrite)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Get retrieves an item, as staged by the transaction or else as stored.
+func (tx *storeTx) Get(model string, id int, result interface{}) bool {
+	w, staged := tx.writes[cacheKey{model, id}]
+	if !staged {
+		return tx.store.Get(model, id, result)
+	}
+	if w.item == nil {
+		return false
+	}
+	assignItem(reflect.ValueOf(result).Elem(), w.item)
+	return true
+}
+
+// Create stages the creation of an item of a registered model and returns it with its ID.
+func (tx *storeTx) Create(model string, item interface{}) (interface{}, error) {
+	c, ok := tx.store.collection(model)
+	if !ok {
+		return nil, &Error{Status: http.StatusNotFound, Code: CodeNotFound, Message: "Unknown model"}
+	}
+	id := tx.store.takeID(c)
+	if c.meta.id != nil {
+		c.meta.id.value(item).SetInt(int64(id))
+	}
+	tx.stage(&txWrite{c: c, id: id, op: OpCreate, item: item})
+	return item, nil
+}
+
+// Update stages the update of an item that exists, in the store or in the transaction. Only the
+// items the transaction created can be updated in immutable models.
+func (tx *storeTx) Update(model string, id int, item interface{}) error {
+	c, ok := tx.store.collection(model)
+	if !ok || !tx.exists(model, id) {
+		return ErrItemNotFound
+	}
+	if c.meta.id != nil {
+		c.meta.id.value(item).SetInt(int64(id))
+	}
+	if w, staged := tx.writes[cacheKey{model, id}]; staged && w.op == OpCreate {
+		w.item = item
+		return nil
+	}
+	if err := tx.store.checkMutable(model); err != nil {
+		return err
+	}
+	tx.stage(&txWrite{c: c, id: id, op: OpUpdate, item: item})
+	return nil
+}
+
+// Delete stages the deletion of an item that exists, in the store or in the transaction. Deleting
+// an item created by the transaction drops its creation, the only deletion immutable models allow.
+func (tx *storeTx) Delete(model string, id int) error {
+	c, ok := tx.store.collection(model)
+	if !ok || !tx.exists(model, id) {
+		return ErrItemNotFound
+	}
+	key := cacheKey{model, id}
+	if w, staged := tx.writes[key]; staged && w.op == OpCreate {
+		delete(tx.writes, key)
+		return nil
+	}
+	if err := tx.store.checkMutable(model); err != nil {
+		return err
+	}
+	tx.stage(&txWrite{c: c, id: id, op: OpDelete})
+	return nil
+}
+
+// exists reports whether an item exists once the writes staged so far are applied.
+func (tx *storeTx) exists(model string, id int) bool {
+	if w, staged := tx.writes[cacheKey{model, id}]; staged {
+		return w.item != nil
+	}
+	return tx.store.exists(model, id)
+}
+
+// stage records a write, replacing the one staged earlier for the same item.
+func (tx *storeTx) stage(w *txWrite) {
+	key := cacheKey{w.c.name, w.id}
+	if _, staged := tx.writes[key]; !staged {
+		tx.order = append(tx.order, key)
+	}
+	tx.writes[key] = w
+}
+
+// txShard is a shard locked by a commit, with the copy of its items being edited.
+type txShard struct {
+	c     *collection
+	index int
+	sh    *storeShard
+	items *entryTree
+}
+
+// commit applies the staged writes under the locks of every shard they touch.
+func (tx *storeTx) commit() error {
+	var writes []*txWrite
+	for _, key := range tx.order {
+		if w, ok := tx.writes[key]; ok {
+			writes = append(writes, w)
+		}
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+
+	// Hold the item quotas of the tenants the writes create items for, then lock the shards in a
+	// fixed order so that concurrent commits cannot deadlock
+	created := make(map[string]int)
+	for _, w := range writes {
+		if w.op == OpCreate {
+			created[w.c.name]++
+		}
+	}
+	release, err := tx.store.reserveItems(created)
+	if err != nil {
+		return err
+	}
+	type shardKey struct {
+		model string
+		index int
+	}
+	shards := make(map[shardKey]*txShard)
+	var locked []*txShard
+	for _, w := range writes {
+		key := shardKey{w.c.name, w.c.shardIndex(w.id)}
+		if _, ok := shards[key]; !ok {
+			shards[key] = &txShard{c: w.c, index: key.index, sh: w.c.shards[key.index]}
+			locked = append(locked, shards[key])
+		}
+	}
+	sort.Slice(locked, func(i, j int) bool {
+		if locked[i].c.name != locked[j].c.name {
+			return locked[i].c.name < locked[j].c.name
+		}
+		return locked[i].index < locked[j].index
+	})
+	var constrained []*collection
+	for _, ts := range locked {
+		if ts.c.constrained() && (len(constrained) == 0 || constrained[len(constrained)-1] != ts.c) {
+			constrained = append(constrained, ts.c)
+		}
+	}
+	for _, c := range constrained {
+		c.uniqueMux.Lock()
+	}
+	for _, ts := range locked {
+		ts.sh.itemMux.Lock()
+	}
+	unlock := func() {
+		for _, ts := range locked {
+			ts.sh.itemMux.Unlock()
+		}
+		for _, c := range constrained {
+			c.uniqueMux.Unlock()
+		}
+		release()
+	}
+
+	// Check that the updated and deleted items still exist before writing anything
+	now := time.Now()
+	for _, w := range writes {
+		if w.op == OpCreate {
+			continue
+		}
+		if e, exists := shards[shardKey{w.c.name, w.c.shardIndex(w.id)}].sh.snapshot().get(w.id); !exists || e.expired(now) {
+			unlock()
+			return ErrItemNotFound
+		}
+	}
+	if err := tx.checkUnique(writes); err != nil {
+		unlock()
+		return err
+	}
+
+	events := make([]ChangeEvent, 0, len(writes))
+	for _, w := range writes {
+		ts := shards[shardKey{w.c.name, w.c.shardIndex(w.id)}]
+		if ts.items == nil {
+			ts.items = ts.sh.edit()
+		}
+		old, exists := ts.items.get(w.id)
+		switch w.op {
+		case OpCreate:
+			ts.items.set(w.id, entry{item: w.item, created: now, modified: now, expires: w.c.meta.expiryFor(w.item, time.Time{})})
+			w.c.reindex(w.id, nil, w.item)
+			w.c.track(w.id)
+			tx.store.persist(tx.ctx, w.c.name, w.id, w.item)
+			events = append(events, tx.store.record(ChangeEvent{Op: OpCreate, Model: w.c.name, ID: w.id, Item: w.item}))
+		case OpUpdate:
+			ts.items.set(w.id, entry{item: w.item, created: old.created, modified: now, expires: w.c.meta.expiryFor(w.item, old.expires)})
+			w.c.reindex(w.id, old.item, w.item)
+			w.c.track(w.id)
+			tx.store.persist(tx.ctx, w.c.name, w.id, w.item)
+			events = append(events, tx.store.record(ChangeEvent{Op: OpUpdate, Model: w.c.name, ID: w.id, Item: w.item, Old: old.item}))
+		case OpDelete:
+			if exists {
+				events = append(events, tx.store.removeLocked(tx.ctx, w.c, ts.items, w.id, old.item, ""))
+			}
+		}
+	}
+	for _, ts := range locked {
+		ts.sh.publish(ts.items)
+	}
+	unlock()
+
+	for _, event := range events {
+		tx.store.notify(event)
+	}
+	for _, ts := range locked {
+		tx.store.evictOverflow(ts.c)
+	}
+	return nil
+}
+
+// checkUnique returns the error of a write giving an item the key or the value of a unique field of
+// another item, stored or written by the transaction. It must be called under the locks of the
+// collections.
+func (tx *storeTx) checkUnique(writes []*txWrite) error {
+	written := make(map[*keyIndex]map[string]int)
+	for _, w := range writes {
+		if w.item == nil || !w.c.constrained() {
+			continue
+		}
+		if err := tx.store.checkKey(w.c.name, w.id, w.item); err != nil {
+			return err
+		}
+		for _, idx := range w.c.keyIndexes() {
+			if !idx.indexed(w.item) {
+				continue
+			}
+			if written[idx] == nil {
+				written[idx] = make(map[string]int)
+			}
+			key := idx.keyOf(w.item)
+			if owner, ok := written[idx][key]; ok && owner != w.id {
+				if idx == w.c.keys {
+					return &Error{Status: http.StatusConflict, Code: CodeConflict, Err: errKeyConflict}
+				}
+				return uniqueConflict(idx.fields[0], w.item)
+			}
+			written[idx][key] = w.id
+		}
+	}
+	return nil
+}
+
+// batchOperation is an operation of a POST /_batch request.
+type batchOperation struct {
+	Op    string          `json:"op"` // create, update or delete
+	Model string          `json:"model"`
+	ID    int             `json:"id,omitempty"`
+	Item  json.RawMessage `json:"item,omitempty"`
+}
+
+// batchResult is the outcome of an operation of a POST /_batch request.
+type batchResult struct {
+	Op    string      `json:"op"`
+	Model string      `json:"model"`
+	ID    int         `json:"id"`
+	Item  interface{} `json:"item,omitempty"`
+}
+
+// handleBatch serves POST /_batch, applying {"operations": [...]} atomically in the namespace of
+// the X-Tenant-ID tenant. It answers the results in the order of the operations, or, applying
+// none of them, the problem of the first one that failed, naming its index.
+func handleBatch(store *Store, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	tenant := r.Header.Get(TenantHeader)
+	if tenant != "" && !validTenant(tenant) {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid tenant")
+		return
+	}
+	var batch struct {
+		Operations []batchOperation `json:"operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if len(batch.Operations) > maxBatchOperations {
+		writeError(w, r, http.StatusRequestEntityTooLarge, localizef("a batch holds at most %d operations", maxBatchOperations))
+		return
+	}
+
+	results := make([]batchResult, len(batch.Operations))
+	failed, status := -1, http.StatusOK
+	err := store.TxContext(r.Context(), func(tx StoreTx) error {
+		for i, op := range batch.Operations {
+			failed = i
+			result, code, err := applyBatchOperation(store, tx, tenantModel(tenant, op.Model), op)
+			if err != nil {
+				status = code
+				return err
+			}
+			result.Model = op.Model
+			results[i] = result
+		}
+		failed = -1
+		return nil
+	})
+	switch {
+	case err != nil && failed < 0:
+		writeError(w, r, http.StatusConflict, err)
+	case err != nil:
+		apiErr := asError(err, status)
+		writeError(w, r, status, &Error{Status: apiErr.Status, Code: apiErr.Code, Err: localizef("operation %d: %v", failed, err)})
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+	}
+}
+
+// applyBatchOperation stages an operation of a batch, returning its result or its error and the
+// status answered with it.
+func applyBatchOperation(store *Store, tx StoreTx, model string, op batchOperation) (batchResult, int, error) {
+	result := batchResult{Op: op.Op, ID: op.ID}
+	// Operations name base models: a tenant-scoped name would reach another tenant's namespace
+	if strings.Contains(op.Model, "/") || !store.registered(op.Model) {
+		return result, http.StatusNotFound, &Error{Status: http.StatusNotFound, Code: CodeNotFound, Message: "Unknown model"}
+	}
+	meta, ok := store.meta(model)
+	if !ok {
+		return result, http.StatusNotFound, &Error{Status: http.StatusNotFound, Code: CodeNotFound, Message: "Unknown model"}
+	}
+	if op.Op == OpDelete {
+		return result, http.StatusNotFound, tx.Delete(model, op.ID)
+	}
+	if op.Op != OpCreate && op.Op != OpUpdate {
+		return result, http.StatusBadRequest, localizef("unknown operation %q", op.Op)
+	}
+
+	item := reflect.New(meta.typ).Interface()
+	if err := unmarshalItem(op.Item, item); err != nil {
+		return result, http.StatusUnprocessableEntity, decodeError(meta, err)
+	}
+	if err := validate(meta, item); err != nil {
+		return result, http.StatusUnprocessableEntity, err
+	}
+	if err := store.checkParents(model, item); err != nil {
+		return result, http.StatusUnprocessableEntity, err
+	}
+	if err := store.checkKey(model, op.ID, item); err != nil {
+		return result, http.StatusConflict, err
+	}
+	if op.Op == OpCreate {
+		created, err := tx.Create(model, item)
+		if err != nil {
+			return result, http.StatusNotFound, err
+		}
+		if meta.id != nil {
+			result.ID = int(meta.id.value(created).Int())
+		}
+		result.Item = created
+		return result, http.StatusCreated, nil
+	}
+	result.Item = item
+	return result, http.StatusNotFound, tx.Update(model, op.ID, item)
+}
@@ -0,0 +1,117 @@
+// File: transactions_test.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file tests POST /_batch: operations are applied all or nothing, inside the
+// namespace of the caller's tenant only, and under the tenant's quota.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestStore creates a store with the models of the server.
+func newTestStore() *Store {
+	store := NewStore()
+	store.Register("item", Item{})
+	store.Register("user", User{})
+	store.Register("tag", Tag{})
+	store.Register("orderline", OrderLine{})
+	return store
+}
+
+// serveTest answers a request with handler, adding the headers given as name, value pairs.
+func serveTest(handler http.HandlerFunc, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func batchHandler(tenants *Tenants) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) { handleTenantBatch(tenants, w, r) }
+}
+
+func TestBatchAppliesAllOrNothing(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	store.Create("item", &Item{Title: "kept"})
+
+	w := serveTest(batchHandler(tenants), http.MethodPost, "/_batch",
+		`{"operations":[{"op":"create","model":"item","item":{"title":"new"}},{"op":"update","model":"item","id":99,"item":{"title":"missing"}}]}`)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("batch with a missing item: status %d, want 404: %s", w.Code, w.Body)
+	}
+	var items []Item
+	store.Find("item", nil, &items)
+	if len(items) != 1 || items[0].Title != "kept" {
+		t.Fatalf("failed batch changed the items: %+v", items)
+	}
+
+	w = serveTest(batchHandler(tenants), http.MethodPost, "/_batch",
+		`{"operations":[{"op":"create","model":"item","item":{"title":"new"}},{"op":"update","model":"item","id":1,"item":{"title":"renamed"}}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch: status %d, want 200: %s", w.Code, w.Body)
+	}
+	items = nil
+	store.Find("item", nil, &items)
+	if len(items) != 2 || items[0].Title != "renamed" || items[1].Title != "new" {
+		t.Fatalf("batch not applied: %+v", items)
+	}
+}
+
+func TestBatchStaysInTheTenantNamespace(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	store.Create("victim/item", &Item{Title: "theirs"})
+
+	for _, model := range []string{"victim/item", "../item", "nope"} {
+		w := serveTest(batchHandler(tenants), http.MethodPost, "/_batch",
+			`{"operations":[{"op":"update","model":"`+model+`","id":1,"item":{"title":"pwned"}}]}`)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("batch on model %q: status %d, want 404", model, w.Code)
+		}
+	}
+	w := serveTest(batchHandler(tenants), http.MethodPost, "/_batch",
+		`{"operations":[{"op":"update","model":"item","id":1,"item":{"title":"pwned"}}]}`, TenantHeader, "attacker")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("batch of another tenant: status %d, want 404", w.Code)
+	}
+
+	var item Item
+	if !store.Get("victim/item", 1, &item) || item.Title != "theirs" {
+		t.Fatalf("the victim's item changed: %+v", item)
+	}
+}
+
+func TestBatchIsHeldToTheTenantQuota(t *testing.T) {
+	store := newTestStore()
+	tenants := NewTenants(store)
+	tenants.Allow("acme", "other")
+	tenants.Default = TenantQuota{Rate: 1, Burst: 1, MaxPayload: 256}
+	body := `{"operations":[{"op":"create","model":"tag","item":{"name":"a"}}]}`
+
+	if w := serveTest(batchHandler(tenants), http.MethodPost, "/_batch", body, TenantHeader, "acme"); w.Code != http.StatusOK {
+		t.Fatalf("first batch: status %d, want 200: %s", w.Code, w.Body)
+	}
+	if w := serveTest(batchHandler(tenants), http.MethodPost, "/_batch", body, TenantHeader, "acme"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second batch: status %d, want 429", w.Code)
+	}
+	usage := tenants.Usage("acme")
+	if usage.Requests != 2 || usage.Writes != 1 || usage.Rejected != 1 || usage.Items != 1 {
+		t.Fatalf("usage not accounted: %+v", usage)
+	}
+
+	tenants.Default = TenantQuota{MaxPayload: 16}
+	if w := serveTest(batchHandler(tenants), http.MethodPost, "/_batch", body, TenantHeader, "other"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized batch: status %d, want 413", w.Code)
+	}
+}
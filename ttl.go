@@ -0,0 +1,106 @@
+// File: ttl.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements per-item expiration. Items expire either through an
+// `ExpiresAt time.Time` field on the model or a `?ttl=` parameter on create. Expired items are hidden
+// from reads immediately and removed by a background sweeper, which emits a regular delete event
+// (with reason "expired") so listeners see the removal like any other deletion.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// expiryFor returns the expiration declared by the item's ExpiresAt field. Items of models without
+// the field keep the current expiration.
+func (m *modelMeta) expiryFor(item interface{}, current time.Time) time.Time {
+	if m.expiresAt == nil {
+		return current
+	}
+	return m.expiresAt.value(item).Interface().(time.Time)
+}
+
+// setExpiry mirrors an expiration time into the item's ExpiresAt field when the model has one.
+func (m *modelMeta) setExpiry(item interface{}, at time.Time) {
+	if m.expiresAt == nil {
+		return
+	}
+	if field := m.expiresAt.value(item); field.CanSet() {
+		field.Set(reflect.ValueOf(at))
+	}
+}
+
+// SweepExpired deletes every expired item and returns how many were removed. Immutable models,
+// whose items cannot expire, are skipped.
+func (s *Store) SweepExpired() int {
+	var events []ChangeEvent
+	now := time.Now()
+	for _, c := range s.allCollections() {
+		if s.immutability(c.name) != "" {
+			continue
+		}
+		for _, sh := range c.shards {
+			sh.itemMux.Lock()
+			var items *entryTree
+			sh.snapshot().ascend(func(id int, e entry) bool {
+				if !e.expired(now) {
+					return true
+				}
+				if items == nil {
+					items = sh.edit()
+				}
+				events = append(events, s.removeLocked(context.Background(), c, items, id, e.item, "expired"))
+				return true
+			})
+			if items != nil {
+				sh.publish(items)
+			}
+			sh.itemMux.Unlock()
+		}
+	}
+
+	for _, event := range events {
+		s.notify(event)
+	}
+	return len(events)
+}
+
+// StartSweeper removes expired items every interval in the background until the returned stop
+// function is called.
+func (s *Store) StartSweeper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				s.SweepExpired()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// parseTTL parses a TTL given either as a Go duration ("90s", "1h") or a number of seconds.
+func parseTTL(v string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0, strconv.ErrRange
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err == nil && ttl < 0 {
+		return 0, strconv.ErrRange
+	}
+	return ttl, err
+}
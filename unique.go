@@ -0,0 +1,113 @@
+// File: unique.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements unique constraints. A field tagged `crud:"unique"` (an email,
+// a slug) is indexed like a lookup field, and creating or updating an item with a value another
+// item holds returns 409 Conflict naming the field. The writes of models with unique fields, keys
+// or lookup fields are checked and applied under a lock of the model, so two concurrent writes
+// cannot both take a value. Empty values are not indexed and never conflict. Store.Create and the
+// replication of writes made on other nodes are not checked; Store.Insert is the checked Create.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// uniqueFields returns the fields of a model tagged unique that are not lookup fields, which are
+// indexed with the lookups. Unique fields must be scalars; other tagged fields are logged and
+// ignored.
+func uniqueFields(m *modelMeta) []*fieldMeta {
+	var fields []*fieldMeta
+	for _, f := range m.fields {
+		if !f.crudOption("unique") || f.crudOption("lookup") {
+			continue
+		}
+		if !orderable(f.typ) || f.jsonName == "-" || f == m.id {
+			log.Printf("unique: ignoring unique field %s.%s, which must be a scalar", m.typ.Name(), f.name)
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// constrained reports whether the writes of a collection are checked for taken keys or values.
+func (c *collection) constrained() bool {
+	return c.keys != nil || len(c.lookups) > 0 || len(c.uniques) > 0
+}
+
+// keyIndexes returns the indexes of the key, the lookup fields and the unique fields of a
+// collection.
+func (c *collection) keyIndexes() []*keyIndex {
+	keys := make([]*keyIndex, 0, len(c.lookups)+len(c.uniques)+1)
+	if c.keys != nil {
+		keys = append(keys, c.keys)
+	}
+	for _, idx := range c.lookups {
+		keys = append(keys, idx)
+	}
+	for _, idx := range c.uniques {
+		keys = append(keys, idx)
+	}
+	return keys
+}
+
+// lockUnique serializes the checked writes of a constrained collection, returning the function
+// releasing the lock.
+func (c *collection) lockUnique() func() {
+	if !c.constrained() {
+		return func() {}
+	}
+	c.uniqueMux.Lock()
+	return c.uniqueMux.Unlock
+}
+
+// uniqueConflict returns the error of an item holding the value of a unique field of another item.
+func uniqueConflict(f *fieldMeta, item interface{}) error {
+	value := f.value(item).Interface()
+	return &Error{Status: http.StatusConflict, Code: CodeConflict, Err: fieldError(f, "unique", value, localizef("%s is already taken", f.jsonName))}
+}
+
+// Insert adds a new item to a registered model like Create, unless its key or a unique field holds
+// the value of another item, returning an error of status 409 naming the field.
+func (s *Store) Insert(model string, item interface{}) (interface{}, error) {
+	return s.createChecked(context.Background(), model, item, 0)
+}
+
+// createChecked creates an item like CreateWithTTL once its key and unique fields are checked,
+// under the lock of the model. No item is created once ctx is done.
+func (s *Store) createChecked(ctx context.Context, model string, item interface{}, ttl time.Duration) (interface{}, error) {
+	return s.createCheckedAt(ctx, model, 0, item, ttl)
+}
+
+// createCheckedAt creates an item like createChecked under id, taken from the model's sequence
+// earlier, or the next ID of the model when id is 0.
+func (s *Store) createCheckedAt(ctx context.Context, model string, id int, item interface{}, ttl time.Duration) (interface{}, error) {
+	c, ok := s.collection(model)
+	if !ok {
+		return nil, &Error{Status: http.StatusNotFound, Code: CodeNotFound, Message: "Unknown model"}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	release, err := s.reserveItems(map[string]int{c.name: 1})
+	if err != nil {
+		return nil, err
+	}
+	unlockUnique := c.lockUnique()
+	unlock := func() {
+		unlockUnique()
+		release()
+	}
+	if err := s.checkKey(model, id, item); err != nil {
+		unlock()
+		return nil, err
+	}
+	return s.create(ctx, c, id, item, ttl, unlock)
+}
@@ -0,0 +1,225 @@
+// File: validation.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file validates the items of POST and PUT requests against the rules of their
+// fields, declared in enum tags (enum:"todo|done") and validate tags (validate:"required,email",
+// also read by the seeder): required, email, url (or uri), oneof, min (or gte), max (or lte) and
+// len, where min, max and len bound numbers or the length of strings and lists. Rules other than
+// required pass on zero values. Items that fail, and bodies with values of the wrong type, are
+// answered with 422 and the list of the offending fields, each with the rule it violates, the
+// submitted value and a message; the value is redacted for fields tagged `crud:"redact"`.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// redactedValue replaces the values of redacted fields in validation errors.
+const redactedValue = "[REDACTED]"
+
+// fieldRules are the constraints of a field read from its enum and validate tags.
+type fieldRules struct {
+	required bool
+	oneOf    []string
+	email    bool
+	url      bool
+	min, max *float64
+	length   *int
+}
+
+// parseFieldRules reads the constraints of a field. Rules it does not know are ignored.
+func parseFieldRules(tag reflect.StructTag) fieldRules {
+	var rules fieldRules
+	if enum := tag.Get("enum"); enum != "" {
+		rules.oneOf = strings.Split(enum, "|")
+	}
+	for _, rule := range strings.Split(tag.Get("validate"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		number, err := strconv.ParseFloat(value, 64)
+		switch {
+		case name == "required":
+			rules.required = true
+		case name == "email":
+			rules.email = true
+		case name == "url" || name == "uri":
+			rules.url = true
+		case name == "oneof" && value != "":
+			rules.oneOf = strings.Fields(value)
+		case (name == "min" || name == "gte") && err == nil:
+			rules.min = &number
+		case (name == "max" || name == "lte") && err == nil:
+			rules.max = &number
+		case name == "len" && err == nil:
+			n := int(number)
+			rules.length = &n
+		}
+	}
+	return rules
+}
+
+// FieldError describes a field of a submitted item violating a rule.
+type FieldError struct {
+	Field   string      `json:"field"`
+	Rule    string      `json:"rule"`
+	Value   interface{} `json:"value,omitempty"`
+	Message string      `json:"message"`
+
+	err error // the error the message was formatted from, for localization
+}
+
+// ValidationError lists the fields of a submitted item violating their rules.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+// Error returns the message of the only offending field, or how many fields are invalid.
+func (e *ValidationError) Error() string {
+	return e.Unwrap().Error()
+}
+
+// Unwrap returns the error of the only offending field, or the one summarizing several.
+func (e *ValidationError) Unwrap() error {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].err
+	}
+	return localizef("%d fields are invalid", len(e.Errors))
+}
+
+// add records a field violating a rule.
+func (e *ValidationError) add(f *fieldMeta, rule string, value interface{}, err error) {
+	if value != nil && f.crudOption("redact") {
+		value = redactedValue
+	} else if s, ok := value.(string); ok && len(f.tag.Get("mask")) > 0 {
+		value = maskField(f, s)
+	}
+	e.Errors = append(e.Errors, FieldError{Field: f.jsonName, Rule: rule, Value: value, Message: err.Error(), err: err})
+}
+
+// fieldError returns a validation error of a single field.
+func fieldError(f *fieldMeta, rule string, value interface{}, err error) *ValidationError {
+	e := &ValidationError{}
+	e.add(f, rule, value, err)
+	return e
+}
+
+// validate checks an item against the rules of the fields of its model.
+func validate(meta *modelMeta, item interface{}) error {
+	e := &ValidationError{}
+	for _, f := range meta.fields {
+		if f.jsonName == "-" || f == meta.id {
+			continue
+		}
+		validateField(e, f, f.value(item), parseFieldRules(f.tag))
+	}
+	if len(e.Errors) > 0 {
+		return e
+	}
+	return nil
+}
+
+// validateField checks the value of a field against its rules.
+func validateField(e *ValidationError, f *fieldMeta, v reflect.Value, rules fieldRules) {
+	value := v.Interface()
+	if v.IsZero() {
+		if rules.required {
+			e.add(f, "required", nil, localizef("%s is required", f.jsonName))
+		}
+		return
+	}
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	text := fmt.Sprint(v.Interface())
+	if len(rules.oneOf) > 0 && !containsString(rules.oneOf, text) {
+		e.add(f, "oneof", value, localizef("%s must be one of %s", f.jsonName, strings.Join(rules.oneOf, ", ")))
+	}
+	if rules.email && v.Kind() == reflect.String {
+		if address, err := mail.ParseAddress(text); err != nil || address.Address != text || !strings.Contains(text, ".") {
+			e.add(f, "email", value, localizef("%s must be a valid email address", f.jsonName))
+		}
+	}
+	if rules.url && v.Kind() == reflect.String {
+		if u, err := url.Parse(text); err != nil || u.Scheme == "" || u.Host == "" {
+			e.add(f, "url", value, localizef("%s must be a valid URL", f.jsonName))
+		}
+	}
+
+	// Bound numbers by their value and strings and lists by their length
+	var size float64
+	measured := true
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		size = v.Float()
+	case reflect.String:
+		size = float64(len([]rune(v.String())))
+	case reflect.Slice, reflect.Array, reflect.Map:
+		size = float64(v.Len())
+	default:
+		measured = false
+	}
+	if !measured {
+		return
+	}
+	number := v.Kind() != reflect.String && v.Kind() != reflect.Slice && v.Kind() != reflect.Array && v.Kind() != reflect.Map
+	switch {
+	case rules.min != nil && size < *rules.min && number:
+		e.add(f, "min", value, localizef("%s must be at least %v", f.jsonName, *rules.min))
+	case rules.min != nil && size < *rules.min:
+		e.add(f, "min", value, localizef("%s must have at least %v elements or characters", f.jsonName, *rules.min))
+	case rules.max != nil && size > *rules.max && number:
+		e.add(f, "max", value, localizef("%s must be at most %v", f.jsonName, *rules.max))
+	case rules.max != nil && size > *rules.max:
+		e.add(f, "max", value, localizef("%s must have at most %v elements or characters", f.jsonName, *rules.max))
+	case rules.length != nil && int(size) != *rules.length:
+		e.add(f, "len", value, localizef("%s must have a length of %d", f.jsonName, *rules.length))
+	}
+}
+
+// decodeError turns the error decoding a request body into the error answered: a validation error
+// of the field holding a value of the wrong type, or the generic invalid payload error.
+func decodeError(meta *modelMeta, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Field == "" {
+		return &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "Invalid request payload", Err: err}
+	}
+	name, _, _ := strings.Cut(typeErr.Field, ".")
+	f, ok := meta.field(name)
+	if !ok {
+		return &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "Invalid request payload", Err: err}
+	}
+	return fieldError(f, "type", nil, localizef("%s must be of type %s", f.jsonName, jsonTypeName(typeErr.Type)))
+}
+
+// jsonTypeName names the JSON type of a Go type in validation messages.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	}
+	return "object"
+}
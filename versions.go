@@ -0,0 +1,240 @@
+// File: versions.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements API versions (-api-versions). Each version mounts the model
+// routes under its own prefix (/v1/item, /v2/item) and may represent a model with its own struct:
+// the items it returns are converted from the stored model, and the items it receives are
+// converted to it, so older clients keep their fields while the stored model evolves. Filters and
+// sorts still name the stored fields. Versions being retired announce it on every response with
+// the Deprecation (RFC 9745) and Sunset (RFC 8594) headers, and a Link to their migration guide.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIVersion is a version of the API mounted under its own path prefix.
+type APIVersion struct {
+	Name       string    // path prefix of the version, such as v1
+	Deprecated time.Time // when the version was deprecated; zero while it is current
+	Sunset     time.Time // when the version stops being served; zero when not scheduled
+	Link       string    // URL of the documentation of the deprecation
+
+	store      *Store
+	transforms map[string]versionTransform
+}
+
+// versionPrefixKey is the context key holding the path prefix of the version serving a request.
+type versionPrefixKey struct{}
+
+// versionTransform converts the items of a model between the stored struct and the one of a
+// version.
+type versionTransform struct {
+	typ  reflect.Type
+	to   func(stored interface{}) interface{}
+	from func(version interface{}) interface{}
+}
+
+// NewAPIVersion creates a version of the API serving the models of a store under /{name}.
+func NewAPIVersion(store *Store, name string) *APIVersion {
+	return &APIVersion{Name: name, store: store, transforms: make(map[string]versionTransform)}
+}
+
+// Deprecate marks the version as deprecated since a time, to be removed at sunset (zero when not
+// scheduled), with the URL of a migration guide (empty when there is none).
+func (v *APIVersion) Deprecate(since, sunset time.Time, link string) *APIVersion {
+	v.Deprecated, v.Sunset, v.Link = since, sunset, link
+	return v
+}
+
+// Transform represents a model with another struct in the version. to converts a stored item (a
+// pointer to the model struct) to the version's representation, and from converts a pointer to
+// the prototype's struct to a pointer to the model struct.
+func (v *APIVersion) Transform(model string, prototype interface{}, to func(stored interface{}) interface{}, from func(version interface{}) interface{}) {
+	t := reflect.TypeOf(prototype)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	v.transforms[model] = versionTransform{typ: t, to: to, from: from}
+}
+
+// ParseAPIVersions parses a list of versions such as "v1:2024-11-01:2025-06-01,v2", each with the
+// dates of its deprecation and sunset.
+func ParseAPIVersions(store *Store, spec string) ([]*APIVersion, error) {
+	var versions []*APIVersion
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if parts[0] == "" || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid API version %q (expected name[:deprecated[:sunset]])", entry)
+		}
+		version := NewAPIVersion(store, parts[0])
+		dates := make([]time.Time, 2)
+		for i, s := range parts[1:] {
+			date, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid date %q of API version %s: %v", s, parts[0], err)
+			}
+			dates[i] = date
+		}
+		versions = append(versions, version.Deprecate(dates[0], dates[1], ""))
+	}
+	return versions, nil
+}
+
+// Handler serves the requests under the version's prefix with next, which routes them by their
+// path without the prefix.
+func (v *APIVersion) Handler(next http.Handler) http.Handler {
+	prefix := "/" + v.Name
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.setDeprecationHeaders(w.Header())
+		p := strings.TrimPrefix(r.URL.Path, prefix)
+		if p == r.URL.Path || (p != "" && !strings.HasPrefix(p, "/")) {
+			notFound(w, r, "Not found")
+			return
+		}
+		if p == "" {
+			p = "/"
+		}
+		routed := new(http.Request)
+		*routed = *r
+		routed.URL = new(url.URL)
+		*routed.URL = *r.URL
+		routed.URL.Path, routed.URL.RawPath = p, ""
+		routed = routed.WithContext(context.WithValue(r.Context(), versionPrefixKey{}, prefix))
+
+		model := routedModel(p)
+		transform, ok := v.transforms[model]
+		meta, registered := v.store.meta(model)
+		if !ok || !registered {
+			next.ServeHTTP(w, routed)
+			return
+		}
+		if r.Body != nil && (r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch) {
+			body, err := transform.request(r.Body)
+			if err != nil {
+				writeError(w, r, http.StatusUnprocessableEntity, decodeError(metaFor(transform.typ), err))
+				return
+			}
+			routed.Body, routed.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+		}
+		recorded := newBufferedResponse()
+		for key, values := range w.Header() {
+			recorded.header[key] = values
+		}
+		next.ServeHTTP(recorded, routed)
+		transform.response(meta, recorded)
+		recorded.writeTo(w)
+	})
+}
+
+// routedModel returns the model of the items a path returns and receives: the model of /{model}
+// and /{model}/by-{field}/{value}, or the child model of /{model}/{id}/{child}, also under
+// /t/{tenant}. It returns "" for the other routes.
+func routedModel(p string) string {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	if len(segments) > 2 && segments[0] == "t" {
+		segments = segments[2:]
+	}
+	switch {
+	case len(segments) == 1:
+		return segments[0]
+	case len(segments) == 3 && strings.HasPrefix(segments[1], "by-"):
+		return segments[0]
+	case len(segments) == 3:
+		if _, err := strconv.Atoi(segments[1]); err == nil {
+			return segments[2]
+		}
+	}
+	return ""
+}
+
+// versionPrefix returns the path prefix of the version serving a request, empty outside versions.
+func versionPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(versionPrefixKey{}).(string)
+	return prefix
+}
+
+// setDeprecationHeaders announces the deprecation and sunset of the version.
+func (v *APIVersion) setDeprecationHeaders(h http.Header) {
+	if !v.Deprecated.IsZero() {
+		h.Set("Deprecation", fmt.Sprintf("@%d", v.Deprecated.Unix()))
+	}
+	if !v.Sunset.IsZero() {
+		h.Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if v.Link != "" {
+		h.Add("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"; type=\"text/html\"", v.Link))
+	}
+}
+
+// request converts a request body holding an item of the version to one holding the stored item.
+func (t versionTransform) request(body io.Reader) ([]byte, error) {
+	item := reflect.New(t.typ).Interface()
+	if err := json.NewDecoder(body).Decode(item); err != nil {
+		return nil, err
+	}
+	return marshalItem(t.from(item))
+}
+
+// response converts the stored item, or list of items, of a recorded JSON response to the
+// version's representation. Other responses are left as they are.
+func (t versionTransform) response(meta *modelMeta, recorded *bufferedResponse) {
+	mediaType, _, _ := mime.ParseMediaType(recorded.header.Get("Content-Type"))
+	body := bytes.TrimSpace(recorded.body.Bytes())
+	if mediaType != "application/json" || len(body) == 0 {
+		return
+	}
+	var converted interface{}
+	if body[0] == '[' {
+		var raw []json.RawMessage
+		if json.Unmarshal(body, &raw) != nil {
+			return
+		}
+		items := make([]interface{}, len(raw))
+		for i, data := range raw {
+			item, ok := t.convert(meta, data)
+			if !ok {
+				return
+			}
+			items[i] = item
+		}
+		converted = items
+	} else {
+		item, ok := t.convert(meta, body)
+		if !ok {
+			return
+		}
+		converted = item
+	}
+	data, err := json.Marshal(converted)
+	if err != nil {
+		return
+	}
+	recorded.body.Reset()
+	recorded.body.Write(data)
+	recorded.header.Del("Content-Length")
+	recorded.header.Del("ETag")
+}
+
+// convert decodes a stored item and converts it to the version's representation.
+func (t versionTransform) convert(meta *modelMeta, data []byte) (interface{}, bool) {
+	item := reflect.New(meta.typ).Interface()
+	if unmarshalItem(data, item) != nil {
+		return nil, false
+	}
+	return t.to(item), true
+}
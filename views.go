@@ -0,0 +1,95 @@
+// File: views.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements materialized aggregate views. A view groups the items of one
+// model (e.g. "open items per category") and keeps a count and optional sum per group. Views are
+// updated incrementally from every change event, so dashboards served from GET /_views/{name}
+// never need a full scan of the store.
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// View is a named aggregate over one model, maintained incrementally on each write.
+type View struct {
+	Model string
+
+	// Filter selects the items counted by the view; nil includes every item.
+	Filter func(item interface{}) bool
+	// Group returns the group key of an item; nil puts every item in the "all" group.
+	Group func(item interface{}) string
+	// Value returns the number summed per group; nil only counts items.
+	Value func(item interface{}) float64
+
+	groups map[string]*ViewGroup
+	mux    sync.RWMutex
+}
+
+// ViewGroup holds the aggregates of one group of a view.
+type ViewGroup struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum,omitempty"`
+}
+
+// NewView creates an empty view over the given model.
+func NewView(model string) *View {
+	return &View{Model: model, groups: make(map[string]*ViewGroup)}
+}
+
+// Apply removes the previous version of the changed item from its group and adds the new one.
+func (v *View) Apply(event ChangeEvent) {
+	if event.Model != v.Model {
+		return
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if event.Old != nil {
+		v.add(event.Old, -1)
+	}
+	if event.Op != OpDelete && event.Item != nil {
+		v.add(event.Item, 1)
+	}
+}
+
+// add adjusts the aggregates of the item's group by sign (+1 or -1).
+func (v *View) add(item interface{}, sign int) {
+	if v.Filter != nil && !v.Filter(item) {
+		return
+	}
+
+	key := "all"
+	if v.Group != nil {
+		key = v.Group(item)
+	}
+	group, ok := v.groups[key]
+	if !ok {
+		group = &ViewGroup{}
+		v.groups[key] = group
+	}
+
+	group.Count += sign
+	if v.Value != nil {
+		group.Sum += float64(sign) * v.Value(item)
+	}
+	if group.Count == 0 {
+		delete(v.groups, key)
+	}
+}
+
+// State encodes the current aggregates keyed by group.
+func (v *View) State() (json.RawMessage, error) {
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	return json.Marshal(map[string]interface{}{
+		"model":  v.Model,
+		"groups": v.groups,
+	})
+}
@@ -0,0 +1,206 @@
+// File: wal.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements the write-ahead log and point-in-time recovery. Every mutation
+// of the store is written to the WAL, in the format of the event log, while its shard is locked and
+// before it is acknowledged. Each backup records the sequence number of the last change before its
+// dump started, and is named after the time the dump was complete, so the store can be restored to
+// any time since the first backup (or since the WAL was started): RestoreTo loads the newest backup
+// complete at that time, then replays the WAL events that followed it, up to that time. Events
+// hold whole items, so replaying the changes made while the dump was written is harmless. POST
+// /_restore?to=2024-11-01T12:00 recovers a running server, and `crud restore --to 2024-11-01T12:00`
+// asks a server to.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// pointInTimeLayouts are the layouts target times are accepted in, in UTC unless they have an offset.
+var pointInTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// PointInTimeResult reports a point-in-time recovery.
+type PointInTimeResult struct {
+	To       time.Time `json:"to"`
+	Backup   string    `json:"backup,omitempty"` // the backup restored first; none when the WAL was replayed from its start
+	Replayed int       `json:"replayed"`         // number of WAL events replayed
+}
+
+// SetWAL makes the store write every mutation ahead to a log, and keeps its sequence numbers ahead
+// of those of the log, so they keep increasing across restarts. It must be called before the store
+// is used concurrently.
+func (s *Store) SetWAL(wal *EventLog) error {
+	events, err := wal.Events()
+	if err != nil {
+		return err
+	}
+	s.seqMux.Lock()
+	if n := len(events); n > 0 && events[n-1].Seq > s.seq {
+		s.seq = events[n-1].Seq
+	}
+	s.seqMux.Unlock()
+	s.wal = wal
+	return nil
+}
+
+// parsePointInTime parses the time a store is restored to.
+func parsePointInTime(value string) (time.Time, error) {
+	for _, layout := range pointInTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (expected e.g. 2024-11-01T12:00)", value)
+}
+
+// backupTime returns the time the dump of a backup was complete.
+func backupTime(name string) time.Time {
+	stamp := strings.TrimPrefix(name, backupPrefix)
+	stamp = strings.TrimSuffix(stamp, sealedSuffix)
+	t, _ := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, backupSuffix))
+	return t
+}
+
+// RestoreTo restores the store to its state at a past time: the newest backup of backups complete
+// at that time (if any, else an empty store) is loaded, and the WAL events that followed it up to
+// that time are replayed. The restore is itself written to the WAL. It is meant to run while the
+// store serves no writes.
+func (s *Store) RestoreTo(ctx context.Context, backups *BackupJob, to time.Time) (PointInTimeResult, error) {
+	result := PointInTimeResult{To: to}
+	if s.wal == nil {
+		return result, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("point-in-time recovery requires a WAL")}
+	}
+	if to.After(time.Now()) {
+		return result, &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Err: localizef("cannot restore to %s, which is in the future", to.Format(time.RFC3339))}
+	}
+
+	// Decode the events to replay before anything is changed
+	stored, err := s.wal.Events()
+	if err != nil {
+		return result, err
+	}
+	base := ""
+	if backups != nil {
+		names, err := backups.Backups(ctx)
+		if err != nil {
+			return result, err
+		}
+		for _, name := range names {
+			if !backupTime(name).After(to) {
+				base = name
+				break
+			}
+		}
+	}
+
+	var seq uint64
+	if base != "" {
+		imported, err := backups.Restore(ctx, base, ImportReplace)
+		if err != nil {
+			return result, err
+		}
+		result.Backup, seq = base, imported.Seq
+	} else if err := s.clear(ctx); err != nil {
+		return result, err
+	}
+
+	var events []ChangeEvent
+	for _, e := range stored {
+		if e.Seq <= seq || e.Time.After(to) {
+			continue
+		}
+		event, err := decodeEvent(s, e)
+		if err != nil {
+			return result, err
+		}
+		events = append(events, event)
+	}
+	for _, event := range events {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		event.Seq = 0 // replayed events get new sequence numbers, after those of the restore
+		event = s.apply(event)
+		event.Time = time.Now() // and the time of the restore, so later recoveries replay them in order
+		s.wal.Append(event)
+		s.notify(event)
+		result.Replayed++
+	}
+	return result, nil
+}
+
+// clear removes every item of every model, through an import replacing them with nothing.
+func (s *Store) clear(ctx context.Context) error {
+	empty := Export{Format: ExportFormat, Exported: time.Now().UTC()}
+	for _, c := range s.allCollections() {
+		empty.Models = append(empty.Models, ExportModel{Name: c.name, NextID: 1})
+	}
+	data, err := json.Marshal(empty)
+	if err != nil {
+		return err
+	}
+	_, err = s.ImportContext(ctx, bytes.NewReader(data), ImportReplace)
+	return err
+}
+
+// runRestore runs `crud restore`, asking a server to restore a backup (-name) or to recover the
+// state of a past time (-to), and returns the exit status.
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	server := flags.String("server", "http://localhost:8080", "Base URL of the server to restore")
+	to := flags.String("to", "", "Time to restore the store to, e.g. 2024-11-01T12:00 (UTC unless it has an offset)")
+	name := flags.String("name", "", "Name of the backup to restore, instead of a time")
+	mode := flags.String("mode", ImportReplace, "How a named backup is imported: replace or merge")
+	authorization := flags.String("authorization", "", "Authorization header sent to the server")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	query := url.Values{}
+	switch {
+	case *to != "" && *name == "":
+		if _, err := parsePointInTime(*to); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		query.Set("to", *to)
+	case *name != "" && *to == "":
+		query.Set("name", *name)
+		query.Set("mode", *mode)
+	default:
+		fmt.Fprintln(os.Stderr, "restore: exactly one of -to and -name is required")
+		return 2
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*server, "/")+"/_restore?"+query.Encode(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *authorization != "" {
+		req.Header.Set("Authorization", *authorization)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,199 @@
+// File: write_behind.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements write-behind persistence. WriteBehindStorage implements Storage
+// over another backend: writes are queued in memory and acknowledged right away, then flushed to the
+// backend in batches every FlushInterval (or as soon as a batch is full). Repeated writes to the same
+// item before a flush are coalesced. The queue is bounded, so writers wait for the flusher when the
+// backend falls behind, and Close flushes everything still queued. A longer interval lowers write
+// latency and backend load at the cost of losing more acknowledged writes if the process crashes.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// writeBehindStats counts the flushed writes and flush errors, and reports the queue length.
+var writeBehindStats = expvar.NewMap("write_behind")
+
+// pendingWrite is a queued write; nil data deletes the item.
+type pendingWrite struct {
+	data []byte
+	seq  uint64
+}
+
+// WriteBehindStorage queues writes in memory and flushes them to a backend asynchronously.
+type WriteBehindStorage struct {
+	backend Storage
+
+	// FlushInterval is the longest a write waits before it is flushed.
+	FlushInterval time.Duration
+	// BatchSize is the number of queued writes that triggers a flush before the interval elapses.
+	BatchSize int
+	// MaxPending bounds the queue; writers wait while it is full.
+	MaxPending int
+
+	pending  map[cacheKey]pendingWrite
+	flushing map[cacheKey]pendingWrite // the batch being written
+	seq      uint64
+	full     *sync.Cond
+	flush    chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	flushMux sync.Mutex
+	mux      sync.Mutex
+}
+
+// NewWriteBehindStorage wraps a backend with a write-behind queue flushed every interval, and starts
+// the flusher.
+func NewWriteBehindStorage(backend Storage, interval time.Duration) *WriteBehindStorage {
+	w := &WriteBehindStorage{
+		backend:       backend,
+		FlushInterval: interval,
+		BatchSize:     1000,
+		MaxPending:    100000,
+		pending:       make(map[cacheKey]pendingWrite),
+		flush:         make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	w.full = sync.NewCond(&w.mux)
+	go w.flushLoop()
+	return w
+}
+
+// Put queues an item for the backend.
+func (w *WriteBehindStorage) Put(model string, id int, data []byte) error {
+	w.enqueue(cacheKey{model, id}, append([]byte(nil), data...))
+	return nil
+}
+
+// Delete queues the removal of an item from the backend.
+func (w *WriteBehindStorage) Delete(model string, id int) error {
+	w.enqueue(cacheKey{model, id}, nil)
+	return nil
+}
+
+// enqueue records a write, waiting while the queue is full.
+func (w *WriteBehindStorage) enqueue(key cacheKey, data []byte) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	for _, queued := w.pending[key]; !queued && len(w.pending) >= w.MaxPending; _, queued = w.pending[key] {
+		w.requestFlush()
+		w.full.Wait()
+	}
+	w.seq++
+	w.pending[key] = pendingWrite{data: data, seq: w.seq}
+	writeBehindStats.Set("pending", intVar(int64(len(w.pending))))
+	if len(w.pending) >= w.BatchSize {
+		w.requestFlush()
+	}
+}
+
+// requestFlush wakes the flusher up without waiting for the interval.
+func (w *WriteBehindStorage) requestFlush() {
+	select {
+	case w.flush <- struct{}{}:
+	default:
+	}
+}
+
+// Get returns the queued version of an item, or the one stored in the backend.
+func (w *WriteBehindStorage) Get(model string, id int) ([]byte, bool, error) {
+	w.mux.Lock()
+	write, ok := w.pending[cacheKey{model, id}]
+	if !ok {
+		write, ok = w.flushing[cacheKey{model, id}]
+	}
+	w.mux.Unlock()
+	if ok {
+		return append([]byte(nil), write.data...), write.data != nil, nil
+	}
+	return w.backend.Get(model, id)
+}
+
+// Models flushes the queue and returns the models stored in the backend.
+func (w *WriteBehindStorage) Models() ([]string, error) {
+	w.Flush()
+	return w.backend.Models()
+}
+
+// Scan flushes the queue and scans the backend.
+func (w *WriteBehindStorage) Scan(model string, fn func(id int, data []byte) error) error {
+	w.Flush()
+	return w.backend.Scan(model, fn)
+}
+
+// Close stops the flusher, flushes every queued write and closes the backend.
+func (w *WriteBehindStorage) Close() error {
+	close(w.done)
+	<-w.stopped
+	w.Flush()
+	return w.backend.Close()
+}
+
+// flushLoop flushes the queue every interval, or early when asked to.
+func (w *WriteBehindStorage) flushLoop() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.flush:
+		case <-w.done:
+			return
+		}
+		w.Flush()
+	}
+}
+
+// Flush writes every queued write to the backend. Writes that fail stay queued for the next flush
+// unless the item was written again meanwhile.
+func (w *WriteBehindStorage) Flush() {
+	w.flushMux.Lock()
+	defer w.flushMux.Unlock()
+
+	w.mux.Lock()
+	batch := w.pending
+	w.pending, w.flushing = make(map[cacheKey]pendingWrite, len(batch)), batch
+	w.full.Broadcast()
+	w.mux.Unlock()
+
+	// Flush in the order the writes were queued
+	keys := make([]cacheKey, 0, len(batch))
+	for key := range batch {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return batch[keys[i]].seq < batch[keys[j]].seq })
+
+	failed := make(map[cacheKey]pendingWrite)
+	for _, key := range keys {
+		if err := writeStorage(context.Background(), w.backend, key.model, key.id, batch[key].data); err != nil {
+			log.Printf("write-behind: cannot flush %s %d: %v", key.model, key.id, err)
+			failed[key] = batch[key]
+		}
+	}
+	writeBehindStats.Add("flushed", int64(len(batch)-len(failed)))
+	writeBehindStats.Add("errors", int64(len(failed)))
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.flushing = nil
+	for key, write := range failed {
+		if _, rewritten := w.pending[key]; !rewritten {
+			w.pending[key] = write
+		}
+	}
+	writeBehindStats.Set("pending", intVar(int64(len(w.pending))))
+}
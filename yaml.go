@@ -0,0 +1,308 @@
+// File: yaml.go
+// Author: Mohamed Riyad
+// Email: mohamed.riyad@example.com
+// Date: November 2024
+// License: MIT
+// Description: This file implements a small YAML reader for fixture files, covering the subset
+// fixtures are written in: block mappings and sequences nested by indentation, comments, plain,
+// single- and double-quoted scalars, and flow sequences and mappings. Anchors, tags, block scalars
+// (| and >) and multiple documents are not supported. Values decode to the types encoding/json
+// produces, numbers being json.Number, so they can be re-encoded and decoded into models.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a line of a YAML document without its indentation and comment.
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// yamlParser reads the lines of a document.
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML decodes a YAML document.
+func parseYAML(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		text := stripYAMLComment(raw)
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.TrimSpace(trimmed) == "" || trimmed == "---" || strings.HasPrefix(trimmed, "%") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") || strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs cannot indent", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: strings.TrimRight(trimmed, " ")})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	value, err := p.node(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("yaml: line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return value, nil
+}
+
+// node reads the block at the current line, which is indented by indent.
+func (p *yamlParser) node(indent int) (interface{}, error) {
+	line := p.lines[p.pos]
+	if isYAMLSequenceItem(line.text) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(line.text); ok {
+		return p.mapping(indent)
+	}
+	p.pos++
+	return parseYAMLScalar(line.text, line.num)
+}
+
+// sequence reads the items of a block sequence.
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	items := []interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLSequenceItem(p.lines[p.pos].text) {
+		line := p.lines[p.pos]
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				items = append(items, nil)
+				continue
+			}
+			value, err := p.node(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+			continue
+		}
+		// Read the rest of the line as a block indented past the dash, so "- name: x" starts a
+		// mapping continued by the lines below it
+		p.lines[p.pos] = yamlLine{num: line.num, indent: indent + len(line.text) - len(rest), text: rest}
+		value, err := p.node(p.lines[p.pos].indent)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return items, nil
+}
+
+// mapping reads the entries of a block mapping.
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	entries := map[string]interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+		key, value, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("yaml: line %d: expected a key", line.num)
+		}
+		if _, duplicate := entries[key]; duplicate {
+			return nil, fmt.Errorf("yaml: line %d: duplicate key %q", line.num, key)
+		}
+		p.pos++
+		if value != "" {
+			v, err := parseYAMLScalar(value, line.num)
+			if err != nil {
+				return nil, err
+			}
+			entries[key] = v
+			continue
+		}
+		// An empty value introduces a nested block, which may be a sequence at the key's indentation
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			if next.indent > indent || (next.indent == indent && isYAMLSequenceItem(next.text)) {
+				v, err := p.node(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				entries[key] = v
+				continue
+			}
+		}
+		entries[key] = nil
+	}
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return nil, fmt.Errorf("yaml: line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return entries, nil
+}
+
+// isYAMLSequenceItem reports whether a line starts a sequence item.
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits a "key: value" line at the first colon outside quotes that ends the line
+// or is followed by a space.
+func splitYAMLKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			key := strings.TrimSpace(text[:i])
+			if unquoted, err := parseYAMLScalar(key, 0); err == nil {
+				if s, ok := unquoted.(string); ok {
+					key = s
+				}
+			}
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+// stripYAMLComment removes a comment from a line: a # at its start or after a space, outside
+// quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" :-[{,", rune(line[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseYAMLScalar decodes a scalar or a flow collection.
+func parseYAMLScalar(text string, num int) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("yaml: line %d: invalid quoted string %s", num, text)
+		}
+		return s, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("yaml: line %d: invalid quoted string %s", num, text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	case strings.HasPrefix(text, "["), strings.HasPrefix(text, "{"):
+		return parseYAMLFlow(text, num)
+	}
+	switch text {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if _, err := strconv.ParseFloat(text, 64); err == nil && json.Valid([]byte(text)) {
+		return json.Number(text), nil
+	}
+	return text, nil
+}
+
+// parseYAMLFlow decodes a flow sequence or mapping ([a, b], {name: x}).
+func parseYAMLFlow(text string, num int) (interface{}, error) {
+	open, end := text[0], byte(']')
+	if open == '{' {
+		end = '}'
+	}
+	if !strings.HasSuffix(text, string(end)) {
+		return nil, fmt.Errorf("yaml: line %d: unterminated flow collection", num)
+	}
+	parts, err := splitYAMLFlow(text[1:len(text)-1], num)
+	if err != nil {
+		return nil, err
+	}
+	if open == '[' {
+		items := []interface{}{}
+		for _, part := range parts {
+			item, err := parseYAMLScalar(part, num)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	entries := map[string]interface{}{}
+	for _, part := range parts {
+		key, value, ok := splitYAMLKey(part)
+		if !ok {
+			return nil, fmt.Errorf("yaml: line %d: expected a key in %s", num, text)
+		}
+		v, err := parseYAMLScalar(value, num)
+		if err != nil {
+			return nil, err
+		}
+		entries[key] = v
+	}
+	return entries, nil
+}
+
+// splitYAMLFlow splits the inside of a flow collection at its top-level commas.
+func splitYAMLFlow(text string, num int) ([]string, error) {
+	var parts []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if quote != 0 || depth != 0 {
+		return nil, fmt.Errorf("yaml: line %d: unbalanced flow collection", num)
+	}
+	if last := strings.TrimSpace(text[start:]); last != "" || len(parts) > 0 {
+		parts = append(parts, last)
+	}
+	return parts, nil
+}